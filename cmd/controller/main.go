@@ -2,26 +2,55 @@ package main
 
 import (
     "context"
+    "encoding/json"
     "flag"
+    "fmt"
     "log"
     "net/http"
     "os"
+    "strconv"
+    "strings"
+    "syscall"
     "time"
 
+    "github.com/example/iptables-controller/internal/conntrack"
     "github.com/example/iptables-controller/internal/controller"
+    "github.com/example/iptables-controller/internal/dataplane"
+    "github.com/example/iptables-controller/internal/health"
+    "github.com/example/iptables-controller/internal/iptables"
     "github.com/example/iptables-controller/internal/kube"
+    "github.com/example/iptables-controller/internal/nftables"
 )
 
 // 程序入口：初始化 Kubernetes 客户端并启动守护进程的周期性同步循环。
 // 说明：
 // - 从环境变量 `NODE_NAME` 获取所在节点名（在 DaemonSet 中通过 fieldRef 填充）。
 // - 使用 `kube.NewClient()` 优先采用 InClusterConfig，回退到本地 kubeconfig 以便本地调试。
-// - 创建 `controller` 实例并以 `sync-interval` 指定的间隔周期性调用 `Sync` 方法，保持本节点 iptables 规则与集群 Deployment/Pod 状态一致。
+// - 创建 `controller` 实例并调用 `Run`：通过 Pod 与工作负载（Deployment、StatefulSet、DaemonSet、Job 等）的 informer 事件驱动同步，另以 `sync-interval` 指定的间隔执行全量同步兜底，保持本节点 iptables 规则与集群工作负载/Pod 状态一致。
+// - 以 `cleanup` 子命令运行时（`iptables-controller cleanup`）只删除本节点上的全部跳转、链与集合并输出报告，见 runCleanup。
 func main() {
     var syncInterval time.Duration
-    flag.DurationVar(&syncInterval, "sync-interval", 30*time.Second, "sync interval")
+    var gcGracePeriod time.Duration
+    var dryRun bool
+    var killRevoked bool
+    var healthCheckURLs string
+    var healthCheckTimeout time.Duration
+    var selectorFallback bool
+    var cleanupTimeout time.Duration
+    flag.DurationVar(&syncInterval, "sync-interval", 30*time.Second, "interval of the periodic full resync (pod and workload changes are synced as they are observed)")
+    flag.DurationVar(&gcGracePeriod, "gc-grace-period", controller.DefaultGCGracePeriod, "grace period before orphaned MS chains/ipsets are removed")
+    flag.BoolVar(&dryRun, "dry-run", false, "compute and log the sync plan on each sync without modifying iptables/ipset/nft (also served at GET /plan)")
+    flag.BoolVar(&killRevoked, "kill-revoked-connections", false, "delete conntrack entries between pods and peers removed from their whitelist so revoked access takes effect immediately (requires the conntrack tool)")
+    flag.StringVar(&healthCheckURLs, "health-check-url", "", "comma-separated URLs probed after switching to a new rule generation; any failure rolls back to the previous generation")
+    flag.DurationVar(&healthCheckTimeout, "health-check-timeout", health.DefaultTimeout, "timeout of each health check probe")
+    flag.BoolVar(&selectorFallback, "selector-fallback", false, "attribute pods without a controller ownerReference by matching deployment, statefulset and daemonset selectors in the same namespace")
+    flag.DurationVar(&cleanupTimeout, "cleanup-timeout", 20*time.Second, "cleanup: how long to wait for a controller running in the same container to stop syncing before deleting anything")
     flag.Parse()
 
+    if flag.Arg(0) == "cleanup" {
+        os.Exit(runCleanup(cleanupTimeout))
+    }
+
     ctx := context.Background()
 
     // 环境变量说明：
@@ -31,28 +60,63 @@ func main() {
     // - API_BIND: HTTP 管理接口监听地址（默认 :18080）。
     // - API_TOKEN: 可选 API 访问令牌（若设置，客户端需在请求头中带 X-API-Token）。
     // - POLICY_FILE: 可选策略持久化文件路径（为空则不落盘）。
-    // - FORWARD_JUMP_POSITION: FORWARD 链跳转插入方式（append/insert）。
+    // - FORWARD_JUMP_POSITION: 根链跳转在内置链中的位置（insert/append/before:<链名>，默认 insert），同样用于 OUTPUT/INPUT。
+    //   before:cali-FORWARD 表示紧挨在 Calico 的跳转之前；before:cali-* 对各内置链分别匹配 cali-FORWARD/cali-OUTPUT/cali-INPUT。
+    // - DATAPLANE: 数据面实现（iptables/nftables，默认 iptables）。Kylin V10 等默认使用 nft 的发行版可选 nftables。
+    // - IPV6: 是否同时下发 IPv6 规则（auto/true/false，默认 auto：节点启用了 IPv6 时下发）。
+    //   开启后使用 ip6tables（或 IPv6 的 nftables 表）与 `family inet6` 集合，与 IPv4 规则在每次同步中一起下发。
+    // - ENFORCE_HOOKS: 挂载根链的内置链，逗号分隔（forward/output/input，默认 forward；forward 始终挂载）。
+    //   output 覆盖节点自身（宿主机进程、kubelet、hostNetwork Pod）发往本节点 Pod 的流量；input 覆盖访问 hostNetwork 工作负载的流量。
+    // - IPTABLES_MODE: iptables 模式（auto/legacy/nft，默认 auto，仅 DATAPLANE=iptables 时生效）。
+    //   auto 时在启动阶段比较 iptables-legacy 与 iptables-nft 两套规则集中 KUBE-/cali- 链的数量，选择与 kube-proxy、Calico 一致的一方。
     nodeName := os.Getenv("NODE_NAME")
     if nodeName == "" {
         log.Fatal("NODE_NAME environment variable is required")
     }
 
+    dp, dp6, ipv6 := selectDataplanes()
+
     apiBind := os.Getenv("API_BIND")
     if apiBind == "" {
         apiBind = ":18080"
     }
     apiToken := os.Getenv("API_TOKEN")
     policyFile := os.Getenv("POLICY_FILE")
-    forwardJumpPosition := os.Getenv("FORWARD_JUMP_POSITION")
+    forwardJumpPosition := strings.TrimSpace(os.Getenv("FORWARD_JUMP_POSITION"))
+    if forwardJumpPosition == "" {
+        forwardJumpPosition = dataplane.JumpInsert
+    }
+    if err := dataplane.ValidateJumpPosition(forwardJumpPosition); err != nil {
+        log.Fatalf("invalid FORWARD_JUMP_POSITION: %v", err)
+    }
+    hooks, err := parseHooks(os.Getenv("ENFORCE_HOOKS"))
+    if err != nil {
+        log.Fatalf("invalid ENFORCE_HOOKS: %v", err)
+    }
 
     kc, err := kube.NewClient()
     if err != nil {
         log.Fatalf("failed to create kube client: %v", err)
     }
 
-    // 初始化策略存储与 HTTP API（同一进程内）
+    // 初始化策略存储、控制器与 HTTP API（同一进程内）
     policyStore := controller.NewPolicyStore(policyFile)
-    apiServer := controller.NewAPIServer(policyStore, apiToken)
+    opts := controller.Options{
+        GCGracePeriod:    gcGracePeriod,
+        IPv6Dataplane:    dp6,
+        Hooks:            hooks,
+        DryRun:           dryRun,
+        SelectorFallback: selectorFallback,
+    }
+    if killRevoked {
+        opts.Conntrack = conntrack.New(nil)
+    }
+    probeURLs := splitList(healthCheckURLs)
+    if len(probeURLs) > 0 {
+        opts.HealthCheck = health.NewHTTPProbe(probeURLs, healthCheckTimeout)
+    }
+    ctrl := controller.NewController(kc, nodeName, policyStore, forwardJumpPosition, dp, opts)
+    apiServer := controller.NewAPIServer(policyStore, apiToken, ctrl)
 
     // 启动 HTTP 管理接口
     go func() {
@@ -62,25 +126,234 @@ func main() {
         }
     }()
 
-    ctrl := controller.NewController(kc, nodeName, policyStore, forwardJumpPosition)
-
     // 变量说明：
-    // - syncInterval: 控制器周期性同步间隔，单位为 time.Duration。默认 30s，可通过命令行参数 `-sync-interval` 覆盖。
-    //   用途：控制调用 `Sync` 的频率，过于频繁会增加 API 调用和 iptables 操作负载，过于稀疏则策略更新延迟较大。
-    // 简单的周期性同步循环：在每次定时触发时调用控制器的 Sync 方法。
-    // 目的：保证节点上 iptables 的自定义链与当前 Deployment/Pod 状态一致，并记录同步日志。
-    ticker := time.NewTicker(syncInterval)
-    defer ticker.Stop()
-
-    log.Printf("starting iptables-controller for node %s", nodeName)
+    // - syncInterval: 全量同步的周期，单位为 time.Duration。默认 30s，可通过命令行参数 `-sync-interval` 覆盖。
+    //   用途：Pod 与工作负载的变化由 informer 事件即时触发同步，策略更新后也立即全量同步；周期性全量同步只作为遗漏事件的兜底，
+    //   全量同步从 informer 缓存读取，不访问 API Server，但会读取并比较本节点的全部规则。
+    // - gcGracePeriod: 孤儿链/集合的回收宽限期（默认 5m），可通过 `-gc-grace-period` 覆盖。
+    // - dryRun: 观察模式（`-dry-run`），每个周期只计算并记录同步计划，不修改节点规则，用于灰度上线前核对变更。
+    // - killRevoked: `-kill-revoked-connections`，白名单移除对端后删除其与本地 Pod 之间已建立的连接（conntrack 表项），撤销立即生效。
+    // - healthCheckURLs: `-health-check-url`，切换到新一代规则后依次探测的地址（逗号分隔），任一失败即回滚到上一代；为空时不做检查。
+    // - selectorFallback: `-selector-fallback`，没有控制者的 Pod 再按同一命名空间内 Deployment、StatefulSet、DaemonSet 的选择器匹配（默认关闭）。
+    // - cleanupTimeout: `-cleanup-timeout`，只用于 cleanup 子命令：等待同一容器中的控制器确认停止同步的最长时间（默认 20s）。
+    log.Printf("starting iptables-controller for node %s (dataplane %s, ipv6 %t, hooks %s, jump position %s, dry-run %t, kill revoked connections %t, health checks %d, selector fallback %t)", nodeName, dp.Name(), ipv6, strings.Join(hooks, ","), forwardJumpPosition, dryRun, killRevoked, len(probeURLs), selectorFallback)
+    // 事件驱动的同步循环：cleanup 开始后（标记文件存在）停止同步，Run 在正在执行的同步结束后返回
+    if err := os.WriteFile(controllerPIDFile, []byte(strconv.Itoa(os.Getpid())), 0o644); err != nil {
+        log.Printf("write pid file %s: %v", controllerPIDFile, err)
+    }
+    paused := func() bool {
+        if cleanupStarted() {
+            log.Printf("cleanup in progress (%s exists), stopping sync", cleanupMarker)
+            return true
+        }
+        return false
+    }
+    if err := ctrl.Run(ctx, syncInterval, paused); err != nil {
+        log.Fatalf("controller stopped: %v", err)
+    }
+    // Run 返回后不再有同步执行：确认已停止，进程保持运行（继续提供 HTTP 接口），等待 cleanup 结束后由 kubelet 终止容器
+    if f, err := os.Create(cleanupAck); err != nil {
+        log.Printf("create cleanup acknowledgement %s: %v", cleanupAck, err)
+    } else {
+        _ = f.Close()
+    }
+    log.Printf("sync stopped for cleanup, waiting for termination")
+    select {}
+}
+
+// cleanupMarker 为 cleanup 子命令开始时创建的标记文件。
+// 说明：作为 preStop 钩子运行时，cleanup 与仍在运行的同步循环处于同一容器中；同步循环在同步锁内看到该文件后停止同步并创建 cleanupAck，避免刚删除的跳转与链被重新下发。
+// 文件位于容器的可写层，容器重启后即消失，不会影响重新启动的控制器。
+const cleanupMarker = "/tmp/iptables-controller.cleanup"
+
+// cleanupAck 为同步循环停止后创建的确认文件；cleanup 看到该文件后才开始删除。
+const cleanupAck = "/tmp/iptables-controller.cleanup.ack"
+
+// controllerPIDFile 记录同一容器中常驻控制器的进程号，cleanup 据此判断是否需要等待同步循环停止。
+const controllerPIDFile = "/tmp/iptables-controller.pid"
+
+// cleanupAckPollInterval 为 cleanup 检查确认文件的间隔。
+const cleanupAckPollInterval = 200 * time.Millisecond
+
+// cleanupStarted 判断本容器中是否已经开始执行 cleanup。
+func cleanupStarted() bool {
+    _, err := os.Stat(cleanupMarker)
+    return err == nil
+}
+
+// controllerRunning 判断同一容器中是否有常驻控制器进程在运行（进程号文件存在且进程存活）。
+// 说明：一次性 Job 的容器中没有常驻控制器，不需要等待。
+func controllerRunning() bool {
+    data, err := os.ReadFile(controllerPIDFile)
+    if err != nil {
+        return false
+    }
+    pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+    if err != nil || pid <= 0 || pid == os.Getpid() {
+        return false
+    }
+    return syscall.Kill(pid, 0) == nil
+}
+
+// waitControllerStopped 等待同一容器中的控制器确认停止同步（创建 cleanupAck），超过 timeout 时返回错误。
+// 说明：没有常驻控制器时立即返回；控制器在持有同步锁时发现标记文件，正在执行的同步结束后才确认，因此确认之后不会再有规则被下发。
+func waitControllerStopped(timeout time.Duration) error {
+    if !controllerRunning() {
+        return nil
+    }
+    deadline := time.Now().Add(timeout)
     for {
-        select {
-        case <-ticker.C:
-            if err := ctrl.Sync(ctx); err != nil {
-                log.Printf("sync error: %v", err)
-            }
-        case <-ctx.Done():
-            return
+        if _, err := os.Stat(cleanupAck); err == nil {
+            return nil
+        }
+        if !controllerRunning() {
+            return nil
+        }
+        if time.Now().After(deadline) {
+            return fmt.Errorf("controller did not stop syncing within %s", timeout)
+        }
+        time.Sleep(cleanupAckPollInterval)
+    }
+}
+
+// runCleanup 执行 cleanup 子命令，返回进程退出码。
+// 说明：
+// - 删除各地址族内置链中跳转到 MS- 链的规则、清空并删除全部 MS- 链、销毁全部 MS- 集合（nftables 数据面同时删除独占表）。
+// - 不需要 NODE_NAME 与 Kubernetes 客户端；数据面按 DATAPLANE/IPTABLES_MODE/IPV6 选择，与常规运行时一致。
+// - 删除的对象以 JSON 输出到标准输出，过程日志输出到标准错误；任何一步失败时以非零退出码结束（已删除的对象仍会输出）。
+// - 可用作 DaemonSet 的 preStop 钩子或一次性 Job（见 DEPLOYMENT.md），重复执行是安全的。
+// - 作为 preStop 钩子运行时先创建标记文件，等待同一容器中的控制器确认停止同步（最长 timeout）后才删除；超时则不做任何删除，以非零退出码结束。
+func runCleanup(timeout time.Duration) int {
+    if f, err := os.Create(cleanupMarker); err != nil {
+        // 没有常驻控制器（一次性 Job）时标记文件不是必需的
+        log.Printf("cleanup: create marker %s: %v", cleanupMarker, err)
+        if controllerRunning() {
+            return 1
+        }
+    } else {
+        _ = f.Close()
+    }
+    if err := waitControllerStopped(timeout); err != nil {
+        log.Printf("cleanup: %v, nothing deleted", err)
+        return 1
+    }
+
+    dp, dp6, _ := selectDataplanes()
+    ctrl := controller.NewController(nil, os.Getenv("NODE_NAME"), nil, "", dp, controller.Options{IPv6Dataplane: dp6})
+    reports, err := ctrl.Cleanup()
+
+    enc := json.NewEncoder(os.Stdout)
+    enc.SetIndent("", "  ")
+    enc.SetEscapeHTML(false)
+    _ = enc.Encode(reports)
+    if err != nil {
+        log.Printf("cleanup error: %v", err)
+        return 1
+    }
+    log.Printf("cleanup finished")
+    return 0
+}
+
+// selectDataplanes 按 DATAPLANE/IPTABLES_MODE/IPV6 环境变量创建 IPv4 数据面，以及启用 IPv6 时的 IPv6 数据面；配置无效时直接退出。
+func selectDataplanes() (dp, dp6 dataplane.Dataplane, ipv6 bool) {
+    mode, err := iptablesMode(os.Getenv("DATAPLANE"), os.Getenv("IPTABLES_MODE"))
+    if err != nil {
+        log.Fatalf("invalid IPTABLES_MODE: %v", err)
+    }
+    dp, err = newDataplane(os.Getenv("DATAPLANE"), dataplane.IPv4, mode)
+    if err != nil {
+        log.Fatalf("failed to select dataplane: %v", err)
+    }
+    ipv6, err = ipv6Enabled(os.Getenv("IPV6"))
+    if err != nil {
+        log.Fatalf("invalid IPV6: %v", err)
+    }
+    if ipv6 {
+        if dp6, err = newDataplane(os.Getenv("DATAPLANE"), dataplane.IPv6, mode); err != nil {
+            log.Fatalf("failed to select dataplane: %v", err)
+        }
+    }
+    return dp, dp6, ipv6
+}
+
+// newDataplane 根据名称选择指定地址族的数据面实现。
+// 支持：iptables（默认，iptables/ip6tables + ipset，mode 决定使用 legacy 还是 nft 命令）、nftables（独立 inet 表 + 命名集合，nft -f 原子提交）。
+func newDataplane(name string, family dataplane.Family, mode iptables.Mode) (dataplane.Dataplane, error) {
+    switch strings.ToLower(strings.TrimSpace(name)) {
+    case "", "iptables":
+        return iptables.NewFamilyBackend(family, mode, nil), nil
+    case "nftables", "nft":
+        return nftables.NewFamilyBackend(family, "", nil), nil
+    default:
+        return nil, fmt.Errorf("unknown dataplane %q (expected iptables or nftables)", name)
+    }
+}
+
+// iptablesMode 解析 IPTABLES_MODE；auto（默认）时探测主机上 kube-proxy/Calico 使用的模式。
+// 说明：数据面为 nftables 时不涉及 iptables 命令，直接返回默认模式且不做探测。
+func iptablesMode(dataplaneName, value string) (iptables.Mode, error) {
+    switch strings.ToLower(strings.TrimSpace(dataplaneName)) {
+    case "", "iptables":
+    default:
+        return iptables.ModeDefault, nil
+    }
+    mode, explicit, err := iptables.ParseMode(value)
+    if err != nil {
+        return iptables.ModeDefault, err
+    }
+    if explicit {
+        log.Printf("iptables mode %s set by IPTABLES_MODE", mode)
+        return mode, nil
+    }
+    return iptables.DetectMode(nil), nil
+}
+
+// ipv6Enabled 解析 IPV6 环境变量。
+// 说明：auto（默认）时以 /proc/net/if_inet6 是否存在判断节点是否启用了 IPv6。
+func ipv6Enabled(value string) (bool, error) {
+    switch strings.ToLower(strings.TrimSpace(value)) {
+    case "", "auto":
+        _, err := os.Stat("/proc/net/if_inet6")
+        return err == nil, nil
+    case "true", "1", "yes":
+        return true, nil
+    case "false", "0", "no":
+        return false, nil
+    default:
+        return false, fmt.Errorf("unknown value %q (expected auto, true or false)", value)
+    }
+}
+
+// parseHooks 解析 ENFORCE_HOOKS（逗号分隔，大小写不敏感），返回内置链名列表；为空时只包含 FORWARD。
+func parseHooks(value string) ([]string, error) {
+    hooks := []string{}
+    seen := map[string]bool{}
+    for _, item := range strings.Split(value, ",") {
+        item = strings.ToUpper(strings.TrimSpace(item))
+        if item == "" || seen[item] {
+            continue
+        }
+        switch item {
+        case dataplane.HookForward, dataplane.HookOutput, dataplane.HookInput:
+        default:
+            return nil, fmt.Errorf("unknown hook %q (expected forward, output or input)", item)
+        }
+        seen[item] = true
+        hooks = append(hooks, item)
+    }
+    if len(hooks) == 0 {
+        hooks = append(hooks, dataplane.HookForward)
+    }
+    return hooks, nil
+}
+
+// splitList 按逗号切分参数值，去掉空白与空项。
+func splitList(value string) []string {
+    out := []string{}
+    for _, item := range strings.Split(value, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            out = append(out, item)
         }
     }
+    return out
 }
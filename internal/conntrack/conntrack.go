@@ -0,0 +1,86 @@
+package conntrack
+
+import (
+    "fmt"
+    "strings"
+
+    "github.com/example/iptables-controller/internal/dataplane"
+    "github.com/example/iptables-controller/internal/iptables"
+)
+
+// Flow 描述一条连接跟踪表项的两端。
+// 字段说明：
+// - Client: 原方向的源地址（发起连接的一方）
+// - Server: 回复方向的源地址（实际应答的一方）；经 Service（DNAT）访问时为后端 Pod IP，而不是 ClusterIP
+type Flow struct {
+    Client string
+    Server string
+}
+
+// Table 通过 conntrack 命令（conntrack-tools）查询与删除内核连接跟踪表项。
+// 说明：连接跟踪表与 iptables/nftables 数据面无关，两种数据面共用同一实现；按 Server 过滤使用回复方向的源地址，
+// 因此经 Service 建立的连接也能按后端 Pod IP 匹配。
+type Table struct {
+    exec dataplane.Executor
+}
+
+// New 创建连接跟踪表操作实例；exec 为 nil 时使用 iptables.HostExecutor。
+func New(exec dataplane.Executor) *Table {
+    if exec == nil {
+        exec = iptables.HostExecutor{}
+    }
+    return &Table{exec: exec}
+}
+
+// ListFlows 列出地址族 family 中原方向源地址为 client、回复方向源地址为 server 的表项；client 或 server 为空表示不限制。
+func (t *Table) ListFlows(family dataplane.Family, client, server string) ([]Flow, error) {
+    out, err := t.exec.Run("conntrack", filterArgs("-L", family, client, server)...)
+    if err != nil {
+        return nil, fmt.Errorf("conntrack: %w", err)
+    }
+    return ParseFlows(out), nil
+}
+
+// DeleteFlows 删除地址族 family 中原方向源地址为 client、回复方向源地址为 server 的全部表项，返回删除的条数。
+// 说明：没有匹配的表项时 conntrack 以非零状态退出，这里视为删除了 0 条。
+func (t *Table) DeleteFlows(family dataplane.Family, client, server string) (int, error) {
+    out, err := t.exec.Run("conntrack", filterArgs("-D", family, client, server)...)
+    if err != nil {
+        if strings.Contains(err.Error(), "0 flow entries") {
+            return 0, nil
+        }
+        return 0, fmt.Errorf("conntrack: %w", err)
+    }
+    return len(ParseFlows(out)), nil
+}
+
+// filterArgs 生成 conntrack 的命令参数：op 为 -L 或 -D，-s 过滤原方向源地址，--reply-src 过滤回复方向源地址。
+func filterArgs(op string, family dataplane.Family, client, server string) []string {
+    args := []string{op, "-f", string(family)}
+    if client != "" {
+        args = append(args, "-s", client)
+    }
+    if server != "" {
+        args = append(args, "--reply-src", server)
+    }
+    return args
+}
+
+// ParseFlows 解析 conntrack -L/-D 的输出：每行第一个 src= 为原方向源地址，第二个 src= 为回复方向源地址。
+// 示例：`tcp 6 431999 ESTABLISHED src=10.244.1.3 dst=10.96.0.10 sport=34512 dport=53 src=10.244.2.5 dst=10.244.1.3 sport=53 dport=34512 [ASSURED] mark=0 use=1`
+func ParseFlows(out string) []Flow {
+    flows := []Flow{}
+    for _, line := range strings.Split(out, "\n") {
+        srcs := []string{}
+        for _, field := range strings.Fields(line) {
+            if v, ok := strings.CutPrefix(field, "src="); ok {
+                srcs = append(srcs, v)
+            }
+        }
+        if len(srcs) < 2 {
+            continue
+        }
+        flows = append(flows, Flow{Client: srcs[0], Server: srcs[1]})
+    }
+    return flows
+}
@@ -2,34 +2,55 @@ package controller
 
 import (
     "encoding/json"
+    "errors"
     "log"
     "net/http"
     "strings"
+
+    "github.com/example/iptables-controller/internal/dataplane"
 )
 
 // APIServer 负责对外提供策略管理接口。
 // 变量说明：
 // - store: 策略存储（内存/可选文件持久化）
 // - token: 可选访问令牌，若设置则要求请求头包含 X-API-Token
+// - ctrl: 控制器实例，用于查询运行状态（GET /status）
 type APIServer struct {
     store *PolicyStore
     token string
+    ctrl  *Controller
 }
 
 // NewAPIServer 创建 API 服务器实例。
-func NewAPIServer(store *PolicyStore, token string) *APIServer {
-    return &APIServer{store: store, token: token}
+func NewAPIServer(store *PolicyStore, token string, ctrl *Controller) *APIServer {
+    return &APIServer{store: store, token: token, ctrl: ctrl}
 }
 
 // Handler 返回 HTTP 处理器。
 // 说明：
 // - GET /policy: 获取当前策略
 // - PUT /policy: 更新策略（请求体为 PolicyConfig JSON）
+// - GET /status: 查询运行状态（数据面、iptables 模式、挂载的内置链）
+// - GET /plan: 查询最近一次同步的计划（要新建的链、各链规则、集合成员、跳转与待回收对象）
+// - GET /counters: 查询各工作负载规则的命中计数（可用 namespace/name 与 kind/apiGroup 参数过滤）
+// - POST /counters/reset: 将命中计数清零（可用 namespace/name 参数限定范围）
+// - GET /audit: 查询审计模式工作负载本应被拒绝的报文数（可用 namespace/name 与 kind/apiGroup 参数过滤）
+// - GET /generations: 查询各地址族的当前代、上一代与被回滚掉的代
+// - POST /rollback: 将入口链切换回上一代（可用 family 参数限定地址族）
+// - GET /ownership: 查询被多个工作负载的选择器同时匹配的 Pod 及其实际归属
 func (s *APIServer) Handler() http.Handler {
     mux := http.NewServeMux()
     mux.HandleFunc("/healthz", s.handleHealthz)
     mux.HandleFunc("/policy", s.handlePolicy)
     mux.HandleFunc("/apply", s.handleApply)
+    mux.HandleFunc("/status", s.handleStatus)
+    mux.HandleFunc("/plan", s.handlePlan)
+    mux.HandleFunc("/counters", s.handleCounters)
+    mux.HandleFunc("/counters/reset", s.handleResetCounters)
+    mux.HandleFunc("/audit", s.handleAudit)
+    mux.HandleFunc("/generations", s.handleGenerations)
+    mux.HandleFunc("/rollback", s.handleRollback)
+    mux.HandleFunc("/ownership", s.handleOwnership)
     return mux
 }
 
@@ -78,17 +99,234 @@ func (s *APIServer) handleApply(w http.ResponseWriter, r *http.Request) {
         _, _ = w.Write([]byte("invalid json"))
         return
     }
+    if err := cfg.Validate(); err != nil {
+        w.WriteHeader(http.StatusBadRequest)
+        _, _ = w.Write([]byte(err.Error()))
+        return
+    }
     if err := s.store.Set(cfg); err != nil {
         log.Printf("set policy error: %v", err)
         w.WriteHeader(http.StatusInternalServerError)
         _, _ = w.Write([]byte("set policy failed"))
         return
     }
+    // 策略变化影响所有工作负载，立即请求一次全量同步，不必等待下一个 resync 周期
+    s.ctrl.RequestResync()
     w.WriteHeader(http.StatusOK)
     _, _ = w.Write([]byte("ok"))
     return
 }
 
+// handleStatus 返回控制器运行状态（GET /status），包括各地址族的数据面与 iptables 模式。
+func (s *APIServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+    if !s.authorized(r) {
+        w.WriteHeader(http.StatusUnauthorized)
+        _, _ = w.Write([]byte("unauthorized"))
+        return
+    }
+
+    if r.Method != http.MethodGet {
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(s.ctrl.Status())
+}
+
+// handlePlan 返回最近一次同步的计划（GET /plan）；尚未完成过同步时返回 404。
+// 说明：观察模式（-dry-run）下计划只被记录、不会下发，可据此在灰度阶段核对控制器将要做的变更。
+func (s *APIServer) handlePlan(w http.ResponseWriter, r *http.Request) {
+    if !s.authorized(r) {
+        w.WriteHeader(http.StatusUnauthorized)
+        _, _ = w.Write([]byte("unauthorized"))
+        return
+    }
+
+    if r.Method != http.MethodGet {
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    plan := s.ctrl.LastPlan()
+    if plan == nil {
+        w.WriteHeader(http.StatusNotFound)
+        _, _ = w.Write([]byte("no plan computed yet"))
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(plan)
+}
+
+// handleCounters 返回规则命中计数（GET /counters?namespace=<ns>&name=<name>）。
+// 说明：不带参数时返回全部工作负载；指定的工作负载在本节点没有专用链时返回 404。
+func (s *APIServer) handleCounters(w http.ResponseWriter, r *http.Request) {
+    if !s.authorized(r) {
+        w.WriteHeader(http.StatusUnauthorized)
+        _, _ = w.Write([]byte("unauthorized"))
+        return
+    }
+
+    if r.Method != http.MethodGet {
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    key, ok := workloadQuery(r)
+    if !ok {
+        w.WriteHeader(http.StatusBadRequest)
+        _, _ = w.Write([]byte("namespace and name must be given together, with a valid kind/apiGroup"))
+        return
+    }
+    counters, err := s.ctrl.Counters(key)
+    if err != nil {
+        log.Printf("read counters error: %v", err)
+        w.WriteHeader(http.StatusInternalServerError)
+        _, _ = w.Write([]byte("read counters failed"))
+        return
+    }
+    if key != nil && len(counters) == 0 {
+        w.WriteHeader(http.StatusNotFound)
+        _, _ = w.Write([]byte("workload not found on this node"))
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(counters)
+}
+
+// handleResetCounters 将规则命中计数清零（POST /counters/reset?namespace=<ns>&name=<name>）。
+func (s *APIServer) handleResetCounters(w http.ResponseWriter, r *http.Request) {
+    if !s.authorized(r) {
+        w.WriteHeader(http.StatusUnauthorized)
+        _, _ = w.Write([]byte("unauthorized"))
+        return
+    }
+
+    if r.Method != http.MethodPost {
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    key, ok := workloadQuery(r)
+    if !ok {
+        w.WriteHeader(http.StatusBadRequest)
+        _, _ = w.Write([]byte("namespace and name must be given together, with a valid kind/apiGroup"))
+        return
+    }
+    if err := s.ctrl.ResetCounters(key); err != nil {
+        log.Printf("reset counters error: %v", err)
+        w.WriteHeader(http.StatusInternalServerError)
+        _, _ = w.Write([]byte("reset counters failed"))
+        return
+    }
+    w.WriteHeader(http.StatusOK)
+    _, _ = w.Write([]byte("ok"))
+}
+
+// handleAudit 返回审计模式工作负载本应被拒绝的流量统计（GET /audit?namespace=<ns>&name=<name>）。
+// 说明：指定的工作负载不处于审计模式或在本节点没有专用链时返回 404。
+func (s *APIServer) handleAudit(w http.ResponseWriter, r *http.Request) {
+    if !s.authorized(r) {
+        w.WriteHeader(http.StatusUnauthorized)
+        _, _ = w.Write([]byte("unauthorized"))
+        return
+    }
+
+    if r.Method != http.MethodGet {
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    key, ok := workloadQuery(r)
+    if !ok {
+        w.WriteHeader(http.StatusBadRequest)
+        _, _ = w.Write([]byte("namespace and name must be given together, with a valid kind/apiGroup"))
+        return
+    }
+    audit, err := s.ctrl.Audit(key)
+    if err != nil {
+        log.Printf("read audit counters error: %v", err)
+        w.WriteHeader(http.StatusInternalServerError)
+        _, _ = w.Write([]byte("read audit counters failed"))
+        return
+    }
+    if key != nil && len(audit) == 0 {
+        w.WriteHeader(http.StatusNotFound)
+        _, _ = w.Write([]byte("workload not audited on this node"))
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(audit)
+}
+
+// handleGenerations 返回各地址族的规则代（GET /generations）。
+func (s *APIServer) handleGenerations(w http.ResponseWriter, r *http.Request) {
+    if !s.authorized(r) {
+        w.WriteHeader(http.StatusUnauthorized)
+        _, _ = w.Write([]byte("unauthorized"))
+        return
+    }
+
+    if r.Method != http.MethodGet {
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(s.ctrl.Generations())
+}
+
+// handleRollback 将入口链切换回上一代（POST /rollback?family=<ipv4|ipv6>），返回回滚后的规则代。
+// 说明：不带 family 时回滚全部地址族；family 无效时返回 400，没有上一代时返回 409，观察模式或其它失败时返回 500（已成功回滚的地址族不会撤销）。
+func (s *APIServer) handleRollback(w http.ResponseWriter, r *http.Request) {
+    if !s.authorized(r) {
+        w.WriteHeader(http.StatusUnauthorized)
+        _, _ = w.Write([]byte("unauthorized"))
+        return
+    }
+
+    if r.Method != http.MethodPost {
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    family := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("family")))
+    if family != "" && family != string(dataplane.IPv4) && family != string(dataplane.IPv6) {
+        w.WriteHeader(http.StatusBadRequest)
+        _, _ = w.Write([]byte("family must be ipv4 or ipv6"))
+        return
+    }
+    gens, err := s.ctrl.Rollback(family)
+    if err != nil {
+        log.Printf("rollback error: %v", err)
+        status := http.StatusInternalServerError
+        if errors.Is(err, ErrNoPreviousGeneration) {
+            status = http.StatusConflict
+        }
+        w.WriteHeader(status)
+        _, _ = w.Write([]byte(err.Error()))
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(gens)
+}
+
+// workloadQuery 解析查询参数中的 namespace/name 与可选的 kind/apiGroup（为空时为 Deployment，见 DeploymentPolicy）；
+// namespace 与 name 都为空时返回 nil（表示全部），只给出其一或 kind/apiGroup 格式不正确时返回 false。
+func workloadQuery(r *http.Request) (*WorkloadKey, bool) {
+    q := r.URL.Query()
+    ns := strings.TrimSpace(q.Get("namespace"))
+    name := strings.TrimSpace(q.Get("name"))
+    if ns == "" && name == "" {
+        return nil, true
+    }
+    if ns == "" || name == "" || validateWorkloadKind(q.Get("apiGroup"), q.Get("kind")) != nil {
+        return nil, false
+    }
+    key := newWorkloadKey(q.Get("apiGroup"), q.Get("kind"), ns, name)
+    return &key, true
+}
+
 // authorized 根据 X-API-Token 头进行简单鉴权。
 // 说明：若 token 为空，则不启用鉴权（便于内网测试）。
 func (s *APIServer) authorized(r *http.Request) bool {
@@ -97,3 +335,27 @@ func (s *APIServer) authorized(r *http.Request) bool {
     }
     return r.Header.Get("X-API-Token") == s.token
 }
+
+// handleOwnership 返回 Pod 归属的诊断结果（GET /ownership），列出选择器重叠的 Pod。
+func (s *APIServer) handleOwnership(w http.ResponseWriter, r *http.Request) {
+    if !s.authorized(r) {
+        w.WriteHeader(http.StatusUnauthorized)
+        _, _ = w.Write([]byte("unauthorized"))
+        return
+    }
+
+    if r.Method != http.MethodGet {
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    report, err := s.ctrl.Ownership(r.Context())
+    if err != nil {
+        log.Printf("check pod ownership error: %v", err)
+        w.WriteHeader(http.StatusInternalServerError)
+        _, _ = w.Write([]byte("check pod ownership failed"))
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,109 @@
+package controller
+
+import (
+    "errors"
+    "fmt"
+    "log"
+
+    "github.com/example/iptables-controller/internal/dataplane"
+)
+
+// CleanupReport 描述 cleanup 在某一地址族数据面上删除的对象。
+// 字段说明：
+// - Family / Dataplane: 地址族（ipv4/ipv6）与数据面名称
+// - Jumps: 从内置链删除的跳转，形如 "FORWARD -> MS-ROOT-IN"
+// - Chains: 删除的带前缀的链
+// - IPSets: 销毁的带前缀的集合
+// - Table: 删除的独占表，例如 "inet microseg"（仅 nftables 数据面）
+type CleanupReport struct {
+    Family    string   `json:"family"`
+    Dataplane string   `json:"dataplane"`
+    Jumps     []string `json:"jumps"`
+    Chains    []string `json:"chains"`
+    IPSets    []string `json:"ipsets"`
+    Table     string   `json:"table,omitempty"`
+}
+
+// tableRemover 由拥有独占表的数据面实现（nftables.Backend）提供，cleanup 最后删除该表。
+type tableRemover interface {
+    DeleteTable() (string, error)
+}
+
+// cleanupHooks 为 cleanup 检查的内置入口；不论当前是否启用，全部检查，以覆盖之前以其它 ENFORCE_HOOKS 运行时留下的跳转。
+var cleanupHooks = []string{dataplane.HookForward, dataplane.HookOutput, dataplane.HookInput}
+
+// Cleanup 从本节点删除本程序留下的全部对象，用于卸载（preStop 钩子或一次性 Job）。
+// 顺序（每个地址族）：
+// 1. 删除 FORWARD/OUTPUT/INPUT 中跳转到带前缀链的规则，流量立即不再经过本程序的链；
+// 2. 清空并删除全部带前缀的链；
+// 3. 销毁全部带前缀的集合（含 ipset swap 的临时集合）；
+// 4. nftables 数据面最后删除独占表。
+// 说明：某一步失败时记录错误并继续后续步骤（链删除失败时跳过集合，集合仍被引用无法销毁），错误合并后返回；返回的报告只包含已成功删除的对象。
+func (c *Controller) Cleanup() ([]CleanupReport, error) {
+    prefix := c.prefix + "-"
+    reports := []CleanupReport{}
+    errs := []error{}
+    for _, pl := range c.planes {
+        report := CleanupReport{Family: string(pl.family), Dataplane: pl.dp.Name(), Jumps: []string{}, Chains: []string{}, IPSets: []string{}}
+        if err := c.cleanupFamily(pl, prefix, &report); err != nil {
+            errs = append(errs, fmt.Errorf("%s: %w", pl.family, err))
+        }
+        reports = append(reports, report)
+    }
+    return reports, errors.Join(errs...)
+}
+
+// cleanupFamily 删除一个地址族数据面上的全部带前缀对象，并把删除的对象写入 report。
+func (c *Controller) cleanupFamily(pl *plane, prefix string, report *CleanupReport) error {
+    chains, err := pl.dp.ListChains(prefix)
+    if err != nil {
+        return fmt.Errorf("list chains: %w", err)
+    }
+
+    errs := []error{}
+    for _, hook := range cleanupHooks {
+        removed, err := pl.dp.RemoveJumps(hook, chains)
+        if err != nil {
+            errs = append(errs, fmt.Errorf("remove jumps from %s: %w", hook, err))
+            continue
+        }
+        for _, target := range removed {
+            report.Jumps = append(report.Jumps, hook+" -> "+target)
+            log.Printf("cleanup: removed %s jump %s -> %s", pl.family, hook, target)
+        }
+    }
+
+    if err := pl.dp.DeleteChains(chains); err != nil {
+        return errors.Join(append(errs, fmt.Errorf("delete chains: %w", err))...)
+    }
+    for _, name := range chains {
+        c.registry.Forget(name)
+        report.Chains = append(report.Chains, name)
+        log.Printf("cleanup: removed %s chain %s", pl.family, name)
+    }
+
+    sets, err := pl.dp.ListIPSets(prefix)
+    if err != nil {
+        return errors.Join(append(errs, fmt.Errorf("list ipsets: %w", err))...)
+    }
+    for _, name := range sets {
+        if err := pl.dp.DestroyIPSet(name); err != nil {
+            errs = append(errs, fmt.Errorf("destroy ipset %s: %w", name, err))
+            continue
+        }
+        c.registry.Forget(name)
+        report.IPSets = append(report.IPSets, name)
+        log.Printf("cleanup: removed %s ipset %s", pl.family, name)
+    }
+
+    if tr, ok := pl.dp.(tableRemover); ok && len(errs) == 0 {
+        table, err := tr.DeleteTable()
+        if err != nil {
+            errs = append(errs, fmt.Errorf("delete table: %w", err))
+        } else if table != "" {
+            report.Table = table
+            log.Printf("cleanup: removed %s table %s", pl.family, table)
+        }
+    }
+    return errors.Join(errs...)
+}
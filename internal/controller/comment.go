@@ -0,0 +1,231 @@
+package controller
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "strconv"
+    "strings"
+)
+
+// maxRuleCommentLen 为规则注释的长度上限。
+// 说明：nftables 的注释上限为 128 字节（iptables 为 255），两种数据面使用同一份注释，取较小值。
+const maxRuleCommentLen = 128
+
+// RuleComment 为写入每条规则 `-m comment` 的归属信息，使节点上的规则不依赖外部状态即可还原归属。
+// 字段说明：
+// - Owner: 所属工作负载；入口链中的规则为空
+// - Direction: in（入向）、out（出向）、hin（hostNetwork 入向），与专用链的用途一致
+// - Revision: 该工作负载生效策略的版本（见 policyRevision）；没有策略时为空
+// - Pod: 规则匹配的本地 Pod 名称
+// - Peers: 白名单规则放行的对端（WorkloadKey 的文本形式，Deployment 为 "namespace/name"；标签选择器对端为 "sel:<哈希>"，见 DeploymentRef.peerName），"*" 表示任意对端；注释超长时末尾为 "+N"（省略的个数）
+// - RuleIndex: 旧规则在策略 rules 中的下标；不是旧规则时为 -1
+// - Audit: 审计模式下代替拒绝规则的放行规则
+// - Established: 入口链中放行已建立/相关连接的规则
+// - Generation / Digest: 入口链分派规则跳转到的代及其链内容摘要（见 generation.go）；其它规则为 0 与空
+// - RejectedGeneration / RejectedDigest: 分派规则上记录的被回滚掉的代及其摘要，文本形式为 `rejected=<代>:<摘要>`
+// 文本形式为空格分隔的 key=value（标志位只有 key），例如
+// `owner=default/web dir=in rev=1a2b3c4d pod=web-5d9f-x2k peer=default/client`；其它类型的归属与对端带类型，例如 `owner=default/StatefulSet/db`。
+type RuleComment struct {
+    Owner       WorkloadKey
+    Direction   string
+    Revision    string
+    Pod         string
+    Peers       []string
+    RuleIndex   int
+    Audit       bool
+    Established bool
+
+    Generation         int
+    Digest             string
+    RejectedGeneration int
+    RejectedDigest     string
+}
+
+// 注释中的方向取值。
+const (
+    dirIngress     = "in"
+    dirEgress      = "out"
+    dirHostIngress = "hin"
+)
+
+// String 返回注释文本；超过 maxRuleCommentLen 时依次省略末尾的对端、Pod 名称，最后截断。
+func (rc RuleComment) String() string {
+    peers := rc.Peers
+    text := rc.render(peers, rc.Pod)
+    // 逐个减少保留的对端，末尾以 "+N" 标出省略的个数
+    for keep := len(rc.Peers) - 1; len(text) > maxRuleCommentLen && keep >= 0; keep-- {
+        peers = append(append([]string{}, rc.Peers[:keep]...), "+"+strconv.Itoa(len(rc.Peers)-keep))
+        text = rc.render(peers, rc.Pod)
+    }
+    if len(text) > maxRuleCommentLen {
+        text = rc.render(peers, "")
+    }
+    if len(text) > maxRuleCommentLen {
+        text = text[:maxRuleCommentLen]
+    }
+    return text
+}
+
+// render 按固定顺序拼接注释字段。
+func (rc RuleComment) render(peers []string, pod string) string {
+    fields := []string{}
+    if rc.Owner.Namespace != "" || rc.Owner.Name != "" {
+        fields = append(fields, ownerCommentPrefix+rc.Owner.String())
+    }
+    if rc.Direction != "" {
+        fields = append(fields, "dir="+rc.Direction)
+    }
+    if rc.Established {
+        fields = append(fields, "established")
+    }
+    if rc.Revision != "" {
+        fields = append(fields, "rev="+rc.Revision)
+    }
+    if pod != "" {
+        fields = append(fields, "pod="+pod)
+    }
+    if len(peers) > 0 {
+        fields = append(fields, "peer="+strings.Join(peers, ","))
+    }
+    if rc.RuleIndex >= 0 {
+        fields = append(fields, "rule="+strconv.Itoa(rc.RuleIndex))
+    }
+    if rc.Audit {
+        fields = append(fields, "mode="+PolicyModeAudit)
+    }
+    if rc.Generation > 0 {
+        fields = append(fields, "gen="+strconv.Itoa(rc.Generation))
+    }
+    if rc.Digest != "" {
+        fields = append(fields, "sum="+rc.Digest)
+    }
+    if rc.RejectedGeneration > 0 {
+        fields = append(fields, "rejected="+strconv.Itoa(rc.RejectedGeneration)+":"+rc.RejectedDigest)
+    }
+    return strings.Join(fields, " ")
+}
+
+// ParseRuleComment 解析 RuleComment.String 生成的注释文本；不认识的字段被忽略，没有任何已知字段时返回 false。
+// 说明：兼容旧版本只写 `owner=<namespace>/<name>` 的根链跳转注释；owner 的格式见 parseWorkloadKey。
+func ParseRuleComment(text string) (RuleComment, bool) {
+    rc := RuleComment{RuleIndex: -1}
+    known := false
+    for _, field := range strings.Fields(text) {
+        key, value, _ := strings.Cut(field, "=")
+        switch key {
+        case "owner":
+            owner, ok := parseWorkloadKey(value)
+            if !ok {
+                continue
+            }
+            rc.Owner = owner
+        case "dir":
+            rc.Direction = value
+        case "established":
+            rc.Established = true
+        case "rev":
+            rc.Revision = value
+        case "pod":
+            rc.Pod = value
+        case "peer":
+            rc.Peers = strings.Split(value, ",")
+        case "rule":
+            idx, err := strconv.Atoi(value)
+            if err != nil || idx < 0 {
+                continue
+            }
+            rc.RuleIndex = idx
+        case "mode":
+            rc.Audit = value == PolicyModeAudit
+        case "gen", "rejected":
+            genText, digest, _ := strings.Cut(value, ":")
+            gen, err := strconv.Atoi(genText)
+            if err != nil || gen <= 0 {
+                continue
+            }
+            if key == "gen" {
+                rc.Generation = gen
+            } else {
+                rc.RejectedGeneration, rc.RejectedDigest = gen, digest
+            }
+        case "sum":
+            rc.Digest = value
+        default:
+            continue
+        }
+        known = true
+    }
+    return rc, known
+}
+
+// newRuleComment 返回属于 owner、方向为 dir 的注释（不是旧规则）。
+func newRuleComment(owner WorkloadKey, dir string) RuleComment {
+    return RuleComment{Owner: owner, Direction: dir, RuleIndex: -1}
+}
+
+// forPeers 返回针对本地目标 t、放行对端 peers 的注释副本。
+func (rc RuleComment) forPeers(t endpoint, peers ...string) RuleComment {
+    rc.Pod = t.Pod
+    rc.Peers = peers
+    return rc
+}
+
+// ruleComment 返回规则参数中第一个可解析的归属注释。
+func ruleComment(rule []string) (RuleComment, bool) {
+    for i := 0; i+1 < len(rule); i++ {
+        if rule[i] != "--comment" {
+            continue
+        }
+        if rc, ok := ParseRuleComment(rule[i+1]); ok {
+            return rc, true
+        }
+    }
+    return RuleComment{RuleIndex: -1}, false
+}
+
+// tagRule 在规则的 -j 之前插入 `-m comment --comment <注释>`（iptables-save 按匹配加载顺序输出，注释位于其它匹配之后）。
+func tagRule(rule []string, rc RuleComment) []string {
+    at := len(rule)
+    for i, a := range rule {
+        if a == "-j" || a == "-g" {
+            at = i
+            break
+        }
+    }
+    out := append([]string{}, rule[:at]...)
+    out = append(out, "-m", "comment", "--comment", rc.String())
+    return append(out, rule[at:]...)
+}
+
+// policyRevision 返回工作负载生效策略的版本：对其策略条目与影响规则的全局字段（defaultAction、denyLog）做哈希，取前 8 位十六进制。
+// 说明：版本只由策略内容决定，与下发时间、节点无关，重启或在其它节点上计算得到的值相同；没有策略时返回空字符串。
+func policyRevision(policy *PolicyConfig, depPolicy *DeploymentPolicy) string {
+    if depPolicy == nil {
+        return ""
+    }
+    in := struct {
+        Deployment    *DeploymentPolicy `json:"deployment"`
+        DefaultAction string            `json:"defaultAction"`
+        DenyLog       *DenyLog          `json:"denyLog,omitempty"`
+    }{Deployment: depPolicy}
+    if policy != nil {
+        in.DefaultAction = policy.DefaultAction
+        in.DenyLog = policy.DenyLog
+    }
+    data, err := json.Marshal(in)
+    if err != nil {
+        return ""
+    }
+    sum := sha256.Sum256(data)
+    return hex.EncodeToString(sum[:4])
+}
+
+// refNames 将 DeploymentRef 列表转换为注释中的对端形式（见 DeploymentRef.peerName）；subjectNs 为策略主体所在的命名空间。
+func refNames(refs []DeploymentRef, subjectNs string) []string {
+    out := make([]string, 0, len(refs))
+    for _, ref := range refs {
+        out = append(out, ref.peerName(subjectNs))
+    }
+    return out
+}
@@ -0,0 +1,115 @@
+package controller
+
+import (
+    "reflect"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+func TestRuleCommentRoundTrip(t *testing.T) {
+    web := newWorkloadKey("", KindDeployment, "default", "web")
+    db := newWorkloadKey("apps", KindStatefulSet, "default", "db")
+    cases := []struct {
+        name string
+        rc   RuleComment
+        text string
+    }{
+        {
+            name: "allow rule",
+            rc:   RuleComment{Owner: web, Direction: dirIngress, Revision: "1a2b3c4d", Pod: "web-5d9f-x2k", Peers: []string{"default/client", "sel:0a1b2c3d"}, RuleIndex: -1},
+            text: "owner=default/web dir=in rev=1a2b3c4d pod=web-5d9f-x2k peer=default/client,sel:0a1b2c3d",
+        },
+        {
+            name: "typed owner and legacy rule in audit mode",
+            rc:   RuleComment{Owner: db, Direction: dirHostIngress, Pod: "db-0", RuleIndex: 2, Audit: true},
+            text: "owner=default/StatefulSet/db dir=hin pod=db-0 rule=2 mode=audit",
+        },
+        {
+            name: "dispatch rule",
+            rc:   RuleComment{Established: true, RuleIndex: -1, Generation: 7, Digest: "89abcdef", RejectedGeneration: 8, RejectedDigest: "01234567"},
+            text: "established gen=7 sum=89abcdef rejected=8:01234567",
+        },
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            if got := tc.rc.String(); got != tc.text {
+                t.Fatalf("String = %q, want %q", got, tc.text)
+            }
+            got, ok := ParseRuleComment(tc.text)
+            if !ok || !reflect.DeepEqual(got, tc.rc) {
+                t.Fatalf("ParseRuleComment = %+v, %v, want %+v", got, ok, tc.rc)
+            }
+        })
+    }
+}
+
+func TestParseRuleComment(t *testing.T) {
+    cases := []struct {
+        name   string
+        text   string
+        want   RuleComment
+        wantOK bool
+    }{
+        {name: "legacy owner only", text: "owner=default/web", want: newRuleComment(newWorkloadKey("", KindDeployment, "default", "web"), ""), wantOK: true},
+        {name: "unknown fields ignored", text: "dir=out future=1 flag", want: RuleComment{Direction: dirEgress, RuleIndex: -1}, wantOK: true},
+        {name: "invalid values ignored", text: "owner=default/ rule=-1 gen=0 dir=in", want: RuleComment{Direction: dirIngress, RuleIndex: -1}, wantOK: true},
+        {name: "foreign comment", text: "cali:wUHhoiAYhphO9Mso", want: RuleComment{RuleIndex: -1}},
+        {name: "empty", text: "", want: RuleComment{RuleIndex: -1}},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            got, ok := ParseRuleComment(tc.text)
+            if ok != tc.wantOK || !reflect.DeepEqual(got, tc.want) {
+                t.Fatalf("ParseRuleComment(%q) = %+v, %v, want %+v, %v", tc.text, got, ok, tc.want, tc.wantOK)
+            }
+        })
+    }
+}
+
+// 超过 maxRuleCommentLen 时依次省略末尾的对端（以 "+N" 标出）、Pod 名称，最后截断；省略后的注释仍可解析出归属。
+func TestRuleCommentLimit(t *testing.T) {
+    owner := newWorkloadKey("", KindDeployment, "production", "payment-api")
+    peers := []string{}
+    for i := 0; i < 10; i++ {
+        peers = append(peers, "production/peer-"+strconv.Itoa(i))
+    }
+    cases := []struct {
+        name      string
+        rc        RuleComment
+        wantPod   string
+        wantPeers []string
+    }{
+        {
+            name:      "peers elided",
+            rc:        RuleComment{Owner: owner, Direction: dirIngress, Revision: "1a2b3c4d", Pod: "payment-api-0", Peers: peers, RuleIndex: -1},
+            wantPod:   "payment-api-0",
+            wantPeers: []string{peers[0], peers[1], peers[2], "+7"},
+        },
+        {
+            name:      "pod dropped",
+            rc:        RuleComment{Owner: owner, Direction: dirIngress, Pod: strings.Repeat("p", 100), Peers: peers[:1], RuleIndex: -1},
+            wantPeers: []string{"+1"},
+        },
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            text := tc.rc.String()
+            if len(text) > maxRuleCommentLen {
+                t.Fatalf("comment is %d bytes: %q", len(text), text)
+            }
+            got, ok := ParseRuleComment(text)
+            if !ok || got.Owner != owner || got.Direction != dirIngress || got.Revision != tc.rc.Revision {
+                t.Fatalf("ParseRuleComment(%q) = %+v, %v", text, got, ok)
+            }
+            if got.Pod != tc.wantPod || !reflect.DeepEqual(got.Peers, tc.wantPeers) {
+                t.Fatalf("pod %q peers %v, want %q %v", got.Pod, got.Peers, tc.wantPod, tc.wantPeers)
+            }
+        })
+    }
+
+    long := RuleComment{Owner: newWorkloadKey("", KindDeployment, "default", strings.Repeat("w", 200)), RuleIndex: -1}
+    if text := long.String(); len(text) != maxRuleCommentLen {
+        t.Fatalf("over-long owner gives %d bytes, want truncation to %d", len(text), maxRuleCommentLen)
+    }
+}
@@ -0,0 +1,179 @@
+package controller
+
+import (
+    "log"
+    "sort"
+
+    "github.com/example/iptables-controller/internal/conntrack"
+    "github.com/example/iptables-controller/internal/dataplane"
+)
+
+// ConntrackTable 为连接跟踪表的操作接口（conntrack.Table 实现），用于在撤销访问后删除已建立的连接。
+// 说明：根链先放行 ESTABLISHED,RELATED 的流量，白名单收紧后已建立的长连接（数据库连接池、gRPC 流等）不会再经过白名单规则；
+// 删除其连接跟踪表项后，后续报文按新连接重新匹配规则，撤销立即生效。
+type ConntrackTable interface {
+    ListFlows(family dataplane.Family, client, server string) ([]conntrack.Flow, error)
+    DeleteFlows(family dataplane.Family, client, server string) (int, error)
+}
+
+// accessKey 标识某个工作负载某个方向上的访问控制。
+type accessKey struct {
+    Owner     WorkloadKey
+    Direction string
+}
+
+// accessState 为某个方向上已下发的白名单。
+// 字段说明：
+// - Restricted: 是否按白名单拒绝其它对端；未配置白名单或处于审计模式时为 false
+// - Peers: 白名单中的对端地址（已排序）
+// - Nets: 白名单中 ipBlock 对端展开的网段集合成员（见 collectPeerNets）
+// - Locals: 本节点上该工作负载的 Pod IP（已排序）
+type accessState struct {
+    Restricted bool
+    Peers      []string
+    Nets       []string
+    Locals     []string
+}
+
+// RevokePlan 描述一次同步撤销的访问，执行计划后删除对应的已建立连接（需开启 Options.Conntrack）。
+// 字段说明：
+// - Owner / Direction: 所属工作负载（见 WorkloadKey.String）与方向（ingress/egress）
+// - Locals: 本节点上该工作负载的 Pod IP
+// - Peers: 被移出白名单的对端地址
+// - AllPeers: 为 true 时白名单是新启用的（或从审计模式切换为执行，或网段对端收缩），Allowed 与 AllowedNets 以外的全部对端都被撤销
+// - Allowed: AllPeers 为 true 时仍被允许的对端地址
+// - AllowedNets: AllPeers 为 true 时仍被允许的网段（网段集合成员，见 dataplane.NetMember）
+type RevokePlan struct {
+    Owner       string   `json:"owner"`
+    Direction   string   `json:"direction"`
+    Locals      []string `json:"locals"`
+    Peers       []string `json:"peers,omitempty"`
+    AllPeers    bool     `json:"allPeers,omitempty"`
+    Allowed     []string `json:"allowed,omitempty"`
+    AllowedNets []string `json:"allowedNets,omitempty"`
+}
+
+// newAccessState 根据白名单与本地目标生成访问状态；restricted 为 false 表示未配置白名单（Pod 集合与网段集合都没有）。
+func newAccessState(restricted, audit bool, peers, nets []string, targets []endpoint) accessState {
+    locals := []string{}
+    seen := map[string]bool{}
+    for _, t := range targets {
+        if !seen[t.IP] {
+            seen[t.IP] = true
+            locals = append(locals, t.IP)
+        }
+    }
+    sort.Strings(locals)
+    return accessState{Restricted: restricted && !audit, Peers: peers, Nets: nets, Locals: locals}
+}
+
+// planRevocations 比较上次下发与本次期望的访问状态，返回被撤销的访问（按工作负载与方向排序）。
+// 说明：
+// - 只比较两次都存在的工作负载；上次状态未知（启动后首次同步）时不撤销任何连接。
+// - 白名单收缩时撤销被移除的对端（仍在网段对端之内的除外）；白名单新启用（含审计模式切换为执行）时撤销白名单以外的全部对端。
+// - 网段对端收缩（移除网段或新增 except）时无法逐个列出对端，同样按白名单以外的全部对端处理。
+func planRevocations(prev, next map[accessKey]accessState) []RevokePlan {
+    out := []RevokePlan{}
+    if prev == nil {
+        return out
+    }
+    for key, n := range next {
+        p, ok := prev[key]
+        if !ok || !n.Restricted || len(n.Locals) == 0 {
+            continue
+        }
+        r := RevokePlan{Owner: key.Owner.String(), Direction: key.Direction, Locals: n.Locals}
+        if !p.Restricted || netsNarrowed(p.Nets, n.Nets) {
+            r.AllPeers = true
+            r.Allowed = n.Peers
+            r.AllowedNets = n.Nets
+            out = append(out, r)
+            continue
+        }
+        allowed := map[string]bool{}
+        for _, ip := range n.Peers {
+            allowed[ip] = true
+        }
+        for _, ip := range p.Peers {
+            if !allowed[ip] && !netsAllow(n.Nets, ip) {
+                r.Peers = append(r.Peers, ip)
+            }
+        }
+        if len(r.Peers) > 0 {
+            out = append(out, r)
+        }
+    }
+    sort.Slice(out, func(i, j int) bool {
+        if out[i].Owner != out[j].Owner {
+            return out[i].Owner < out[j].Owner
+        }
+        return out[i].Direction < out[j].Direction
+    })
+    return out
+}
+
+// killRevoked 删除被撤销访问的已建立连接。
+// 说明：
+// - 入向：客户端为对端、服务端为本地 Pod；出向：客户端为本地 Pod、服务端为对端。服务端按回复方向的源地址匹配，经 Service 的连接同样生效。
+// - AllPeers 时先列出本地 Pod 的连接，再删除对端既不在 Allowed 中、也不属于 AllowedNets 的连接。
+// - 删除失败只记录日志：新规则已经生效，失败只意味着已有连接要等到自然结束。
+func (c *Controller) killRevoked(pl *plane, revokes []RevokePlan) {
+    for _, r := range revokes {
+        ingress := r.Direction == "ingress"
+        pairs := []conntrack.Flow{}
+        for _, local := range r.Locals {
+            if !r.AllPeers {
+                for _, peer := range r.Peers {
+                    pairs = append(pairs, directedFlow(ingress, local, peer))
+                }
+                continue
+            }
+            client, server := "", local
+            if !ingress {
+                client, server = local, ""
+            }
+            flows, err := c.opts.Conntrack.ListFlows(pl.family, client, server)
+            if err != nil {
+                log.Printf("conntrack: list %s flows of %s %s: %v", pl.family, r.Owner, r.Direction, err)
+                continue
+            }
+            allowed := map[string]bool{}
+            for _, ip := range r.Allowed {
+                allowed[ip] = true
+            }
+            seen := map[conntrack.Flow]bool{}
+            for _, f := range flows {
+                peer := f.Client
+                if !ingress {
+                    peer = f.Server
+                }
+                if allowed[peer] || netsAllow(r.AllowedNets, peer) || seen[f] {
+                    continue
+                }
+                seen[f] = true
+                pairs = append(pairs, f)
+            }
+        }
+
+        deleted := 0
+        for _, f := range pairs {
+            n, err := c.opts.Conntrack.DeleteFlows(pl.family, f.Client, f.Server)
+            if err != nil {
+                log.Printf("conntrack: delete %s flows %s -> %s: %v", pl.family, f.Client, f.Server, err)
+                continue
+            }
+            deleted += n
+        }
+        if deleted > 0 {
+            log.Printf("conntrack: deleted %d %s flows of %s %s after access was revoked", deleted, pl.family, r.Owner, r.Direction)
+        }
+    }
+}
+
+// directedFlow 按方向组合本地 Pod 与对端：入向时对端为客户端，出向时本地 Pod 为客户端。
+func directedFlow(ingress bool, local, peer string) conntrack.Flow {
+    if ingress {
+        return conntrack.Flow{Client: peer, Server: local}
+    }
+    return conntrack.Flow{Client: local, Server: peer}
+}
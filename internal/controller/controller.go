@@ -2,45 +2,119 @@ package controller
 
 import (
     "context"
+    "errors"
     "fmt"
     "log"
     "sort"
+    "strings"
+    "sync"
+    "time"
 
+    "github.com/example/iptables-controller/internal/dataplane"
     "github.com/example/iptables-controller/internal/iptables"
-    "k8s.io/apimachinery/pkg/labels"
-    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    corev1 "k8s.io/api/core/v1"
     "k8s.io/client-go/kubernetes"
+    "k8s.io/client-go/util/workqueue"
 )
 
-// Controller 是核心结构，负责将 Kubernetes 的 Deployment/Pod 状态映射为本节点的 iptables 规则。
+// Controller 是核心结构，负责将 Kubernetes 的工作负载/Pod 状态映射为本节点的 iptables 规则。
 // 字段说明：
-// - client: Kubernetes API client
+// - client: Kubernetes API client（接口类型，测试中可使用 fake clientset）
 // - nodeName: 控制器运行所在节点名（用于筛选仅属于本节点的 Pods）
 // - prefix: 生成链名时使用的前缀，以便区分系统内其它链（例如 Calico 的链）
 type Controller struct {
-    client   *kubernetes.Clientset
+    client   kubernetes.Interface
     nodeName string
     prefix   string
     // policyStore: 策略存储，来自 API 下发（内存/可选文件持久化）
     policyStore *PolicyStore
-    // forwardJumpPosition: FORWARD 链跳转插入方式（append/insert）
+    // forwardJumpPosition: 内置链跳转位置（insert/append/before:<链名>，见 dataplane.ValidateJumpPosition）
     forwardJumpPosition string
+    // planes: 各地址族的数据面实例（iptables/ip6tables 或 nftables），所有链/跳转/规则/IP 集合操作都经由它们下发
+    planes []*plane
+    // opts: 可选配置
+    opts Options
+    // orphanSince: 孤儿链/集合首次被发现的时间（key 为 "<地址族>/chain/<name>" 或 "<地址族>/set/<name>"），用于垃圾回收宽限期
+    orphanSince map[string]time.Time
+    // registry: 链/集合名称 -> 所属工作负载，用于检测命名冲突
+    registry *NameRegistry
+    // planMu / lastPlan: 最近一次同步的计划（GET /plan），由同步循环写入、API 读取
+    planMu   sync.Mutex
+    lastPlan *SyncPlan
+    // lastPlanLogged: 观察模式下上次完整输出的计划内容，内容不变时不重复输出
+    lastPlanLogged string
+    // syncMu: 串行化同步与回滚，避免回滚发生在计划与执行之间而被执行覆盖
+    syncMu sync.Mutex
+    // workloads: informer 的本地缓存（见 owners.go），Run 在缓存同步完成后设置（持有 syncMu）；为 nil 时同步直接 List API Server
+    workloads *workloads
+    // queue: 事件驱动同步的工作队列，元素为受变化影响的 WorkloadKey，fullResyncKey 表示全量同步（见 watch.go）
+    queue workqueue.RateLimitingInterface
+    // stop: Run 的 paused 函数，返回 true 时停止同步（例如 cleanup 已开始）；stopped: 是否已经停止。两者均在持有 syncMu 时读写（见 stopLocked）
+    stop    func() bool
+    stopped bool
 }
 
-// DeploymentKey 用于标识一个 Deployment（命名空间 + 名称）。
-// 说明：使用结构体避免对 "namespace/name" 字符串进行解析，减少匹配错误。
-type DeploymentKey struct {
-    Namespace string
-    Name      string
+// plane 表示某一地址族的数据面实例。
+// 字段说明：
+// - family: 地址族（IPv4/IPv6），决定使用哪些 Pod IP、集合名后缀以及 SrcCIDR 规则的归属
+// - dp: 该地址族的数据面实现
+// - registryRecovered: 是否已从该数据面现有规则的归属注释恢复过注册表
+// - orderChecked: 是否已检查过根链跳转与 Calico 跳转的先后顺序（只在启动后首次同步时检查并告警）
+type plane struct {
+    family            dataplane.Family
+    dp                dataplane.Dataplane
+    registryRecovered bool
+    orderChecked      bool
+    // access: 上次成功下发的各工作负载白名单，用于计算撤销的访问（仅开启 Options.Conntrack 时记录）
+    access map[accessKey]accessState
+    // gens: 当前代、上一代与被回滚掉的代（见 generation.go）
+    gens generations
+}
+
+// Options 为控制器的可选配置。
+// 字段说明：
+// - GCGracePeriod: 孤儿链/集合在被回收前需持续处于孤儿状态的时间；为 0 时使用 DefaultGCGracePeriod。
+// - IPv6Dataplane: IPv6 数据面实例（ip6tables 或 IPv6 的 nftables 表）；为 nil 时不下发 IPv6 规则。
+// - Hooks: 挂载根链的内置入口（dataplane.HookForward/HookOutput/HookInput）；FORWARD 始终挂载，OUTPUT/INPUT 需显式开启。
+// - DryRun: 观察模式，每次同步只计算并记录计划，不修改数据面。
+// - Conntrack: 连接跟踪表；不为 nil 时，同步撤销白名单中的对端后删除它们与本地 Pod 之间已建立的连接，为 nil 时已建立的连接保持到自然结束。
+// - HealthCheck: 切换到新一代规则后执行的健康检查；不为 nil 时检查失败自动回滚到上一代（见 Rollback）。
+// - SelectorFallback: 没有控制者的 Pod 是否再按 Deployment、StatefulSet、DaemonSet 的选择器匹配（见 owners.go）。
+type Options struct {
+    GCGracePeriod    time.Duration
+    IPv6Dataplane    dataplane.Dataplane
+    Hooks            []string
+    DryRun           bool
+    Conntrack        ConntrackTable
+    HealthCheck      HealthChecker
+    SelectorFallback bool
 }
 
+// DefaultGCGracePeriod 为孤儿对象回收的默认宽限期。
+const DefaultGCGracePeriod = 5 * time.Minute
+
 // NewController 创建并返回一个 Controller 实例。
 // 说明：
 // - 默认使用前缀 "MS" 来标识本程序管理的链名；可在创建后扩展配置以使用其它前缀。
 // - policyStore 来自程序内置的管理 API，用于存放外部下发的策略。
-func NewController(client *kubernetes.Clientset, nodeName string, policyStore *PolicyStore, forwardJumpPosition string) *Controller {
+// - dp 为启动时选定的 IPv4 数据面实现；为 nil 时使用 iptables。IPv6 数据面通过 opts.IPv6Dataplane 提供，两者在每次同步中同步下发。
+// - opts 为可选配置，零值字段使用默认值。
+func NewController(client kubernetes.Interface, nodeName string, policyStore *PolicyStore, forwardJumpPosition string, dp dataplane.Dataplane, opts Options) *Controller {
     if forwardJumpPosition == "" {
-        forwardJumpPosition = "insert"
+        forwardJumpPosition = dataplane.JumpInsert
+    }
+    if dp == nil {
+        dp = iptables.NewBackend(nil)
+    }
+    if opts.GCGracePeriod <= 0 {
+        opts.GCGracePeriod = DefaultGCGracePeriod
+    }
+    if len(opts.Hooks) == 0 {
+        opts.Hooks = []string{dataplane.HookForward}
+    }
+    planes := []*plane{{family: dataplane.IPv4, dp: dp}}
+    if opts.IPv6Dataplane != nil {
+        planes = append(planes, &plane{family: dataplane.IPv6, dp: opts.IPv6Dataplane})
     }
     return &Controller{
         client:      client,
@@ -48,169 +122,661 @@ func NewController(client *kubernetes.Clientset, nodeName string, policyStore *P
         prefix:      "MS",
         policyStore: policyStore,
         forwardJumpPosition: forwardJumpPosition,
+        planes:      planes,
+        opts:        opts,
+        orphanSince: map[string]time.Time{},
+        registry:    NewNameRegistry(),
+        queue:       workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "iptables-controller"),
+    }
+}
+
+// Sync 执行一次同步操作：先计算同步计划（Plan），再按计划修改本节点的规则（Apply）。
+// 说明：
+// - 开启 DryRun 时只计算并记录计划（日志与 GET /plan），不对 iptables/ipset/nft 做任何写操作。
+// - 无论是否 DryRun，最近一次的计划都会保存下来，供 GET /plan 查询。
+// - 某个地址族计划或执行失败不影响另一个地址族，错误合并后返回。
+// - 由 Run 驱动时作为全量同步使用：启动后、策略更新后、以及每个 resync 周期各执行一次（见 watch.go）。
+// - 执行前在持有 syncMu 时检查是否已停止（stopLocked）；停止后只计算计划，不再修改数据面。
+func (c *Controller) Sync(ctx context.Context) error {
+    c.syncMu.Lock()
+    defer c.syncMu.Unlock()
+    return c.syncLocked(ctx)
+}
+
+// syncLocked 为 Sync 的实现，调用方需持有 syncMu。
+func (c *Controller) syncLocked(ctx context.Context) error {
+    plan, err := c.Plan(ctx)
+    if plan == nil {
+        return err
     }
+    errs := []error{err}
+    if c.opts.DryRun {
+        c.logPlan(plan)
+    } else if c.stopLocked() {
+        log.Printf("sync stopped, plan not applied")
+    } else {
+        errs = append(errs, c.Apply(plan))
+    }
+    c.setLastPlan(plan)
+    return errors.Join(errs...)
 }
 
-// Sync 执行一次同步操作，将集群中的 Deployment 与本节点上的 Pod 进行关联，并确保相应的 iptables 链与规则被正确创建或更新。
+// Plan 计算一次同步将对本节点做出的全部变更，不修改数据面。
 // 主要步骤：
-// 1. 列出集群中所有 Deployment；将每个 Deployment 的 LabelSelector 转换为 Selector。
-// 2. 列出本节点上的 Pod（通过 fieldSelector 指定 `spec.nodeName`）。
-// 3. 对于本节点上的每个 Pod，匹配属于哪个 Deployment（使用 LabelSelector），收集每个 Deployment 在本节点上的 Pod IP 列表。
-// 4. 确保存在一个根链（rootChain），并在 `FORWARD` 链上插入跳转到该根链的规则（通过 `EnsureChain` 与 `EnsureJump`）。
-// 5. 为每个有 Pod 在本节点运行的 Deployment 创建或更新一个独立链（链名由 `MakeChainName` 生成），并在该链中 `ACCEPT` 对应 Pod IP 的流量。
-// 6. 在 rootChain 中添加对每个 Deployment 专用链的跳转（如果尚未存在）。
+// 1. 由 collectPodIPs 按地址族收集每个工作负载的 Pod IP 与本节点上的规则匹配目标。
+// 2. 对每个地址族的数据面执行 planFamily：IPv4 与 IPv6 使用同一套策略与链名，各自只包含本地址族的地址。
 // 设计要点：
 // - 通过独立命名的自定义链避免直接改动 CNI（如 Calico）创建的链；只插入跳转并管理自有链的内容。
-// - 目前的策略为基于 Pod 源 IP 的简单允许（ACCEPT）示例；实际环境可扩展为白名单/黑名单/端口/方向等更复杂策略。
-func (c *Controller) Sync(ctx context.Context) error {
-    // 列出所有命名空间的 Deployments
-    deps, err := c.client.AppsV1().Deployments("").List(ctx, metav1.ListOptions{})
-    if err != nil {
-        return fmt.Errorf("list deployments: %w", err)
-    }
+// - 计算计划只读取数据面（现有链、集合与根链注释），因此可以在观察模式下放心运行。
+// 返回值：读取 Kubernetes 资源失败时返回 nil；某个地址族计划失败时该地址族不出现在计划中，错误合并后返回。
+func (c *Controller) Plan(ctx context.Context) (*SyncPlan, error) {
+    // 从内存策略存储读取当前策略（由 API 下发）
+    policy := c.policyStore.Get()
 
-    // 列出全量 Pods（用于构建跨节点来源/去向白名单）
-    podList, err := c.client.CoreV1().Pods("").List(ctx, metav1.ListOptions{})
+    depPodIPsAll, depPodIPsLocal, err := c.collectPodIPs(ctx, &policy)
     if err != nil {
-        return fmt.Errorf("list pods: %w", err)
+        return nil, err
     }
 
-    // 将每个 Deployment 的 LabelSelector 转换为 Selector，并记录到映射中： key = "namespace/name"
-    depSelectors := map[DeploymentKey]labels.Selector{}
-    for _, d := range deps.Items {
-        sel, err := metav1.LabelSelectorAsSelector(d.Spec.Selector)
+    plan := &SyncPlan{
+        GeneratedAt: time.Now(),
+        NodeName:    c.nodeName,
+        DryRun:      c.opts.DryRun,
+        Families:    []*FamilyPlan{},
+    }
+    errs := []error{}
+    for _, pl := range c.planes {
+        fp, err := c.planFamily(pl, &policy, depPodIPsAll[pl.family], depPodIPsLocal[pl.family])
         if err != nil {
-            log.Printf("invalid selector for deployment %s/%s: %v", d.Namespace, d.Name, err)
+            errs = append(errs, fmt.Errorf("%s: %w", pl.family, err))
             continue
         }
-        key := DeploymentKey{Namespace: d.Namespace, Name: d.Name}
-        depSelectors[key] = sel
+        plan.Families = append(plan.Families, fp)
     }
+    return plan, errors.Join(errs...)
+}
 
-    // 遍历 Pods，判断其匹配哪些 Deployment，并分别收集：
+// collectPodIPs 按地址族收集每个工作负载的 Pod 地址。
+// 主要步骤：
+// 1. 读取工作负载与 Pod，沿 ownerReferences 确定每个 Pod 的归属链与策略主体（见 owners.go）；
+//    开启 Options.SelectorFallback 时，没有控制者的 Pod 再按选择器匹配。
+// 2. 按地址族收集归属链上每个工作负载、以及策略中每个标签选择器对端（见 peers.go）的 Pod IP 列表（`Status.PodIPs` 中的全部地址，用于白名单对端），
+//    其中本节点上的 Pod 按策略主体作为规则匹配目标（普通 Pod 为 Pod IP；hostNetwork Pod 为节点地址 + 容器端口）。
+// 说明：Run 启动后从 informer 的本地缓存读取，不再访问 API Server；未启动 informer 时（例如只调用 Sync）直接 List。
+func (c *Controller) collectPodIPs(ctx context.Context, policy *PolicyConfig) (map[dataplane.Family]map[WorkloadKey][]string, map[dataplane.Family]map[WorkloadKey][]endpoint, error) {
+    w, err := c.listWorkloads(ctx)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    // 按地址族分别收集：
     // - 全量 Pod IP（用于跨节点白名单匹配）
-    // - 本节点 Pod IP（用于本节点链规则）
-    depPodIPsAll := map[DeploymentKey][]string{}
-    depPodIPsLocal := map[DeploymentKey][]string{}
-    for _, p := range podList.Items {
-        for key, sel := range depSelectors {
-            if sel.Matches(labels.Set(p.Labels)) {
-                depPodIPsAll[key] = append(depPodIPsAll[key], p.Status.PodIP)
-                if p.Spec.NodeName == c.nodeName {
-                    depPodIPsLocal[key] = append(depPodIPsLocal[key], p.Status.PodIP)
+    // - 本节点的规则匹配目标
+    depPodIPsAll := map[dataplane.Family]map[WorkloadKey][]string{}
+    depPodIPsLocal := map[dataplane.Family]map[WorkloadKey][]endpoint{}
+    owners, subjects := w.resolvePods(policy, c.opts.SelectorFallback)
+    // 选择器对端匹配到的 Pod 与工作负载对端放在同一张表中，由 collectPeerIPs 统一展开（键不会与工作负载重名，见 peerKey）
+    for key, pods := range w.selectPeers(policy) {
+        owners[key] = pods
+    }
+    // 已结束（Succeeded/Failed）的 Pod 不计入：其 Status.PodIPs 仍保留，而地址可能已被 CNI 分配给无关的 Pod（见 podActive）
+    for key, pods := range owners {
+        for _, p := range pods {
+            if !podActive(p) {
+                continue
+            }
+            for _, ip := range podIPs(p) {
+                family, ok := dataplane.FamilyOf(ip)
+                if !ok {
+                    log.Printf("ignoring invalid ip %q of pod %s/%s", ip, p.Namespace, p.Name)
+                    continue
                 }
+                if depPodIPsAll[family] == nil {
+                    depPodIPsAll[family] = map[WorkloadKey][]string{}
+                    depPodIPsLocal[family] = map[WorkloadKey][]endpoint{}
+                }
+                depPodIPsAll[family][key] = append(depPodIPsAll[family][key], ip)
             }
         }
     }
+    for key, pods := range subjects {
+        for _, p := range pods {
+            if p.Spec.NodeName != c.nodeName || !podActive(p) {
+                continue
+            }
+            for _, ip := range podIPs(p) {
+                // 地址非法时已在上面记录日志
+                if family, ok := dataplane.FamilyOf(ip); ok {
+                    depPodIPsLocal[family][key] = append(depPodIPsLocal[family][key], podEndpoints(p, ip)...)
+                }
+            }
+        }
+    }
+    return depPodIPsAll, depPodIPsLocal, nil
+}
 
-    // 从内存策略存储读取当前策略（由 API 下发）
-    policy := c.policyStore.Get()
-
-    // 确保入向/出向根链存在并在 FORWARD 链插入跳转点
-    rootChainIn := iptables.MakeChainName(c.prefix, "ROOT", "IN")
-    rootChainOut := iptables.MakeChainName(c.prefix, "ROOT", "OUT")
-    if err := iptables.EnsureChain(rootChainOut); err != nil {
-        return fmt.Errorf("ensure root out chain: %w", err)
+// Apply 按计划修改各地址族的数据面；某个地址族失败不影响另一个地址族，错误合并后返回。
+func (c *Controller) Apply(plan *SyncPlan) error {
+    errs := []error{}
+    for _, fp := range plan.Families {
+        if err := c.applyFamily(fp); err != nil {
+            errs = append(errs, fmt.Errorf("%s: %w", fp.Family, err))
+        }
     }
-    if err := iptables.EnsureChain(rootChainIn); err != nil {
-        return fmt.Errorf("ensure root in chain: %w", err)
+    return errors.Join(errs...)
+}
+
+// planFamily 计算一个地址族的同步计划。
+// 主要步骤：
+// 1. 启动后首次同步前，从现有规则的注释恢复名称注册表与代的状态。
+// 2. 由 planGenerations 选择要下发的代（沿用当前代、生成新代或保持回滚），并生成入口链、代的链与白名单集合（见 buildGeneration）。
+// 3. 为每个启用的入口生成内置链到入口链的跳转：
+//    - FORWARD: MS-ROOT-OUT（出向）与 MS-ROOT-IN（入向）。
+//    - OUTPUT: MS-ROOT-NODE（节点发往本节点 Pod 的流量与转发流量按同样的目的 Pod IP 规则校验）。
+//    - INPUT: MS-ROOT-HOST（hostNetwork 入向）。
+// 4. 与数据面中现有的 MS 链比较，得到需要新建的链；当前代与上一代以外的代（链与集合）立即删除，其余不再属于期望状态的链与 ipset 在孤儿状态超过宽限期后回收
+//    （关闭某个入口后其入口链、从旧版本升级后不按代命名的专用链也按此回收）。
+// 说明：链名在两个地址族中相同（iptables 与 ip6tables 的链互不相干），代号在两个地址族中各自递增；
+// ipset 名称空间不区分地址族，IPv6 集合使用 SRC6/DST6 用途名，两个地址族同一代号的集合名因此不会相同。
+func (c *Controller) planFamily(pl *plane, policy *PolicyConfig, depPodIPsAll map[WorkloadKey][]string, depPodIPsLocal map[WorkloadKey][]endpoint) (*FamilyPlan, error) {
+    existing, err := pl.dp.ListChains(c.prefix + "-")
+    if err != nil {
+        return nil, fmt.Errorf("list chains: %w", err)
     }
-    // 顺序：先出向（OUT）再入向（IN），保证先进行出向控制，再做入向控制
-    // insert 情况下需要先插入 IN 再插入 OUT，才能保证 OUT 在更靠前的位置。
-    if c.forwardJumpPosition == "insert" {
-        if err := iptables.EnsureJump(rootChainIn, c.forwardJumpPosition); err != nil {
-            return fmt.Errorf("ensure jump in: %w", err)
+
+    // 启动后首次同步前，从现有规则的归属注释恢复名称注册表，保证冲突检测覆盖重启前已下发的名称；同时恢复当前代与上一代
+    if !pl.registryRecovered {
+        if err := c.recoverRegistry(pl.dp, existing); err != nil {
+            return nil, fmt.Errorf("recover name registry: %w", err)
         }
-        if err := iptables.EnsureJump(rootChainOut, c.forwardJumpPosition); err != nil {
-            return fmt.Errorf("ensure jump out: %w", err)
+        if err := c.recoverGenerations(pl, existing); err != nil {
+            return nil, fmt.Errorf("recover generations: %w", err)
         }
-    } else {
-        if err := iptables.EnsureJump(rootChainOut, c.forwardJumpPosition); err != nil {
-            return fmt.Errorf("ensure jump out: %w", err)
+        pl.registryRecovered = true
+    }
+
+    fp, err := c.planGenerations(pl, policy, depPodIPsAll, depPodIPsLocal)
+    if err != nil {
+        return nil, err
+    }
+
+    // FORWARD 中出向（OUT）在前、入向（IN）在后，保证先进行出向控制，再做入向控制；
+    // 可选入口：OUTPUT（节点发往本节点 Pod）与 INPUT（访问 hostNetwork 工作负载）
+    for _, e := range c.entryChains() {
+        if n := len(fp.Jumps); n > 0 && fp.Jumps[n-1].Hook == e.Hook {
+            fp.Jumps[n-1].Chains = append(fp.Jumps[n-1].Chains, e.Chain)
+            continue
         }
-        if err := iptables.EnsureJump(rootChainIn, c.forwardJumpPosition); err != nil {
-            return fmt.Errorf("ensure jump in: %w", err)
+        fp.Jumps = append(fp.Jumps, JumpPlan{Hook: e.Hook, Chains: []string{e.Chain}, Position: c.forwardJumpPosition})
+    }
+
+    // 与数据面中现有的链比较：不存在的链需要新建；过期的代立即删除，其余孤儿链与集合超过宽限期后回收
+    present := map[string]bool{}
+    others := []string{}
+    for _, name := range existing {
+        present[name] = true
+        if _, retained, ok := c.retainedGeneration(fp.gens, name); ok {
+            if !retained {
+                fp.DeleteChains = append(fp.DeleteChains, name)
+            }
+            continue
+        }
+        others = append(others, name)
+    }
+    desiredChains := []string{}
+    for _, chain := range fp.Chains {
+        desiredChains = append(desiredChains, chain.Chain)
+        if !present[chain.Chain] {
+            fp.CreateChains = append(fp.CreateChains, chain.Chain)
         }
     }
+    desiredSets := []string{}
+    for _, set := range fp.IPSets {
+        desiredSets = append(desiredSets, set.Name)
+    }
+    orphanChains, orphanSets := c.planGarbage(pl, fp, others, desiredChains, desiredSets)
+    fp.DeleteChains = append(fp.DeleteChains, orphanChains...)
+    fp.DeleteIPSets = orphanSets
 
-    // 收集所有需要挂接到 rootChain 的专用链名
+    if c.opts.Conntrack != nil && !fp.Hold {
+        fp.Revoke = planRevocations(pl.access, fp.access)
+    }
+    return fp, nil
+}
+
+// buildGeneration 按第 gen 代的链名生成代的链（代根链与各工作负载专用链）与白名单集合，不含入口链。
+// 主要步骤：
+// 1. 为每个有本地址族 Pod IP 在本节点运行的策略主体（见 owners.go）生成入向/出向专用链的内容（链名由 `MakeOwnerChainName` 按 WorkloadKey 文本形式的哈希生成，前缀带代号）与白名单 ipset 的成员；
+//    启用 INPUT 入口时，hostNetwork Pod 另有按容器端口限定的入向链（HIN）。
+//    名称已被其它工作负载占用（注册表检测到冲突）或超出长度上限（代号过长）时拒绝下发该工作负载，记录错误并列入计划的 refused。
+// 2. 为每个启用的入口生成代根链：按顺序跳转到对应的工作负载专用链（跳转规则带 `owner=<ns>/<name>` 等归属注释，用于重启后恢复注册表）。
+//    ROOT-OUT 跳转出向链，ROOT-IN 与 ROOT-NODE 跳转入向链，ROOT-HOST 跳转 hostNetwork 入向链。
+// 说明：白名单集合与旧规则端口集合同样按代命名（MS-G<n>-SRC-* 等），每代的链只引用本代的集合；
+// 上一代的集合保持切换时的成员，回滚后白名单随规则一起回到上一代的状态。
+func (c *Controller) buildGeneration(pl *plane, gen int, policy *PolicyConfig, depPodIPsAll map[WorkloadKey][]string, depPodIPsLocal map[WorkloadKey][]endpoint) *FamilyPlan {
+    genPrefix := c.generationPrefix(gen)
+    hookInput := c.hookEnabled(dataplane.HookInput)
+
+    fp := newFamilyPlan(pl)
+
+    // 收集所有需要挂接到代根链的专用链名
     desiredChainsIn := []string{}
     desiredChainsOut := []string{}
+    desiredChainsHost := []string{}
+    // depChains: 各工作负载专用链的期望内容，最终与根链一起通过一次 iptables-restore 提交
+    depChains := []ChainPlan{}
+    // chainOwners: 专用链 -> 所属工作负载，用于在根链跳转规则上写入归属注释
+    chainOwners := map[string]WorkloadKey{}
+    // access: 各工作负载入向/出向的白名单，与上次下发的比较得到被撤销的访问
+    access := map[accessKey]accessState{}
+
+    // 按固定顺序处理，保证名称冲突时的结果可复现
+    depKeys := make([]WorkloadKey, 0, len(depPodIPsLocal))
+    for depKey := range depPodIPsLocal {
+        depKeys = append(depKeys, depKey)
+    }
+    sortWorkloadKeys(depKeys)
 
-    // 对于每个在本节点运行的 Deployment，创建/更新入向/出向专用链
-    for depKey, localIPs := range depPodIPsLocal {
-        if len(localIPs) == 0 {
+    // 对于每个在本节点运行的工作负载，计算入向/出向专用链与白名单集合
+    for _, depKey := range depKeys {
+        // podTargets: 普通 Pod（FORWARD/OUTPUT）；hostTargets: hostNetwork Pod 的容器端口（INPUT）
+        podTargets := hookEndpoints(depPodIPsLocal[depKey], dataplane.HookForward)
+        hostTargets := []endpoint{}
+        if hookInput {
+            hostTargets = hookEndpoints(depPodIPsLocal[depKey], dataplane.HookInput)
+        }
+        if len(podTargets) == 0 && len(hostTargets) == 0 {
             continue
         }
-        // 使用结构化字段，避免字符串解析误差
-        ns, name := depKey.Namespace, depKey.Name
-        chainIn := iptables.MakeChainName(c.prefix, "IN", ns+"-"+name)
-        chainOut := iptables.MakeChainName(c.prefix, "OUT", ns+"-"+name)
-        desiredChainsIn = append(desiredChainsIn, chainIn)
-        desiredChainsOut = append(desiredChainsOut, chainOut)
-        if err := iptables.EnsureChain(chainIn); err != nil {
-            log.Printf("ensure chain %s: %v", chainIn, err)
+        // 使用结构化字段，避免字符串解析误差；name 为带类型的部分（Deployment 仍为名称本身，见 WorkloadKey.qualifiedName）
+        ns, name := depKey.Namespace, depKey.qualifiedName()
+        owner := depKey.String()
+        chainIn, errIn := iptables.MakeOwnerChainName(genPrefix, "IN", ns, name)
+        chainOut, errOut := iptables.MakeOwnerChainName(genPrefix, "OUT", ns, name)
+        chainHost, errHost := iptables.MakeOwnerChainName(genPrefix, "HIN", ns, name)
+
+        depPolicy := findDeploymentPolicy(policy, depKey)
+        // Pod 对端（工作负载与标签选择器）写入 SRC/DST 集合，ipBlock 对端写入 SRCNET/DSTNET 网段集合（见 ipblock.go）
+        peers, errPeers := peerSetNames(genPrefix, pl.family, depKey, depPolicy)
+        srcRefs, srcNets, dstRefs, dstNets := peers.srcRefs, peers.srcNets, peers.dstRefs, peers.dstNets
+        srcSetName, srcNetSetName, dstSetName, dstNetSetName := peers.src, peers.srcNet, peers.dst, peers.dstNet
+
+        // 冲突检测：任一名称已属于其它工作负载时拒绝下发，避免两个工作负载共用规则
+        names := []string{}
+        if len(podTargets) > 0 {
+            names = append(names, chainIn, chainOut)
+        }
+        if len(hostTargets) > 0 {
+            names = append(names, chainHost)
+        }
+        for _, set := range []string{srcSetName, srcNetSetName, dstSetName, dstNetSetName} {
+            if set != "" {
+                names = append(names, set)
+            }
+        }
+        // 旧规则的端口列表超出 multiport 容量时使用的端口集合，成员为本节点 Pod IP 与端口的组合
+        portSets, portSetNames, errPorts := legacyPortSets(genPrefix, depPolicy, depKey, pl.family, podTargets)
+        for _, set := range portSets {
+            names = append(names, set.Name)
+        }
+        inLog, errInLog := c.denyLogger(policy, depPolicy, "IN", depKey)
+        outLog, errOutLog := c.denyLogger(policy, depPolicy, "OUT", depKey)
+        hostLog, errHostLog := c.denyLogger(policy, depPolicy, "HIN", depKey)
+        // 名称超出长度上限（代号过长）时同样拒绝下发，而不是提交内核会拒绝的名称
+        if err := errors.Join(errIn, errOut, errHost, errPeers, errPorts, errInLog, errOutLog, errHostLog); err != nil {
+            log.Printf("refusing to program %s: %v", owner, err)
+            fp.Refused = append(fp.Refused, fmt.Sprintf("%s: %v", owner, err))
             continue
         }
-        if err := iptables.EnsureChain(chainOut); err != nil {
-            log.Printf("ensure chain %s: %v", chainOut, err)
+        if err := c.registry.Claim(depKey, names...); err != nil {
+            log.Printf("refusing to program %s: %v", owner, err)
+            fp.Refused = append(fp.Refused, fmt.Sprintf("%s: %v", owner, err))
             continue
         }
 
-        depPolicy := findDeploymentPolicy(&policy, ns, name)
-        srcSetName := ""
-        dstSetName := ""
-        if depPolicy != nil && len(depPolicy.IngressFrom) > 0 {
-            srcSetName = iptables.MakeSetName(c.prefix, "SRC", ns+"-"+name)
-            allowedSrcIPs := collectPeerIPs(depPolicy.IngressFrom, depPodIPsAll)
-            if err := iptables.SyncIPSet(srcSetName, allowedSrcIPs); err != nil {
-                log.Printf("sync ipset %s: %v", srcSetName, err)
-            }
+        srcPeers, dstPeers := []string{}, []string{}
+        srcPeerNets, dstPeerNets := []string{}, []string{}
+        if srcSetName != "" {
+            srcPeers = collectPeerIPs(srcRefs, depKey.Namespace, depPodIPsAll)
+            fp.IPSets = append(fp.IPSets, IPSetPlan{Name: srcSetName, Owner: owner, Members: srcPeers})
         }
-        if depPolicy != nil && len(depPolicy.EgressTo) > 0 {
-            dstSetName = iptables.MakeSetName(c.prefix, "DST", ns+"-"+name)
-            allowedDstIPs := collectPeerIPs(depPolicy.EgressTo, depPodIPsAll)
-            if err := iptables.SyncIPSet(dstSetName, allowedDstIPs); err != nil {
-                log.Printf("sync ipset %s: %v", dstSetName, err)
-            }
+        if srcNetSetName != "" {
+            srcPeerNets = collectPeerNets(srcNets, pl.family)
+            fp.IPSets = append(fp.IPSets, IPSetPlan{Name: srcNetSetName, Owner: owner, Type: iptables.SetTypeNet, Members: srcPeerNets})
         }
-
-        ingressRules := buildIngressRules(localIPs, &policy, ns, name, srcSetName)
-        if _, err := iptables.SyncRules(chainIn, ingressRules); err != nil {
-            log.Printf("sync rules for %s: %v", chainIn, err)
-            continue
+        if dstSetName != "" {
+            dstPeers = collectPeerIPs(dstRefs, depKey.Namespace, depPodIPsAll)
+            fp.IPSets = append(fp.IPSets, IPSetPlan{Name: dstSetName, Owner: owner, Members: dstPeers})
+        }
+        if dstNetSetName != "" {
+            dstPeerNets = collectPeerNets(dstNets, pl.family)
+            fp.IPSets = append(fp.IPSets, IPSetPlan{Name: dstNetSetName, Owner: owner, Type: iptables.SetTypeNet, Members: dstPeerNets})
+        }
+        fp.IPSets = append(fp.IPSets, portSets...)
+        if len(podTargets) > 0 {
+            audit := auditMode(depPolicy)
+            access[accessKey{Owner: depKey, Direction: "ingress"}] = newAccessState(srcSetName != "" || srcNetSetName != "", audit, srcPeers, srcPeerNets, podTargets)
+            access[accessKey{Owner: depKey, Direction: "egress"}] = newAccessState(dstSetName != "" || dstNetSetName != "", audit, dstPeers, dstPeerNets, podTargets)
         }
 
-        egressRules := buildEgressRules(localIPs, ns, name, dstSetName)
-        if _, err := iptables.SyncRules(chainOut, egressRules); err != nil {
-            log.Printf("sync rules for %s: %v", chainOut, err)
-            continue
+        if len(podTargets) > 0 {
+            desiredChainsIn = append(desiredChainsIn, chainIn)
+            desiredChainsOut = append(desiredChainsOut, chainOut)
+            chainOwners[chainIn] = depKey
+            chainOwners[chainOut] = depKey
+            ingressRules := buildIngressRules(podTargets, policy, depKey, srcSetName, srcNetSetName, portSetNames, pl.family, dataplane.HookForward, inLog)
+            egressRules := buildEgressRules(podTargets, policy, depKey, dstSetName, dstNetSetName, dataplane.HookForward, outLog)
+            depChains = append(depChains,
+                ChainPlan{Chain: chainIn, Owner: owner, Rules: ingressRules},
+                ChainPlan{Chain: chainOut, Owner: owner, Rules: egressRules},
+            )
+        }
+        if len(hostTargets) > 0 {
+            desiredChainsHost = append(desiredChainsHost, chainHost)
+            chainOwners[chainHost] = depKey
+            hostRules := buildIngressRules(hostTargets, policy, depKey, srcSetName, srcNetSetName, nil, pl.family, dataplane.HookInput, hostLog)
+            depChains = append(depChains, ChainPlan{Chain: chainHost, Owner: owner, Rules: hostRules})
         }
     }
 
-    // 用最新的专用链列表重建 rootChain，避免历史残留链导致策略失效
+    // 用最新的专用链列表生成代根链，避免历史残留链导致策略失效
     sort.Strings(desiredChainsIn)
     sort.Strings(desiredChainsOut)
-    rootRulesIn := [][]string{}
-    rootRulesOut := [][]string{}
+    sort.Strings(desiredChainsHost)
 
-    // 放行已建立/相关连接的返回流量，避免白名单误拦截回包
-    establishedRule := []string{"-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"}
-    rootRulesOut = append(rootRulesOut, establishedRule)
-    rootRulesIn = append(rootRulesIn, establishedRule)
-    for _, chain := range desiredChainsIn {
-        rootRulesIn = append(rootRulesIn, []string{"-j", chain})
+    // 代根链在前、专用链在后；执行时与入口链在同一个事务中做差分同步
+    roots := map[string][]string{"OUT": desiredChainsOut, "IN": desiredChainsIn, "NODE": desiredChainsIn, "HOST": desiredChainsHost}
+    for _, e := range c.entryChains() {
+        root := iptables.MakeChainName(genPrefix, "ROOT", e.Role)
+        fp.Chains = append(fp.Chains, ChainPlan{Chain: root, Rules: buildRootRules(roots[e.Role], chainOwners, e.Dir)})
     }
-    for _, chain := range desiredChainsOut {
-        rootRulesOut = append(rootRulesOut, []string{"-j", chain})
+    fp.Chains = append(fp.Chains, depChains...)
+    fp.access = access
+    return fp
+}
+
+// newFamilyPlan 返回 pl 地址族的空计划。
+func newFamilyPlan(pl *plane) *FamilyPlan {
+    return &FamilyPlan{
+        Family:       string(pl.family),
+        Dataplane:    pl.dp.Name(),
+        CreateChains: []string{},
+        Chains:       []ChainPlan{},
+        IPSets:       []IPSetPlan{},
+        Jumps:        []JumpPlan{},
+        DeleteChains: []string{},
+        DeleteIPSets: []string{},
+        plane:        pl,
+    }
+}
+
+// workloadPeerSets 为一个工作负载白名单中的对端与其集合名。
+// 字段说明：
+// - srcRefs / dstRefs: ingressFrom / egressTo 中写入 Pod IP 集合的对端（工作负载与标签选择器）
+// - srcNets / dstNets: ingressFrom / egressTo 中的 ipBlock 对端
+// - src / srcNet / dst / dstNet: 对应集合的名称；没有该类对端时为空
+type workloadPeerSets struct {
+    srcRefs, srcNets, dstRefs, dstNets []DeploymentRef
+    src, srcNet, dst, dstNet           string
+}
+
+// peerSetNames 拆分工作负载 key 的白名单对端，并按 prefix（代的前缀，例如 "MS-G42"）生成集合名；depPolicy 为 nil 时没有任何集合。
+// 集合名超出长度上限时返回错误（见 iptables.MakeOwnerSetName）。
+func peerSetNames(prefix string, family dataplane.Family, key WorkloadKey, depPolicy *DeploymentPolicy) (workloadPeerSets, error) {
+    out := workloadPeerSets{}
+    if depPolicy == nil {
+        return out, nil
+    }
+    ns, name := key.Namespace, key.qualifiedName()
+    out.srcRefs, out.srcNets = splitPeers(depPolicy.IngressFrom)
+    out.dstRefs, out.dstNets = splitPeers(depPolicy.EgressTo)
+    var err error
+    if len(out.srcRefs) > 0 {
+        if out.src, err = iptables.MakeOwnerSetName(prefix, setRole("SRC", family), ns, name); err != nil {
+            return workloadPeerSets{}, err
+        }
+    }
+    if len(out.srcNets) > 0 {
+        if out.srcNet, err = iptables.MakeOwnerSetName(prefix, setRole("SRCNET", family), ns, name); err != nil {
+            return workloadPeerSets{}, err
+        }
     }
-    if _, err := iptables.SyncRules(rootChainIn, rootRulesIn); err != nil {
-        log.Printf("sync rules for %s: %v", rootChainIn, err)
+    if len(out.dstRefs) > 0 {
+        if out.dst, err = iptables.MakeOwnerSetName(prefix, setRole("DST", family), ns, name); err != nil {
+            return workloadPeerSets{}, err
+        }
     }
-    if _, err := iptables.SyncRules(rootChainOut, rootRulesOut); err != nil {
-        log.Printf("sync rules for %s: %v", rootChainOut, err)
+    if len(out.dstNets) > 0 {
+        if out.dstNet, err = iptables.MakeOwnerSetName(prefix, setRole("DSTNET", family), ns, name); err != nil {
+            return workloadPeerSets{}, err
+        }
     }
+    return out, nil
+}
 
-    log.Printf("sync completed for node %s", c.nodeName)
+// applyFamily 按计划修改一个地址族的数据面。
+// 顺序：
+// 1. 同步白名单 ipset 的成员；任一集合失败时其余集合照常同步，之后返回错误，本地址族不提交规则、不切换代，
+//    也不删除连接、不记录新的白名单（被撤销的对端可能仍在现有集合中），由下次同步重试。
+// 2. 将入口链与代的全部链与现有内容比较，仅把差异渲染为一个 iptables-restore 输入（或 nft -f 脚本）提交，内容未变化的链不产生任何写操作；
+//    生成新代时，新代的链与改写后的入口链在这一个事务中生效，流量原子地切换到新代。
+// 3. 入口链已由上面的事务创建，此时再通过 `EnsureJumps` 确保各内置链跳转到入口链（首次同步后检查与 Calico 的先后顺序）。
+// 4. 切换到新代且配置了 Options.HealthCheck 时执行健康检查，失败则回滚到上一代并返回错误。
+// 5. 回收计划中列出的过期代与孤儿链、ipset（按“解除跳转 -> 清空 -> 删除”的顺序）。
+// 6. 开启 Options.Conntrack 时，新规则生效后删除被撤销访问的已建立连接，并记录本次下发的白名单供下次比较。
+func (c *Controller) applyFamily(fp *FamilyPlan) error {
+    pl := fp.plane
+    var setErr error
+    for _, set := range fp.IPSets {
+        if err := syncSet(pl.dp, set); err != nil {
+            log.Printf("sync ipset %s: %v", set.Name, err)
+            if setErr == nil {
+                setErr = fmt.Errorf("sync ipset %s: %w", set.Name, err)
+            }
+        }
+    }
+    // 规则引用的集合不存在时 iptables-restore 拒绝整个事务（"Set ... doesn't exist"）；集合内容不完整时规则也不应生效
+    if setErr != nil {
+        return setErr
+    }
+
+    chains := make([]dataplane.ChainRules, 0, len(fp.Chains))
+    for _, chain := range fp.Chains {
+        chains = append(chains, dataplane.ChainRules{Chain: chain.Chain, Rules: chain.Rules})
+    }
+    changed, err := pl.dp.SyncChains(chains)
+    if err != nil {
+        return fmt.Errorf("sync chains: %w", err)
+    }
+
+    for _, j := range fp.Jumps {
+        if err := pl.dp.EnsureJumps(j.Hook, j.Chains, j.Position); err != nil {
+            return fmt.Errorf("ensure jumps %s: %w", strings.ToLower(j.Hook), err)
+        }
+    }
+    if !pl.orderChecked {
+        for _, j := range fp.Jumps {
+            c.checkJumpOrder(pl, j.Hook, j.Chains...)
+        }
+        pl.orderChecked = true
+    }
+
+    switched := fp.Generation != pl.gens.active
+    pl.gens = fp.gens
+    if switched {
+        log.Printf("generations: %s/%s switched to generation %d (previous %d)", pl.dp.Name(), pl.family, fp.Generation, fp.Previous)
+        if c.opts.HealthCheck != nil {
+            if err := c.opts.HealthCheck.Check(); err != nil {
+                log.Printf("generations: %s/%s health check failed after switching to generation %d: %v", pl.dp.Name(), pl.family, fp.Generation, err)
+                if rerr := c.rollbackPlane(pl); rerr != nil {
+                    return fmt.Errorf("health check failed (%v), rollback: %w", err, rerr)
+                }
+                return fmt.Errorf("health check failed, rolled back to generation %d: %w", pl.gens.active, err)
+            }
+        }
+    }
+
+    // 回收已删除/已无本节点 Pod 的工作负载遗留的链与集合
+    c.collectGarbage(pl, fp.DeleteChains, fp.DeleteIPSets)
+
+    if c.opts.Conntrack != nil {
+        c.killRevoked(pl, fp.Revoke)
+        pl.access = fp.access
+    }
+
+    log.Printf("sync completed for node %s via %s/%s (%d/%d chains changed)", c.nodeName, pl.dp.Name(), pl.family, len(changed), len(chains))
     return nil
 }
+
+// syncSet 按集合类型同步一个 ipset 的成员：Pod IP 集合、端口集合（hash:ip,port）或网段集合（hash:net）。
+func syncSet(dp dataplane.Dataplane, set IPSetPlan) error {
+    switch set.Type {
+    case iptables.SetTypeIPPort:
+        return dp.SyncIPPortSet(set.Name, set.Members)
+    case iptables.SetTypeNet:
+        return dp.SyncNetSet(set.Name, set.Members)
+    }
+    return dp.SyncIPSet(set.Name, set.Members)
+}
+
+// calicoChainPrefix 为 Calico 在内置链中跳转的目标链前缀（cali-FORWARD、cali-OUTPUT、cali-INPUT 等）。
+const calicoChainPrefix = "cali-"
+
+// checkJumpOrder 检查内置链 hook 中 Calico 的跳转是否排在本程序根链之前，是则输出告警。
+// 说明：Calico 链对已放行的流量直接 ACCEPT，排在前面时本程序的规则不会被匹配（例如 append 模式）。
+// 读取规则失败（例如 nftables 实现的基础链与 Calico 互不影响）时不做判断。
+func (c *Controller) checkJumpOrder(pl *plane, hook string, rootChains ...string) {
+    rules, err := pl.dp.ListRules(hook)
+    if err != nil {
+        return
+    }
+    ours := map[string]bool{}
+    for _, rc := range rootChains {
+        ours[rc] = true
+    }
+    calico := ""
+    for _, r := range rules {
+        target := ruleJumpTarget(r)
+        if ours[target] {
+            break
+        }
+        if calico == "" && strings.HasPrefix(target, calicoChainPrefix) {
+            calico = target
+        }
+    }
+    if calico != "" {
+        log.Printf("warning: %s/%s: jump to %s precedes %s, Calico will accept traffic before policy is evaluated (set FORWARD_JUMP_POSITION=before:%s or insert)",
+            pl.dp.Name(), hook, calico, strings.Join(rootChains, ","), calico)
+    }
+}
+
+// hookEnabled 判断根链是否需要挂载到内置入口 hook。
+func (c *Controller) hookEnabled(hook string) bool {
+    for _, h := range c.opts.Hooks {
+        if h == hook {
+            return true
+        }
+    }
+    return false
+}
+
+// denyLogger 返回工作负载在某个方向（IN/OUT/HIN，与专用链的用途一致）上的拒绝日志配置；日志前缀超出长度上限时返回错误。
+func (c *Controller) denyLogger(policy *PolicyConfig, depPolicy *DeploymentPolicy, role string, key WorkloadKey) (denyLogger, error) {
+    if auditMode(depPolicy) {
+        // 审计模式始终记录日志：未开启拒绝日志时使用默认速率的 LOG
+        cfg := resolveDenyLog(policy, depPolicy)
+        if cfg.Mode != DenyLogLog && cfg.Mode != DenyLogNFLOG {
+            cfg.Mode = DenyLogLog
+        }
+        allow := "ACCEPT"
+        if role == "OUT" {
+            allow = "RETURN"
+        }
+        prefix, err := iptables.MakeOwnerLogPrefix(c.prefix, "AUDIT-"+role, key.Namespace, key.qualifiedName())
+        if err != nil {
+            return denyLogger{}, err
+        }
+        return denyLogger{
+            cfg:    cfg,
+            prefix: prefix,
+            audit:  allow,
+        }, nil
+    }
+    prefix, err := iptables.MakeOwnerLogPrefix(c.prefix, "DROP-"+role, key.Namespace, key.qualifiedName())
+    if err != nil {
+        return denyLogger{}, err
+    }
+    return denyLogger{
+        cfg:    resolveDenyLog(policy, depPolicy),
+        prefix: prefix,
+    }, nil
+}
+
+// buildRootRules 生成代根链内容：按顺序跳转到各专用链（已建立连接的返回流量已在入口链中放行，见 entryChainPlans）。
+// 跳转规则带归属注释（方向为 dir），用于重启后恢复名称注册表。
+func buildRootRules(chains []string, owners map[string]WorkloadKey, dir string) [][]string {
+    rules := [][]string{}
+    for _, chain := range chains {
+        rules = append(rules, tagRule([]string{"-j", chain}, newRuleComment(owners[chain], dir)))
+    }
+    return rules
+}
+
+// podEndpoints 返回 Pod 在地址 ip 上的规则匹配目标。
+// 说明：
+// - 普通 Pod 返回不限端口的单个目标。
+// - hostNetwork Pod 的地址即节点地址，按整个地址匹配会把节点上的全部流量（SSH、kubelet 等）纳入策略，
+//   因此按容器声明的端口（hostNetwork 下即主机端口）逐个生成目标；未声明端口时返回空，不做限制。
+func podEndpoints(p *corev1.Pod, ip string) []endpoint {
+    if !p.Spec.HostNetwork {
+        return []endpoint{{IP: ip, Pod: p.Name}}
+    }
+    eps := []endpoint{}
+    for _, container := range p.Spec.Containers {
+        for _, port := range container.Ports {
+            proto := strings.ToLower(string(port.Protocol))
+            if proto == "" {
+                proto = "tcp"
+            }
+            eps = append(eps, endpoint{IP: ip, Protocol: proto, Port: port.ContainerPort, Pod: p.Name})
+        }
+    }
+    if len(eps) == 0 {
+        log.Printf("hostNetwork pod %s/%s declares no container ports, not enforced", p.Namespace, p.Name)
+    }
+    return eps
+}
+
+// podIPs 返回 Pod 的全部地址：优先使用 `Status.PodIPs`（双栈时包含 IPv4 与 IPv6），为空时回退到 `Status.PodIP`。
+// 说明：尚未分配 IP 的 Pod 返回空列表。
+func podIPs(p *corev1.Pod) []string {
+    ips := []string{}
+    for _, podIP := range p.Status.PodIPs {
+        if ip := strings.TrimSpace(podIP.IP); ip != "" {
+            ips = append(ips, ip)
+        }
+    }
+    if len(ips) == 0 {
+        if ip := strings.TrimSpace(p.Status.PodIP); ip != "" {
+            ips = append(ips, ip)
+        }
+    }
+    return ips
+}
+
+// podActive 判断 Pod 的地址是否仍归它使用：阶段为 Succeeded/Failed（例如 Job 已完成的 Pod）时返回 false。
+// 说明：
+// - 这些 Pod 的 Status.PodIPs 不会被清空，CNI 却可能已把地址分配给其它 Pod；计入白名单会让无关的 Pod 继承访问权限。
+// - 正在删除（带有 DeletionTimestamp）的 Pod 在整个优雅终止期内仍在运行并占用地址，继续计入：
+//   其规则照常过滤它的流量，对端白名单也不会在连接排空期间撤销它（开启 -kill-revoked-connections 时也不会杀掉这些连接）。
+func podActive(p *corev1.Pod) bool {
+    return p.Status.Phase != corev1.PodSucceeded && p.Status.Phase != corev1.PodFailed
+}
+
+// setRole 返回集合名中的用途部分；IPv6 集合追加 "6"，避免与同一工作负载的 IPv4 集合重名（ipset 名称不区分地址族）。
+func setRole(role string, family dataplane.Family) string {
+    if family == dataplane.IPv6 {
+        return role + "6"
+    }
+    return role
+}
@@ -0,0 +1,232 @@
+package controller
+
+import (
+    "context"
+    "errors"
+    "reflect"
+    "strings"
+    "testing"
+
+    corev1 "k8s.io/api/core/v1"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    k8sfake "k8s.io/client-go/kubernetes/fake"
+
+    "github.com/example/iptables-controller/internal/conntrack"
+    "github.com/example/iptables-controller/internal/dataplane"
+    "github.com/example/iptables-controller/internal/dataplane/fake"
+    "github.com/example/iptables-controller/internal/iptables"
+)
+
+// convergePods 返回本节点上的 web-0 与其它节点上的 client-0，配合 webPolicy("client") 使用。
+func convergePods() []*corev1.Pod {
+    return []*corev1.Pod{
+        testPod("web", "web-0", testNode, "10.244.1.10"),
+        testPod("client", "client-0", "node-b", "10.244.2.10"),
+    }
+}
+
+// newExecController 返回使用 iptables 实现、命令由 fake 执行器 exec 记录的控制器，策略为 webPolicy("client")。
+func newExecController(t *testing.T, exec *fake.Executor) *Controller {
+    t.Helper()
+    pods := convergePods()
+    client := k8sfake.NewSimpleClientset(pods[0], pods[1])
+    store := NewPolicyStore("")
+    if err := store.Set(webPolicy("client")); err != nil {
+        t.Fatalf("set policy: %v", err)
+    }
+    return NewController(client, testNode, store, "", iptables.NewBackend(exec), Options{})
+}
+
+func TestSyncConverges(t *testing.T) {
+    c, dp, _ := newTestController(t, webPolicy("client"), convergePods()...)
+    mustSync(t, c)
+
+    if got, want := dp.Jumps[fake.ForwardHook], []string{"MS-ROOT-OUT", "MS-ROOT-IN"}; !reflect.DeepEqual(got, want) {
+        t.Fatalf("FORWARD jumps = %v, want %v", got, want)
+    }
+    entry, ok := dp.Rules("MS-ROOT-IN")
+    if !ok || len(entry) == 0 || !jumpsTo(entry[len(entry)-1], "MS-G1-ROOT-IN") {
+        t.Fatalf("MS-ROOT-IN = %v, want last rule jumping to MS-G1-ROOT-IN", entry)
+    }
+    assertSets(t, setsWithPrefix(dp, "MS-G1-SRC-"), []string{"10.244.2.10"})
+
+    // web-0 的入向链：白名单集合放行，其余流量拒绝
+    chain := ""
+    for name := range dp.Tables[fake.FilterTable].Chains {
+        if strings.HasPrefix(name, "MS-G1-IN-") {
+            chain = name
+        }
+    }
+    rules, _ := dp.Rules(chain)
+    if len(rules) != 2 || !jumpsTo(rules[0], "ACCEPT") || !jumpsTo(rules[1], "DROP") {
+        t.Fatalf("ingress chain %q = %v, want ACCEPT from the set then DROP", chain, rules)
+    }
+    for i, r := range rules {
+        if !strings.Contains(strings.Join(r, " "), "-d 10.244.1.10") {
+            t.Fatalf("ingress rule %d = %v, want destination web-0", i, r)
+        }
+    }
+}
+
+func TestSecondSyncIsNoop(t *testing.T) {
+    c, dp, _ := newTestController(t, webPolicy("client"), convergePods()...)
+    mustSync(t, c)
+    if len(dp.Writes) == 0 {
+        t.Fatal("first sync wrote nothing")
+    }
+
+    dp.Writes = nil
+    mustSync(t, c)
+    if len(dp.Writes) != 0 {
+        t.Fatalf("second sync wrote %v, want no writes", dp.Writes)
+    }
+}
+
+func TestSyncChainsFailure(t *testing.T) {
+    c, dp, _ := newTestController(t, webPolicy("client"), convergePods()...)
+    errBusy := errors.New("resource busy")
+    dp.FailOn("SyncChains", "MS-ROOT-IN", errBusy)
+
+    if err := c.Sync(context.Background()); !errors.Is(err, errBusy) {
+        t.Fatalf("sync error = %v, want %v", err, errBusy)
+    }
+    // 链事务整体不生效，也不会挂载跳转或切换代
+    if len(dp.Tables[fake.FilterTable].Chains) != 0 || len(dp.Jumps[fake.ForwardHook]) != 0 {
+        t.Fatalf("failed sync left chains %v, jumps %v", dp.Tables[fake.FilterTable].Chains, dp.Jumps)
+    }
+    if active, _ := activeGeneration(c); active != 0 {
+        t.Fatalf("active generation after failed sync = %d, want 0", active)
+    }
+}
+
+func TestSyncIPTablesRestoreFailure(t *testing.T) {
+    exec := fake.NewExecutor()
+    errBusy := errors.New("exit status 4: Another app is currently holding the xtables lock")
+    exec.FailOn("iptables-restore", errBusy)
+    c := newExecController(t, exec)
+
+    err := c.Sync(context.Background())
+    if !errors.Is(err, errBusy) {
+        t.Fatalf("sync error = %v, want %v", err, errBusy)
+    }
+    // 规则事务失败后不再尝试挂载跳转：iptables-restore 只执行一次
+    restores := 0
+    for _, cmd := range exec.Commands {
+        if strings.HasPrefix(cmd, "iptables-restore") {
+            restores++
+        }
+    }
+    if restores != 1 {
+        t.Fatalf("iptables-restore ran %d times, want 1: %v", restores, exec.Commands)
+    }
+    if active, _ := activeGeneration(c); active != 0 {
+        t.Fatalf("active generation after failed sync = %d, want 0", active)
+    }
+}
+
+func TestSyncIPSetRestoreFailure(t *testing.T) {
+    exec := fake.NewExecutor()
+    errSet := errors.New("exit status 1: Kernel error received: set type not supported")
+    exec.FailOn("ipset restore", errSet)
+    c := newExecController(t, exec)
+
+    // 规则引用的集合未能写入时，真实的 iptables-restore 会以 "Set ... doesn't exist" 拒绝整个事务：
+    // 同步返回错误，不提交引用该集合的规则，也不切换代，下次同步重试集合
+    for i := 0; i < 2; i++ {
+        before := len(exec.Commands)
+        if err := c.Sync(context.Background()); !errors.Is(err, errSet) {
+            t.Fatalf("sync %d error = %v, want %v", i, err, errSet)
+        }
+        retried := false
+        for _, cmd := range exec.Commands[before:] {
+            if strings.HasPrefix(cmd, "iptables-restore") {
+                t.Fatalf("sync %d committed rules after the set failed: %v", i, exec.Commands[before:])
+            }
+            if strings.HasPrefix(cmd, "ipset restore") {
+                retried = true
+            }
+        }
+        if !retried {
+            t.Fatalf("sync %d did not write the set: %v", i, exec.Commands[before:])
+        }
+    }
+    if active, _ := activeGeneration(c); active != 0 {
+        t.Fatalf("active generation after failed syncs = %d, want 0", active)
+    }
+}
+
+// recordingConntrack 是只记录删除请求的 ConntrackTable。
+type recordingConntrack struct {
+    deleted []conntrack.Flow
+}
+
+func (r *recordingConntrack) ListFlows(dataplane.Family, string, string) ([]conntrack.Flow, error) {
+    return nil, nil
+}
+
+func (r *recordingConntrack) DeleteFlows(_ dataplane.Family, client, server string) (int, error) {
+    r.deleted = append(r.deleted, conntrack.Flow{Client: client, Server: server})
+    return 1, nil
+}
+
+// newRevokeController 返回开启连接清理、web 只允许 client 访问的控制器；client 有两个 Pod，删除 client-1 即撤销其访问。
+func newRevokeController(t *testing.T) (*Controller, *fake.Dataplane, *k8sfake.Clientset, *recordingConntrack) {
+    t.Helper()
+    c, dp, client := newTestController(t, webPolicy("client"),
+        testPod("web", "web-0", testNode, "10.244.1.10"),
+        testPod("client", "client-0", "node-b", "10.244.2.10"),
+        testPod("client", "client-1", "node-b", "10.244.2.11"),
+    )
+    ct := &recordingConntrack{}
+    c.opts.Conntrack = ct
+    mustSync(t, c)
+    if err := client.CoreV1().Pods("default").Delete(context.Background(), "client-1", metav1.DeleteOptions{}); err != nil {
+        t.Fatal(err)
+    }
+    return c, dp, client, ct
+}
+
+// 集合同步失败时被撤销的对端仍在现有集合中：不删除连接，也不记录新的白名单，集合同步成功后再撤销。
+func TestRevocationWaitsForSetSync(t *testing.T) {
+    revoked := conntrack.Flow{Client: "10.244.2.11", Server: "10.244.1.10"}
+    t.Run("full sync", func(t *testing.T) {
+        c, dp, _, ct := newRevokeController(t)
+        dp.FailOn("SyncIPSet", "", errors.New("set busy"))
+        if err := c.Sync(context.Background()); err == nil {
+            t.Fatal("set failure was not reported")
+        }
+        if len(ct.deleted) != 0 {
+            t.Fatalf("connections deleted while the set still holds the peer: %v", ct.deleted)
+        }
+
+        dp.FailOn("SyncIPSet", "", nil)
+        mustSync(t, c)
+        if !reflect.DeepEqual(ct.deleted, []conntrack.Flow{revoked}) {
+            t.Fatalf("deleted = %v, want %v", ct.deleted, revoked)
+        }
+    })
+    t.Run("sets only", func(t *testing.T) {
+        c, dp, _, ct := newRevokeController(t)
+        keys := []WorkloadKey{newWorkloadKey("apps", KindStatefulSet, "default", "client")}
+        dp.FailOn("SyncIPSet", "", errors.New("set busy"))
+        if err := c.SyncWorkloads(context.Background(), keys); err == nil {
+            t.Fatal("set failure was not reported")
+        }
+        if len(ct.deleted) != 0 {
+            t.Fatalf("connections deleted while the set still holds the peer: %v", ct.deleted)
+        }
+
+        dp.FailOn("SyncIPSet", "", nil)
+        if err := c.SyncWorkloads(context.Background(), keys); err != nil {
+            t.Fatalf("sync workloads: %v", err)
+        }
+        if !reflect.DeepEqual(ct.deleted, []conntrack.Flow{revoked}) {
+            t.Fatalf("deleted = %v, want %v", ct.deleted, revoked)
+        }
+    })
+}
+
+// jumpsTo 判断规则的跳转目标是否为 target。
+func jumpsTo(rule []string, target string) bool {
+    return len(rule) >= 2 && rule[len(rule)-2] == "-j" && rule[len(rule)-1] == target
+}
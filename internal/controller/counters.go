@@ -0,0 +1,311 @@
+package controller
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+
+    "github.com/example/iptables-controller/internal/dataplane"
+)
+
+// DeploymentCounters 为某个工作负载专用链中各规则的命中计数（GET /counters 的返回元素）。
+// 字段说明：Namespace / Name / Kind / APIGroup 标识工作负载（含义同 DeploymentPolicy，Kind 总是给出）；Rules 为各条规则的计数。
+type DeploymentCounters struct {
+    Namespace string        `json:"namespace"`
+    Name      string        `json:"name"`
+    Kind      string        `json:"kind"`
+    APIGroup  string        `json:"apiGroup,omitempty"`
+    Rules     []RuleCounter `json:"rules"`
+}
+
+// newDeploymentCounters 返回工作负载 key 的空计数。
+func newDeploymentCounters(key WorkloadKey) *DeploymentCounters {
+    return &DeploymentCounters{Namespace: key.Namespace, Name: key.Name, Kind: key.Kind, APIGroup: key.Group, Rules: []RuleCounter{}}
+}
+
+// key 返回计数所属的工作负载。
+func (dc DeploymentCounters) key() WorkloadKey {
+    return newWorkloadKey(dc.APIGroup, dc.Kind, dc.Namespace, dc.Name)
+}
+
+// RuleCounter 描述一条规则自上次清零以来的命中情况。
+// 字段说明：
+// - Family: 地址族（ipv4/ipv6）
+// - Chain: 规则所在的专用链
+// - Direction: ingress（入向，FORWARD/OUTPUT）、egress（出向）、host-ingress（hostNetwork 入向，INPUT）
+// - Local: 规则匹配的本地端点（Pod IP；hostNetwork 为 "节点地址:端口/协议"）
+// - Peers: 规则放行的对端：白名单工作负载（见 WorkloadKey.String，Deployment 为 "namespace/name"）、标签选择器（"sel:" + 规范文本）、ipBlock 网段（见 IPBlock.text）或旧规则的 srcCIDR；"*" 表示任意对端
+// - Verdict: ALLOW / DROP / REJECT（出向链中的 RETURN 即放行，记为 ALLOW）；拒绝日志规则（LOG/NFLOG）记为 LOG，计数为实际记录的报文数；
+//   审计模式下代替拒绝规则的放行规则记为 AUDIT，计数为本应被拒绝的报文数
+// - Pod / Revision / PolicyRule: 取自规则注释（见 RuleComment）的 Pod 名称、策略版本与旧规则下标；规则不带注释时为空
+// - Packets / Bytes: 命中的报文数与字节数
+type RuleCounter struct {
+    Family     string   `json:"family"`
+    Chain      string   `json:"chain"`
+    Direction  string   `json:"direction"`
+    Local      string   `json:"local"`
+    Peers      []string `json:"peers"`
+    Verdict    string   `json:"verdict"`
+    Pod        string   `json:"pod,omitempty"`
+    Revision   string   `json:"revision,omitempty"`
+    PolicyRule *int     `json:"policyRule,omitempty"`
+    Packets    uint64   `json:"packets"`
+    Bytes      uint64   `json:"bytes"`
+}
+
+// Counters 读取本程序专用链中每条规则的命中计数，并归属到工作负载、方向、对端与动作。
+// 参数说明：key 为 nil 时返回全部工作负载，否则只返回指定工作负载（不存在时返回空列表）。
+// 说明：链与工作负载的对应关系来自名称注册表，只统计各地址族当前代的链；对端根据规则引用的白名单集合与当前策略还原。
+func (c *Controller) Counters(key *WorkloadKey) ([]DeploymentCounters, error) {
+    owned := c.ownedChains(key)
+    if len(owned) == 0 {
+        return []DeploymentCounters{}, nil
+    }
+
+    policy := c.policyStore.Get()
+    byKey := map[WorkloadKey]*DeploymentCounters{}
+    for _, pl := range c.planes {
+        chains := c.activeChains(pl, owned)
+        counters, err := pl.dp.ListCounters(chains)
+        if err != nil {
+            return nil, fmt.Errorf("list counters via %s/%s: %w", pl.dp.Name(), pl.family, err)
+        }
+        for _, chain := range chains {
+            owner := owned[chain]
+            dc, ok := byKey[owner]
+            if !ok {
+                dc = newDeploymentCounters(owner)
+                byKey[owner] = dc
+            }
+            for _, rc := range counters[chain] {
+                dc.Rules = append(dc.Rules, c.describeRule(pl.family, chain, rc, &policy))
+            }
+        }
+    }
+
+    out := make([]DeploymentCounters, 0, len(byKey))
+    for _, dc := range byKey {
+        out = append(out, *dc)
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i].key().less(out[j].key()) })
+    return out, nil
+}
+
+// AuditCounters 为审计模式工作负载本应被拒绝的流量统计（GET /audit 的返回元素）。
+// 字段说明：
+// - Namespace / Name / Kind / APIGroup: 工作负载，同 DeploymentCounters
+// - WouldDenyPackets / WouldDenyBytes: 自上次清零以来本应被拒绝、因审计模式被放行的报文数与字节数（全部地址族与方向之和）
+// - Rules: 各条审计规则的计数（Verdict 均为 AUDIT），可据此区分方向与本地端点
+type AuditCounters struct {
+    Namespace        string        `json:"namespace"`
+    Name             string        `json:"name"`
+    Kind             string        `json:"kind"`
+    APIGroup         string        `json:"apiGroup,omitempty"`
+    WouldDenyPackets uint64        `json:"wouldDenyPackets"`
+    WouldDenyBytes   uint64        `json:"wouldDenyBytes"`
+    Rules            []RuleCounter `json:"rules"`
+}
+
+// Audit 返回当前策略中处于审计模式的工作负载本应被拒绝的流量统计；key 非 nil 时只返回该工作负载。
+// 说明：统计来自审计规则（注释带 mode=audit 的放行规则）的命中计数，与 GET /counters 同源，POST /counters/reset 会一并清零；
+// 审计模式的工作负载在本节点没有专用链时不出现在结果中。
+func (c *Controller) Audit(key *WorkloadKey) ([]AuditCounters, error) {
+    counters, err := c.Counters(key)
+    if err != nil {
+        return nil, err
+    }
+    policy := c.policyStore.Get()
+    out := []AuditCounters{}
+    for _, dc := range counters {
+        if !auditMode(findDeploymentPolicy(&policy, dc.key())) {
+            continue
+        }
+        ac := AuditCounters{Namespace: dc.Namespace, Name: dc.Name, Kind: dc.Kind, APIGroup: dc.APIGroup, Rules: []RuleCounter{}}
+        for _, rc := range dc.Rules {
+            if rc.Verdict != "AUDIT" {
+                continue
+            }
+            ac.WouldDenyPackets += rc.Packets
+            ac.WouldDenyBytes += rc.Bytes
+            ac.Rules = append(ac.Rules, rc)
+        }
+        out = append(out, ac)
+    }
+    return out, nil
+}
+
+// ResetCounters 将当前代专用链的命中计数清零；key 为 nil 时清零全部工作负载。
+func (c *Controller) ResetCounters(key *WorkloadKey) error {
+    owned := c.ownedChains(key)
+    for _, pl := range c.planes {
+        if err := pl.dp.ResetCounters(c.activeChains(pl, owned)); err != nil {
+            return fmt.Errorf("reset counters via %s/%s: %w", pl.dp.Name(), pl.family, err)
+        }
+    }
+    return nil
+}
+
+// ownedChains 返回名称注册表中登记的专用链（入向/出向/hostNetwork 入向）及其所属工作负载；key 非 nil 时只保留该工作负载。
+func (c *Controller) ownedChains(key *WorkloadKey) map[string]WorkloadKey {
+    owned := map[string]WorkloadKey{}
+    for name, owner := range c.registry.Snapshot() {
+        if key != nil && owner != *key {
+            continue
+        }
+        if c.chainDirection(name) != "" {
+            owned[name] = owner
+        }
+    }
+    return owned
+}
+
+// activeChains 返回 owned 中属于地址族 pl 当前代的链（已排序）；上一代的链不再有流量经过，不参与统计。
+func (c *Controller) activeChains(pl *plane, owned map[string]WorkloadKey) []string {
+    c.syncMu.Lock()
+    active := pl.gens.active
+    c.syncMu.Unlock()
+    chains := []string{}
+    for chain := range owned {
+        if gen, ok := c.chainGeneration(chain); !ok || gen == active {
+            chains = append(chains, chain)
+        }
+    }
+    sort.Strings(chains)
+    return chains
+}
+
+// chainDirection 根据链名中的用途部分（IN/OUT/HIN，不含代号）返回方向；不是专用链时返回空字符串。
+func (c *Controller) chainDirection(chain string) string {
+    chain = c.stripGeneration(chain)
+    switch {
+    case strings.HasPrefix(chain, c.prefix+"-IN-"):
+        return "ingress"
+    case strings.HasPrefix(chain, c.prefix+"-OUT-"):
+        return "egress"
+    case strings.HasPrefix(chain, c.prefix+"-HIN-"):
+        return "host-ingress"
+    default:
+        return ""
+    }
+}
+
+// describeRule 将一条规则的计数还原为可读的归属信息。
+func (c *Controller) describeRule(family dataplane.Family, chain string, rc dataplane.RuleCounter, policy *PolicyConfig) RuleCounter {
+    direction := c.chainDirection(chain)
+    localFlag, peerFlag := "-d", "-s"
+    if direction == "egress" {
+        localFlag, peerFlag = "-s", "-d"
+    }
+
+    local, peerCIDR, proto, port, portSet := "", "", "", "", ""
+    peers := []string{}
+    for i := 0; i+1 < len(rc.Rule); i++ {
+        switch rc.Rule[i] {
+        case localFlag:
+            local = strings.TrimSuffix(rc.Rule[i+1], "/32")
+            local = strings.TrimSuffix(local, "/128")
+        case peerFlag:
+            peerCIDR = rc.Rule[i+1]
+        case "-p":
+            proto = rc.Rule[i+1]
+        case "--dport", "--sport", "--dports":
+            port = rc.Rule[i+1]
+        case "--match-set":
+            // 旧规则的端口集合（dst,dst）匹配的是本地端口，不是对端
+            if i+2 < len(rc.Rule) && rc.Rule[i+2] == "dst,dst" {
+                portSet = rc.Rule[i+1]
+                continue
+            }
+            peers = append(peers, c.setPeers(rc.Rule[i+1], policy)...)
+        }
+    }
+    comment, _ := ruleComment(rc.Rule)
+    if portSet != "" {
+        port = legacyRulePorts(policy, comment, portSet)
+    }
+    if port != "" {
+        local = local + ":" + port + "/" + proto
+    }
+    if peerCIDR != "" {
+        peers = append(peers, peerCIDR)
+    }
+    if len(peers) == 0 {
+        // 当前策略中已找不到对端时，使用规则下发时写入注释的对端
+        peers = append(peers, comment.Peers...)
+    }
+    if len(peers) == 0 {
+        peers = append(peers, "*")
+    }
+
+    verdict := strings.ToUpper(ruleJumpTarget(rc.Rule))
+    switch verdict {
+    case "ACCEPT", "RETURN":
+        verdict = "ALLOW"
+    case "NFLOG":
+        verdict = "LOG"
+    }
+    if comment.Audit {
+        verdict = "AUDIT"
+    }
+    out := RuleCounter{
+        Family:    string(family),
+        Chain:     chain,
+        Direction: direction,
+        Local:     local,
+        Peers:     peers,
+        Verdict:   verdict,
+        Pod:       comment.Pod,
+        Revision:  comment.Revision,
+        Packets:   rc.Packets,
+        Bytes:     rc.Bytes,
+    }
+    if comment.RuleIndex >= 0 {
+        idx := comment.RuleIndex
+        out.PolicyRule = &idx
+    }
+    return out
+}
+
+// legacyRulePorts 返回端口集合规则对应的旧规则端口列表（"80,443,8000:8090"）；策略中已找不到该规则时返回集合名。
+func legacyRulePorts(policy *PolicyConfig, comment RuleComment, setName string) string {
+    depPolicy := findDeploymentPolicy(policy, comment.Owner)
+    if depPolicy == nil || comment.RuleIndex < 0 || comment.RuleIndex >= len(depPolicy.Rules) {
+        return setName
+    }
+    ranges, err := rulePorts(depPolicy.Rules[comment.RuleIndex])
+    if err != nil || len(ranges) == 0 {
+        return setName
+    }
+    return formatPorts(ranges)
+}
+
+// setPeers 返回白名单集合对应的对端（见 DeploymentRef.displayName）：集合所属工作负载在当前策略中的 ingressFrom（SRC 集合）或 egressTo（DST 集合），
+// 网段集合（SRCNET/DSTNET）只取其中的 ipBlock 对端，其余集合只取 Pod 对端（见 splitPeers）。
+// 说明：集合未登记或策略中已无对应配置时返回集合名本身。
+func (c *Controller) setPeers(setName string, policy *PolicyConfig) []string {
+    owner, ok := c.registry.Owner(setName)
+    if !ok {
+        return []string{setName}
+    }
+    depPolicy := findDeploymentPolicy(policy, owner)
+    if depPolicy == nil {
+        return []string{setName}
+    }
+    refs := depPolicy.IngressFrom
+    if strings.HasPrefix(setName, c.prefix+"-DST") {
+        refs = depPolicy.EgressTo
+    }
+    pods, nets := splitPeers(refs)
+    refs = pods
+    if strings.HasPrefix(setName, c.prefix+"-SRCNET") || strings.HasPrefix(setName, c.prefix+"-DSTNET") {
+        refs = nets
+    }
+    peers := make([]string, 0, len(refs))
+    for _, ref := range refs {
+        peers = append(peers, ref.displayName(owner.Namespace))
+    }
+    if len(peers) == 0 {
+        return []string{setName}
+    }
+    return peers
+}
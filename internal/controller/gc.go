@@ -0,0 +1,96 @@
+package controller
+
+import (
+    "log"
+    "strings"
+    "time"
+)
+
+// planGarbage 计算本次同步应回收的 MS 链与 ipset。
+// 流程：
+// 1. existingChains 为数据面中带本程序前缀、不按代命名的链；再列出带前缀的集合，与本次同步的期望名单比较，得到“孤儿”对象。
+// 2. 按代命名的集合与链一样处理：过期的代（计划 fp 执行后的当前代与上一代以外）的集合立即回收，上一代的集合保留；
+//    当前代的集合与其它集合一样按孤儿处理（策略移除白名单后不再被引用），回滚到的代策略未知（fp.frozen）时全部保留。
+// 3. 孤儿对象首次出现时只记录时间；持续超过 GCGracePeriod 后才列入回收名单，避免滚动升级等短暂缺席时反复删建。
+// 说明：列出集合失败只记录日志并跳过集合回收，下个周期会重试。
+// 说明：孤儿记录按地址族区分（key 形如 "ipv6/chain/<name>"），两个地址族的同名链互不影响。
+func (c *Controller) planGarbage(pl *plane, fp *FamilyPlan, existingChains, desiredChains, desiredSets []string) (chains, sets []string) {
+    now := time.Now()
+    chains = c.expiredOrphans(string(pl.family)+"/chain", existingChains, desiredChains, now)
+
+    existingSets, err := pl.dp.ListIPSets(c.prefix + "-")
+    if err != nil {
+        log.Printf("gc: list ipsets: %v", err)
+        return chains, []string{}
+    }
+    expired, others := []string{}, []string{}
+    for _, name := range existingSets {
+        gen, retained, ok := c.retainedGeneration(fp.gens, name)
+        switch {
+        case !ok || (gen == fp.gens.active && !fp.frozen):
+            others = append(others, name)
+        case !retained:
+            expired = append(expired, name)
+        }
+    }
+    return chains, append(expired, c.expiredOrphans(string(pl.family)+"/set", others, desiredSets, now)...)
+}
+
+// collectGarbage 回收 planGarbage 列出的孤儿链与 ipset。
+// 流程：
+// 1. 先删除链（数据面负责“解除跳转 -> 清空 -> 删除”的顺序），再销毁集合（集合被规则引用时无法销毁）。
+// 2. 每个被删除的对象都会记录一条日志，便于审计。
+// 说明：回收失败只记录日志，不影响本次同步结果，下个周期会重试。
+func (c *Controller) collectGarbage(pl *plane, expiredChains, expiredSets []string) {
+    chainKind := string(pl.family) + "/chain"
+    setKind := string(pl.family) + "/set"
+    if len(expiredChains) > 0 {
+        if err := pl.dp.DeleteChains(expiredChains); err != nil {
+            log.Printf("gc: delete chains %s: %v", strings.Join(expiredChains, ","), err)
+            return
+        }
+        for _, name := range expiredChains {
+            delete(c.orphanSince, chainKind+"/"+name)
+            c.registry.Forget(name)
+            log.Printf("gc: removed orphaned %s chain %s", pl.family, name)
+        }
+    }
+
+    for _, name := range expiredSets {
+        if err := pl.dp.DestroyIPSet(name); err != nil {
+            log.Printf("gc: destroy ipset %s: %v", name, err)
+            continue
+        }
+        delete(c.orphanSince, setKind+"/"+name)
+        c.registry.Forget(name)
+        log.Printf("gc: removed orphaned %s ipset %s", pl.family, name)
+    }
+}
+
+// expiredOrphans 返回 existing 中不在 desired 内、且孤儿状态已超过宽限期的对象。
+// 说明：重新被期望的对象会清除其孤儿记录；kind 用于区分链与集合的记录键。
+func (c *Controller) expiredOrphans(kind string, existing, desired []string, now time.Time) []string {
+    want := map[string]bool{}
+    for _, name := range desired {
+        want[name] = true
+        delete(c.orphanSince, kind+"/"+name)
+    }
+
+    expired := []string{}
+    for _, name := range existing {
+        if want[name] {
+            continue
+        }
+        key := kind + "/" + name
+        since, ok := c.orphanSince[key]
+        if !ok {
+            c.orphanSince[key] = now
+            log.Printf("gc: %s %s is orphaned, removing after %s", kind, name, c.opts.GCGracePeriod)
+            since = now
+        }
+        if now.Sub(since) >= c.opts.GCGracePeriod {
+            expired = append(expired, name)
+        }
+    }
+    return expired
+}
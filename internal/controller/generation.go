@@ -0,0 +1,472 @@
+package controller
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "strconv"
+    "strings"
+
+    "github.com/example/iptables-controller/internal/dataplane"
+    "github.com/example/iptables-controller/internal/iptables"
+)
+
+// 规则代（generation）：
+// - 每代是一整套链：代根链 `MS-G<n>-ROOT-*` 与各工作负载的专用链 `MS-G<n>-IN/OUT/HIN-*`，代号 n 在每个地址族中单独递增。
+// - 内置链只跳转到固定的入口链（MS-ROOT-*），入口链放行已建立连接后跳转到当前代的代根链（分派规则）。
+// - 只有规则结构变化（见 structureDigest）时才生成新的一代：新代的全部链、集合与改写后的入口链在同一个 iptables-restore（或 nft -f）事务中提交，流量原子地切换到新代。
+//   本节点 Pod 的增删与地址变化、对端成员变化、只影响 rev 注释的策略变化都在当前代中原地差分，只改写有差异的规则与集合成员。
+// - 每代有自己的白名单集合（MS-G<n>-SRC-* 等）。上一代的链与集合保持切换时的内容，回滚只需把入口链改回跳转到上一代，一个事务即可完成，
+//   白名单随之回到上一代的成员；更早的代（链与集合）在切换后立即删除。
+
+// HealthChecker 为切换到新一代规则后执行的健康检查（health.HTTPProbe 实现）；检查失败时自动回滚到上一代。
+type HealthChecker interface {
+    Check() error
+}
+
+// generations 记录某一地址族的规则代。
+// 字段说明：
+// - active: 入口链当前跳转到的代；0 表示尚未按代下发（首次部署或从旧版本升级）
+// - previous: 保留在数据面中、可回滚到的上一代；0 表示没有
+// - latest: 已使用过的最大代号，新代号在其基础上递增
+// - digests: 各代规则结构的摘要（见 structureDigest），用于判断是否需要生成新代
+// - rejected / rejectedDigest: 被回滚掉的代及其摘要；规则结构仍与它相同时不再生成新代（保持回滚），策略变化后自动解除
+// - policies: 生成各代时使用的策略，保持回滚时按它在当前代中原地跟随 Pod 变化；只在内存中记录，重启后为空
+// - content: 当前代链的完整内容（含 Pod 与 rev 注释）的摘要（见 contentDigest），用于判断只同步集合是否足够；只在内存中记录
+type generations struct {
+    active         int
+    previous       int
+    latest         int
+    digests        map[int]string
+    rejected       int
+    rejectedDigest string
+    policies       map[int]*PolicyConfig
+    content        string
+}
+
+// GenerationStatus 描述某一地址族的规则代（GET /generations 与 POST /rollback 的返回元素）。
+// 字段说明：
+// - Family / Dataplane: 地址族（ipv4/ipv6）与数据面名称
+// - Active: 入口链当前跳转到的代；0 表示尚未按代下发
+// - Digest: 当前代规则结构的摘要（重启后首次同步前可能为空）
+// - Previous: 可回滚到的上一代；0 表示没有
+// - Rejected: 被回滚掉的代；规则结构与它相同时保持回滚，不再生成新代
+type GenerationStatus struct {
+    Family    string `json:"family"`
+    Dataplane string `json:"dataplane"`
+    Active    int    `json:"active"`
+    Digest    string `json:"digest,omitempty"`
+    Previous  int    `json:"previous"`
+    Rejected  int    `json:"rejected,omitempty"`
+}
+
+// ErrNoPreviousGeneration 表示没有可回滚到的上一代。
+var ErrNoPreviousGeneration = errors.New("no previous generation to roll back to")
+
+// generationPrefix 返回第 gen 代链名使用的前缀，例如 "MS-G42"。
+func (c *Controller) generationPrefix(gen int) string {
+    return c.prefix + "-G" + strconv.Itoa(gen)
+}
+
+// chainGeneration 解析链名中的代号；不是按代命名的链（入口链、旧版本的专用链）返回 false。
+func (c *Controller) chainGeneration(chain string) (int, bool) {
+    rest, ok := strings.CutPrefix(chain, c.prefix+"-G")
+    if !ok {
+        return 0, false
+    }
+    digits, _, ok := strings.Cut(rest, "-")
+    if !ok || digits == "" {
+        return 0, false
+    }
+    gen, err := strconv.Atoi(digits)
+    if err != nil || gen <= 0 {
+        return 0, false
+    }
+    return gen, true
+}
+
+// stripGeneration 去掉链名中的代号，例如 "MS-G42-IN-..." -> "MS-IN-..."；不是按代命名的链原样返回。
+func (c *Controller) stripGeneration(chain string) string {
+    gen, ok := c.chainGeneration(chain)
+    if !ok {
+        return chain
+    }
+    return c.prefix + "-" + strings.TrimPrefix(chain, c.generationPrefix(gen)+"-")
+}
+
+// isRootChain 判断链是否为入口链或代根链。
+func (c *Controller) isRootChain(chain string) bool {
+    return strings.HasPrefix(c.stripGeneration(chain), c.prefix+"-ROOT-")
+}
+
+// contentDigest 返回一代链的完整内容（链名与规则，含 Pod 与 rev 注释）的摘要，取前 8 位十六进制。
+// 说明：链名含代号，只有同一代号下计算的摘要才可比较。
+func contentDigest(chains []ChainPlan) string {
+    return digestOf(chains)
+}
+
+// shapeTarget 为计算规则结构时代替本地 Pod 的占位目标。
+var shapeTarget = endpoint{IP: "pod"}
+
+// workloadShape 为一个策略主体在规则结构中的部分：以占位目标生成的入向与出向规则。
+type workloadShape struct {
+    Owner   string     `json:"owner"`
+    Ingress [][]string `json:"ingress"`
+    Egress  [][]string `json:"egress"`
+}
+
+// structureDigest 返回一个地址族规则结构的摘要，取前 8 位十六进制；摘要变化时才生成新的一代。
+// 说明：
+// - 结构包括地址族、启用的入口，以及本节点上有 Pod 的每个策略主体以占位目标（shapeTarget）、不带代号的集合名生成的规则，去掉 rev 注释；
+// - 因此本节点 Pod 的增删与地址变化（同一工作负载仍有 Pod 时）、对端成员变化、没有策略的工作负载、只改变 rev 的策略变化都不改变摘要；
+//   策略主体在本节点出现第一个 Pod 或最后一个 Pod 离开、白名单对端或规则变化时摘要随之变化。
+// - 摘要与代号无关，不同代之间可以直接比较。
+func (c *Controller) structureDigest(pl *plane, policy *PolicyConfig, depPodIPsLocal map[WorkloadKey][]endpoint) string {
+    shape := struct {
+        Family    string          `json:"family"`
+        Entries   []string        `json:"entries"`
+        Workloads []workloadShape `json:"workloads"`
+    }{Family: string(pl.family), Entries: []string{}, Workloads: []workloadShape{}}
+    for _, e := range c.entryChains() {
+        shape.Entries = append(shape.Entries, e.Role)
+    }
+    keys := make([]WorkloadKey, 0, len(depPodIPsLocal))
+    for key, eps := range depPodIPsLocal {
+        if len(hookEndpoints(eps, dataplane.HookForward)) > 0 || (c.hookEnabled(dataplane.HookInput) && len(hookEndpoints(eps, dataplane.HookInput)) > 0) {
+            keys = append(keys, key)
+        }
+    }
+    sortWorkloadKeys(keys)
+    targets := []endpoint{shapeTarget}
+    for _, key := range keys {
+        depPolicy := findDeploymentPolicy(policy, key)
+        if depPolicy == nil {
+            continue
+        }
+        peers, errPeers := peerSetNames(c.prefix, pl.family, key, depPolicy)
+        _, portSets, errPorts := legacyPortSets(c.prefix, depPolicy, key, pl.family, targets)
+        inLog, errInLog := c.denyLogger(policy, depPolicy, "IN", key)
+        outLog, errOutLog := c.denyLogger(policy, depPolicy, "OUT", key)
+        if errors.Join(errPeers, errPorts, errInLog, errOutLog) != nil {
+            // 不带代号的名称已超长时带代号的名称同样超长，该工作负载会被拒绝下发（见 buildGeneration），不计入结构
+            continue
+        }
+        ingress := buildIngressRules(targets, policy, key, peers.src, peers.srcNet, portSets, pl.family, dataplane.HookForward, inLog)
+        egress := buildEgressRules(targets, policy, key, peers.dst, peers.dstNet, dataplane.HookForward, outLog)
+        shape.Workloads = append(shape.Workloads, workloadShape{Owner: key.String(), Ingress: stripRevision(ingress), Egress: stripRevision(egress)})
+    }
+    return digestOf(shape)
+}
+
+// stripRevision 返回去掉注释中 rev 字段的规则副本。
+func stripRevision(rules [][]string) [][]string {
+    out := make([][]string, 0, len(rules))
+    for _, rule := range rules {
+        rule = append([]string{}, rule...)
+        for i := 0; i+1 < len(rule); i++ {
+            if rule[i] != "--comment" {
+                continue
+            }
+            if rc, ok := ParseRuleComment(rule[i+1]); ok {
+                rc.Revision = ""
+                rule[i+1] = rc.String()
+            }
+        }
+        out = append(out, rule)
+    }
+    return out
+}
+
+// digestOf 对 v 的 JSON 形式做哈希，取前 8 位十六进制；无法序列化时返回空字符串。
+func digestOf(v interface{}) string {
+    data, err := json.Marshal(v)
+    if err != nil {
+        return ""
+    }
+    sum := sha256.Sum256(data)
+    return hex.EncodeToString(sum[:4])
+}
+
+// entryChain 描述一个入口链：Chain 为固定链名，Hook 为跳转到它的内置链，Role 为代根链的用途（与 MakeChainName 的 ROOT-<Role> 对应），Dir 为注释中的方向。
+type entryChain struct {
+    Chain string
+    Hook  string
+    Role  string
+    Dir   string
+}
+
+// entryChains 返回当前启用的入口链（顺序与根链在计划中的顺序一致）。
+func (c *Controller) entryChains() []entryChain {
+    entries := []entryChain{
+        {Chain: iptables.MakeChainName(c.prefix, "ROOT", "OUT"), Hook: dataplane.HookForward, Role: "OUT", Dir: dirEgress},
+        {Chain: iptables.MakeChainName(c.prefix, "ROOT", "IN"), Hook: dataplane.HookForward, Role: "IN", Dir: dirIngress},
+    }
+    if c.hookEnabled(dataplane.HookOutput) {
+        entries = append(entries, entryChain{Chain: iptables.MakeChainName(c.prefix, "ROOT", "NODE"), Hook: dataplane.HookOutput, Role: "NODE", Dir: dirIngress})
+    }
+    if c.hookEnabled(dataplane.HookInput) {
+        entries = append(entries, entryChain{Chain: iptables.MakeChainName(c.prefix, "ROOT", "HOST"), Hook: dataplane.HookInput, Role: "HOST", Dir: dirHostIngress})
+    }
+    return entries
+}
+
+// entryChainPlans 生成入口链的内容：先放行已建立/相关连接的返回流量（避免白名单误拦截回包），再跳转到 gens.active 代的代根链。
+// 分派规则的注释记录代号、摘要与被回滚掉的代，控制器重启后据此恢复代的状态。
+func (c *Controller) entryChainPlans(gens generations) []ChainPlan {
+    out := []ChainPlan{}
+    for _, e := range c.entryChains() {
+        established := RuleComment{Direction: e.Dir, Established: true, RuleIndex: -1}
+        dispatch := RuleComment{
+            Direction:          e.Dir,
+            RuleIndex:          -1,
+            Generation:         gens.active,
+            Digest:             gens.digests[gens.active],
+            RejectedGeneration: gens.rejected,
+            RejectedDigest:     gens.rejectedDigest,
+        }
+        out = append(out, ChainPlan{Chain: e.Chain, Rules: [][]string{
+            tagRule([]string{"-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"}, established),
+            tagRule([]string{"-j", iptables.MakeChainName(c.generationPrefix(gens.active), "ROOT", e.Role)}, dispatch),
+        }})
+    }
+    return out
+}
+
+// recoverGenerations 从数据面恢复某一地址族的代状态（仅在启动后首次同步时执行一次）。
+// 说明：
+// - 当前代、摘要与被回滚掉的代来自入口链分派规则的注释；入口链不存在或没有分派规则（旧版本）时当前代为 0。
+// - 上一代为数据面中除当前代以外代号最大的一代（回滚后为被回滚掉的代），其摘要未知。
+// - 各代使用的策略与当前代的完整内容无法从数据面恢复：处于回滚状态时当前代保持原样（见 planGenerations），只同步集合的同步在首次全量同步前退化为全量同步。
+func (c *Controller) recoverGenerations(pl *plane, existing []string) error {
+    gens := generations{digests: map[int]string{}, policies: map[int]*PolicyConfig{}}
+    present := map[string]bool{}
+    seen := map[int]bool{}
+    for _, name := range existing {
+        present[name] = true
+        if gen, ok := c.chainGeneration(name); ok {
+            seen[gen] = true
+            if gen > gens.latest {
+                gens.latest = gen
+            }
+        }
+    }
+    for _, e := range c.entryChains() {
+        if !present[e.Chain] || gens.active != 0 {
+            continue
+        }
+        rules, err := pl.dp.ListRules(e.Chain)
+        if err != nil {
+            return fmt.Errorf("list rules of %s: %w", e.Chain, err)
+        }
+        for _, rule := range rules {
+            rc, ok := ruleComment(rule)
+            if !ok || rc.Generation == 0 {
+                continue
+            }
+            gens.active = rc.Generation
+            gens.digests[rc.Generation] = rc.Digest
+            gens.rejected, gens.rejectedDigest = rc.RejectedGeneration, rc.RejectedDigest
+            break
+        }
+    }
+    if gens.rejected != 0 && seen[gens.rejected] {
+        gens.previous = gens.rejected
+    } else {
+        gens.rejected, gens.rejectedDigest = 0, ""
+        for gen := range seen {
+            if gen != gens.active && gen > gens.previous {
+                gens.previous = gen
+            }
+        }
+    }
+    if gens.active > gens.latest {
+        gens.latest = gens.active
+    }
+    pl.gens = gens
+    if gens.active != 0 {
+        log.Printf("generations: %s/%s recovered active generation %d (previous %d)", pl.dp.Name(), pl.family, gens.active, gens.previous)
+    }
+    return nil
+}
+
+// retainedGeneration 判断链或集合是否属于需要保留的代（当前代与上一代）；不是按代命名的对象 ok 为 false。
+func (c *Controller) retainedGeneration(gens generations, chain string) (gen int, retained, ok bool) {
+    gen, ok = c.chainGeneration(chain)
+    if !ok {
+        return 0, false, false
+    }
+    return gen, gen == gens.active || gen == gens.previous, true
+}
+
+// Generations 返回各地址族的规则代。
+func (c *Controller) Generations() []GenerationStatus {
+    c.syncMu.Lock()
+    defer c.syncMu.Unlock()
+    out := []GenerationStatus{}
+    for _, pl := range c.planes {
+        out = append(out, GenerationStatus{
+            Family:    string(pl.family),
+            Dataplane: pl.dp.Name(),
+            Active:    pl.gens.active,
+            Digest:    pl.gens.digests[pl.gens.active],
+            Previous:  pl.gens.previous,
+            Rejected:  pl.gens.rejected,
+        })
+    }
+    return out
+}
+
+// Rollback 将入口链切换回上一代；family 为空时回滚全部地址族，否则只回滚指定地址族。
+// 说明：
+// - 只改写入口链的分派规则，一个事务完成；当前代随之成为“被回滚掉的代”，期望内容不变时后续同步保持回滚，策略变化后才生成新代。
+// - 再次回滚会切换回被回滚掉的代（撤销回滚）。
+// - 观察模式下、以及控制器停止后（cleanup 已开始）不修改数据面，返回错误；某个地址族失败不影响另一个地址族，错误合并后返回。
+func (c *Controller) Rollback(family string) ([]GenerationStatus, error) {
+    if c.opts.DryRun {
+        return nil, errors.New("rollback is not available in dry-run mode")
+    }
+    c.syncMu.Lock()
+    if c.stopLocked() {
+        c.syncMu.Unlock()
+        return nil, errors.New("rollback is not available after the controller has stopped")
+    }
+    errs := []error{}
+    matched := false
+    for _, pl := range c.planes {
+        if family != "" && string(pl.family) != family {
+            continue
+        }
+        matched = true
+        if err := c.rollbackPlane(pl); err != nil {
+            errs = append(errs, fmt.Errorf("%s: %w", pl.family, err))
+        }
+    }
+    c.syncMu.Unlock()
+    if !matched {
+        errs = append(errs, fmt.Errorf("unknown family %q", family))
+    }
+    return c.Generations(), errors.Join(errs...)
+}
+
+// rollbackPlane 将一个地址族的入口链切换到上一代。
+// 说明：
+// - 上一代缺少某个入口需要的代根链（例如之后才启用的 OUTPUT/INPUT 入口）时拒绝回滚，不做任何修改。
+// - 上一代的链与集合保持切换时的内容，回滚后规则与白名单成员立即回到那时的状态；随后请求一次全量同步，
+//   按上一代的策略在该代中原地跟随之后的 Pod 变化（见 planGenerations）。
+func (c *Controller) rollbackPlane(pl *plane) error {
+    gens := pl.gens
+    if gens.previous == 0 || gens.active == 0 {
+        return ErrNoPreviousGeneration
+    }
+    existing, err := pl.dp.ListChains(c.generationPrefix(gens.previous) + "-")
+    if err != nil {
+        return fmt.Errorf("list chains: %w", err)
+    }
+    present := map[string]bool{}
+    for _, name := range existing {
+        present[name] = true
+    }
+    for _, e := range c.entryChains() {
+        root := iptables.MakeChainName(c.generationPrefix(gens.previous), "ROOT", e.Role)
+        if !present[root] {
+            return fmt.Errorf("generation %d is incomplete: chain %s does not exist", gens.previous, root)
+        }
+    }
+
+    next := generations{
+        active:         gens.previous,
+        previous:       gens.active,
+        latest:         gens.latest,
+        digests:        map[int]string{gens.previous: gens.digests[gens.previous], gens.active: gens.digests[gens.active]},
+        rejected:       gens.active,
+        rejectedDigest: gens.digests[gens.active],
+        policies:       map[int]*PolicyConfig{gens.previous: gens.policies[gens.previous], gens.active: gens.policies[gens.active]},
+    }
+    chains := []dataplane.ChainRules{}
+    for _, ch := range c.entryChainPlans(next) {
+        chains = append(chains, dataplane.ChainRules{Chain: ch.Chain, Rules: ch.Rules})
+    }
+    if _, err := pl.dp.SyncChains(chains); err != nil {
+        return fmt.Errorf("sync entry chains: %w", err)
+    }
+    pl.gens = next
+    // 已下发的白名单随之回到上一代，以之为基准计算撤销会误删连接，下次同步前不计算撤销
+    pl.access = nil
+    log.Printf("generations: %s/%s rolled back from generation %d to %d", pl.dp.Name(), pl.family, gens.active, gens.previous)
+    c.RequestResync()
+    return nil
+}
+
+// planGenerations 为一个地址族选择要下发的代，并生成对应的链与集合。
+// 流程：
+// 1. 计算当前策略的规则结构摘要（structureDigest，与代号和 Pod 地址无关）。
+// 2. 存在被回滚掉的代且摘要与它相同时保持回滚（hold），见 holdGeneration。
+// 3. 摘要与当前代相同则沿用当前代：按当前代的链名与集合名生成期望内容，执行时只对有差异的规则与集合成员做增删（Pod 变化通常只涉及少量规则）。
+// 4. 否则以新代号（latest+1）生成期望内容，执行时新代与入口链一起提交，当前代成为上一代，更早的代被删除。
+func (c *Controller) planGenerations(pl *plane, policy *PolicyConfig, depPodIPsAll map[WorkloadKey][]string, depPodIPsLocal map[WorkloadKey][]endpoint) (*FamilyPlan, error) {
+    gens := pl.gens
+    digest := c.structureDigest(pl, policy, depPodIPsLocal)
+    if gens.rejected != 0 {
+        if digest == gens.rejectedDigest {
+            return c.holdGeneration(pl, gens, depPodIPsAll, depPodIPsLocal), nil
+        }
+        gens.rejected, gens.rejectedDigest = 0, ""
+    }
+
+    gen := gens.active
+    if gen == 0 || digest != gens.digests[gen] {
+        gen = gens.latest + 1
+    }
+    fp := c.buildGeneration(pl, gen, policy, depPodIPsAll, depPodIPsLocal)
+    return c.finishGeneration(fp, gens, gen, digest, policy), nil
+}
+
+// holdGeneration 生成保持回滚时的计划：入口链继续跳转到当前代（回滚到的代），不生成新代。
+// 说明：
+// - 生成当前代时使用的策略仍在内存中时，按该策略与最新的 Pod 在当前代中原地更新链与集合，回滚期间新增的 Pod 同样受回滚后的策略约束；
+// - 控制器重启后该策略未知，当前代的链与集合保持原样（计划只包含入口链），直到策略变化后生成新代。
+func (c *Controller) holdGeneration(pl *plane, gens generations, depPodIPsAll map[WorkloadKey][]string, depPodIPsLocal map[WorkloadKey][]endpoint) *FamilyPlan {
+    var fp *FamilyPlan
+    if held := gens.policies[gens.active]; held != nil {
+        fp = c.buildGeneration(pl, gens.active, held, depPodIPsAll, depPodIPsLocal)
+        gens.content = contentDigest(fp.Chains)
+    } else {
+        fp = newFamilyPlan(pl)
+        fp.access = pl.access
+        fp.frozen = true
+    }
+    fp.Chains = append(c.entryChainPlans(gens), fp.Chains...)
+    fp.Generation, fp.Digest, fp.Previous, fp.Hold = gens.active, gens.digests[gens.active], gens.previous, true
+    fp.gens = gens
+    return fp
+}
+
+// finishGeneration 记录计划选定的代 gen 及执行后的代状态，并在代的链之前加入跳转到该代的入口链。
+// 说明：digest 为规则结构的摘要，policy 为生成该代使用的策略（保持回滚时使用）。
+func (c *Controller) finishGeneration(fp *FamilyPlan, gens generations, gen int, digest string, policy *PolicyConfig) *FamilyPlan {
+    next := generations{
+        active:   gen,
+        previous: gens.previous,
+        latest:   gens.latest,
+        digests:  map[int]string{gen: digest},
+        policies: map[int]*PolicyConfig{gen: policy},
+        content:  contentDigest(fp.Chains),
+    }
+    if gen != gens.active {
+        next.previous = gens.active
+    }
+    if gen > next.latest {
+        next.latest = gen
+    }
+    if next.previous != 0 {
+        next.digests[next.previous] = gens.digests[next.previous]
+        next.policies[next.previous] = gens.policies[next.previous]
+    }
+    fp.Generation, fp.Digest, fp.Previous = gen, digest, next.previous
+    fp.Chains = append(c.entryChainPlans(next), fp.Chains...)
+    fp.gens = next
+    return fp
+}
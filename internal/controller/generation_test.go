@@ -0,0 +1,160 @@
+package controller
+
+import (
+    "context"
+    "reflect"
+    "strings"
+    "testing"
+
+    corev1 "k8s.io/api/core/v1"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/runtime"
+    k8sfake "k8s.io/client-go/kubernetes/fake"
+
+    "github.com/example/iptables-controller/internal/dataplane/fake"
+)
+
+const testNode = "node-a"
+
+// newTestController 返回使用 fake 客户端与 fake 数据面、运行在 testNode 上的控制器。
+func newTestController(t *testing.T, policy PolicyConfig, pods ...*corev1.Pod) (*Controller, *fake.Dataplane, *k8sfake.Clientset) {
+    t.Helper()
+    objs := []runtime.Object{}
+    for _, p := range pods {
+        objs = append(objs, p)
+    }
+    client := k8sfake.NewSimpleClientset(objs...)
+    store := NewPolicyStore("")
+    if err := store.Set(policy); err != nil {
+        t.Fatalf("set policy: %v", err)
+    }
+    dp := fake.NewDataplane()
+    return NewController(client, testNode, store, "", dp, Options{}), dp, client
+}
+
+// testPod 返回属于 StatefulSet owner、运行在 node 上、地址为 ip 的 Pod。
+func testPod(owner, name, node, ip string) *corev1.Pod {
+    controller := true
+    return &corev1.Pod{
+        ObjectMeta: metav1.ObjectMeta{
+            Namespace: "default",
+            Name:      name,
+            OwnerReferences: []metav1.OwnerReference{{
+                APIVersion: "apps/v1",
+                Kind:       KindStatefulSet,
+                Name:       owner,
+                Controller: &controller,
+            }},
+        },
+        Spec:   corev1.PodSpec{NodeName: node},
+        Status: corev1.PodStatus{Phase: corev1.PodRunning, PodIP: ip, PodIPs: []corev1.PodIP{{IP: ip}}},
+    }
+}
+
+// webPolicy 返回 web 只允许 peers 访问的策略。
+func webPolicy(peers ...string) PolicyConfig {
+    refs := []DeploymentRef{}
+    for _, peer := range peers {
+        refs = append(refs, DeploymentRef{Namespace: "default", Name: peer, Kind: KindStatefulSet})
+    }
+    return PolicyConfig{
+        DefaultAction: "ALLOW",
+        Deployments:   []DeploymentPolicy{{Namespace: "default", Name: "web", Kind: KindStatefulSet, IngressFrom: refs}},
+    }
+}
+
+// mustSync 执行一次全量同步，失败时终止测试。
+func mustSync(t *testing.T, c *Controller) {
+    t.Helper()
+    if err := c.Sync(context.Background()); err != nil {
+        t.Fatalf("sync: %v", err)
+    }
+}
+
+// activeGeneration 返回 IPv4 地址族的当前代与上一代。
+func activeGeneration(c *Controller) (active, previous int) {
+    gens := c.planes[0].gens
+    return gens.active, gens.previous
+}
+
+// setsWithPrefix 返回 fake 数据面中名称以 prefix 开头的集合及其成员。
+func setsWithPrefix(dp *fake.Dataplane, prefix string) map[string][]string {
+    out := map[string][]string{}
+    for name, members := range dp.Sets {
+        if strings.HasPrefix(name, prefix) {
+            out[name] = members
+        }
+    }
+    return out
+}
+
+// assertSets 断言 sets 中恰有一个集合，且其成员为 want。
+func assertSets(t *testing.T, sets map[string][]string, want []string) {
+    t.Helper()
+    if len(sets) != 1 {
+        t.Fatalf("sets = %v, want exactly one", sets)
+    }
+    for name, members := range sets {
+        if !reflect.DeepEqual(members, want) {
+            t.Fatalf("set %s = %v, want %v", name, members, want)
+        }
+    }
+}
+
+func TestLocalPodChurnStaysInGeneration(t *testing.T) {
+    c, dp, client := newTestController(t, webPolicy("client"),
+        testPod("web", "web-0", testNode, "10.244.1.10"),
+        testPod("client", "client-0", "node-b", "10.244.2.10"),
+    )
+    mustSync(t, c)
+    if active, _ := activeGeneration(c); active != 1 {
+        t.Fatalf("active generation = %d, want 1", active)
+    }
+
+    ctx := context.Background()
+    if _, err := client.CoreV1().Pods("default").Create(ctx, testPod("web", "web-1", testNode, "10.244.1.11"), metav1.CreateOptions{}); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := client.CoreV1().Pods("default").Create(ctx, testPod("client", "client-1", "node-b", "10.244.2.11"), metav1.CreateOptions{}); err != nil {
+        t.Fatal(err)
+    }
+    mustSync(t, c)
+    if active, previous := activeGeneration(c); active != 1 || previous != 0 {
+        t.Fatalf("generations after pod churn = %d/%d, want 1/0", active, previous)
+    }
+    if len(setsWithPrefix(dp, "MS-G2-")) != 0 {
+        t.Fatalf("pod churn created a new generation: %v", dp.Sets)
+    }
+    assertSets(t, setsWithPrefix(dp, "MS-G1-SRC-"), []string{"10.244.2.10", "10.244.2.11"})
+}
+
+func TestRollbackRestoresWhitelist(t *testing.T) {
+    c, dp, _ := newTestController(t, webPolicy("client"),
+        testPod("web", "web-0", testNode, "10.244.1.10"),
+        testPod("client", "client-0", "node-b", "10.244.2.10"),
+        testPod("admin", "admin-0", "node-b", "10.244.3.10"),
+    )
+    mustSync(t, c)
+    if err := c.policyStore.Set(webPolicy("client", "admin")); err != nil {
+        t.Fatal(err)
+    }
+    mustSync(t, c)
+    if active, previous := activeGeneration(c); active != 2 || previous != 1 {
+        t.Fatalf("generations after policy change = %d/%d, want 2/1", active, previous)
+    }
+    assertSets(t, setsWithPrefix(dp, "MS-G1-SRC-"), []string{"10.244.2.10"})
+    assertSets(t, setsWithPrefix(dp, "MS-G2-SRC-"), []string{"10.244.2.10", "10.244.3.10"})
+
+    if _, err := c.Rollback(""); err != nil {
+        t.Fatalf("rollback: %v", err)
+    }
+    if active, _ := activeGeneration(c); active != 1 {
+        t.Fatalf("active generation after rollback = %d, want 1", active)
+    }
+    // 保持回滚：按回滚到的代的策略原地同步，白名单不包含新策略加入的对端
+    mustSync(t, c)
+    if active, _ := activeGeneration(c); active != 1 {
+        t.Fatalf("active generation after held sync = %d, want 1", active)
+    }
+    assertSets(t, setsWithPrefix(dp, "MS-G1-SRC-"), []string{"10.244.2.10"})
+}
@@ -0,0 +1,131 @@
+package controller
+
+import (
+    "fmt"
+    "net/netip"
+    "strings"
+
+    "github.com/example/iptables-controller/internal/dataplane"
+)
+
+// 网段对端（ipBlock）：
+// - 白名单中的 ipBlock 对端写入单独的网段集合（MS-SRCNET-* / MS-DSTNET-*，ipset hash:net），工作负载与选择器对端仍写入 MS-SRC-* / MS-DST-*；
+//   两类对端可以出现在同一份白名单中，规则中各有一条放行规则，之后是同一条兜底拒绝规则。
+// - 对端之间取并集：先求出每个 ipBlock 放行的地址（cidr 去掉其 except），合并后再编码为集合成员（见 dataplane.NetMembers）；
+//   ipset 按最长前缀匹配，例外写为 nomatch 成员，一个对端的 except 不会抵消另一个对端放行的地址。
+//   nftables 数据面没有 nomatch，按同样的语义换算为区间集合（见 nftables.SyncNetSet）。
+// - 网段按地址族拆分：IPv4 网段只进入 iptables 的集合，IPv6 网段只进入 ip6tables 的集合。
+
+// validate 校验 ipBlock：cidr 为合法的网段或 IP；except 与 cidr 属于同一地址族且包含在 cidr 之内（与 Kubernetes NetworkPolicy 一致）。
+func (b *IPBlock) validate() error {
+    cidr, ok := dataplane.ParsePrefix(b.CIDR)
+    if !ok {
+        return fmt.Errorf("invalid ipBlock cidr %q", b.CIDR)
+    }
+    for _, text := range b.Except {
+        except, ok := dataplane.ParsePrefix(text)
+        if !ok {
+            return fmt.Errorf("invalid ipBlock except %q", text)
+        }
+        if except.Addr().Is4() != cidr.Addr().Is4() || except.Bits() < cidr.Bits() || !cidr.Contains(except.Addr()) {
+            return fmt.Errorf("ipBlock except %q is not within cidr %q", text, b.CIDR)
+        }
+    }
+    return nil
+}
+
+// text 返回 ipBlock 在规则注释与 GET /counters 中的形式：cidr 之后以 "!" 连接各 except，例如 "10.20.0.0/16!10.20.5.0/24"。
+// 说明：不含空格与逗号，可直接写入注释的对端列表；格式非法的网段保留原文。
+func (b *IPBlock) text() string {
+    parts := []string{canonicalPrefix(b.CIDR)}
+    for _, except := range b.Except {
+        parts = append(parts, canonicalPrefix(except))
+    }
+    return strings.Join(parts, "!")
+}
+
+// canonicalPrefix 返回按掩码对齐的网段文本；无法解析时返回去除空白的原文。
+func canonicalPrefix(text string) string {
+    if prefix, ok := dataplane.ParsePrefix(text); ok {
+        return prefix.String()
+    }
+    return strings.TrimSpace(text)
+}
+
+// splitPeers 将白名单拆分为写入 Pod IP 集合的对端（工作负载与标签选择器）与写入网段集合的 ipBlock 对端。
+func splitPeers(refs []DeploymentRef) (pods, nets []DeploymentRef) {
+    for _, ref := range refs {
+        if ref.IPBlock != nil {
+            nets = append(nets, ref)
+        } else {
+            pods = append(pods, ref)
+        }
+    }
+    return pods, nets
+}
+
+// collectPeerNets 将 ipBlock 对端展开为 family 地址族的网段集合成员（见 dataplane.NetMember，已排序）。
+// 说明：
+// - 每个对端放行 cidr 去掉其 except 后的地址，各对端取并集，再编码为成员数最少的普通成员与 nomatch 成员；
+//   例如 10.0.0.0/8 去掉 10.1.0.0/16、与 10.0.0.0/12 同时存在时，10.1.0.0/16 仍由后者放行。
+// - 非法网段被忽略（POST /apply 时已拒绝）；其它地址族的对端不进入本地址族的集合。
+func collectPeerNets(refs []DeploymentRef, family dataplane.Family) []string {
+    return dataplane.NetMembers(peerNetRanges(refs, family))
+}
+
+// peerNetRanges 返回 ipBlock 对端在 family 地址族中放行的地址区间（各对端 cidr 去掉 except 后的并集）。
+func peerNetRanges(refs []DeploymentRef, family dataplane.Family) []dataplane.AddrRange {
+    union := []dataplane.AddrRange{}
+    for _, ref := range refs {
+        if ref.IPBlock == nil {
+            continue
+        }
+        cidr, ok := dataplane.ParsePrefix(ref.IPBlock.CIDR)
+        if !ok || cidr.Addr().Is4() != (family == dataplane.IPv4) {
+            continue
+        }
+        allowed := []dataplane.AddrRange{dataplane.PrefixRange(cidr)}
+        for _, text := range ref.IPBlock.Except {
+            if except, ok := dataplane.ParsePrefix(text); ok && except.Addr().Is4() == cidr.Addr().Is4() {
+                allowed = dataplane.SubtractRange(allowed, dataplane.PrefixRange(except))
+            }
+        }
+        union = append(union, allowed...)
+    }
+    return dataplane.MergeRanges(union)
+}
+
+// netsAllow 判断地址 ip 是否属于网段集合 members（最长前缀匹配，命中 nomatch 成员时不属于）。
+func netsAllow(members []string, ip string) bool {
+    addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+    if err != nil {
+        return false
+    }
+    addr = addr.Unmap()
+    best, allowed := -1, false
+    for _, m := range members {
+        prefix, nomatch, ok := dataplane.ParseNetMember(m)
+        if !ok || prefix.Bits() <= best || !prefix.Contains(addr) {
+            continue
+        }
+        best, allowed = prefix.Bits(), !nomatch
+    }
+    return allowed
+}
+
+// netsNarrowed 判断网段集合从 prev 变为 next 时是否撤销了访问：prev 放行的地址中有 next 不再放行的部分。
+// 说明：成员按最长前缀语义还原为地址区间后比较（见 dataplane.NetRanges），成员写法变化而放行范围不变时不算收缩；无法解析时按收缩处理。
+func netsNarrowed(prev, next []string) bool {
+    prevRanges, err := dataplane.NetRanges(prev)
+    if err != nil {
+        return true
+    }
+    nextRanges, err := dataplane.NetRanges(next)
+    if err != nil {
+        return true
+    }
+    for _, cut := range nextRanges {
+        prevRanges = dataplane.SubtractRange(prevRanges, cut)
+    }
+    return len(prevRanges) > 0
+}
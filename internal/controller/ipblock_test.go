@@ -0,0 +1,55 @@
+package controller
+
+import (
+    "testing"
+
+    "github.com/example/iptables-controller/internal/dataplane"
+)
+
+// 多个 ipBlock 对端取并集：一个对端的 except 不能抵消另一个对端放行的地址。
+func TestCollectPeerNetsUnion(t *testing.T) {
+    refs := []DeploymentRef{
+        {IPBlock: &IPBlock{CIDR: "10.0.0.0/8", Except: []string{"10.1.0.0/16"}}},
+        {IPBlock: &IPBlock{CIDR: "10.0.0.0/12"}},
+        {IPBlock: &IPBlock{CIDR: "0.0.0.0/0", Except: []string{"169.254.169.254/32", "10.0.0.0/8"}}},
+        {IPBlock: &IPBlock{CIDR: "fd00::/8"}},
+        {Namespace: "default", Name: "api"},
+    }
+    members := collectPeerNets(refs, dataplane.IPv4)
+    for ip, want := range map[string]bool{
+        "10.1.2.3":        true, // A 的 except，但在 B 之内
+        "10.200.0.1":      true, // A 放行
+        "169.254.169.254": false,
+        "8.8.8.8":         true,
+    } {
+        if got := netsAllow(members, ip); got != want {
+            t.Errorf("%s allowed = %v, want %v (members %q)", ip, got, want, members)
+        }
+    }
+
+    members = collectPeerNets(refs[:2], dataplane.IPv4)
+    for ip, want := range map[string]bool{"10.1.2.3": true, "10.16.0.1": true, "11.0.0.1": false} {
+        if got := netsAllow(members, ip); got != want {
+            t.Errorf("%s allowed = %v, want %v (members %q)", ip, got, want, members)
+        }
+    }
+    if got := collectPeerNets(refs, dataplane.IPv6); len(got) != 1 || got[0] != "fd00::/8" {
+        t.Errorf("ipv6 members = %q, want [fd00::/8]", got)
+    }
+}
+
+func TestNetsNarrowed(t *testing.T) {
+    wide := collectPeerNets([]DeploymentRef{{IPBlock: &IPBlock{CIDR: "10.0.0.0/8"}}}, dataplane.IPv4)
+    narrow := collectPeerNets([]DeploymentRef{{IPBlock: &IPBlock{CIDR: "10.0.0.0/8", Except: []string{"10.5.0.0/16"}}}}, dataplane.IPv4)
+    // 写法不同、范围相同
+    split := []string{"10.0.0.0/9", "10.128.0.0/9"}
+    if !netsNarrowed(wide, narrow) {
+        t.Errorf("adding an except should narrow %q -> %q", wide, narrow)
+    }
+    if netsNarrowed(narrow, wide) {
+        t.Errorf("removing an except should not narrow %q -> %q", narrow, wide)
+    }
+    if netsNarrowed(wide, split) || netsNarrowed(split, wide) {
+        t.Errorf("re-encoding the same range should not narrow")
+    }
+}
@@ -0,0 +1,330 @@
+package controller
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "sort"
+
+    appsv1 "k8s.io/api/apps/v1"
+    corev1 "k8s.io/api/core/v1"
+    apimeta "k8s.io/apimachinery/pkg/api/meta"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/labels"
+    "k8s.io/apimachinery/pkg/runtime"
+    "k8s.io/apimachinery/pkg/runtime/schema"
+    "k8s.io/client-go/tools/cache"
+)
+
+// Pod 的归属：
+// - 沿 ownerReferences 自下而上解析：从 Pod 的控制者（controller: true）开始，中间层的 ReplicaSet 与 Job 在缓存中按 namespace/name 查到后
+//   （UID 一致）继续取它们的控制者，得到 Pod 的归属链，例如 Pod -> ReplicaSet -> Deployment、Pod -> Job -> CronJob、Pod -> StatefulSet。
+//   其它类型（含 CRD，例如 Argo Rollout -> ReplicaSet）只按 ownerReference 中的 apiVersion/kind/name 识别，不需要读取这些对象。
+//   计算量与 Pod 数成正比，每个 Pod 只做几次按键查找，不再对每个 Pod 逐一匹配全部工作负载的选择器。
+// - 归属链上的每一层都可以作为白名单的对端（例如 CronJob 与它创建的 Job 都能引用同一批 Pod）。
+// - 本节点 Pod 所属的策略主体（决定进入哪条专用链）为归属链上最靠近 Pod、且有策略的一层；都没有策略时为最顶层。
+//   每个 Pod 只属于一个主体，选择器重叠的工作负载不会把彼此的 Pod IP 写进自己的白名单。
+// - 开启 Options.SelectorFallback 时，没有控制者的 Pod（裸 Pod）再按同一命名空间内 Deployment、StatefulSet、DaemonSet 的选择器匹配；
+//   匹配到多个工作负载时归属不明确，不归入任何一个。
+// - 同一个 Pod 被多个工作负载的选择器匹配（选择器重叠）时，可通过 GET /ownership 查看（见 Ownership）。
+
+// maxOwnerDepth 为归属链的最大层数，防止异常的 ownerReferences（例如互相引用）导致死循环。
+const maxOwnerDepth = 8
+
+// workloads 为同步读取到的工作负载缓存，均带 cache.NamespaceIndex 索引。
+// 字段说明：
+// - controllers: Deployment、StatefulSet 与 DaemonSet（选择器回退与重叠诊断使用）
+// - replicaSets / jobs: 归属链的中间层，按 namespace/name 查找
+// - pods: 全部 Pod
+// - namespaces: 全部命名空间（选择器对端的 namespaceSelector 使用，见 peers.go）
+// 说明：Run 启动后为 informer 的索引器（长期使用）；未启动 informer 时由 List 结果临时构建。
+type workloads struct {
+    controllers []cache.Indexer
+    replicaSets cache.Indexer
+    jobs        cache.Indexer
+    pods        cache.Indexer
+    namespaces  cache.Indexer
+}
+
+// listWorkloads 返回集群中的工作负载、Pod 与命名空间：informer 缓存已就绪时直接使用，否则通过 API Server List（跨所有命名空间）后构建临时索引。
+// 说明：缓存中的对象与 informer 共享，调用方只能读取。
+func (c *Controller) listWorkloads(ctx context.Context) (*workloads, error) {
+    if c.workloads != nil {
+        return c.workloads, nil
+    }
+
+    lists := []struct {
+        resource string
+        list     func() (runtime.Object, error)
+    }{
+        {"deployments", func() (runtime.Object, error) { return c.client.AppsV1().Deployments("").List(ctx, metav1.ListOptions{}) }},
+        {"statefulsets", func() (runtime.Object, error) { return c.client.AppsV1().StatefulSets("").List(ctx, metav1.ListOptions{}) }},
+        {"daemonsets", func() (runtime.Object, error) { return c.client.AppsV1().DaemonSets("").List(ctx, metav1.ListOptions{}) }},
+        {"replicasets", func() (runtime.Object, error) { return c.client.AppsV1().ReplicaSets("").List(ctx, metav1.ListOptions{}) }},
+        {"jobs", func() (runtime.Object, error) { return c.client.BatchV1().Jobs("").List(ctx, metav1.ListOptions{}) }},
+        // 列出全量 Pods（用于构建跨节点来源/去向白名单）
+        {"pods", func() (runtime.Object, error) { return c.client.CoreV1().Pods("").List(ctx, metav1.ListOptions{}) }},
+        {"namespaces", func() (runtime.Object, error) { return c.client.CoreV1().Namespaces().List(ctx, metav1.ListOptions{}) }},
+    }
+    indexers := make([]cache.Indexer, 0, len(lists))
+    for _, l := range lists {
+        obj, err := l.list()
+        if err != nil {
+            return nil, fmt.Errorf("list %s: %w", l.resource, err)
+        }
+        indexer, err := indexList(obj)
+        if err != nil {
+            return nil, fmt.Errorf("index %s: %w", l.resource, err)
+        }
+        indexers = append(indexers, indexer)
+    }
+    return &workloads{controllers: indexers[:3], replicaSets: indexers[3], jobs: indexers[4], pods: indexers[5], namespaces: indexers[6]}, nil
+}
+
+// indexList 将 List 结果放入带 cache.NamespaceIndex 索引的临时缓存（与 informer 的默认索引一致）。
+func indexList(list runtime.Object) (cache.Indexer, error) {
+    items, err := apimeta.ExtractList(list)
+    if err != nil {
+        return nil, err
+    }
+    indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+    for _, obj := range items {
+        if err := indexer.Add(obj); err != nil {
+            return nil, err
+        }
+    }
+    return indexer, nil
+}
+
+// ownerChain 返回对象的归属链：从对象的控制者开始逐层向上（Pod -> ReplicaSet -> Deployment 返回 [ReplicaSet, Deployment]）；没有控制者时返回空。
+// 说明：只有 ReplicaSet 与 Job 会在缓存中继续查找其控制者；不在缓存中（尚未同步或已删除）或 UID 不一致时归属链到此为止。
+func (w *workloads) ownerChain(obj metav1.Object) []WorkloadKey {
+    chain := []WorkloadKey{}
+    for len(chain) < maxOwnerDepth {
+        ref := metav1.GetControllerOfNoCopy(obj)
+        if ref == nil {
+            break
+        }
+        gv, err := schema.ParseGroupVersion(ref.APIVersion)
+        if err != nil {
+            break
+        }
+        key := newWorkloadKey(gv.Group, ref.Kind, obj.GetNamespace(), ref.Name)
+        chain = append(chain, key)
+        next, ok := w.lookupOwner(key, ref)
+        if !ok {
+            break
+        }
+        obj = next
+    }
+    return chain
+}
+
+// lookupOwner 在缓存中查找归属链的中间层（ReplicaSet、Job）；其它类型或缓存中不存在、UID 不一致时返回 false。
+func (w *workloads) lookupOwner(key WorkloadKey, ref *metav1.OwnerReference) (metav1.Object, bool) {
+    var indexer cache.Indexer
+    switch {
+    case key.Kind == KindReplicaSet && key.Group == builtinKinds[KindReplicaSet]:
+        indexer = w.replicaSets
+    case key.Kind == KindJob && key.Group == builtinKinds[KindJob]:
+        indexer = w.jobs
+    }
+    if indexer == nil {
+        return nil, false
+    }
+    obj, exists, err := indexer.GetByKey(key.Namespace + "/" + key.Name)
+    if err != nil || !exists {
+        return nil, false
+    }
+    owner, err := metaObject(obj)
+    if err != nil || owner.GetUID() != ref.UID {
+        return nil, false
+    }
+    return owner, true
+}
+
+// subjectOf 返回归属链对应的策略主体：最靠近 Pod、且在 policy 中有策略的一层；都没有策略时为最顶层。
+func subjectOf(chain []WorkloadKey, policy *PolicyConfig) WorkloadKey {
+    for _, key := range chain {
+        if findDeploymentPolicy(policy, key) != nil {
+            return key
+        }
+    }
+    return chain[len(chain)-1]
+}
+
+// metaObject 取出对象的元数据；informer 删除事件中的 DeletedFinalStateUnknown 取其中的对象。
+func metaObject(obj interface{}) (metav1.Object, error) {
+    if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+        obj = tombstone.Obj
+    }
+    meta, ok := obj.(metav1.Object)
+    if !ok {
+        return nil, fmt.Errorf("object %T has no metadata", obj)
+    }
+    return meta, nil
+}
+
+// workloadSelector 为某个工作负载的标签选择器（选择器回退与重叠诊断使用）。
+type workloadSelector struct {
+    key      WorkloadKey
+    selector labels.Selector
+}
+
+// workloadSelectorOf 返回 Deployment、StatefulSet 或 DaemonSet 的 WorkloadKey 与标签选择器；其它对象返回 false。
+func workloadSelectorOf(obj interface{}) (WorkloadKey, *metav1.LabelSelector, bool) {
+    if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+        obj = tombstone.Obj
+    }
+    switch o := obj.(type) {
+    case *appsv1.Deployment:
+        return newWorkloadKey("", KindDeployment, o.Namespace, o.Name), o.Spec.Selector, true
+    case *appsv1.StatefulSet:
+        return newWorkloadKey("", KindStatefulSet, o.Namespace, o.Name), o.Spec.Selector, true
+    case *appsv1.DaemonSet:
+        return newWorkloadKey("", KindDaemonSet, o.Namespace, o.Name), o.Spec.Selector, true
+    default:
+        return WorkloadKey{}, nil, false
+    }
+}
+
+// selectors 返回命名空间 ns 中 Deployment、StatefulSet 与 DaemonSet 的选择器；空选择器与非法选择器被忽略。
+func (w *workloads) selectors(ns string) []workloadSelector {
+    out := []workloadSelector{}
+    for _, indexer := range w.controllers {
+        objs, err := indexer.ByIndex(cache.NamespaceIndex, ns)
+        if err != nil {
+            continue
+        }
+        for _, obj := range objs {
+            key, ls, ok := workloadSelectorOf(obj)
+            if !ok {
+                continue
+            }
+            sel, err := metav1.LabelSelectorAsSelector(ls)
+            if err != nil {
+                log.Printf("invalid selector for %s: %v", key, err)
+                continue
+            }
+            if sel.Empty() {
+                continue
+            }
+            out = append(out, workloadSelector{key: key, selector: sel})
+        }
+    }
+    return out
+}
+
+// matchSelectors 返回选择器匹配 Pod 标签的工作负载（已排序）。
+func matchSelectors(selectors []workloadSelector, pod *corev1.Pod) []WorkloadKey {
+    keys := []WorkloadKey{}
+    for _, s := range selectors {
+        if s.selector.Matches(labels.Set(pod.Labels)) {
+            keys = append(keys, s.key)
+        }
+    }
+    sortWorkloadKeys(keys)
+    return keys
+}
+
+// resolvePods 返回每个工作负载的 Pod（按名称排序，保证规则顺序与代的摘要稳定）。
+// 返回值：
+// - owners: 归属链上每一层工作负载的 Pod，用于展开白名单对端（见 collectPeerIPs）
+// - subjects: 每个策略主体的 Pod（见 subjectOf），用于生成本节点的专用链；每个 Pod 只出现一次
+// 说明：开启 selectorFallback 时，没有控制者的 Pod 按同一命名空间内的选择器匹配，只匹配到一个工作负载时归属于它。
+func (w *workloads) resolvePods(policy *PolicyConfig, selectorFallback bool) (map[WorkloadKey][]*corev1.Pod, map[WorkloadKey][]*corev1.Pod) {
+    owners := map[WorkloadKey][]*corev1.Pod{}
+    subjects := map[WorkloadKey][]*corev1.Pod{}
+    selectors := map[string][]workloadSelector{}
+    for _, obj := range w.pods.List() {
+        p, ok := obj.(*corev1.Pod)
+        if !ok {
+            continue
+        }
+        chain := w.ownerChain(p)
+        if len(chain) == 0 && selectorFallback {
+            if _, ok := selectors[p.Namespace]; !ok {
+                selectors[p.Namespace] = w.selectors(p.Namespace)
+            }
+            keys := matchSelectors(selectors[p.Namespace], p)
+            switch len(keys) {
+            case 0:
+            case 1:
+                chain = keys
+            default:
+                log.Printf("pod %s/%s matches selectors of %d workloads (%s), not attributed to any", p.Namespace, p.Name, len(keys), formatWorkloadKeys(keys))
+            }
+        }
+        if len(chain) == 0 {
+            continue
+        }
+        for _, key := range chain {
+            owners[key] = append(owners[key], p)
+        }
+        subject := subjectOf(chain, policy)
+        subjects[subject] = append(subjects[subject], p)
+    }
+
+    for _, byKey := range []map[WorkloadKey][]*corev1.Pod{owners, subjects} {
+        for _, pods := range byKey {
+            sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+        }
+    }
+    return owners, subjects
+}
+
+// PodClaim 描述一个被多个工作负载的选择器匹配的 Pod（GET /ownership 的返回元素）。
+// 字段说明：
+// - Pod: Pod（<namespace>/<name>）
+// - Owner: 沿 ownerReferences 解析到的最顶层工作负载（见 WorkloadKey.String）；为空表示 Pod 没有控制者（开启选择器回退时该 Pod 不归属任何工作负载）
+// - ClaimedBy: 选择器匹配该 Pod 的全部工作负载（已排序）
+type PodClaim struct {
+    Pod       string   `json:"pod"`
+    Owner     string   `json:"owner,omitempty"`
+    ClaimedBy []string `json:"claimedBy"`
+}
+
+// OwnershipReport 为 Pod 归属的诊断结果（GET /ownership）。
+// 字段说明：
+// - SelectorFallback: 是否开启了选择器回退（-selector-fallback）
+// - Overlaps: 被多个工作负载的选择器匹配的 Pod（按 Pod 排序）；沿 ownerReferences 归属时这些 Pod 只计入 Owner，回退时归属不明确的 Pod 不计入任何工作负载
+type OwnershipReport struct {
+    SelectorFallback bool       `json:"selectorFallback"`
+    Overlaps         []PodClaim `json:"overlaps"`
+}
+
+// Ownership 检查选择器重叠：列出标签同时被多个 Deployment、StatefulSet 或 DaemonSet 的选择器匹配的 Pod 及其实际归属。
+// 说明：需要对每个 Pod 匹配同一命名空间内全部工作负载的选择器，只在查询时计算，不影响同步。
+func (c *Controller) Ownership(ctx context.Context) (*OwnershipReport, error) {
+    c.syncMu.Lock()
+    w, err := c.listWorkloads(ctx)
+    c.syncMu.Unlock()
+    if err != nil {
+        return nil, err
+    }
+    report := &OwnershipReport{SelectorFallback: c.opts.SelectorFallback, Overlaps: []PodClaim{}}
+    selectors := map[string][]workloadSelector{}
+    for _, obj := range w.pods.List() {
+        p, ok := obj.(*corev1.Pod)
+        if !ok {
+            continue
+        }
+        if _, ok := selectors[p.Namespace]; !ok {
+            selectors[p.Namespace] = w.selectors(p.Namespace)
+        }
+        keys := matchSelectors(selectors[p.Namespace], p)
+        if len(keys) < 2 {
+            continue
+        }
+        claim := PodClaim{Pod: p.Namespace + "/" + p.Name, ClaimedBy: []string{}}
+        if chain := w.ownerChain(p); len(chain) > 0 {
+            claim.Owner = chain[len(chain)-1].String()
+        }
+        for _, key := range keys {
+            claim.ClaimedBy = append(claim.ClaimedBy, key.String())
+        }
+        report.Overlaps = append(report.Overlaps, claim)
+    }
+    sort.Slice(report.Overlaps, func(i, j int) bool { return report.Overlaps[i].Pod < report.Overlaps[j].Pod })
+    return report, nil
+}
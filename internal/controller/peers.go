@@ -0,0 +1,285 @@
+package controller
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "log"
+    "sort"
+    "strings"
+
+    corev1 "k8s.io/api/core/v1"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/labels"
+    "k8s.io/client-go/tools/cache"
+)
+
+// 标签选择器对端：
+// - 白名单（ingressFrom/egressTo）中给出 podSelector 或 namespaceSelector 的对端按标签匹配 Pod，不必逐个列出工作负载；
+//   新服务只要带上约定的标签即自动进入引用它的白名单。
+// - 同步时 collectPodIPs 把每个选择器对端匹配到的 Pod 与工作负载的 Pod 放在同一张表中（键见 peerKey），
+//   collectPeerIPs 展开为 MS-SRC-* / MS-DST-* 集合的成员，规则与集合的结构与工作负载对端相同。
+// - Pod 新增、删除或标签变化时，除归属链外还把白名单中有选择器匹配该 Pod 的策略主体放入工作队列（selectorSubjects）；
+//   命名空间标签变化时放入 namespaceSelector 匹配新旧标签的策略主体（namespaceSubjects）。只影响集合成员，按只同步集合处理。
+
+// selectorPeerKind 为选择器对端在 Pod IP 表中的键所用的类型；不是合法的 kind，不会与工作负载重名。
+const selectorPeerKind = "*selector"
+
+// selectorPeer 为编译后的选择器对端。
+// 字段说明：
+// - namespace: namespaces 为 nil 时只匹配该命名空间
+// - namespaces: 命名空间标签选择器；为 nil 表示按 namespace 匹配
+// - pods: Pod 标签选择器（未给出时为 labels.Everything()）
+type selectorPeer struct {
+    namespace  string
+    namespaces labels.Selector
+    pods       labels.Selector
+}
+
+// isSelector 判断对端是否为标签选择器对端。
+func (ref DeploymentRef) isSelector() bool {
+    return ref.PodSelector != nil || ref.NamespaceSelector != nil
+}
+
+// validate 校验对端的字段组合：工作负载对端校验 kind/apiGroup；选择器对端不能带名称与类型，namespace 与 namespaceSelector 互斥，选择器必须合法；
+// 网段对端见 IPBlock.validate。
+func (ref DeploymentRef) validate() error {
+    if ref.IPBlock != nil {
+        if strings.TrimSpace(ref.Namespace) != "" || strings.TrimSpace(ref.Name) != "" || strings.TrimSpace(ref.Kind) != "" ||
+            strings.TrimSpace(ref.APIGroup) != "" || ref.isSelector() {
+            return errors.New("ipBlock cannot be combined with other peer fields")
+        }
+        return ref.IPBlock.validate()
+    }
+    if !ref.isSelector() {
+        return validateWorkloadKind(ref.APIGroup, ref.Kind)
+    }
+    if strings.TrimSpace(ref.Name) != "" || strings.TrimSpace(ref.Kind) != "" || strings.TrimSpace(ref.APIGroup) != "" {
+        return errors.New("name, kind and apiGroup cannot be combined with podSelector/namespaceSelector")
+    }
+    if strings.TrimSpace(ref.Namespace) != "" && ref.NamespaceSelector != nil {
+        return errors.New("namespace and namespaceSelector are mutually exclusive")
+    }
+    _, err := ref.compile("")
+    return err
+}
+
+// compile 编译选择器对端；subjectNs 为策略主体所在的命名空间（既没有 namespace 也没有 namespaceSelector 时使用）。
+func (ref DeploymentRef) compile(subjectNs string) (selectorPeer, error) {
+    peer := selectorPeer{namespace: strings.TrimSpace(ref.Namespace), pods: labels.Everything()}
+    if peer.namespace == "" {
+        peer.namespace = subjectNs
+    }
+    if ref.PodSelector != nil {
+        sel, err := metav1.LabelSelectorAsSelector(ref.PodSelector)
+        if err != nil {
+            return selectorPeer{}, fmt.Errorf("invalid podSelector: %w", err)
+        }
+        peer.pods = sel
+    }
+    if ref.NamespaceSelector != nil {
+        sel, err := metav1.LabelSelectorAsSelector(ref.NamespaceSelector)
+        if err != nil {
+            return selectorPeer{}, fmt.Errorf("invalid namespaceSelector: %w", err)
+        }
+        peer.namespaces = sel
+    }
+    return peer, nil
+}
+
+// text 返回选择器对端的规范文本 "<命名空间>/<Pod 选择器>"：命名空间部分为名称、"{<命名空间选择器>}" 或 "*"（全部命名空间），
+// Pod 选择器为空时为 "*"。例如 "default/app=web"、"{env=prod}/tier in (api,web)"。
+// 说明：选择器文本由 labels.Selector 规范化（按键排序），语义相同的对端得到相同的文本。
+func (p selectorPeer) text() string {
+    ns := p.namespace
+    switch {
+    case p.namespaces == nil:
+    case p.namespaces.Empty():
+        ns = "*"
+    default:
+        ns = "{" + p.namespaces.String() + "}"
+    }
+    pods := "*"
+    if !p.pods.Empty() {
+        pods = p.pods.String()
+    }
+    return ns + "/" + pods
+}
+
+// matchesNamespace 判断命名空间 ns（标签为 nsLabels）是否在对端的范围内。
+func (p selectorPeer) matchesNamespace(ns string, nsLabels map[string]string) bool {
+    if p.namespaces == nil {
+        return ns == p.namespace
+    }
+    return p.namespaces.Matches(labels.Set(nsLabels))
+}
+
+// peerKey 返回对端在 Pod IP 表中的键：工作负载对端为其 WorkloadKey；选择器对端的类型为 selectorPeerKind、名称为规范文本（见 selectorPeer.text）。
+// 非法选择器（只可能来自未经校验的策略文件）得到的键不对应任何 Pod。
+func (ref DeploymentRef) peerKey(subjectNs string) WorkloadKey {
+    if !ref.isSelector() {
+        return ref.Key()
+    }
+    peer, err := ref.compile(subjectNs)
+    if err != nil {
+        return WorkloadKey{Kind: selectorPeerKind}
+    }
+    return WorkloadKey{Kind: selectorPeerKind, Name: peer.text()}
+}
+
+// displayName 返回对端的可读形式（GET /counters 与错误信息）：工作负载对端见 WorkloadKey.String，选择器对端为 "sel:" + 规范文本，
+// 网段对端见 IPBlock.text。
+func (ref DeploymentRef) displayName(subjectNs string) string {
+    if ref.IPBlock != nil {
+        return ref.IPBlock.text()
+    }
+    if !ref.isSelector() {
+        return ref.Key().String()
+    }
+    peer, err := ref.compile(subjectNs)
+    if err != nil {
+        return "sel:<invalid>"
+    }
+    return "sel:" + peer.text()
+}
+
+// peerName 返回对端在规则注释中的形式：工作负载对端见 WorkloadKey.String；
+// 选择器文本含空格与逗号，不能直接写入注释，选择器对端为 "sel:" + 规范文本哈希的前 8 位十六进制；网段对端见 IPBlock.text。
+func (ref DeploymentRef) peerName(subjectNs string) string {
+    if ref.IPBlock != nil {
+        return ref.IPBlock.text()
+    }
+    if !ref.isSelector() {
+        return ref.Key().String()
+    }
+    sum := sha256.Sum256([]byte(ref.displayName(subjectNs)))
+    return "sel:" + hex.EncodeToString(sum[:4])
+}
+
+// selectorRefs 返回策略中全部的选择器对端（按策略主体分组，已编译）；非法选择器记录日志后跳过。
+func selectorRefs(policy *PolicyConfig) map[WorkloadKey][]selectorPeer {
+    out := map[WorkloadKey][]selectorPeer{}
+    if policy == nil {
+        return out
+    }
+    for _, dp := range policy.Deployments {
+        key := dp.Key()
+        for _, ref := range append(append([]DeploymentRef{}, dp.IngressFrom...), dp.EgressTo...) {
+            if !ref.isSelector() {
+                continue
+            }
+            peer, err := ref.compile(key.Namespace)
+            if err != nil {
+                log.Printf("ignoring peer selector of %s: %v", key, err)
+                continue
+            }
+            out[key] = append(out[key], peer)
+        }
+    }
+    return out
+}
+
+// selectPeers 返回策略中每个选择器对端匹配到的 Pod（键见 peerKey，Pod 按命名空间与名称排序）。
+func (w *workloads) selectPeers(policy *PolicyConfig) map[WorkloadKey][]*corev1.Pod {
+    out := map[WorkloadKey][]*corev1.Pod{}
+    for _, peers := range selectorRefs(policy) {
+        for _, peer := range peers {
+            key := WorkloadKey{Kind: selectorPeerKind, Name: peer.text()}
+            if _, done := out[key]; done {
+                continue
+            }
+            pods := []*corev1.Pod{}
+            for _, ns := range w.peerNamespaces(peer) {
+                objs, err := w.pods.ByIndex(cache.NamespaceIndex, ns)
+                if err != nil {
+                    continue
+                }
+                for _, obj := range objs {
+                    if p, ok := obj.(*corev1.Pod); ok && peer.pods.Matches(labels.Set(p.Labels)) {
+                        pods = append(pods, p)
+                    }
+                }
+            }
+            sort.Slice(pods, func(i, j int) bool {
+                if pods[i].Namespace != pods[j].Namespace {
+                    return pods[i].Namespace < pods[j].Namespace
+                }
+                return pods[i].Name < pods[j].Name
+            })
+            out[key] = pods
+        }
+    }
+    return out
+}
+
+// peerNamespaces 返回选择器对端范围内的命名空间。
+func (w *workloads) peerNamespaces(peer selectorPeer) []string {
+    if peer.namespaces == nil {
+        return []string{peer.namespace}
+    }
+    out := []string{}
+    if w.namespaces == nil {
+        return out
+    }
+    for _, obj := range w.namespaces.List() {
+        if ns, ok := obj.(*corev1.Namespace); ok && peer.namespaces.Matches(labels.Set(ns.Labels)) {
+            out = append(out, ns.Name)
+        }
+    }
+    return out
+}
+
+// namespaceLabels 返回缓存中命名空间 ns 的标签；不在缓存中时返回 nil。
+func (w *workloads) namespaceLabels(ns string) map[string]string {
+    if w.namespaces == nil {
+        return nil
+    }
+    obj, exists, err := w.namespaces.GetByKey(ns)
+    if err != nil || !exists {
+        return nil
+    }
+    if n, ok := obj.(*corev1.Namespace); ok {
+        return n.Labels
+    }
+    return nil
+}
+
+// selectorSubjects 返回白名单中有选择器对端匹配 Pod 的策略主体（Pod 的标签与所在命名空间的当前标签）。
+func (w *workloads) selectorSubjects(policy *PolicyConfig, pod *corev1.Pod) []WorkloadKey {
+    keys := []WorkloadKey{}
+    var nsLabels map[string]string
+    nsLoaded := false
+    for key, peers := range selectorRefs(policy) {
+        for _, peer := range peers {
+            if peer.namespaces != nil && !nsLoaded {
+                nsLabels, nsLoaded = w.namespaceLabels(pod.Namespace), true
+            }
+            if peer.matchesNamespace(pod.Namespace, nsLabels) && peer.pods.Matches(labels.Set(pod.Labels)) {
+                keys = append(keys, key)
+                break
+            }
+        }
+    }
+    return keys
+}
+
+// namespaceSubjects 返回白名单中有 namespaceSelector 匹配命名空间新标签或旧标签的策略主体。
+func namespaceSubjects(policy *PolicyConfig, labelSets ...map[string]string) []WorkloadKey {
+    keys := []WorkloadKey{}
+    for key, peers := range selectorRefs(policy) {
+    peers:
+        for _, peer := range peers {
+            if peer.namespaces == nil {
+                continue
+            }
+            for _, set := range labelSets {
+                if peer.namespaces.Matches(labels.Set(set)) {
+                    keys = append(keys, key)
+                    break peers
+                }
+            }
+        }
+    }
+    return keys
+}
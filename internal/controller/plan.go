@@ -0,0 +1,121 @@
+package controller
+
+import (
+    "encoding/json"
+    "log"
+    "time"
+)
+
+// SyncPlan 描述一次同步将对本节点做出的全部变更（GET /plan 的返回值）。
+// 字段说明：
+// - GeneratedAt: 计划的计算时间
+// - NodeName: 控制器所在节点
+// - DryRun: 是否为观察模式（为 true 时计划只被记录，未下发）
+// - Families: 各地址族的计划；计划失败的地址族不出现在列表中
+type SyncPlan struct {
+    GeneratedAt time.Time     `json:"generatedAt"`
+    NodeName    string        `json:"nodeName"`
+    DryRun      bool          `json:"dryRun"`
+    Families    []*FamilyPlan `json:"families"`
+}
+
+// FamilyPlan 描述某一地址族数据面上的变更。
+// 字段说明：
+// - Family / Dataplane: 地址族（ipv4/ipv6）与数据面名称
+// - Generation / Digest: 执行后入口链跳转到的代及其规则结构的摘要；与当前代不同时即为新生成的一代
+// - Previous: 执行后保留、可回滚到的上一代；0 表示没有
+// - Hold: 处于回滚状态且规则结构与被回滚掉的代相同，本次不生成新代，入口链继续跳转到回滚到的代（该代按回滚前的策略原地更新，见 holdGeneration）
+// - CreateChains: 数据面中尚不存在、需要新建的链
+// - Chains: 全部本程序管理的链（入口链与所选代的代根链、各工作负载专用链）的期望内容；执行时只对有差异的规则做增删
+// - IPSets: 所选代的白名单集合与旧规则端口集合及其期望成员
+// - Jumps: 内置链到根链的跳转
+// - DeleteChains / DeleteIPSets: 过期的代（当前代与上一代以外）的链与集合，以及孤儿状态已超过宽限期、将被回收的链与集合
+// - Refused: 因名称冲突或名称超长被拒绝下发的工作负载（"<归属>: 原因"，归属见 WorkloadKey.String）
+// - Revoke: 相比上次下发被撤销的访问，执行后删除对应的已建立连接（仅开启连接清理时计算）
+type FamilyPlan struct {
+    Family       string       `json:"family"`
+    Dataplane    string       `json:"dataplane"`
+    Generation   int          `json:"generation"`
+    Digest       string       `json:"digest"`
+    Previous     int          `json:"previous"`
+    Hold         bool         `json:"hold,omitempty"`
+    CreateChains []string     `json:"createChains"`
+    Chains       []ChainPlan  `json:"chains"`
+    IPSets       []IPSetPlan  `json:"ipsets"`
+    Jumps        []JumpPlan   `json:"jumps"`
+    DeleteChains []string     `json:"deleteChains"`
+    DeleteIPSets []string     `json:"deleteIPSets"`
+    Refused      []string     `json:"refused,omitempty"`
+    Revoke       []RevokePlan `json:"revoke,omitempty"`
+
+    // plane: 计划所属的数据面实例，执行计划时使用
+    plane *plane
+    // access: 本次期望的各工作负载白名单，执行成功后成为下次计算撤销的基准
+    access map[accessKey]accessState
+    // gens: 执行成功后该地址族的代状态
+    gens generations
+    // frozen: 保持回滚且回滚到的代的策略未知（重启后），本次不改写该代的链与集合，其集合也不按孤儿回收
+    frozen bool
+}
+
+// ChainPlan 描述一条链的期望内容。
+// 字段说明：
+// - Chain: 链名
+// - Owner: 所属工作负载（见 WorkloadKey.String，Deployment 为 "namespace/name"）；根链为空
+// - Rules: 链内规则（iptables 风格参数，与 dataplane.ChainRules.Rules 相同）
+type ChainPlan struct {
+    Chain string     `json:"chain"`
+    Owner string     `json:"owner,omitempty"`
+    Rules [][]string `json:"rules"`
+}
+
+// IPSetPlan 描述一个集合的期望成员。
+// 说明：Type 为空表示白名单集合（hash:ip，成员为 IP）；旧规则的端口集合为 hash:ip,port，成员形如 "10.244.1.5,tcp:80"；
+// ipBlock 对端的网段集合为 hash:net，成员形如 "10.20.0.0/16"、"10.20.5.0/24 nomatch"。
+type IPSetPlan struct {
+    Name    string   `json:"name"`
+    Owner   string   `json:"owner"`
+    Type    string   `json:"type,omitempty"`
+    Members []string `json:"members"`
+}
+
+// JumpPlan 描述内置链 Hook 中按顺序连续跳转到 Chains 的规则，Position 为跳转位置（见 dataplane.ValidateJumpPosition）。
+type JumpPlan struct {
+    Hook     string   `json:"hook"`
+    Chains   []string `json:"chains"`
+    Position string   `json:"position"`
+}
+
+// LastPlan 返回最近一次同步计算出的计划；尚未完成过同步时返回 nil。
+func (c *Controller) LastPlan() *SyncPlan {
+    c.planMu.Lock()
+    defer c.planMu.Unlock()
+    return c.lastPlan
+}
+
+// setLastPlan 保存最近一次同步的计划，供 GET /plan 查询。
+func (c *Controller) setLastPlan(plan *SyncPlan) {
+    c.planMu.Lock()
+    defer c.planMu.Unlock()
+    c.lastPlan = plan
+}
+
+// logPlan 在观察模式下记录计划：每个地址族输出一行摘要；计划内容与上次不同时再输出完整计划（JSON）。
+func (c *Controller) logPlan(plan *SyncPlan) {
+    for _, fp := range plan.Families {
+        log.Printf("dry-run: plan for node %s via %s/%s: generation %d, %d chains (%d to create), %d ipsets, %d jumps, delete %d chains and %d ipsets, %d refused",
+            plan.NodeName, fp.Dataplane, fp.Family, fp.Generation, len(fp.Chains), len(fp.CreateChains), len(fp.IPSets), len(fp.Jumps),
+            len(fp.DeleteChains), len(fp.DeleteIPSets), len(fp.Refused))
+    }
+
+    data, err := json.MarshalIndent(plan.Families, "", "  ")
+    if err != nil {
+        log.Printf("dry-run: encode plan: %v", err)
+        return
+    }
+    if string(data) == c.lastPlanLogged {
+        return
+    }
+    c.lastPlanLogged = string(data)
+    log.Printf("dry-run: plan changed:\n%s", data)
+}
@@ -2,56 +2,237 @@ package controller
 
 import (
     "encoding/json"
+    "fmt"
     "os"
     "strings"
     "sync"
+
+    "github.com/example/iptables-controller/internal/dataplane"
+    "github.com/example/iptables-controller/internal/iptables"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // PolicyConfig 表示外部管理端通过 HTTP API 下发的策略配置。
 // 说明：
 // - DefaultAction: 当某个 Deployment 未匹配到规则时的默认动作（建议: ALLOW 或 RETURN）。
-// - Deployments: 针对每个 Deployment 的规则列表。
+// - Deployments: 针对每个工作负载（Deployment、StatefulSet 等，见 DeploymentPolicy.Kind）的规则列表；字段名沿用只支持 Deployment 时的命名。
+// - DenyLog: 全局的拒绝日志配置；为空时不记录拒绝日志，单个 Deployment 可通过同名字段覆盖。
 // 该结构用于反序列化管理端提交的 JSON 配置。
 type PolicyConfig struct {
     DefaultAction string             `json:"defaultAction"`
     Deployments   []DeploymentPolicy `json:"deployments"`
+    DenyLog       *DenyLog           `json:"denyLog,omitempty"`
 }
 
-// DeploymentPolicy 表示单个 Deployment 的访问控制策略。
+// DeploymentPolicy 表示单个工作负载的访问控制策略。
 // 变量说明：
-// - Namespace / Name: 指定目标 Deployment 的命名空间与名称。
-// - Rules: 该 Deployment 的规则列表。
+// - Namespace / Name: 指定目标工作负载的命名空间与名称。
+// - Kind / APIGroup: 目标工作负载的类型与 API 组；kind 为空时为 Deployment，内置类型（Deployment、StatefulSet、DaemonSet、Job、CronJob、ReplicaSet）
+//   的 apiGroup 可省略，其它类型需给出 apiGroup（核心组为空），按 Pod 的 ownerReferences 解析（见 WorkloadKey）。
+// - Mode: 执行模式，enforce（默认）或 audit（见 PolicyModeAudit）。
+// - Rules: 该工作负载的规则列表。
 type DeploymentPolicy struct {
     Namespace string `json:"namespace"`
     Name      string `json:"name"`
-    // IngressFrom: 允许访问该 Deployment 的来源 Deployment 列表（白名单）。
+    Kind      string `json:"kind,omitempty"`
+    APIGroup  string `json:"apiGroup,omitempty"`
+    Mode      string `json:"mode,omitempty"`
+    // IngressFrom: 允许访问该工作负载的来源工作负载列表（白名单）。
     // 若为空，表示不限制来源（放行所有）。
     IngressFrom []DeploymentRef `json:"ingressFrom"`
-    // EgressTo: 该 Deployment 允许访问的目标 Deployment 列表（白名单）。
+    // EgressTo: 该工作负载允许访问的目标工作负载列表（白名单）。
     // 若为空，表示不限制去向（放行所有）。
     EgressTo   []DeploymentRef `json:"egressTo"`
     // Rules: 兼容历史策略（基于 CIDR/端口）。当 ingressFrom 未配置时仍可使用。
     Rules      []Rule          `json:"rules"`
+    // DenyLog: 该 Deployment 的拒绝日志配置，非零字段覆盖全局配置（mode 为 "off" 时关闭）。
+    DenyLog    *DenyLog        `json:"denyLog,omitempty"`
 }
 
-// DeploymentRef 表示一个 Deployment 引用（命名空间 + 名称）。
-// 用于白名单关联关系配置（谁能访问我 / 我能访问谁）。
+// 策略执行模式。
+// - PolicyModeEnforce: 按策略拒绝未命中白名单的流量（默认）
+// - PolicyModeAudit: 审计模式，原本会被拒绝的流量改为记录日志后放行，并单独计数（GET /audit），用于上线新白名单前评估影响
+const (
+    PolicyModeEnforce = "enforce"
+    PolicyModeAudit   = "audit"
+)
+
+// auditMode 判断 Deployment 策略是否处于审计模式。
+func auditMode(depPolicy *DeploymentPolicy) bool {
+    return depPolicy != nil && strings.EqualFold(strings.TrimSpace(depPolicy.Mode), PolicyModeAudit)
+}
+
+// 拒绝日志模式。
+// - DenyLogOff: 不记录（默认）
+// - DenyLogLog: 使用 LOG 目标写入内核日志（dmesg/journal）
+// - DenyLogNFLOG: 使用 NFLOG 目标发送到 nfnetlink_log 组，由 ulogd 等用户态程序收集
+const (
+    DenyLogOff   = "off"
+    DenyLogLog   = "log"
+    DenyLogNFLOG = "nflog"
+)
+
+// DefaultDenyLogRate 为未配置 rate 时的日志速率上限。
+const DefaultDenyLogRate = "10/min"
+
+// DenyLog 表示拒绝日志配置：开启后在每条兜底 DROP（以及旧规则的 DROP/REJECT）之前插入一条限速的日志规则。
+// 变量说明：
+// - Mode: off / log / nflog，为空时沿用上一级配置。
+// - Rate: 日志速率上限，格式为 N/sec|min|hour|day（与 iptables limit 模块一致），为空时使用 DefaultDenyLogRate。
+// - Burst: 突发上限，为 0 时使用 limit 模块默认值（5）。
+// - NFLOGGroup: NFLOG 目标的 nfnetlink_log 组号（0-65535），仅 mode 为 nflog 时生效；为 nil 时沿用上一级配置，
+//   因此工作负载级配置可以显式写 0 覆盖全局的非零组号。
+type DenyLog struct {
+    Mode       string `json:"mode"`
+    Rate       string `json:"rate"`
+    Burst      int    `json:"burst"`
+    NFLOGGroup *int   `json:"nflogGroup,omitempty"`
+}
+
+// validate 校验拒绝日志配置的取值范围。
+func (d *DenyLog) validate() error {
+    if d == nil {
+        return nil
+    }
+    switch strings.ToLower(strings.TrimSpace(d.Mode)) {
+    case "", DenyLogOff, DenyLogLog, DenyLogNFLOG:
+    default:
+        return fmt.Errorf("invalid mode %q (expected off|log|nflog)", d.Mode)
+    }
+    if rate := strings.TrimSpace(d.Rate); rate != "" {
+        if _, err := iptables.CanonicalLimit(rate); err != nil {
+            return err
+        }
+    }
+    if d.Burst < 0 || d.Burst > 10000 {
+        return fmt.Errorf("invalid burst %d (expected 0-10000)", d.Burst)
+    }
+    if g := d.NFLOGGroup; g != nil && (*g < 0 || *g > 65535) {
+        return fmt.Errorf("invalid nflogGroup %d (expected 0-65535)", *g)
+    }
+    return nil
+}
+
+// resolveDenyLog 合并全局与 Deployment 级的拒绝日志配置，返回生效的配置（Mode 已归一化为小写，Rate 已补默认值）。
+// 说明：Deployment 级配置中的非零字段（NFLOGGroup 为非 nil，可以是 0）覆盖全局配置；Mode 为空或 off 时表示不记录。
+func resolveDenyLog(policy *PolicyConfig, depPolicy *DeploymentPolicy) DenyLog {
+    out := DenyLog{Mode: DenyLogOff}
+    layers := []*DenyLog{}
+    if policy != nil {
+        layers = append(layers, policy.DenyLog)
+    }
+    if depPolicy != nil {
+        layers = append(layers, depPolicy.DenyLog)
+    }
+    for _, l := range layers {
+        if l == nil {
+            continue
+        }
+        if mode := strings.ToLower(strings.TrimSpace(l.Mode)); mode != "" {
+            out.Mode = mode
+        }
+        if rate := strings.TrimSpace(l.Rate); rate != "" {
+            out.Rate = rate
+        }
+        if l.Burst > 0 {
+            out.Burst = l.Burst
+        }
+        if l.NFLOGGroup != nil {
+            out.NFLOGGroup = l.NFLOGGroup
+        }
+    }
+    if out.Rate == "" {
+        out.Rate = DefaultDenyLogRate
+    }
+    return out
+}
+
+// DeploymentRef 表示白名单中的一个对端，用于白名单关联关系配置（谁能访问我 / 我能访问谁）。
+// 对端有三种形式：
+// - 工作负载引用：命名空间 + 名称，以及可选的类型与 API 组（含义同 DeploymentPolicy）。
+//   对端可以是 Pod 归属链上的任一层，例如 Job 与创建它的 CronJob 都能引用到同一批 Pod（见 owners.go）。
+// - 标签选择器：PodSelector 与/或 NamespaceSelector（此时不能给出 Name、Kind、APIGroup），匹配的 Pod 随标签变化自动增减（见 peers.go）：
+//   - Namespace 非空：只匹配该命名空间中的 Pod；与 NamespaceSelector 不能同时给出。
+//   - NamespaceSelector: 匹配标签符合的命名空间中的 Pod；空选择器（{}）表示全部命名空间。
+//   - 两者都没有时为策略主体所在的命名空间（与 Kubernetes NetworkPolicy 一致）。
+//   - PodSelector 为空或未给出时匹配上述命名空间中的全部 Pod。
+// - 网段：IPBlock（此时不能给出其它字段），用于集群外的对端，写入单独的 hash:net 集合（见 ipblock.go）。
 type DeploymentRef struct {
-    Namespace string `json:"namespace"`
-    Name      string `json:"name"`
+    Namespace         string                `json:"namespace"`
+    Name              string                `json:"name"`
+    Kind              string                `json:"kind,omitempty"`
+    APIGroup          string                `json:"apiGroup,omitempty"`
+    PodSelector       *metav1.LabelSelector `json:"podSelector,omitempty"`
+    NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+    IPBlock           *IPBlock              `json:"ipBlock,omitempty"`
+}
+
+// IPBlock 表示白名单中的一个网段对端（集群外的数据库、LDAP、元数据服务等）。
+// 变量说明：
+// - CIDR: 网段（或单个 IP），例如 "10.20.0.0/16"、"fd00::/64"；IPv4 网段只下发到 iptables，IPv6 网段只下发到 ip6tables。
+// - Except: CIDR 中不放行的网段，必须与 CIDR 属于同一地址族并包含在 CIDR 之内。
+type IPBlock struct {
+    CIDR   string   `json:"cidr"`
+    Except []string `json:"except,omitempty"`
 }
 
 // Rule 表示一条访问控制规则。
 // 变量说明：
 // - Action: 动作，允许值示例：ALLOW/ACCEPT、DENY/DROP、REJECT、RETURN。
-// - SrcCIDR: 源地址 CIDR，例如 "10.0.0.0/24"。为空时表示不限制来源。
+// - SrcCIDR: 源地址 CIDR（或单个 IP），例如 "10.0.0.0/24"、"fd00::/64"。为空时表示不限制来源。
+//   IPv4 CIDR 只下发到 iptables，IPv6 CIDR 只下发到 ip6tables。
 // - Protocol: 协议，如 "tcp" / "udp" / "icmp"，为空时表示不限制协议。
-// - Port: 目的端口，仅当 Protocol 为 tcp/udp 时有效；为 0 表示不限制端口。
+// - Port: 目的端口，仅当 Protocol 为 tcp/udp/sctp 时有效；为 0 表示不限制端口。
+// - Ports: 目的端口列表，每项为单个端口或端口范围（例如 [80, 443, "8000-8090"]），与 Port 合并生效；
+//   一条 multiport 匹配放得下时渲染为 `-m multiport --dports`，否则改用 hash:ip,port 集合（见 legacyPortSets）。
 type Rule struct {
-    Action   string `json:"action"`
-    SrcCIDR  string `json:"srcCIDR"`
-    Protocol string `json:"protocol"`
-    Port     int32  `json:"port"`
+    Action   string     `json:"action"`
+    SrcCIDR  string     `json:"srcCIDR"`
+    Protocol string     `json:"protocol"`
+    Port     int32      `json:"port"`
+    Ports    []PortSpec `json:"ports,omitempty"`
+}
+
+// Validate 校验策略中的字段格式。
+// 说明：目前校验每条 Rule 的 SrcCIDR 必须是合法的 IPv4/IPv6 地址或 CIDR、端口与端口范围的取值及其协议（见 validatePorts），
+// 策略主体与白名单对端的 kind/apiGroup 格式、标签选择器对端的选择器与字段组合、网段对端的 cidr/except，各工作负载的执行模式，以及全局/各工作负载的拒绝日志配置，
+// 避免错误的值被静默忽略或下发失败。
+func (cfg PolicyConfig) Validate() error {
+    if err := cfg.DenyLog.validate(); err != nil {
+        return fmt.Errorf("denyLog: %w", err)
+    }
+    for _, dp := range cfg.Deployments {
+        if err := validateWorkloadKind(dp.APIGroup, dp.Kind); err != nil {
+            return fmt.Errorf("workload %s/%s: %w", dp.Namespace, dp.Name, err)
+        }
+        key := dp.Key()
+        switch strings.ToLower(strings.TrimSpace(dp.Mode)) {
+        case "", PolicyModeEnforce, PolicyModeAudit:
+        default:
+            return fmt.Errorf("workload %s: invalid mode %q (expected enforce|audit)", key, dp.Mode)
+        }
+        if err := dp.DenyLog.validate(); err != nil {
+            return fmt.Errorf("workload %s denyLog: %w", key, err)
+        }
+        for _, ref := range append(append([]DeploymentRef{}, dp.IngressFrom...), dp.EgressTo...) {
+            if err := ref.validate(); err != nil {
+                return fmt.Errorf("workload %s peer %s: %w", key, ref.displayName(key.Namespace), err)
+            }
+        }
+        for i, r := range dp.Rules {
+            if err := r.validatePorts(); err != nil {
+                return fmt.Errorf("workload %s rule %d: %w", key, i, err)
+            }
+            cidr := strings.TrimSpace(r.SrcCIDR)
+            if cidr == "" {
+                continue
+            }
+            if _, ok := dataplane.FamilyOf(cidr); !ok {
+                return fmt.Errorf("workload %s rule %d: invalid srcCIDR %q", key, i, r.SrcCIDR)
+            }
+        }
+    }
+    return nil
 }
 
 // PolicyStore 保存当前生效的策略（内存），可选地持久化到本地文件。
@@ -0,0 +1,50 @@
+package controller
+
+import (
+    "encoding/json"
+    "testing"
+)
+
+func TestResolveDenyLogNFLOGGroup(t *testing.T) {
+    cases := []struct {
+        name      string
+        global    string
+        workload  string
+        wantGroup int
+        wantSet   bool
+    }{
+        {name: "unset", global: `{"mode": "nflog"}`},
+        {name: "global group", global: `{"mode": "nflog", "nflogGroup": 5}`, wantGroup: 5, wantSet: true},
+        {name: "workload inherits", global: `{"mode": "nflog", "nflogGroup": 5}`, workload: `{"rate": "1/sec"}`, wantGroup: 5, wantSet: true},
+        {name: "workload overrides", global: `{"mode": "nflog", "nflogGroup": 5}`, workload: `{"nflogGroup": 7}`, wantGroup: 7, wantSet: true},
+        {name: "workload chooses group 0", global: `{"mode": "nflog", "nflogGroup": 5}`, workload: `{"nflogGroup": 0}`, wantGroup: 0, wantSet: true},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            policy := &PolicyConfig{}
+            dep := &DeploymentPolicy{}
+            if err := json.Unmarshal([]byte(tc.global), &policy.DenyLog); err != nil {
+                t.Fatal(err)
+            }
+            if tc.workload != "" {
+                if err := json.Unmarshal([]byte(tc.workload), &dep.DenyLog); err != nil {
+                    t.Fatal(err)
+                }
+            }
+            got := resolveDenyLog(policy, dep).NFLOGGroup
+            if (got != nil) != tc.wantSet || (got != nil && *got != tc.wantGroup) {
+                t.Fatalf("nflogGroup = %v, want %d (set %v)", got, tc.wantGroup, tc.wantSet)
+            }
+
+            // 组号为 0 时与 iptables-save 的输出一致，不写 --nflog-group
+            rules := denyLogger{cfg: resolveDenyLog(policy, dep), prefix: "MS-DROP-IN-X "}.rules(nil, "DROP", RuleComment{})
+            hasGroup := false
+            for _, arg := range rules[0] {
+                hasGroup = hasGroup || arg == "--nflog-group"
+            }
+            if hasGroup != (tc.wantGroup > 0) {
+                t.Fatalf("log rule %v, want --nflog-group only for a non-zero group", rules[0])
+            }
+        })
+    }
+}
@@ -0,0 +1,254 @@
+package controller
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/example/iptables-controller/internal/dataplane"
+    "github.com/example/iptables-controller/internal/iptables"
+)
+
+// maxMultiportPorts 为一条 multiport 匹配最多可写的端口数，端口范围占两个（iptables multiport 模块的限制）。
+const maxMultiportPorts = 15
+
+// maxPortSetPorts 为一条旧规则使用“IP + 协议端口”集合时最多展开的端口数。
+// 说明：hash:ip,port 集合按“目标 IP × 端口”逐个存放成员（ipset 默认上限 65536 个），端口范围需逐个展开，
+// 限制单条规则的端口数，避免大范围端口列表撑满集合。
+const maxPortSetPorts = 1024
+
+// PortSpec 为旧规则 ports 列表中的一项：单个端口（JSON 中可写为数字 80 或字符串 "80"）或端口范围（"8000-8090"）。
+type PortSpec string
+
+// UnmarshalJSON 同时接受数字与字符串形式。
+func (p *PortSpec) UnmarshalJSON(data []byte) error {
+    var n json.Number
+    if err := json.Unmarshal(data, &n); err == nil {
+        *p = PortSpec(n.String())
+        return nil
+    }
+    var s string
+    if err := json.Unmarshal(data, &s); err != nil {
+        return fmt.Errorf("port must be a number or a string like \"8000-8090\"")
+    }
+    *p = PortSpec(s)
+    return nil
+}
+
+// MarshalJSON 单个端口输出为数字，端口范围输出为字符串，与常见的写法保持一致。
+func (p PortSpec) MarshalJSON() ([]byte, error) {
+    if n, err := strconv.Atoi(string(p)); err == nil {
+        return json.Marshal(n)
+    }
+    return json.Marshal(string(p))
+}
+
+// portRange 表示闭区间 [From, To] 的目的端口，单个端口时 From 与 To 相同。
+type portRange struct {
+    From int
+    To   int
+}
+
+// String 返回 iptables 写法：单个端口 "80"，范围 "8000:8090"。
+func (pr portRange) String() string {
+    if pr.From == pr.To {
+        return strconv.Itoa(pr.From)
+    }
+    return strconv.Itoa(pr.From) + ":" + strconv.Itoa(pr.To)
+}
+
+// parsePortSpec 解析单个端口或端口范围（"8000-8090"，也接受 iptables 写法 "8000:8090"），端口取值 1-65535 且范围起点不大于终点。
+func parsePortSpec(spec string) (portRange, error) {
+    spec = strings.TrimSpace(spec)
+    fromText, toText, isRange := strings.Cut(spec, "-")
+    if !isRange {
+        fromText, toText, isRange = strings.Cut(spec, ":")
+    }
+    if !isRange {
+        toText = fromText
+    }
+    from, err := strconv.Atoi(strings.TrimSpace(fromText))
+    if err != nil {
+        return portRange{}, fmt.Errorf("invalid port %q", spec)
+    }
+    to, err := strconv.Atoi(strings.TrimSpace(toText))
+    if err != nil {
+        return portRange{}, fmt.Errorf("invalid port %q", spec)
+    }
+    if from < 1 || from > 65535 || to < 1 || to > 65535 {
+        return portRange{}, fmt.Errorf("port %q out of range (expected 1-65535)", spec)
+    }
+    if from > to {
+        return portRange{}, fmt.Errorf("invalid port range %q (start greater than end)", spec)
+    }
+    return portRange{From: from, To: to}, nil
+}
+
+// rulePorts 返回规则的目的端口：合并 port 与 ports，按起点排序并合并重叠或相邻的范围；没有端口限制时返回空列表。
+func rulePorts(r Rule) ([]portRange, error) {
+    ranges := []portRange{}
+    if r.Port < 0 || r.Port > 65535 {
+        return nil, fmt.Errorf("port %d out of range (expected 1-65535)", r.Port)
+    }
+    if r.Port > 0 {
+        ranges = append(ranges, portRange{From: int(r.Port), To: int(r.Port)})
+    }
+    for _, spec := range r.Ports {
+        pr, err := parsePortSpec(string(spec))
+        if err != nil {
+            return nil, err
+        }
+        ranges = append(ranges, pr)
+    }
+    sort.Slice(ranges, func(i, j int) bool { return ranges[i].From < ranges[j].From })
+    merged := []portRange{}
+    for _, pr := range ranges {
+        if n := len(merged); n > 0 && pr.From <= merged[n-1].To+1 {
+            if pr.To > merged[n-1].To {
+                merged[n-1].To = pr.To
+            }
+            continue
+        }
+        merged = append(merged, pr)
+    }
+    return merged, nil
+}
+
+// portProtocol 判断协议是否带端口（tcp/udp/sctp）；只有这些协议的规则可以限定端口。
+func portProtocol(proto string) bool {
+    switch strings.ToLower(strings.TrimSpace(proto)) {
+    case "tcp", "udp", "sctp":
+        return true
+    default:
+        return false
+    }
+}
+
+// validatePorts 校验规则的端口：取值与范围合法、协议带端口，且超出 multiport 上限时展开后的端口数不超过 maxPortSetPorts。
+func (r Rule) validatePorts() error {
+    ranges, err := rulePorts(r)
+    if err != nil {
+        return err
+    }
+    if len(ranges) == 0 {
+        return nil
+    }
+    if !portProtocol(r.Protocol) {
+        return fmt.Errorf("port requires protocol tcp, udp or sctp (got %q)", r.Protocol)
+    }
+    if needsPortSet(ranges) && portCount(ranges) > maxPortSetPorts {
+        return fmt.Errorf("ports need more than %d multiport slots and expand to %d ports (max %d)", maxMultiportPorts, portCount(ranges), maxPortSetPorts)
+    }
+    return nil
+}
+
+// multiportSlots 返回 multiport 匹配需要的端口数（范围占两个）。
+func multiportSlots(ranges []portRange) int {
+    n := 0
+    for _, pr := range ranges {
+        if pr.From == pr.To {
+            n++
+        } else {
+            n += 2
+        }
+    }
+    return n
+}
+
+// portCount 返回端口列表展开后的端口数。
+func portCount(ranges []portRange) int {
+    n := 0
+    for _, pr := range ranges {
+        n += pr.To - pr.From + 1
+    }
+    return n
+}
+
+// needsPortSet 判断端口列表是否超出一条 multiport 匹配的容量，需改用“IP + 协议端口”集合。
+func needsPortSet(ranges []portRange) bool {
+    return multiportSlots(ranges) > maxMultiportPorts
+}
+
+// containsPort 判断端口是否落在列表中的某个范围内。
+func containsPort(ranges []portRange, port int32) bool {
+    for _, pr := range ranges {
+        if int(port) >= pr.From && int(port) <= pr.To {
+            return true
+        }
+    }
+    return false
+}
+
+// portMatch 返回匹配端口列表的规则参数（应位于 `-p <proto>` 之后）：
+// - 单个端口或单个范围：`--dport 80` / `--dport 8000:8090`
+// - 其余列表：`-m multiport --dports 80,443,8000:8090`
+// 超出 multiport 容量的列表由调用方改用集合匹配（见 legacyPortSets）。
+func portMatch(ranges []portRange) []string {
+    if len(ranges) == 1 {
+        return []string{"--dport", ranges[0].String()}
+    }
+    items := make([]string, 0, len(ranges))
+    for _, pr := range ranges {
+        items = append(items, pr.String())
+    }
+    return []string{"-m", "multiport", "--dports", strings.Join(items, ",")}
+}
+
+// formatPorts 返回端口列表的可读形式（"80,443,8000:8090"），用于计数等展示。
+func formatPorts(ranges []portRange) string {
+    items := make([]string, 0, len(ranges))
+    for _, pr := range ranges {
+        items = append(items, pr.String())
+    }
+    return strings.Join(items, ",")
+}
+
+// legacyPortSets 为工作负载的旧规则生成需要的“IP + 协议端口”集合（hash:ip,port），返回集合计划（按规则下标排序）与规则下标 -> 集合名。
+// 说明：
+// - 只有沿用旧规则（未配置 ingressFrom）、属于本地址族、且端口列表超出一条 multiport 匹配容量的规则需要集合；
+//   其余规则直接以 `--dport` 或 multiport 匹配，不需要集合。
+// - 成员为本节点上该工作负载各 Pod IP 与规则端口（逐个展开）的组合，规则以 `-m set --match-set <集合> dst,dst` 匹配。
+// - 集合名按规则下标区分（用途名 PORT-<下标>，IPv6 为 PORT6-<下标>），prefix 为代的前缀，与白名单集合一样每代一组；
+//   集合名超出长度上限时返回错误（见 iptables.MakeOwnerSetName）。
+func legacyPortSets(prefix string, depPolicy *DeploymentPolicy, key WorkloadKey, family dataplane.Family, targets []endpoint) ([]IPSetPlan, map[int]string, error) {
+    sets := []IPSetPlan{}
+    names := map[int]string{}
+    if depPolicy == nil || len(depPolicy.IngressFrom) > 0 || len(targets) == 0 {
+        return sets, names, nil
+    }
+    for i, r := range depPolicy.Rules {
+        if cidr := strings.TrimSpace(r.SrcCIDR); cidr != "" {
+            if cidrFamily, ok := dataplane.FamilyOf(cidr); !ok || cidrFamily != family {
+                continue
+            }
+        }
+        proto := strings.ToLower(strings.TrimSpace(r.Protocol))
+        ranges, err := rulePorts(r)
+        if err != nil || !portProtocol(proto) || !needsPortSet(ranges) {
+            continue
+        }
+        if portCount(ranges) > maxPortSetPorts {
+            log.Printf("policy rule %d ignored for %s: ports expand to %d ports (max %d)", i, key, portCount(ranges), maxPortSetPorts)
+            continue
+        }
+        members := []string{}
+        for _, t := range targets {
+            for _, pr := range ranges {
+                for port := pr.From; port <= pr.To; port++ {
+                    members = append(members, dataplane.IPPortMember(t.IP, proto, port))
+                }
+            }
+        }
+        sort.Strings(members)
+        setName, err := iptables.MakeOwnerSetName(prefix, setRole("PORT", family)+"-"+strconv.Itoa(i), key.Namespace, key.qualifiedName())
+        if err != nil {
+            return nil, nil, err
+        }
+        sets = append(sets, IPSetPlan{Name: setName, Owner: key.String(), Type: iptables.SetTypeIPPort, Members: members})
+        names[i] = setName
+    }
+    return sets, names, nil
+}
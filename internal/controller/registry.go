@@ -0,0 +1,173 @@
+package controller
+
+import (
+    "fmt"
+    "log"
+    "sync"
+
+    "github.com/example/iptables-controller/internal/dataplane"
+)
+
+// ownerCommentPrefix 为规则注释（见 RuleComment）中归属字段的前缀，完整形式为 `owner=<namespace>/<name>`（其它类型的工作负载见 WorkloadKey.String）。
+// 说明：注释随规则一起保存在内核中，控制器重启后可据此恢复名称注册表。
+const ownerCommentPrefix = "owner="
+
+// NameRegistry 记录每个链/集合名称属于哪个工作负载，用于在下发前检测命名冲突。
+// 说明：
+// - 名称由工作负载标识的哈希生成，正常情况下不会重名；注册表是最后一道防线，发现冲突时拒绝下发而不是让两个工作负载共用规则。
+// - 注册表不单独持久化：启动后首次同步时由 recoverRegistry 从根链跳转规则的归属注释中恢复。
+type NameRegistry struct {
+    mu     sync.Mutex
+    owners map[string]WorkloadKey
+}
+
+// NewNameRegistry 创建一个空的名称注册表。
+func NewNameRegistry() *NameRegistry {
+    return &NameRegistry{owners: map[string]WorkloadKey{}}
+}
+
+// Claim 将一组名称登记到 key 名下。
+// 说明：任一名称已属于其它工作负载时返回错误，且不登记任何名称（要么全部成功，要么全部不变）。
+func (r *NameRegistry) Claim(key WorkloadKey, names ...string) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for _, name := range names {
+        if owner, ok := r.owners[name]; ok && owner != key {
+            return fmt.Errorf("name %s already owned by %s", name, owner)
+        }
+    }
+    for _, name := range names {
+        r.owners[name] = key
+    }
+    return nil
+}
+
+// Owner 返回名称当前的归属。
+func (r *NameRegistry) Owner(name string) (WorkloadKey, bool) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    key, ok := r.owners[name]
+    return key, ok
+}
+
+// Forget 移除名称的登记（对应的链/集合已被删除时调用）。
+func (r *NameRegistry) Forget(name string) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    delete(r.owners, name)
+}
+
+// Snapshot 返回当前全部登记的副本（名称 -> 所属工作负载）。
+func (r *NameRegistry) Snapshot() map[string]WorkloadKey {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    out := make(map[string]WorkloadKey, len(r.owners))
+    for name, key := range r.owners {
+        out[name] = key
+    }
+    return out
+}
+
+// parseOwnerComment 从规则参数中解析归属注释，规则不含归属注释（或注释中没有 owner 字段）时返回 false。
+func parseOwnerComment(rule []string) (WorkloadKey, bool) {
+    rc, ok := ruleComment(rule)
+    if !ok || rc.Owner.Name == "" {
+        return WorkloadKey{}, false
+    }
+    return rc.Owner, true
+}
+
+// ruleJumpTarget 返回规则的 -j 目标。
+func ruleJumpTarget(rule []string) string {
+    for i := 0; i+1 < len(rule); i++ {
+        if rule[i] == "-j" {
+            return rule[i+1]
+        }
+    }
+    return ""
+}
+
+// ruleMatchSets 返回规则中 --match-set 引用的集合名。
+func ruleMatchSets(rule []string) []string {
+    sets := []string{}
+    for i := 0; i+1 < len(rule); i++ {
+        if rule[i] == "--match-set" {
+            sets = append(sets, rule[i+1])
+        }
+    }
+    return sets
+}
+
+// recoverRegistry 从数据面现有规则恢复名称注册表（仅在启动后首次成功时执行一次），existing 为数据面中带前缀的链。
+// 流程：
+// 1. 读取各代代根链（及旧版本根链）的跳转规则，根据归属注释登记被跳转的专用链。
+// 2. 读取这些专用链的规则，将其中 --match-set 引用的集合登记到同一归属下。
+// 3. 没有被根链跳转的专用链（例如等待回收的孤儿链）根据链内规则自身的归属注释登记。
+// 说明：根链尚不存在（首次部署）时视为没有可恢复的内容；读取失败时返回错误，下个周期重试。
+func (c *Controller) recoverRegistry(dp dataplane.Dataplane, existing []string) error {
+    present := map[string]bool{}
+    for _, name := range existing {
+        present[name] = true
+    }
+
+    recovered := 0
+    for _, root := range existing {
+        if !c.isRootChain(root) {
+            continue
+        }
+        rules, err := dp.ListRules(root)
+        if err != nil {
+            return fmt.Errorf("list rules of %s: %w", root, err)
+        }
+        for _, rule := range rules {
+            key, ok := parseOwnerComment(rule)
+            chain := ruleJumpTarget(rule)
+            if !ok || !present[chain] {
+                continue
+            }
+            names := []string{chain}
+            chainRules, err := dp.ListRules(chain)
+            if err != nil {
+                return fmt.Errorf("list rules of %s: %w", chain, err)
+            }
+            for _, r := range chainRules {
+                names = append(names, ruleMatchSets(r)...)
+            }
+            if err := c.registry.Claim(key, names...); err != nil {
+                log.Printf("registry: recover %s for %s/%s: %v", chain, key.Namespace, key.Name, err)
+                continue
+            }
+            recovered++
+        }
+    }
+    for _, chain := range existing {
+        if c.isRootChain(chain) {
+            continue
+        }
+        if _, ok := c.registry.Owner(chain); ok {
+            continue
+        }
+        rules, err := dp.ListRules(chain)
+        if err != nil {
+            return fmt.Errorf("list rules of %s: %w", chain, err)
+        }
+        for _, rule := range rules {
+            key, ok := parseOwnerComment(rule)
+            if !ok {
+                continue
+            }
+            names := []string{chain}
+            for _, r := range rules {
+                names = append(names, ruleMatchSets(r)...)
+            }
+            if err := c.registry.Claim(key, names...); err != nil {
+                log.Printf("registry: recover %s for %s/%s: %v", chain, key.Namespace, key.Name, err)
+            } else {
+                recovered++
+            }
+            break
+        }
+    }
+    log.Printf("registry: recovered ownership of %d chains from rule comments", recovered)
+    return nil
+}
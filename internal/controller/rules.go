@@ -2,130 +2,294 @@ package controller
 
 import (
     "log"
+    "sort"
     "strconv"
     "strings"
+
+    "github.com/example/iptables-controller/internal/dataplane"
 )
 
-// buildIngressRules 根据策略为指定 Deployment 生成“入向”规则。
+// endpoint 表示规则匹配的一个本地目标（入向规则中为目的，出向规则中为来源）。
+// 字段说明：
+// - IP: Pod IP；hostNetwork Pod 为节点地址
+// - Protocol / Port: 仅 hostNetwork Pod 使用，限定为容器声明的端口，避免节点地址上的其它流量被策略拦截
+// - Pod: 所属 Pod 名称，写入规则注释
+type endpoint struct {
+    IP       string
+    Protocol string
+    Port     int32
+    Pod      string
+}
+
+// match 返回匹配该目标的规则参数；dir 为 "-d"（入向）或 "-s"（出向）。
+func (e endpoint) match(dir string) []string {
+    args := []string{dir, e.IP}
+    if e.Port > 0 {
+        portFlag := "--dport"
+        if dir == "-s" {
+            portFlag = "--sport"
+        }
+        args = append(args, "-p", e.Protocol, portFlag, strconv.Itoa(int(e.Port)))
+    }
+    return args
+}
+
+// hookEndpoints 返回在内置入口 hook 上需要生成规则的目标。
+// 说明：
+// - FORWARD/OUTPUT：只包含普通 Pod（按 Pod IP 匹配）；hostNetwork Pod 的流量不经过这两个入口到达它们。
+// - INPUT：只包含 hostNetwork Pod 的端口限定目标，绝不按整个节点地址匹配。
+func hookEndpoints(eps []endpoint, hook string) []endpoint {
+    out := []endpoint{}
+    for _, e := range eps {
+        if strings.TrimSpace(e.IP) == "" {
+            continue
+        }
+        if (hook == dataplane.HookInput) == (e.Port > 0) {
+            out = append(out, e)
+        }
+    }
+    return out
+}
+
+// denyLogger 描述某个工作负载某个方向上的拒绝日志。
+// 字段说明：
+// - cfg: 生效的拒绝日志配置（见 resolveDenyLog）
+// - prefix: 日志前缀，编码工作负载与方向（见 iptables.MakeOwnerLogPrefix）
+// - audit: 审计模式下代替拒绝动作的放行动作（入向 ACCEPT，出向 RETURN）；为空表示按策略拒绝
+type denyLogger struct {
+    cfg    DenyLog
+    prefix string
+    audit  string
+}
+
+// rules 返回拒绝 match 所匹配流量的规则：开启拒绝日志时先是一条限速的 LOG/NFLOG 规则，随后是 verdict 规则，两者都带注释 comment。
+// 说明：
+// - LOG/NFLOG 不是终结目标，报文记录后继续匹配下一条规则，因此日志规则必须紧贴在拒绝规则之前且匹配条件相同。
+// - 审计模式下 verdict 规则改为注释带 mode=audit 的放行规则，其计数即本应被拒绝的报文数（不受日志限速影响）。
+func (l denyLogger) rules(match []string, verdict string, comment RuleComment) [][]string {
+    deny := tagRule(append(append([]string{}, match...), "-j", verdict), comment)
+    if l.audit != "" {
+        audited := comment
+        audited.Audit = true
+        deny = tagRule(append(append([]string{}, match...), "-j", l.audit), audited)
+    }
+    if l.cfg.Mode != DenyLogLog && l.cfg.Mode != DenyLogNFLOG {
+        return [][]string{deny}
+    }
+    logRule := append([]string{}, match...)
+    logRule = append(logRule, "-m", "limit", "--limit", l.cfg.Rate)
+    if l.cfg.Burst > 0 {
+        logRule = append(logRule, "--limit-burst", strconv.Itoa(l.cfg.Burst))
+    }
+    if l.cfg.Mode == DenyLogNFLOG {
+        // 与 iptables-save 的输出顺序一致：先 --nflog-prefix，组号为 0 时省略
+        logRule = append(logRule, "-j", "NFLOG", "--nflog-prefix", l.prefix)
+        if g := l.cfg.NFLOGGroup; g != nil && *g > 0 {
+            logRule = append(logRule, "--nflog-group", strconv.Itoa(*g))
+        }
+    } else {
+        logRule = append(logRule, "-j", "LOG", "--log-prefix", l.prefix)
+    }
+    return [][]string{tagRule(logRule, comment), deny}
+}
+
+// buildIngressRules 根据策略为指定工作负载生成“入向”规则。
 // 规则逻辑（白名单）：
 // - 未配置 ingressFrom：放行所有（ACCEPT）。
-// - 配置 ingressFrom：仅允许来自指定 Deployment 的 Pod IP，其他来源丢弃（DROP）。
-// - 兼容历史 rules：当 ingressFrom 为空且 rules 非空时，按旧规则生成。
-func buildIngressRules(podIPs []string, policy *PolicyConfig, ns, name string, srcSetName string) [][]string {
+// - 配置 ingressFrom：仅允许来自指定工作负载的 Pod IP 与 ipBlock 网段，其他来源丢弃（DROP）。
+// - 兼容历史 rules：当 ingressFrom 为空且 rules 非空时，按旧规则生成（只生成 SrcCIDR 属于 family 的规则）。
+// 说明：
+// - targets、srcSetName 与 srcNetSetName 均应属于 family 对应的地址族；Pod 对端与网段对端在 srcSetName / srcNetSetName 中，
+//   没有该类对端时对应的名称为空、不生成该条放行规则（见 ipblock.go）；portSets 为旧规则下标 -> 端口集合名（见 legacyPortSets）。
+// - hook 决定匹配方式（见 hookEndpoints）：FORWARD/OUTPUT 按目的 Pod IP 匹配，INPUT 按节点地址 + 容器端口匹配；
+//   同一份策略因此在转发、节点本机访问与 hostNetwork 三条路径上得到一致的执行。
+// - deny 决定是否在每条 DROP（含旧规则的 DROP/REJECT）之前插入限速的日志规则；审计模式下这些 DROP 改为记录日志后 ACCEPT。
+// - 每条规则都带归属注释（见 RuleComment）：工作负载、方向、策略版本、Pod，以及白名单对端或旧规则下标。
+func buildIngressRules(targets []endpoint, policy *PolicyConfig, key WorkloadKey, srcSetName, srcNetSetName string, portSets map[int]string, family dataplane.Family, hook string, deny denyLogger) [][]string {
     rules := [][]string{}
-    depPolicy := findDeploymentPolicy(policy, ns, name)
+    targets = hookEndpoints(targets, hook)
+    depPolicy := findDeploymentPolicy(policy, key)
+    dir := dirIngress
+    if hook == dataplane.HookInput {
+        dir = dirHostIngress
+    }
+    base := newRuleComment(key, dir)
+    base.Revision = policyRevision(policy, depPolicy)
 
     if depPolicy == nil {
         // 无策略 => 放行所有
-        for _, ip := range podIPs {
-            if strings.TrimSpace(ip) == "" {
-                continue
-            }
-            rules = append(rules, []string{"-d", ip, "-j", "ACCEPT"})
+        for _, t := range targets {
+            rules = append(rules, tagRule(append(t.match("-d"), "-j", "ACCEPT"), base.forPeers(t, "*")))
         }
         return rules
     }
 
     // 若未配置 ingressFrom，但存在 legacy rules，则沿用旧规则
     if len(depPolicy.IngressFrom) == 0 && len(depPolicy.Rules) > 0 {
-        return buildLegacyIngressRules(podIPs, policy, depPolicy, ns, name)
+        return buildLegacyIngressRules(targets, policy, depPolicy, key, family, portSets, deny, base)
     }
 
     // 未配置 ingressFrom => 放行所有
     if len(depPolicy.IngressFrom) == 0 {
-        for _, ip := range podIPs {
-            if strings.TrimSpace(ip) == "" {
-                continue
-            }
-            rules = append(rules, []string{"-d", ip, "-j", "ACCEPT"})
+        for _, t := range targets {
+            rules = append(rules, tagRule(append(t.match("-d"), "-j", "ACCEPT"), base.forPeers(t, "*")))
         }
         return rules
     }
 
-    // 白名单：允许来源 -> ACCEPT（使用 ipset）
-    for _, dstIP := range podIPs {
-        if strings.TrimSpace(dstIP) == "" {
-            continue
-        }
+    // 白名单：允许来源 -> ACCEPT（使用 ipset；Pod 对端与网段对端各一条）
+    pods, nets := splitPeers(depPolicy.IngressFrom)
+    for _, t := range targets {
         if strings.TrimSpace(srcSetName) != "" {
-            rules = append(rules, []string{"-m", "set", "--match-set", srcSetName, "src", "-d", dstIP, "-j", "ACCEPT"})
+            args := []string{"-m", "set", "--match-set", srcSetName, "src"}
+            args = append(args, t.match("-d")...)
+            rules = append(rules, tagRule(append(args, "-j", "ACCEPT"), base.forPeers(t, refNames(pods, key.Namespace)...)))
+        }
+        if strings.TrimSpace(srcNetSetName) != "" {
+            args := []string{"-m", "set", "--match-set", srcNetSetName, "src"}
+            args = append(args, t.match("-d")...)
+            rules = append(rules, tagRule(append(args, "-j", "ACCEPT"), base.forPeers(t, refNames(nets, key.Namespace)...)))
         }
         // 未命中白名单的来源全部拒绝
-        rules = append(rules, []string{"-d", dstIP, "-j", "DROP"})
+        rules = append(rules, deny.rules(t.match("-d"), "DROP", base.forPeers(t, "*"))...)
     }
 
     return rules
 }
 
-// buildEgressRules 根据策略为指定 Deployment 生成“出向”规则。
+// buildEgressRules 根据策略为指定工作负载生成“出向”规则。
 // 规则逻辑（白名单）：
 // - 未配置 egressTo：放行所有（RETURN）。
-// - 配置 egressTo：仅允许访问指定 Deployment 的 Pod IP，其他去向丢弃（DROP）。
-// 说明：出向链使用 RETURN 作为放行动作，以便继续进入入向链做校验。
-func buildEgressRules(podIPs []string, ns, name string, dstSetName string) [][]string {
+// - 配置 egressTo：仅允许访问指定工作负载的 Pod IP 与 ipBlock 网段（dstSetName / dstNetSetName），其他去向丢弃（DROP）。
+// 说明：
+// - 出向链使用 RETURN 作为放行动作，以便继续进入入向链做校验。
+// - 只有 FORWARD 入口生成出向规则：节点本机（含 hostNetwork Pod）发出的流量以节点地址为源，无法区分所属工作负载，
+//   其它 hook 返回空规则。
+// - deny 决定是否在每条 DROP 之前插入限速的日志规则；审计模式下这些 DROP 改为记录日志后 RETURN。
+// - 每条规则都带归属注释（见 RuleComment），白名单规则的对端为 egressTo 中写入对应集合的对端。
+func buildEgressRules(targets []endpoint, policy *PolicyConfig, key WorkloadKey, dstSetName, dstNetSetName string, hook string, deny denyLogger) [][]string {
     rules := [][]string{}
-    if strings.TrimSpace(dstSetName) == "" {
+    if hook != dataplane.HookForward {
+        return rules
+    }
+    targets = hookEndpoints(targets, hook)
+    depPolicy := findDeploymentPolicy(policy, key)
+    base := newRuleComment(key, dirEgress)
+    base.Revision = policyRevision(policy, depPolicy)
+    if (strings.TrimSpace(dstSetName) == "" && strings.TrimSpace(dstNetSetName) == "") || depPolicy == nil {
         // 无配置 => 放行所有
-        for _, ip := range podIPs {
-            if strings.TrimSpace(ip) == "" {
-                continue
-            }
-            rules = append(rules, []string{"-s", ip, "-j", "RETURN"})
+        for _, t := range targets {
+            rules = append(rules, tagRule(append(t.match("-s"), "-j", "RETURN"), base.forPeers(t, "*")))
         }
         return rules
     }
 
-    for _, srcIP := range podIPs {
-        if strings.TrimSpace(srcIP) == "" {
-            continue
+    pods, nets := splitPeers(depPolicy.EgressTo)
+    for _, t := range targets {
+        if strings.TrimSpace(dstSetName) != "" {
+            args := []string{"-m", "set", "--match-set", dstSetName, "dst"}
+            args = append(args, t.match("-s")...)
+            rules = append(rules, tagRule(append(args, "-j", "RETURN"), base.forPeers(t, refNames(pods, key.Namespace)...)))
+        }
+        if strings.TrimSpace(dstNetSetName) != "" {
+            args := []string{"-m", "set", "--match-set", dstNetSetName, "dst"}
+            args = append(args, t.match("-s")...)
+            rules = append(rules, tagRule(append(args, "-j", "RETURN"), base.forPeers(t, refNames(nets, key.Namespace)...)))
         }
-        rules = append(rules, []string{"-m", "set", "--match-set", dstSetName, "dst", "-s", srcIP, "-j", "RETURN"})
         // 未命中白名单的去向全部拒绝
-        rules = append(rules, []string{"-s", srcIP, "-j", "DROP"})
+        rules = append(rules, deny.rules(t.match("-s"), "DROP", base.forPeers(t, "*"))...)
     }
     return rules
 }
 
 // buildLegacyIngressRules 保持历史规则行为（基于 CIDR/端口）。
-func buildLegacyIngressRules(podIPs []string, policy *PolicyConfig, depPolicy *DeploymentPolicy, ns, name string) [][]string {
+// 说明：
+// - SrcCIDR 属于其它地址族的规则不会出现在本地址族的链中（例如 IPv6 CIDR 只下发到 ip6tables）。
+// - 端口限定的目标（hostNetwork Pod）只接受协议一致、端口列表包含其端口的规则，不一致的规则跳过。
+// - 其余目标按规则的端口列表匹配（见 portMatch）：单个端口或范围用 `--dport`，多项用 multiport，超出 multiport 容量时用 portSets 中的端口集合。
+// - 动作为 DROP/REJECT 的规则之前按 deny 插入日志规则；审计模式下这些规则改为记录日志后 ACCEPT。
+// - 规则注释在 base 的基础上记录 Pod 与该规则在 rules 中的下标。
+func buildLegacyIngressRules(targets []endpoint, policy *PolicyConfig, depPolicy *DeploymentPolicy, key WorkloadKey, family dataplane.Family, portSets map[int]string, deny denyLogger, base RuleComment) [][]string {
     rules := [][]string{}
-    for _, ip := range podIPs {
-        if strings.TrimSpace(ip) == "" {
-            continue
-        }
-        for _, r := range depPolicy.Rules {
+    for _, t := range targets {
+        for i, r := range depPolicy.Rules {
+            comment := base.forPeers(t)
+            comment.RuleIndex = i
+            if cidr := strings.TrimSpace(r.SrcCIDR); cidr != "" {
+                cidrFamily, ok := dataplane.FamilyOf(cidr)
+                if !ok {
+                    log.Printf("policy rule ignored invalid srcCIDR %q for %s", cidr, key)
+                    continue
+                }
+                if cidrFamily != family {
+                    continue
+                }
+            }
+            ports, err := rulePorts(r)
+            if err != nil {
+                log.Printf("policy rule %d ignored for %s: %v", i, key, err)
+                continue
+            }
+
             action := normalizeAction(r.Action)
             if action == "" {
                 action = normalizeAction(policy.DefaultAction)
             }
 
-            args := []string{"-d", ip}
+            args := []string{"-d", t.IP}
             if strings.TrimSpace(r.SrcCIDR) != "" {
-                args = append(args, "-s", r.SrcCIDR)
+                args = append(args, "-s", strings.TrimSpace(r.SrcCIDR))
             }
 
-            if proto := strings.TrimSpace(r.Protocol); proto != "" {
+            if t.Port > 0 {
+                proto := strings.ToLower(strings.TrimSpace(r.Protocol))
+                if (proto != "" && proto != t.Protocol) || (len(ports) > 0 && !containsPort(ports, t.Port)) {
+                    continue
+                }
+                args = append(args, "-p", t.Protocol, "--dport", strconv.Itoa(int(t.Port)))
+            } else if proto := strings.TrimSpace(r.Protocol); proto != "" {
                 args = append(args, "-p", strings.ToLower(proto))
-                if r.Port > 0 {
-                    args = append(args, "--dport", strconv.Itoa(int(r.Port)))
+                switch {
+                case len(ports) == 0:
+                case !portProtocol(proto):
+                    // 协议不带端口时 --dport 会使整个事务失败，跳过该规则（POST /apply 时已拒绝此类策略）
+                    log.Printf("policy rule %d ignored for %s: protocol %q has no ports", i, key, proto)
+                    continue
+                case !needsPortSet(ports):
+                    args = append(args, portMatch(ports)...)
+                case portSets[i] != "":
+                    args = append(args, "-m", "set", "--match-set", portSets[i], "dst,dst")
+                default:
+                    // 端口数超出上限，未生成端口集合；不能放宽为不限端口
+                    log.Printf("policy rule %d ignored for %s: ports cannot be matched", i, key)
+                    continue
                 }
-            } else if r.Port > 0 {
-                log.Printf("policy rule ignored port without protocol for %s/%s", ns, name)
+            } else if len(ports) > 0 {
+                log.Printf("policy rule ignored port without protocol for %s", key)
             }
 
+            if action == "DROP" || action == "REJECT" {
+                rules = append(rules, deny.rules(args, action, comment)...)
+                continue
+            }
             args = append(args, "-j", action)
-            rules = append(rules, args)
+            rules = append(rules, tagRule(args, comment))
         }
     }
     return rules
 }
 
-// collectPeerIPs 将 DeploymentRef 列表展开为唯一的 Pod IP 列表。
-func collectPeerIPs(refs []DeploymentRef, depPodIPsAll map[DeploymentKey][]string) []string {
+// collectPeerIPs 将 DeploymentRef 列表展开为唯一的 Pod IP 列表（已排序，保证同步计划的内容稳定）。
+// 说明：
+// - depPodIPsAll 中每个 Pod 计入其归属链上的每一层工作负载（见 owners.go），对端引用任一层都能得到这些 Pod。
+// - 标签选择器对端按 peerKey 查找，ipBlock 对端不在其中（见 collectPeerNets）；subjectNs 为策略主体所在的命名空间（选择器对端未指定命名空间时使用）。
+func collectPeerIPs(refs []DeploymentRef, subjectNs string, depPodIPsAll map[WorkloadKey][]string) []string {
     uniq := map[string]struct{}{}
     for _, ref := range refs {
-        key := DeploymentKey{Namespace: ref.Namespace, Name: ref.Name}
-        for _, ip := range depPodIPsAll[key] {
+        if ref.IPBlock != nil {
+            continue
+        }
+        for _, ip := range depPodIPsAll[ref.peerKey(subjectNs)] {
             if strings.TrimSpace(ip) == "" {
                 continue
             }
@@ -137,16 +301,17 @@ func collectPeerIPs(refs []DeploymentRef, depPodIPsAll map[DeploymentKey][]strin
     for ip := range uniq {
         out = append(out, ip)
     }
+    sort.Strings(out)
     return out
 }
 
-// findDeploymentPolicy 查找匹配命名空间与名称的 DeploymentPolicy。
-func findDeploymentPolicy(policy *PolicyConfig, ns, name string) *DeploymentPolicy {
+// findDeploymentPolicy 查找主体为 key（类型、命名空间与名称均一致）的策略。
+func findDeploymentPolicy(policy *PolicyConfig, key WorkloadKey) *DeploymentPolicy {
     if policy == nil {
         return nil
     }
     for i := range policy.Deployments {
-        if policy.Deployments[i].Namespace == ns && policy.Deployments[i].Name == name {
+        if policy.Deployments[i].Key() == key {
             return &policy.Deployments[i]
         }
     }
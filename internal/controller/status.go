@@ -0,0 +1,51 @@
+package controller
+
+// Status 描述控制器的运行配置，供 GET /status 返回，便于排查规则"写入成功却不生效"一类问题。
+// 字段说明：
+// - NodeName: 控制器所在节点
+// - Hooks: 已挂载根链的内置链
+// - DryRun: 是否为观察模式（只计算同步计划，不修改规则）
+// - KillRevokedConnections: 撤销访问后是否删除已建立的连接（见 Options.Conntrack）
+// - Planes: 各地址族的数据面信息
+type Status struct {
+    NodeName               string        `json:"nodeName"`
+    Hooks                  []string      `json:"hooks"`
+    DryRun                 bool          `json:"dryRun"`
+    KillRevokedConnections bool          `json:"killRevokedConnections"`
+    Planes                 []PlaneStatus `json:"planes"`
+}
+
+// PlaneStatus 描述某一地址族的数据面。
+// 字段说明：
+// - Family: 地址族（ipv4/ipv6）
+// - Dataplane: 数据面名称（iptables 实现为实际调用的命令名，例如 iptables-nft）
+// - Mode: iptables 模式（legacy/nft/default）；数据面不区分模式（nftables）时为空
+type PlaneStatus struct {
+    Family    string `json:"family"`
+    Dataplane string `json:"dataplane"`
+    Mode      string `json:"mode,omitempty"`
+}
+
+// modeReporter 由区分 iptables 模式的数据面实现（iptables.Backend）提供。
+type modeReporter interface {
+    Mode() string
+}
+
+// Status 返回控制器当前的运行配置。
+func (c *Controller) Status() Status {
+    st := Status{
+        NodeName:               c.nodeName,
+        Hooks:                  append([]string{}, c.opts.Hooks...),
+        DryRun:                 c.opts.DryRun,
+        KillRevokedConnections: c.opts.Conntrack != nil,
+        Planes:                 []PlaneStatus{},
+    }
+    for _, pl := range c.planes {
+        ps := PlaneStatus{Family: string(pl.family), Dataplane: pl.dp.Name()}
+        if mr, ok := pl.dp.(modeReporter); ok {
+            ps.Mode = mr.Mode()
+        }
+        st.Planes = append(st.Planes, ps)
+    }
+    return st
+}
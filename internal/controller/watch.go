@@ -0,0 +1,478 @@
+package controller
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "reflect"
+    "strings"
+    "time"
+
+    corev1 "k8s.io/api/core/v1"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/client-go/informers"
+    "k8s.io/client-go/tools/cache"
+)
+
+// 事件驱动同步：
+// - Run 启动 Pod、ReplicaSet、Job、Deployment、StatefulSet、DaemonSet 与 Namespace 的共享 informer，同步时从本地缓存读取，不再周期性 List 全量对象。
+// - informer 事件沿 ownerReferences 换算为 Pod 归属链上受影响的工作负载（见 owners.go）放入限速工作队列；队列中积压的事件合并为一批处理。
+// - 一批事件只影响其它节点的 Pod 时（本节点的链内容不变），只同步引用了这些工作负载的白名单集合（SyncWorkloads）；
+//   标签选择器对端匹配的 Pod 或命名空间变化时，放入白名单引用了这些选择器的策略主体（见 peers.go），同样只同步集合；
+//   本节点的链内容有变化（本地 Pod 增减、IP 变化等）时执行全量同步：规则结构不变时在当前代中原地差分，只有结构变化才生成新一代规则。
+// - 启动后、策略更新后（RequestResync）以及每个 resync 周期执行一次全量同步，作为遗漏事件的兜底。
+
+// fullResyncKey 为工作队列中表示全量同步的元素。
+var fullResyncKey = WorkloadKey{}
+
+// Run 启动 informer 与工作队列，按事件同步本节点规则，直到 ctx 结束。
+// 说明：
+// - resync 为全量同步的周期（`-sync-interval`）；为 0 时只在启动与策略更新时执行全量同步。
+// - paused 返回 true 时停止（例如 cleanup 已开始）：正在执行的同步结束后关闭工作队列，之后的同步、只同步集合与回滚都不再修改数据面；为 nil 时不停止。
+//   除每批同步前检查外，另每 stopPollInterval 检查一次，队列空闲时也能及时停止；检查在持有 syncMu 时进行（见 stopLocked）。
+// - 同步失败的元素按限速器退避后重新入队。
+// 返回值：informer 缓存同步失败（ctx 结束）时返回错误，否则在 ctx 结束或停止后返回 nil；停止后返回时不再有同步在执行。
+func (c *Controller) Run(ctx context.Context, resync time.Duration, paused func() bool) error {
+    defer c.queue.ShutDown()
+    c.syncMu.Lock()
+    c.stop = paused
+    c.syncMu.Unlock()
+
+    factory := informers.NewSharedInformerFactory(c.client, 0)
+    podInformer := factory.Core().V1().Pods().Informer()
+    rsInformer := factory.Apps().V1().ReplicaSets().Informer()
+    jobInformer := factory.Batch().V1().Jobs().Informer()
+    nsInformer := factory.Core().V1().Namespaces().Informer()
+    controllerInformers := []cache.SharedIndexInformer{
+        factory.Apps().V1().Deployments().Informer(),
+        factory.Apps().V1().StatefulSets().Informer(),
+        factory.Apps().V1().DaemonSets().Informer(),
+    }
+    w := &workloads{
+        replicaSets: rsInformer.GetIndexer(),
+        jobs:        jobInformer.GetIndexer(),
+        pods:        podInformer.GetIndexer(),
+        namespaces:  nsInformer.GetIndexer(),
+    }
+    for _, informer := range controllerInformers {
+        w.controllers = append(w.controllers, informer.GetIndexer())
+    }
+
+    if _, err := podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+        AddFunc:    func(obj interface{}) { c.enqueuePod(w, obj) },
+        UpdateFunc: func(oldObj, newObj interface{}) { c.updatePod(w, oldObj, newObj) },
+        DeleteFunc: func(obj interface{}) { c.enqueuePod(w, obj) },
+    }); err != nil {
+        return fmt.Errorf("add pod event handler: %w", err)
+    }
+    // ReplicaSet 与 Job 为归属链的中间层：先于或晚于其 Pod 进入缓存、或被收养/释放时，借此重新归属这些 Pod
+    for _, owner := range []struct {
+        informer cache.SharedIndexInformer
+        kind     string
+    }{{rsInformer, KindReplicaSet}, {jobInformer, KindJob}} {
+        kind := owner.kind
+        if _, err := owner.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+            AddFunc:    func(obj interface{}) { c.enqueueOwner(w, kind, obj) },
+            UpdateFunc: func(oldObj, newObj interface{}) { c.updateOwner(w, kind, oldObj, newObj) },
+            DeleteFunc: func(obj interface{}) { c.enqueueOwner(w, kind, obj) },
+        }); err != nil {
+            return fmt.Errorf("add %s event handler: %w", strings.ToLower(kind), err)
+        }
+    }
+    if _, err := nsInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+        AddFunc:    c.enqueueNamespace,
+        UpdateFunc: c.updateNamespace,
+        DeleteFunc: c.enqueueNamespace,
+    }); err != nil {
+        return fmt.Errorf("add namespace event handler: %w", err)
+    }
+    for _, informer := range controllerInformers {
+        if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+            AddFunc:    c.enqueueWorkload,
+            UpdateFunc: c.updateWorkload,
+            DeleteFunc: c.enqueueWorkload,
+        }); err != nil {
+            return fmt.Errorf("add workload event handler: %w", err)
+        }
+    }
+
+    factory.Start(ctx.Done())
+    synced := []cache.InformerSynced{podInformer.HasSynced, rsInformer.HasSynced, jobInformer.HasSynced, nsInformer.HasSynced}
+    for _, informer := range controllerInformers {
+        synced = append(synced, informer.HasSynced)
+    }
+    if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+        return errors.New("wait for informer caches to sync")
+    }
+    c.syncMu.Lock()
+    c.workloads = w
+    c.syncMu.Unlock()
+    log.Printf("informer caches synced (resync interval %s)", resync)
+
+    // 缓存就绪后先执行一次全量同步；之后按周期执行全量同步兜底
+    c.RequestResync()
+    if resync > 0 {
+        go func() {
+            ticker := time.NewTicker(resync)
+            defer ticker.Stop()
+            for {
+                select {
+                case <-ticker.C:
+                    c.RequestResync()
+                case <-ctx.Done():
+                    return
+                }
+            }
+        }()
+    }
+    go func() {
+        <-ctx.Done()
+        c.queue.ShutDown()
+    }()
+    if paused != nil {
+        go func() {
+            ticker := time.NewTicker(stopPollInterval)
+            defer ticker.Stop()
+            for {
+                select {
+                case <-ticker.C:
+                    if c.halt() {
+                        return
+                    }
+                case <-ctx.Done():
+                    return
+                }
+            }
+        }()
+    }
+
+    for c.processNextBatch(ctx) {
+    }
+    return nil
+}
+
+// stopPollInterval 为 Run 在队列空闲时检查 paused 的间隔。
+const stopPollInterval = time.Second
+
+// halt 在持有 syncMu 时检查是否需要停止，见 stopLocked；正在执行的同步结束后才返回。
+func (c *Controller) halt() bool {
+    c.syncMu.Lock()
+    defer c.syncMu.Unlock()
+    return c.stopLocked()
+}
+
+// stopLocked 判断控制器是否已停止，调用方需持有 syncMu。
+// 说明：首次发现 Run 的 paused 返回 true 时记录停止并关闭工作队列，Run 随之返回；之后始终返回 true，不再调用 paused。
+// 同步与回滚在修改数据面前调用本函数，因此 cleanup 开始后不会再有跳转、链或集合被重新下发。
+func (c *Controller) stopLocked() bool {
+    if c.stopped {
+        return true
+    }
+    if c.stop == nil || !c.stop() {
+        return false
+    }
+    c.stopped = true
+    c.queue.ShutDown()
+    log.Printf("sync stopped, no further changes will be applied")
+    return true
+}
+
+// RequestResync 请求一次全量同步（例如策略更新后），由 Run 的工作队列异步执行；Run 未启动时等到启动后执行。
+func (c *Controller) RequestResync() {
+    c.queue.Add(fullResyncKey)
+}
+
+// processNextBatch 取出队列中当前积压的全部元素作为一批同步；队列关闭或控制器已停止时返回 false。
+// 说明：批中包含 fullResyncKey 时执行全量同步，否则只同步受影响的工作负载（SyncWorkloads）。
+func (c *Controller) processNextBatch(ctx context.Context) bool {
+    item, shutdown := c.queue.Get()
+    if shutdown {
+        return false
+    }
+    items := []interface{}{item}
+    // 只有一个消费者，Len() > 0 时 Get 不会阻塞
+    for c.queue.Len() > 0 {
+        next, shutdown := c.queue.Get()
+        if shutdown {
+            break
+        }
+        items = append(items, next)
+    }
+    defer func() {
+        for _, it := range items {
+            c.queue.Done(it)
+        }
+    }()
+
+    if c.halt() {
+        log.Printf("sync stopped, dropping %d queued items", len(items))
+        for _, it := range items {
+            c.queue.Forget(it)
+        }
+        return false
+    }
+
+    full := false
+    keys := []WorkloadKey{}
+    for _, it := range items {
+        key := it.(WorkloadKey)
+        if key == fullResyncKey {
+            full = true
+            continue
+        }
+        keys = append(keys, key)
+    }
+    var err error
+    if full {
+        err = c.Sync(ctx)
+    } else {
+        err = c.SyncWorkloads(ctx, keys)
+    }
+    if err != nil {
+        log.Printf("sync error: %v", err)
+        for _, it := range items {
+            c.queue.AddRateLimited(it)
+        }
+        return true
+    }
+    for _, it := range items {
+        c.queue.Forget(it)
+    }
+    return true
+}
+
+// SyncWorkloads 同步 keys 中的工作负载发生变化（Pod 增删、IP 或标签变化等）后受影响的规则。
+// 说明：
+// - 对每个地址族按当前代的代号重新生成代的链（只在内存中计算）；与上次下发的内容相同时本节点的链不变，
+//   只同步属于这些工作负载、或白名单引用了它们的集合，不读取、不改写任何链。
+// - 内容不同（本节点 Pod 变化等）、尚未按代下发、重启后尚未全量同步、处于回滚保持或观察模式时退化为全量同步（Sync）；
+//   全量同步只在规则结构变化时生成新代，否则在当前代中原地差分（见 planGenerations）。
+// - 开启 Options.Conntrack 时，只对同步过集合的工作负载计算并清理被撤销的连接。
+// - 集合同步失败时返回错误，由工作队列限速重试（见 applySets）。
+// - 只同步集合时不更新 GET /plan 返回的计划，计划反映最近一次全量同步。
+// - 控制器已停止（见 stopLocked）时直接返回。
+func (c *Controller) SyncWorkloads(ctx context.Context, keys []WorkloadKey) error {
+    c.syncMu.Lock()
+    defer c.syncMu.Unlock()
+    if c.stopLocked() {
+        return nil
+    }
+    if c.opts.DryRun || len(keys) == 0 {
+        return c.syncLocked(ctx)
+    }
+
+    policy := c.policyStore.Get()
+    depPodIPsAll, depPodIPsLocal, err := c.collectPodIPs(ctx, &policy)
+    if err != nil {
+        return err
+    }
+    changed := map[WorkloadKey]bool{}
+    for _, key := range keys {
+        changed[key] = true
+    }
+
+    var firstErr error
+    for _, pl := range c.planes {
+        fp := c.planSetsOnly(pl, &policy, depPodIPsAll[pl.family], depPodIPsLocal[pl.family])
+        if fp == nil {
+            log.Printf("sync: chains of %s/%s changed for %d workloads, running full sync", pl.dp.Name(), pl.family, len(keys))
+            return c.syncLocked(ctx)
+        }
+        if err := c.applySets(fp, &policy, changed); err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+    return firstErr
+}
+
+// planSetsOnly 按当前代的代号在内存中生成代的链与白名单集合；链的完整内容与上次下发的不同、或当前状态需要全量同步时返回 nil。
+// 说明：比较的是包含 Pod 与 rev 注释的完整内容（contentDigest），本地 Pod 变化时同样退化为全量同步，在当前代中原地差分。
+func (c *Controller) planSetsOnly(pl *plane, policy *PolicyConfig, depPodIPsAll map[WorkloadKey][]string, depPodIPsLocal map[WorkloadKey][]endpoint) *FamilyPlan {
+    gens := pl.gens
+    if !pl.registryRecovered || gens.active == 0 || gens.rejected != 0 || gens.content == "" {
+        return nil
+    }
+    fp := c.buildGeneration(pl, gens.active, policy, depPodIPsAll, depPodIPsLocal)
+    if contentDigest(fp.Chains) != gens.content {
+        return nil
+    }
+    return fp
+}
+
+// applySets 同步计划中受 changed 中工作负载影响的集合：集合属于这些工作负载，或所属工作负载的白名单（ingressFrom/egressTo）引用了它们。
+// 说明：集合同步失败时其余集合照常同步，返回第一个错误；该集合所属的工作负载不删除连接、也不更新记录的白名单
+// （被撤销的对端仍在现有集合中，见 applyFamily），等重试成功后再比较。
+func (c *Controller) applySets(fp *FamilyPlan, policy *PolicyConfig, changed map[WorkloadKey]bool) error {
+    pl := fp.plane
+    synced := map[WorkloadKey]bool{}
+    failed := map[WorkloadKey]bool{}
+    var firstErr error
+    count := 0
+    for _, set := range fp.IPSets {
+        owner := ownerKey(set.Owner)
+        if !changed[owner] && !referencesAny(findDeploymentPolicy(policy, owner), changed) {
+            continue
+        }
+        if err := syncSet(pl.dp, set); err != nil {
+            log.Printf("sync ipset %s: %v", set.Name, err)
+            failed[owner] = true
+            if firstErr == nil {
+                firstErr = fmt.Errorf("sync ipset %s: %w", set.Name, err)
+            }
+            continue
+        }
+        synced[owner] = true
+        count++
+    }
+
+    if c.opts.Conntrack != nil {
+        next := map[accessKey]accessState{}
+        for key, state := range fp.access {
+            if synced[key.Owner] && !failed[key.Owner] {
+                next[key] = state
+            }
+        }
+        c.killRevoked(pl, planRevocations(pl.access, next))
+        if pl.access != nil {
+            for key, state := range next {
+                pl.access[key] = state
+            }
+        }
+    }
+
+    log.Printf("sync completed for node %s via %s/%s (%d workloads changed, %d ipsets synced)", c.nodeName, pl.dp.Name(), pl.family, len(changed), count)
+    return firstErr
+}
+
+// ownerKey 将计划中的归属（见 WorkloadKey.String）还原为 WorkloadKey。
+func ownerKey(owner string) WorkloadKey {
+    key, _ := parseWorkloadKey(owner)
+    return key
+}
+
+// referencesAny 判断策略的白名单（ingressFrom/egressTo）是否引用了 keys 中的任一工作负载。
+func referencesAny(depPolicy *DeploymentPolicy, keys map[WorkloadKey]bool) bool {
+    if depPolicy == nil {
+        return false
+    }
+    for _, refs := range [][]DeploymentRef{depPolicy.IngressFrom, depPolicy.EgressTo} {
+        for _, ref := range refs {
+            if keys[ref.Key()] {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// enqueuePod 将 Pod 归属链上的全部工作负载放入工作队列；没有控制者且开启 Options.SelectorFallback 时按同一命名空间内的选择器匹配。
+// 白名单中有标签选择器匹配该 Pod 的策略主体也放入队列，以更新其白名单集合。
+func (c *Controller) enqueuePod(w *workloads, obj interface{}) {
+    pod, ok := podFromObject(obj)
+    if !ok {
+        return
+    }
+    keys := w.ownerChain(pod)
+    if len(keys) == 0 && c.opts.SelectorFallback {
+        keys = matchSelectors(w.selectors(pod.Namespace), pod)
+    }
+    policy := c.policyStore.Get()
+    keys = append(keys, w.selectorSubjects(&policy, pod)...)
+    for _, key := range keys {
+        c.queue.Add(key)
+    }
+}
+
+// updatePod 只在影响规则的字段（标签、地址、所在节点、hostNetwork、控制者，以及是否已结束，见 podActive）变化时处理更新事件；新旧 Pod 的归属链都受影响。
+func (c *Controller) updatePod(w *workloads, oldObj, newObj interface{}) {
+    oldPod, ok1 := podFromObject(oldObj)
+    newPod, ok2 := podFromObject(newObj)
+    if !ok1 || !ok2 {
+        return
+    }
+    if reflect.DeepEqual(oldPod.Labels, newPod.Labels) &&
+        reflect.DeepEqual(podIPs(oldPod), podIPs(newPod)) &&
+        podActive(oldPod) == podActive(newPod) &&
+        reflect.DeepEqual(metav1.GetControllerOfNoCopy(oldPod), metav1.GetControllerOfNoCopy(newPod)) &&
+        oldPod.Spec.NodeName == newPod.Spec.NodeName &&
+        oldPod.Spec.HostNetwork == newPod.Spec.HostNetwork {
+        return
+    }
+    c.enqueuePod(w, oldPod)
+    c.enqueuePod(w, newPod)
+}
+
+// enqueueOwner 将归属链中间层的对象（kind 为 ReplicaSet 或 Job）及其归属链上的工作负载放入工作队列。
+func (c *Controller) enqueueOwner(w *workloads, kind string, obj interface{}) {
+    owner, err := metaObject(obj)
+    if err != nil {
+        return
+    }
+    c.queue.Add(newWorkloadKey("", kind, owner.GetNamespace(), owner.GetName()))
+    for _, key := range w.ownerChain(owner) {
+        c.queue.Add(key)
+    }
+}
+
+// updateOwner 只在控制者变化（被收养或释放）时处理 ReplicaSet/Job 的更新事件；副本数、状态等变化由 Pod 事件体现。
+func (c *Controller) updateOwner(w *workloads, kind string, oldObj, newObj interface{}) {
+    oldOwner, err1 := metaObject(oldObj)
+    newOwner, err2 := metaObject(newObj)
+    if err1 != nil || err2 != nil || reflect.DeepEqual(metav1.GetControllerOfNoCopy(oldOwner), metav1.GetControllerOfNoCopy(newOwner)) {
+        return
+    }
+    c.enqueueOwner(w, kind, oldOwner)
+    c.enqueueOwner(w, kind, newOwner)
+}
+
+// enqueueNamespace 将白名单中 namespaceSelector 匹配新增或删除的命名空间的策略主体放入工作队列。
+func (c *Controller) enqueueNamespace(obj interface{}) {
+    ns, err := metaObject(obj)
+    if err != nil {
+        return
+    }
+    policy := c.policyStore.Get()
+    for _, key := range namespaceSubjects(&policy, ns.GetLabels()) {
+        c.queue.Add(key)
+    }
+}
+
+// updateNamespace 只在标签变化时处理命名空间的更新事件；namespaceSelector 匹配新旧标签之一的策略主体都受影响。
+func (c *Controller) updateNamespace(oldObj, newObj interface{}) {
+    oldNs, err1 := metaObject(oldObj)
+    newNs, err2 := metaObject(newObj)
+    if err1 != nil || err2 != nil || reflect.DeepEqual(oldNs.GetLabels(), newNs.GetLabels()) {
+        return
+    }
+    policy := c.policyStore.Get()
+    for _, key := range namespaceSubjects(&policy, oldNs.GetLabels(), newNs.GetLabels()) {
+        c.queue.Add(key)
+    }
+}
+
+// enqueueWorkload 将新增或删除的 Deployment、StatefulSet 或 DaemonSet 放入工作队列。
+func (c *Controller) enqueueWorkload(obj interface{}) {
+    if key, _, ok := workloadSelectorOf(obj); ok {
+        c.queue.Add(key)
+    }
+}
+
+// updateWorkload 只在选择器变化时处理更新事件（影响选择器回退的匹配；副本数、状态等变化不影响规则，由 Pod 事件体现）。
+func (c *Controller) updateWorkload(oldObj, newObj interface{}) {
+    _, oldSelector, ok1 := workloadSelectorOf(oldObj)
+    _, newSelector, ok2 := workloadSelectorOf(newObj)
+    if !ok1 || !ok2 || reflect.DeepEqual(oldSelector, newSelector) {
+        return
+    }
+    c.enqueueWorkload(newObj)
+}
+
+// podFromObject 从 informer 事件对象中取出 Pod（删除事件可能是 DeletedFinalStateUnknown）。
+func podFromObject(obj interface{}) (*corev1.Pod, bool) {
+    if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+        obj = tombstone.Obj
+    }
+    pod, ok := obj.(*corev1.Pod)
+    return pod, ok
+}
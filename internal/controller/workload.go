@@ -0,0 +1,156 @@
+package controller
+
+import (
+    "fmt"
+    "regexp"
+    "sort"
+    "strings"
+)
+
+// WorkloadKey 用于标识一个工作负载（API 组 + 类型 + 命名空间 + 名称），即策略的主体与白名单的对端。
+// 说明：
+// - 使用结构体避免对 "namespace/name" 字符串进行解析，减少匹配错误；由 newWorkloadKey 构造，Kind 与 Group 已归一化。
+// - 文本形式见 String：Deployment 为 "namespace/name"，与只支持 Deployment 的版本一致，升级后已下发的链、集合名称与注释不变。
+type WorkloadKey struct {
+    Group     string
+    Kind      string
+    Namespace string
+    Name      string
+}
+
+// 内置支持的工作负载类型及其 API 组。
+// 说明：策略中的 kind 按大小写不敏感匹配这些类型，apiGroup 为空时取表中的组；
+// 其它类型（例如 Argo Rollout、OpenKruise CloneSet）按 apiGroup + kind 原样使用，只沿 Pod 的 ownerReferences 解析（见 owners.go）。
+const (
+    KindDeployment  = "Deployment"
+    KindStatefulSet = "StatefulSet"
+    KindDaemonSet   = "DaemonSet"
+    KindReplicaSet  = "ReplicaSet"
+    KindJob         = "Job"
+    KindCronJob     = "CronJob"
+)
+
+var builtinKinds = map[string]string{
+    KindDeployment:  "apps",
+    KindStatefulSet: "apps",
+    KindDaemonSet:   "apps",
+    KindReplicaSet:  "apps",
+    KindJob:         "batch",
+    KindCronJob:     "batch",
+}
+
+// kindPattern / groupPattern 为策略中 kind 与 apiGroup 的合法形式（类型名为字母开头的字母数字；API 组为小写 DNS 名称，核心组为空）。
+var (
+    kindPattern  = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`)
+    groupPattern = regexp.MustCompile(`^([a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*)?$`)
+)
+
+// newWorkloadKey 返回归一化的 WorkloadKey：kind 为空时为 Deployment；内置类型的 kind 统一为标准写法，apiGroup 为空时取其所属的组。
+func newWorkloadKey(group, kind, ns, name string) WorkloadKey {
+    group, kind = strings.TrimSpace(group), strings.TrimSpace(kind)
+    if kind == "" {
+        kind = KindDeployment
+    }
+    for builtin, builtinGroup := range builtinKinds {
+        if strings.EqualFold(kind, builtin) && (group == "" || group == builtinGroup) {
+            kind, group = builtin, builtinGroup
+            break
+        }
+    }
+    return WorkloadKey{Group: group, Kind: kind, Namespace: ns, Name: name}
+}
+
+// validateWorkloadKind 校验策略中的 kind 与 apiGroup 的格式。
+func validateWorkloadKind(group, kind string) error {
+    if kind = strings.TrimSpace(kind); kind != "" && !kindPattern.MatchString(kind) {
+        return fmt.Errorf("invalid kind %q", kind)
+    }
+    if group = strings.TrimSpace(group); !groupPattern.MatchString(group) {
+        return fmt.Errorf("invalid apiGroup %q", group)
+    }
+    return nil
+}
+
+// isDeployment 判断工作负载是否为 Deployment。
+func (k WorkloadKey) isDeployment() bool {
+    return k.Kind == KindDeployment && k.Group == builtinKinds[KindDeployment]
+}
+
+// qualifiedName 返回不含命名空间的部分：Deployment 为 "name"，其它内置类型为 "Kind/name"，
+// 其它类型为 "Kind.group/name"（核心组为 "Kind/name"）。
+// 说明：链名、集合名与日志前缀的哈希按 "namespace/" + qualifiedName 计算，不同类型的同名工作负载不会重名。
+func (k WorkloadKey) qualifiedName() string {
+    switch {
+    case k.isDeployment():
+        return k.Name
+    case k.Group == "" || builtinKinds[k.Kind] == k.Group:
+        return k.Kind + "/" + k.Name
+    default:
+        return k.Kind + "." + k.Group + "/" + k.Name
+    }
+}
+
+// String 返回 "namespace/" + qualifiedName 形式的文本，用于规则注释、计划中的归属与日志，可由 parseWorkloadKey 还原。
+func (k WorkloadKey) String() string {
+    return k.Namespace + "/" + k.qualifiedName()
+}
+
+// less 按命名空间、名称、类型、API 组排序（只有 Deployment 时与按 namespace/name 排序一致）。
+func (k WorkloadKey) less(o WorkloadKey) bool {
+    if k.Namespace != o.Namespace {
+        return k.Namespace < o.Namespace
+    }
+    if k.Name != o.Name {
+        return k.Name < o.Name
+    }
+    if k.Kind != o.Kind {
+        return k.Kind < o.Kind
+    }
+    return k.Group < o.Group
+}
+
+// parseWorkloadKey 解析 WorkloadKey.String 生成的文本；格式不正确时返回 false。
+func parseWorkloadKey(text string) (WorkloadKey, bool) {
+    parts := strings.Split(text, "/")
+    for _, p := range parts {
+        if p == "" {
+            return WorkloadKey{}, false
+        }
+    }
+    switch len(parts) {
+    case 2:
+        return newWorkloadKey("", KindDeployment, parts[0], parts[1]), true
+    case 3:
+        kind, group, qualified := strings.Cut(parts[1], ".")
+        if !qualified {
+            group = builtinKinds[kind]
+        }
+        return WorkloadKey{Group: group, Kind: kind, Namespace: parts[0], Name: parts[2]}, true
+    default:
+        return WorkloadKey{}, false
+    }
+}
+
+// Key 返回策略主体的 WorkloadKey。
+func (dp DeploymentPolicy) Key() WorkloadKey {
+    return newWorkloadKey(dp.APIGroup, dp.Kind, dp.Namespace, dp.Name)
+}
+
+// Key 返回白名单对端的 WorkloadKey。
+func (ref DeploymentRef) Key() WorkloadKey {
+    return newWorkloadKey(ref.APIGroup, ref.Kind, ref.Namespace, ref.Name)
+}
+
+// sortWorkloadKeys 按 WorkloadKey.less 排序。
+func sortWorkloadKeys(keys []WorkloadKey) {
+    sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+}
+
+// formatWorkloadKeys 返回 "ns/a, ns/StatefulSet/b" 形式的列表，用于日志。
+func formatWorkloadKeys(keys []WorkloadKey) string {
+    items := make([]string, 0, len(keys))
+    for _, key := range keys {
+        items = append(items, key.String())
+    }
+    return strings.Join(items, ", ")
+}
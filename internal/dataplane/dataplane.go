@@ -0,0 +1,199 @@
+package dataplane
+
+import (
+    "fmt"
+    "net"
+    "strconv"
+    "strings"
+)
+
+// ChainRules 描述一条自定义链的期望内容。
+// 字段说明：
+// - Chain: 链名
+// - Rules: 链内规则，每条规则为追加到链时的 iptables 风格参数（不包含 -A chain 部分），
+//   例如 {"-m", "set", "--match-set", "MS-SRC-X", "src", "-d", "10.0.0.5", "-j", "ACCEPT"}。
+//   各实现负责把该形式翻译为自身的规则语法。
+type ChainRules struct {
+    Chain string
+    Rules [][]string
+}
+
+// Dataplane 是策略下发的数据面抽象，覆盖链、跳转、规则与 IP 集合四类操作。
+// 说明：
+// - 控制器只依赖该接口，不直接调用 iptables/ipset/nft 命令，便于在不同发行版上切换实现。
+// - 现有实现：iptables（iptables + ipset）与 nftables（独立 inet 表 + 命名集合）。
+type Dataplane interface {
+    // Name 返回实现名称（用于日志），例如 "iptables"、"nftables"。
+    Name() string
+    // EnsureChain 确保自定义链存在；若不存在则创建。
+    EnsureChain(chain string) error
+    // EnsureJumps 确保内置入口 hook（HookForward/HookOutput/HookInput）中按 rootChains 的顺序连续跳转到各根链，位置由 position 决定（见 ValidateJumpPosition）。
+    // 说明：已在正确位置时不做任何写操作；位置不对时先在目标位置插入新跳转、再删除旧跳转（同一事务内完成），不会出现跳转缺失的窗口。
+    EnsureJumps(hook string, rootChains []string, position string) error
+    // RemoveJumps 删除内置入口 hook 中跳转到 chains 中任一链的全部规则，返回被删除跳转的目标（按规则顺序）；没有这些跳转时不做写操作。
+    // 说明：nftables 实现删除本表中与 hook 对应的基础链（其中只有本程序的跳转）。
+    RemoveJumps(hook string, chains []string) (removed []string, err error)
+    // SyncChains 将多条链同步为期望内容，返回内容确实发生变化的链名；无差异时不产生写操作。
+    SyncChains(chains []ChainRules) (changed []string, err error)
+    // EnsureIPSet 确保 IP 集合存在；若不存在则创建。
+    EnsureIPSet(setName string) error
+    // SyncIPSet 将 IP 集合的成员替换为给定的 IP 列表。
+    SyncIPSet(setName string, ips []string) error
+    // SyncIPPortSet 将“IP + 协议端口”集合（ipset hash:ip,port）的成员替换为给定的列表，集合不存在时创建。
+    // 说明：成员形如 "10.0.0.5,tcp:80"（见 IPPortMember），规则中以 `-m set --match-set <name> dst,dst` 匹配目的地址与目的端口。
+    SyncIPPortSet(setName string, members []string) error
+    // SyncNetSet 将网段集合（ipset hash:net）的成员替换为给定的列表，集合不存在时创建。
+    // 说明：成员形如 "10.0.0.0/8" 或 "10.1.0.0/16 nomatch"（见 NetMember）；地址按最长前缀匹配，命中 nomatch 成员的地址不属于集合，
+    // 规则中与白名单集合一样以 `-m set --match-set <name> src|dst` 匹配。
+    SyncNetSet(setName string, members []string) error
+    // ListRules 返回链当前的规则，形式与 ChainRules.Rules 相同（用于从规则注释恢复归属关系）。
+    // 说明：nftables 实现只还原注释、集合引用与跳转目标等用于归属识别的部分。
+    ListRules(chain string) ([][]string, error)
+    // ListChains 返回名称以 prefix 开头的全部自定义链。
+    ListChains(prefix string) ([]string, error)
+    // DeleteChains 删除给定的链：先移除其它链中指向它们的跳转，再清空，最后删除（同一事务内完成）。
+    DeleteChains(chains []string) error
+    // ListIPSets 返回名称以 prefix 开头的全部 IP 集合。
+    ListIPSets(prefix string) ([]string, error)
+    // DestroyIPSet 销毁 IP 集合；调用前引用该集合的规则必须已被删除。
+    DestroyIPSet(setName string) error
+    // ListCounters 返回各链中每条规则的匹配计数（按规则在链中的顺序）；不存在的链不出现在结果中。
+    ListCounters(chains []string) (map[string][]RuleCounter, error)
+    // ResetCounters 将各链中全部规则的匹配计数清零；不存在的链被忽略。
+    ResetCounters(chains []string) error
+}
+
+// IPPortMember 返回“IP + 协议端口”集合的成员写法（与 `ipset save` 的输出一致），例如 "10.0.0.5,tcp:80"。
+func IPPortMember(ip, proto string, port int) string {
+    return ip + "," + strings.ToLower(proto) + ":" + strconv.Itoa(port)
+}
+
+// ParseIPPortMember 解析 IPPortMember 生成的成员；格式不正确时返回 false。
+func ParseIPPortMember(member string) (ip, proto string, port int, ok bool) {
+    i := strings.LastIndex(member, ",")
+    if i < 0 {
+        return "", "", 0, false
+    }
+    ip = member[:i]
+    proto, portText, found := strings.Cut(member[i+1:], ":")
+    if !found || ip == "" || proto == "" {
+        return "", "", 0, false
+    }
+    port, err := strconv.Atoi(portText)
+    if err != nil || port < 0 || port > 65535 {
+        return "", "", 0, false
+    }
+    return ip, proto, port, true
+}
+
+// RuleCounter 为一条规则及其自上次清零以来的匹配计数。
+// 字段说明：
+// - Rule: 规则参数，形式与 ChainRules.Rules 相同（nftables 实现只还原用于归属识别的部分，见 ListRules）
+// - Packets / Bytes: 命中的报文数与字节数
+type RuleCounter struct {
+    Rule    []string
+    Packets uint64
+    Bytes   uint64
+}
+
+// 根链可挂载的内置入口（filter 表的内置链；nftables 中对应同名 hook 的基础链）。
+// - HookForward: 经节点转发的流量（Pod 与 Pod、跨节点流量）。
+// - HookOutput: 节点自身（宿主机进程、hostNetwork Pod、kubelet）发往本节点 Pod 的流量。
+// - HookInput: 发往本节点地址的流量，即访问 hostNetwork 工作负载的流量。
+const (
+    HookForward = "FORWARD"
+    HookOutput  = "OUTPUT"
+    HookInput   = "INPUT"
+)
+
+// 根链跳转在内置链中的位置（FORWARD_JUMP_POSITION）。
+// - JumpInsert: 放在链首，优先于其它所有规则。
+// - JumpAppend: 放在链尾，对 CNI 影响最小，但会被前面的 ACCEPT 短路。
+// - JumpBefore + <链名>: 紧挨在第一条跳转到该链的规则之前，例如 "before:cali-FORWARD"；
+//   链名以 `*` 结尾时按前缀匹配（"before:cali-*" 对 FORWARD/OUTPUT/INPUT 分别对应 cali-FORWARD/cali-OUTPUT/cali-INPUT）。
+//   内置链中不存在该跳转时退化为链首。
+const (
+    JumpInsert = "insert"
+    JumpAppend = "append"
+    JumpBefore = "before:"
+)
+
+// ValidateJumpPosition 校验跳转位置的写法。
+func ValidateJumpPosition(position string) error {
+    switch {
+    case position == JumpInsert || position == JumpAppend:
+        return nil
+    case strings.HasPrefix(position, JumpBefore) && strings.TrimPrefix(position, JumpBefore) != "":
+        return nil
+    default:
+        return fmt.Errorf("unknown jump position %q (expected insert, append or before:<chain>)", position)
+    }
+}
+
+// AnchorIndex 返回根链跳转应放置的位置：targets 为内置链中除本程序跳转以外的各规则的跳转目标（按顺序，无目标为空字符串），
+// 返回值为跳转组之前应保留的规则数量（0 表示链首，len(targets) 表示链尾）。
+func AnchorIndex(targets []string, position string) int {
+    if position == JumpAppend {
+        return len(targets)
+    }
+    anchor := strings.TrimPrefix(position, JumpBefore)
+    if anchor == position {
+        return 0
+    }
+    for i, t := range targets {
+        if MatchAnchor(anchor, t) {
+            return i
+        }
+    }
+    return 0
+}
+
+// MatchAnchor 判断跳转目标 target 是否匹配锚点链名 anchor（anchor 以 `*` 结尾时按前缀匹配）。
+func MatchAnchor(anchor, target string) bool {
+    if target == "" {
+        return false
+    }
+    if strings.HasSuffix(anchor, "*") {
+        return strings.HasPrefix(target, strings.TrimSuffix(anchor, "*"))
+    }
+    return target == anchor
+}
+
+// Executor 抽象外部命令的执行（iptables、ipset、nft 等）。
+// 说明：数据面实现只通过该接口执行命令，测试时可注入 fake 执行器记录命令或对指定命令注入失败，
+// 从而无需 root 权限与真实 iptables 即可驱动完整同步流程。
+type Executor interface {
+    // Run 执行命令并返回去除首尾空白的 stdout；失败时错误中包含 stderr。
+    Run(name string, args ...string) (string, error)
+    // RunWithInput 与 Run 相同，但把 input 写入命令的 stdin（用于 iptables-restore、nft -f - 等）。
+    RunWithInput(input, name string, args ...string) (string, error)
+}
+
+// Family 表示数据面实例处理的地址族。
+// 说明：iptables 与 ip6tables 的链、ipset 的 inet 与 inet6 集合彼此独立，控制器为每个地址族各持有一个数据面实例，
+// 并在每次同步中对它们下发同一套（按地址族拆分的）期望状态。
+type Family string
+
+const (
+    // IPv4 对应 iptables / `family inet` 的 ipset / nft 的 ipv4_addr 集合。
+    IPv4 Family = "ipv4"
+    // IPv6 对应 ip6tables / `family inet6` 的 ipset / nft 的 ipv6_addr 集合。
+    IPv6 Family = "ipv6"
+)
+
+// FamilyOf 返回 IP 地址或 CIDR 所属的地址族；无法解析时返回 false。
+func FamilyOf(addr string) (Family, bool) {
+    addr = strings.TrimSpace(addr)
+    ip := net.ParseIP(addr)
+    if ip == nil {
+        parsed, _, err := net.ParseCIDR(addr)
+        if err != nil {
+            return "", false
+        }
+        ip = parsed
+    }
+    if ip.To4() != nil {
+        return IPv4, true
+    }
+    return IPv6, true
+}
@@ -0,0 +1,82 @@
+package fake
+
+import (
+    "strings"
+    "sync"
+)
+
+// Executor 是 dataplane.Executor 的 fake 实现，用于在不具备 root 权限的环境中测试 iptables/nftables 实现。
+// 行为：
+// - 记录每次执行的命令行（Commands）与 stdin（Inputs，与 Commands 一一对应）。
+// - 通过 Respond 为以指定前缀开头的命令设置 stdout。
+// - 通过 FailOn 让以指定前缀开头的命令返回错误（例如 "iptables-restore" 或 "ipset swap"）。
+type Executor struct {
+    mu sync.Mutex
+
+    Commands []string
+    Inputs   []string
+
+    outputs  map[string]string
+    failures map[string]error
+}
+
+// NewExecutor 创建 fake 执行器。
+func NewExecutor() *Executor {
+    return &Executor{outputs: map[string]string{}, failures: map[string]error{}}
+}
+
+// Respond 为以 prefix 开头的命令设置返回的 stdout。
+func (e *Executor) Respond(prefix, output string) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    e.outputs[prefix] = output
+}
+
+// FailOn 让以 prefix 开头的命令返回 err。
+func (e *Executor) FailOn(prefix string, err error) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    e.failures[prefix] = err
+}
+
+// Run 记录命令并返回预设结果。
+func (e *Executor) Run(name string, args ...string) (string, error) {
+    return e.RunWithInput("", name, args...)
+}
+
+// RunWithInput 记录命令及其 stdin 并返回预设结果；多个前缀同时匹配时取最长者。
+func (e *Executor) RunWithInput(input, name string, args ...string) (string, error) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    line := strings.Join(append([]string{name}, args...), " ")
+    e.Commands = append(e.Commands, line)
+    e.Inputs = append(e.Inputs, input)
+
+    if prefix, ok := longestPrefix(line, keysOf(e.failures)); ok {
+        return "", e.failures[prefix]
+    }
+    if prefix, ok := longestPrefix(line, keysOf(e.outputs)); ok {
+        return e.outputs[prefix], nil
+    }
+    return "", nil
+}
+
+// longestPrefix 返回 prefixes 中与 line 匹配的最长前缀。
+func longestPrefix(line string, prefixes []string) (string, bool) {
+    best, found := "", false
+    for _, p := range prefixes {
+        if strings.HasPrefix(line, p) && (!found || len(p) > len(best)) {
+            best, found = p, true
+        }
+    }
+    return best, found
+}
+
+// keysOf 返回 map 的全部键。
+func keysOf[V any](m map[string]V) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    return keys
+}
@@ -0,0 +1,431 @@
+package fake
+
+import (
+    "fmt"
+    "reflect"
+    "sort"
+    "strings"
+    "sync"
+
+    "github.com/example/iptables-controller/internal/dataplane"
+)
+
+// FilterTable 为 fake 数据面中规则所在的表名（与真实实现一致，只使用 filter 表）。
+const FilterTable = "filter"
+
+// ForwardHook 为默认的根链跳转挂载点。
+const ForwardHook = dataplane.HookForward
+
+// Table 表示内存中的一张表：链名 -> 规则列表（iptables 风格参数）。
+type Table struct {
+    Chains map[string][][]string
+}
+
+// Dataplane 是 dataplane.Dataplane 的内存实现，用于在 go test 中驱动完整同步流程。
+// 模型说明：
+// - Tables: 表 -> 链 -> 规则；所有链操作都落在 FilterTable。
+// - Jumps: 内置链（FORWARD/OUTPUT/INPUT）-> 按顺序排列的跳转目标链。
+// - Sets: IP 集合 -> 成员（已排序）。
+// - Calls: 按调用顺序记录的操作（包括只读操作），格式为 "<操作> <对象>"。
+// - Writes: 按调用顺序记录确实改变了状态的操作，格式同 Calls；内容未变的同步、已存在的链与集合不记录，
+//   对应真实实现中会执行写命令的调用，便于断言同步是否为空操作。
+// - Counters: 链 -> 各规则的报文计数（下标与规则顺序一致），测试中直接赋值模拟流量命中；字节数按每个报文 100 字节计算。
+// 通过 FailOn 可对指定操作/对象注入失败，验证控制器的错误处理路径。
+type Dataplane struct {
+    mu sync.Mutex
+
+    Tables map[string]*Table
+    Jumps  map[string][]string
+    Sets   map[string][]string
+    Calls  []string
+    Writes []string
+
+    Counters map[string][]uint64
+
+    failures map[string]error
+}
+
+// NewDataplane 创建一个空的内存数据面。
+func NewDataplane() *Dataplane {
+    return &Dataplane{
+        Tables:   map[string]*Table{FilterTable: {Chains: map[string][][]string{}}},
+        Jumps:    map[string][]string{},
+        Counters: map[string][]uint64{},
+        Sets:     map[string][]string{},
+        failures: map[string]error{},
+    }
+}
+
+// FailOn 让之后对 object 执行 op 时返回 err；object 为空表示该操作全部失败，err 为 nil 时取消此前的注入。
+// op 取值为接口方法名，例如 "EnsureChain"、"EnsureJumps"、"RemoveJumps"、"SyncChains"、"SyncIPSet"、"SyncIPPortSet"、"SyncNetSet"、"DeleteChains"、"DestroyIPSet"；RemoveJumps 的对象为内置链名。
+func (d *Dataplane) FailOn(op, object string, err error) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if err == nil {
+        delete(d.failures, op+" "+object)
+        return
+    }
+    d.failures[op+" "+object] = err
+}
+
+// Name 返回实现名称。
+func (d *Dataplane) Name() string { return "fake" }
+
+// EnsureChain 确保链存在。
+func (d *Dataplane) EnsureChain(chain string) error {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if err := d.record("EnsureChain", chain); err != nil {
+        return err
+    }
+    if _, ok := d.Tables[FilterTable].Chains[chain]; !ok {
+        d.wrote("EnsureChain", chain)
+    }
+    d.ensureChain(chain)
+    return nil
+}
+
+// EnsureJumps 确保 hook 中按顺序连续跳转到 rootChains，位置语义与真实实现相同（insert/append/before:<链名>）。
+// 说明：Jumps[hook] 中不属于 rootChains 的条目视为其它组件（例如 Calico）的跳转，用于驱动 before:<链名> 的定位。
+func (d *Dataplane) EnsureJumps(hook string, rootChains []string, position string) error {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    ours := map[string]bool{}
+    for _, c := range rootChains {
+        if err := d.record("EnsureJumps", c); err != nil {
+            return err
+        }
+        if _, ok := d.Tables[FilterTable].Chains[c]; !ok {
+            return fmt.Errorf("jump target %s does not exist", c)
+        }
+        ours[c] = true
+    }
+    others := []string{}
+    for _, j := range d.Jumps[hook] {
+        if !ours[j] {
+            others = append(others, j)
+        }
+    }
+    at := dataplane.AnchorIndex(others, position)
+    jumps := append([]string{}, others[:at]...)
+    jumps = append(jumps, rootChains...)
+    jumps = append(jumps, others[at:]...)
+    if !reflect.DeepEqual(jumps, d.Jumps[hook]) {
+        d.wrote("EnsureJumps", hook)
+    }
+    d.Jumps[hook] = jumps
+    return nil
+}
+
+// RemoveJumps 从 Jumps[hook] 中移除指向 chains 的跳转，其它组件的跳转保持原有顺序。
+func (d *Dataplane) RemoveJumps(hook string, chains []string) ([]string, error) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if err := d.record("RemoveJumps", hook); err != nil {
+        return nil, err
+    }
+    doomed := map[string]bool{}
+    for _, c := range chains {
+        doomed[c] = true
+    }
+    removed := []string{}
+    kept := []string{}
+    for _, j := range d.Jumps[hook] {
+        if doomed[j] {
+            removed = append(removed, j)
+            continue
+        }
+        kept = append(kept, j)
+    }
+    if len(removed) > 0 {
+        d.wrote("RemoveJumps", hook)
+    }
+    d.Jumps[hook] = kept
+    return removed, nil
+}
+
+// SyncChains 将链替换为期望内容，只返回内容确实变化的链；任意链被注入失败时整体不生效（模拟事务）。
+func (d *Dataplane) SyncChains(chains []dataplane.ChainRules) ([]string, error) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    for _, c := range chains {
+        if err := d.record("SyncChains", c.Chain); err != nil {
+            return nil, err
+        }
+    }
+    table := d.Tables[FilterTable]
+    changed := []string{}
+    for _, c := range chains {
+        existing, ok := table.Chains[c.Chain]
+        if ok && reflect.DeepEqual(existing, c.Rules) {
+            continue
+        }
+        changed = append(changed, c.Chain)
+        d.wrote("SyncChains", c.Chain)
+    }
+    for _, c := range chains {
+        table.Chains[c.Chain] = copyRules(c.Rules)
+    }
+    return changed, nil
+}
+
+// EnsureIPSet 确保集合存在。
+func (d *Dataplane) EnsureIPSet(setName string) error {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if err := d.record("EnsureIPSet", setName); err != nil {
+        return err
+    }
+    if _, ok := d.Sets[setName]; !ok {
+        d.wrote("EnsureIPSet", setName)
+        d.Sets[setName] = []string{}
+    }
+    return nil
+}
+
+// SyncIPSet 替换集合成员（去重、去空白并排序）。
+func (d *Dataplane) SyncIPSet(setName string, ips []string) error {
+    return d.syncSet("SyncIPSet", setName, ips)
+}
+
+// SyncIPPortSet 替换“IP + 协议端口”集合的成员，与 SyncIPSet 共用 Sets（成员形如 "10.0.0.5,tcp:80"）。
+func (d *Dataplane) SyncIPPortSet(setName string, members []string) error {
+    return d.syncSet("SyncIPPortSet", setName, members)
+}
+
+// SyncNetSet 替换网段集合的成员，与 SyncIPSet 共用 Sets（成员形如 "10.0.0.0/8"、"10.1.0.0/16 nomatch"）。
+func (d *Dataplane) SyncNetSet(setName string, members []string) error {
+    return d.syncSet("SyncNetSet", setName, members)
+}
+
+// syncSet 记录操作 op 并替换集合成员（去重、去空白并排序）。
+func (d *Dataplane) syncSet(op, setName string, ips []string) error {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if err := d.record(op, setName); err != nil {
+        return err
+    }
+    uniq := map[string]struct{}{}
+    for _, ip := range ips {
+        if ip = strings.TrimSpace(ip); ip != "" {
+            uniq[ip] = struct{}{}
+        }
+    }
+    members := make([]string, 0, len(uniq))
+    for ip := range uniq {
+        members = append(members, ip)
+    }
+    sort.Strings(members)
+    if existing, ok := d.Sets[setName]; !ok || !reflect.DeepEqual(existing, members) {
+        d.wrote(op, setName)
+    }
+    d.Sets[setName] = members
+    return nil
+}
+
+// Rules 返回指定链当前的规则副本；链不存在时第二个返回值为 false。
+func (d *Dataplane) Rules(chain string) ([][]string, bool) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    rules, ok := d.Tables[FilterTable].Chains[chain]
+    return copyRules(rules), ok
+}
+
+// record 记录一次调用，并返回为该调用注入的失败（若有）。调用方需持有锁。
+func (d *Dataplane) record(op, object string) error {
+    d.Calls = append(d.Calls, op+" "+object)
+    if err, ok := d.failures[op+" "+object]; ok {
+        return err
+    }
+    if err, ok := d.failures[op+" "]; ok {
+        return err
+    }
+    return nil
+}
+
+// wrote 记录一次改变了状态的操作。调用方需持有锁。
+func (d *Dataplane) wrote(op, object string) {
+    d.Writes = append(d.Writes, op+" "+object)
+}
+
+// ensureChain 在 filter 表中创建空链（若不存在）。调用方需持有锁。
+func (d *Dataplane) ensureChain(chain string) {
+    table := d.Tables[FilterTable]
+    if _, ok := table.Chains[chain]; !ok {
+        table.Chains[chain] = [][]string{}
+    }
+}
+
+// copyRules 深拷贝规则，避免调用方修改内部状态。
+func copyRules(rules [][]string) [][]string {
+    out := make([][]string, 0, len(rules))
+    for _, r := range rules {
+        out = append(out, append([]string(nil), r...))
+    }
+    return out
+}
+
+// ListChains 返回 filter 表中名称以 prefix 开头的链（已排序）。
+func (d *Dataplane) ListChains(prefix string) ([]string, error) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if err := d.record("ListChains", prefix); err != nil {
+        return nil, err
+    }
+    out := []string{}
+    for name := range d.Tables[FilterTable].Chains {
+        if strings.HasPrefix(name, prefix) {
+            out = append(out, name)
+        }
+    }
+    sort.Strings(out)
+    return out, nil
+}
+
+// DeleteChains 删除链：先移除其它链与 Jumps 中指向它们的跳转，再删除链本身。
+func (d *Dataplane) DeleteChains(chains []string) error {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    doomed := map[string]bool{}
+    for _, c := range chains {
+        if err := d.record("DeleteChains", c); err != nil {
+            return err
+        }
+        doomed[c] = true
+    }
+    table := d.Tables[FilterTable]
+    for name, rules := range table.Chains {
+        kept := [][]string{}
+        for _, r := range rules {
+            if len(r) >= 2 && r[len(r)-2] == "-j" && doomed[r[len(r)-1]] {
+                continue
+            }
+            kept = append(kept, r)
+        }
+        table.Chains[name] = kept
+    }
+    for hook, jumps := range d.Jumps {
+        kept := []string{}
+        for _, j := range jumps {
+            if !doomed[j] {
+                kept = append(kept, j)
+            }
+        }
+        d.Jumps[hook] = kept
+    }
+    for _, c := range chains {
+        if _, ok := table.Chains[c]; ok {
+            d.wrote("DeleteChains", c)
+        }
+    }
+    for c := range doomed {
+        delete(table.Chains, c)
+    }
+    return nil
+}
+
+// ListIPSets 返回名称以 prefix 开头的集合（已排序）。
+func (d *Dataplane) ListIPSets(prefix string) ([]string, error) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if err := d.record("ListIPSets", prefix); err != nil {
+        return nil, err
+    }
+    out := []string{}
+    for name := range d.Sets {
+        if strings.HasPrefix(name, prefix) {
+            out = append(out, name)
+        }
+    }
+    sort.Strings(out)
+    return out, nil
+}
+
+// DestroyIPSet 删除集合；若仍有规则引用该集合则返回错误（与 ipset 行为一致）。
+func (d *Dataplane) DestroyIPSet(setName string) error {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if err := d.record("DestroyIPSet", setName); err != nil {
+        return err
+    }
+    for chain, rules := range d.Tables[FilterTable].Chains {
+        for _, r := range rules {
+            for _, arg := range r {
+                if arg == setName {
+                    return fmt.Errorf("set %s is in use by chain %s", setName, chain)
+                }
+            }
+        }
+    }
+    if _, ok := d.Sets[setName]; ok {
+        d.wrote("DestroyIPSet", setName)
+    }
+    delete(d.Sets, setName)
+    return nil
+}
+
+// ListRules 返回链当前的规则副本；链不存在时返回错误。
+func (d *Dataplane) ListRules(chain string) ([][]string, error) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if err := d.record("ListRules", chain); err != nil {
+        return nil, err
+    }
+    rules, ok := d.Tables[FilterTable].Chains[chain]
+    if !ok {
+        // 内置链：以 Jumps 中的跳转目标构造规则
+        jumps, ok := d.Jumps[chain]
+        if !ok {
+            return nil, fmt.Errorf("chain %s does not exist", chain)
+        }
+        out := make([][]string, 0, len(jumps))
+        for _, j := range jumps {
+            out = append(out, []string{"-j", j})
+        }
+        return out, nil
+    }
+    return copyRules(rules), nil
+}
+
+// ListCounters 返回各链规则及 Counters 中预置的计数；未预置的规则计数为 0。
+func (d *Dataplane) ListCounters(chains []string) (map[string][]dataplane.RuleCounter, error) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    result := map[string][]dataplane.RuleCounter{}
+    for _, chain := range chains {
+        if err := d.record("ListCounters", chain); err != nil {
+            return nil, err
+        }
+        rules, ok := d.Tables[FilterTable].Chains[chain]
+        if !ok {
+            continue
+        }
+        counters := make([]dataplane.RuleCounter, 0, len(rules))
+        for i, r := range copyRules(rules) {
+            rc := dataplane.RuleCounter{Rule: r}
+            if i < len(d.Counters[chain]) {
+                rc.Packets = d.Counters[chain][i]
+                rc.Bytes = rc.Packets * 100
+            }
+            counters = append(counters, rc)
+        }
+        result[chain] = counters
+    }
+    return result, nil
+}
+
+// ResetCounters 清除各链在 Counters 中的计数。
+func (d *Dataplane) ResetCounters(chains []string) error {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    for _, chain := range chains {
+        if err := d.record("ResetCounters", chain); err != nil {
+            return err
+        }
+        if _, ok := d.Counters[chain]; ok {
+            d.wrote("ResetCounters", chain)
+        }
+        delete(d.Counters, chain)
+    }
+    return nil
+}
@@ -0,0 +1,259 @@
+package dataplane
+
+import (
+    "fmt"
+    "net/netip"
+    "sort"
+    "strings"
+)
+
+// 网段集合（ipset hash:net）：
+// - 成员为网段，可带 nomatch；地址是否属于集合由包含它的最长成员决定，该成员带 nomatch 时不属于集合。
+// - 控制器先求出期望的地址范围（见 AddrRange），再由 NetMembers 编码为成员；nftables 没有 nomatch，由 NetRanges 把成员还原为区间写入区间集合。
+
+// NetMember 返回网段集合的成员写法（与 `ipset save` 的输出一致）：网段按掩码对齐，单个地址（/32、/128）省略前缀长度，
+// nomatch 为 true 时追加 " nomatch"。例如 "10.0.0.0/8"、"10.0.0.5"、"10.1.0.0/16 nomatch"。
+func NetMember(prefix netip.Prefix, nomatch bool) string {
+    prefix = prefix.Masked()
+    text := prefix.String()
+    if prefix.IsSingleIP() {
+        text = prefix.Addr().String()
+    }
+    if nomatch {
+        text += " nomatch"
+    }
+    return text
+}
+
+// ParseNetMember 解析 NetMember 生成的成员；格式不正确时返回 false。
+func ParseNetMember(member string) (prefix netip.Prefix, nomatch bool, ok bool) {
+    fields := strings.Fields(member)
+    if len(fields) == 0 || len(fields) > 2 || (len(fields) == 2 && fields[1] != "nomatch") {
+        return netip.Prefix{}, false, false
+    }
+    prefix, ok = ParsePrefix(fields[0])
+    return prefix, len(fields) == 2, ok
+}
+
+// ParsePrefix 解析 CIDR 或单个地址（视为 /32 或 /128），返回按掩码对齐的网段；IPv4 映射的 IPv6 地址按 IPv4 处理。
+func ParsePrefix(text string) (netip.Prefix, bool) {
+    text = strings.TrimSpace(text)
+    if !strings.Contains(text, "/") {
+        addr, err := netip.ParseAddr(text)
+        if err != nil {
+            return netip.Prefix{}, false
+        }
+        addr = addr.Unmap()
+        return netip.PrefixFrom(addr, addr.BitLen()), true
+    }
+    prefix, err := netip.ParsePrefix(text)
+    if err != nil {
+        return netip.Prefix{}, false
+    }
+    if prefix.Addr().Is4In6() {
+        bits := prefix.Bits() - 96
+        if bits < 0 {
+            return netip.Prefix{}, false
+        }
+        prefix = netip.PrefixFrom(prefix.Addr().Unmap(), bits)
+    }
+    return prefix.Masked(), true
+}
+
+// LastAddr 返回网段中的最后一个地址（主机位全为 1）。
+func LastAddr(prefix netip.Prefix) netip.Addr {
+    raw := prefix.Masked().Addr().AsSlice()
+    for i := prefix.Bits(); i < len(raw)*8; i++ {
+        raw[i/8] |= 1 << (7 - i%8)
+    }
+    addr, _ := netip.AddrFromSlice(raw)
+    return addr
+}
+
+// AddrRange 为闭区间 [Lo, Hi] 内的地址（同一地址族）。
+type AddrRange struct {
+    Lo netip.Addr
+    Hi netip.Addr
+}
+
+// PrefixRange 返回网段覆盖的地址区间。
+func PrefixRange(prefix netip.Prefix) AddrRange {
+    prefix = prefix.Masked()
+    return AddrRange{Lo: prefix.Addr(), Hi: LastAddr(prefix)}
+}
+
+// MergeRanges 排序并合并重叠或相邻的区间。
+func MergeRanges(ranges []AddrRange) []AddrRange {
+    sorted := append([]AddrRange{}, ranges...)
+    sort.Slice(sorted, func(i, j int) bool { return sorted[i].Lo.Less(sorted[j].Lo) })
+    out := []AddrRange{}
+    for _, r := range sorted {
+        if n := len(out); n > 0 {
+            last := &out[n-1]
+            // last.Hi 为地址空间的最后一个地址时 Next 无效，之后的区间都已被覆盖
+            if next := last.Hi.Next(); !next.IsValid() || !next.Less(r.Lo) {
+                if last.Hi.Less(r.Hi) {
+                    last.Hi = r.Hi
+                }
+                continue
+            }
+        }
+        out = append(out, r)
+    }
+    return out
+}
+
+// SubtractRange 从各区间中扣除 cut，返回剩余的区间（保持有序）。
+func SubtractRange(ranges []AddrRange, cut AddrRange) []AddrRange {
+    out := []AddrRange{}
+    for _, r := range ranges {
+        if r.Hi.Less(cut.Lo) || cut.Hi.Less(r.Lo) {
+            out = append(out, r)
+            continue
+        }
+        if r.Lo.Less(cut.Lo) {
+            out = append(out, AddrRange{Lo: r.Lo, Hi: cut.Lo.Prev()})
+        }
+        if cut.Hi.Less(r.Hi) {
+            out = append(out, AddrRange{Lo: cut.Hi.Next(), Hi: r.Hi})
+        }
+    }
+    return out
+}
+
+// NetRanges 按 hash:net 的最长前缀语义把网段集合的成员换算为互不重叠、不相邻的有序区间。
+// 说明：按前缀长度从短到长依次并入（普通成员）或扣除（nomatch 成员）区间，后处理的更长前缀覆盖之前的结果；同一网段同时以两种形式出现时普通成员优先。
+func NetRanges(members []string) ([]AddrRange, error) {
+    type entry struct {
+        prefix  netip.Prefix
+        nomatch bool
+    }
+    entries := []entry{}
+    for _, m := range members {
+        prefix, nomatch, ok := ParseNetMember(m)
+        if !ok {
+            return nil, fmt.Errorf("invalid net member %q", m)
+        }
+        entries = append(entries, entry{prefix: prefix, nomatch: nomatch})
+    }
+    sort.SliceStable(entries, func(i, j int) bool {
+        if entries[i].prefix.Bits() != entries[j].prefix.Bits() {
+            return entries[i].prefix.Bits() < entries[j].prefix.Bits()
+        }
+        return entries[i].nomatch && !entries[j].nomatch
+    })
+
+    ranges := []AddrRange{}
+    for _, e := range entries {
+        if e.nomatch {
+            ranges = SubtractRange(ranges, PrefixRange(e.prefix))
+        } else {
+            ranges = MergeRanges(append(ranges, PrefixRange(e.prefix)))
+        }
+    }
+    return ranges, nil
+}
+
+// NetMembers 将地址区间编码为成员数最少的网段集合成员（已排序），NetRanges 的逆运算。
+// 说明：
+// - 沿地址前缀树自上而下，对每个网段比较“在此写入一个成员（普通或 nomatch），子网段继承其结果”与“不写入、交给子网段”两种做法的成员数；
+//   例如 10.20.0.0/16 去掉 10.20.5.0/24 编码为 "10.20.0.0/16" 与 "10.20.5.0/24 nomatch" 两个成员。
+// - hash:net 不接受前缀长度为 0 的成员，地址空间的根不写入成员（"0.0.0.0/0" 编码为两个 /1）。
+// - ranges 须属于同一地址族；为空时返回空列表。
+func NetMembers(ranges []AddrRange) []string {
+    ranges = MergeRanges(ranges)
+    out := []string{}
+    if len(ranges) == 0 {
+        return out
+    }
+    root := netip.PrefixFrom(ranges[0].Lo, 0).Masked()
+    enc := netEncoder{ranges: ranges, costs: map[netip.Prefix][2]int{}}
+    enc.emit(root, false, &out)
+    sort.Strings(out)
+    return out
+}
+
+// netEncoder 为 NetMembers 的前缀树编码状态。
+// 字段说明：
+// - ranges: 期望的地址区间（有序、互不重叠）
+// - costs: 网段 -> 继承结果分别为 false/true 时子树需要的最少成员数
+type netEncoder struct {
+    ranges []AddrRange
+    costs  map[netip.Prefix][2]int
+}
+
+// uniform 判断网段内的地址是否全部属于（或全部不属于）区间，返回该结果。
+func (e *netEncoder) uniform(prefix netip.Prefix) (value, ok bool) {
+    span := PrefixRange(prefix)
+    for _, r := range e.ranges {
+        if r.Hi.Less(span.Lo) || span.Hi.Less(r.Lo) {
+            continue
+        }
+        // 区间互不重叠：与第一个相交的区间完全包含网段时全部属于，否则为部分属于
+        inside := !span.Lo.Less(r.Lo) && !r.Hi.Less(span.Hi)
+        return inside, inside
+    }
+    return false, true
+}
+
+// children 返回网段的两个子网段。
+func children(prefix netip.Prefix) (netip.Prefix, netip.Prefix) {
+    bits := prefix.Bits() + 1
+    return netip.PrefixFrom(prefix.Addr(), bits), netip.PrefixFrom(LastAddr(prefix), bits).Masked()
+}
+
+// cost 返回网段在继承结果为 inherited 时子树需要的最少成员数。
+func (e *netEncoder) cost(prefix netip.Prefix, inherited bool) int {
+    idx := 0
+    if inherited {
+        idx = 1
+    }
+    if c, ok := e.costs[prefix]; ok {
+        return c[idx]
+    }
+    var c [2]int
+    if value, ok := e.uniform(prefix); ok && prefix.Bits() > 0 {
+        for i, inh := range []bool{false, true} {
+            if value != inh {
+                c[i] = 1
+            }
+        }
+    } else {
+        left, right := children(prefix)
+        split := [2]int{e.cost(left, false) + e.cost(right, false), e.cost(left, true) + e.cost(right, true)}
+        c = split
+        if prefix.Bits() > 0 {
+            // 在此写入与继承结果相反的成员，子网段改为继承该结果
+            c[0] = minInt(split[0], 1+split[1])
+            c[1] = minInt(split[1], 1+split[0])
+        }
+    }
+    e.costs[prefix] = c
+    return c[idx]
+}
+
+// emit 按 cost 选择的做法输出网段子树的成员。
+func (e *netEncoder) emit(prefix netip.Prefix, inherited bool, out *[]string) {
+    if value, ok := e.uniform(prefix); ok && prefix.Bits() > 0 {
+        if value != inherited {
+            *out = append(*out, NetMember(prefix, !value))
+        }
+        return
+    }
+    left, right := children(prefix)
+    next := inherited
+    if prefix.Bits() > 0 && 1+e.cost(left, !inherited)+e.cost(right, !inherited) < e.cost(left, inherited)+e.cost(right, inherited) {
+        *out = append(*out, NetMember(prefix, inherited))
+        next = !inherited
+    }
+    e.emit(left, next, out)
+    e.emit(right, next, out)
+}
+
+// minInt 返回两个整数中较小的一个。
+func minInt(a, b int) int {
+    if a < b {
+        return a
+    }
+    return b
+}
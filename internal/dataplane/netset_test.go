@@ -0,0 +1,85 @@
+package dataplane
+
+import (
+    "net/netip"
+    "reflect"
+    "testing"
+)
+
+func mustRanges(t *testing.T, members []string) []AddrRange {
+    t.Helper()
+    ranges, err := NetRanges(members)
+    if err != nil {
+        t.Fatalf("NetRanges(%q): %v", members, err)
+    }
+    return ranges
+}
+
+// allowed 按 hash:net 的最长前缀语义判断地址是否属于成员集合。
+func allowed(members []string, ip string) bool {
+    addr := netip.MustParseAddr(ip)
+    best, ok := -1, false
+    for _, m := range members {
+        prefix, nomatch, valid := ParseNetMember(m)
+        if !valid || prefix.Bits() <= best || !prefix.Contains(addr) {
+            continue
+        }
+        best, ok = prefix.Bits(), !nomatch
+    }
+    return ok
+}
+
+func TestNetMembers(t *testing.T) {
+    cases := []struct {
+        name   string
+        ranges []string // 以成员形式给出期望的地址范围
+        want   []string
+    }{
+        {"cidr with except", []string{"10.20.0.0/16", "10.20.5.0/24 nomatch"}, []string{"10.20.0.0/16", "10.20.5.0/24 nomatch"}},
+        {"whole space", []string{"0.0.0.0/1", "128.0.0.0/1"}, []string{"0.0.0.0/1", "128.0.0.0/1"}},
+        {"single address", []string{"203.0.113.10"}, []string{"203.0.113.10"}},
+        {"adjacent halves merge", []string{"10.0.0.0/9", "10.128.0.0/9"}, []string{"10.0.0.0/8"}},
+        {"ipv6", []string{"fd00::/8", "fd00::1 nomatch"}, []string{"fd00::/8", "fd00::1 nomatch"}},
+        {"empty", nil, []string{}},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            got := NetMembers(mustRanges(t, tc.ranges))
+            if !reflect.DeepEqual(got, tc.want) {
+                t.Fatalf("NetMembers got %q, want %q", got, tc.want)
+            }
+            // 编码结果还原后与输入范围一致
+            if back := mustRanges(t, got); !reflect.DeepEqual(back, mustRanges(t, tc.ranges)) {
+                t.Fatalf("round trip got %v, want %v", back, mustRanges(t, tc.ranges))
+            }
+        })
+    }
+}
+
+func TestNetMembersNeverWritesZeroPrefix(t *testing.T) {
+    ranges := SubtractRange([]AddrRange{PrefixRange(netip.MustParsePrefix("0.0.0.0/0"))}, PrefixRange(netip.MustParsePrefix("169.254.169.254/32")))
+    members := NetMembers(ranges)
+    for _, m := range members {
+        if prefix, _, _ := ParseNetMember(m); prefix.Bits() == 0 {
+            t.Fatalf("member %q has a zero-length prefix", m)
+        }
+    }
+    for ip, want := range map[string]bool{"8.8.8.8": true, "169.254.169.254": false, "169.254.169.253": true, "255.255.255.255": true} {
+        if got := allowed(members, ip); got != want {
+            t.Fatalf("%s in %q = %v, want %v", ip, members, got, want)
+        }
+    }
+}
+
+func TestNetRangesLongestPrefix(t *testing.T) {
+    got := mustRanges(t, []string{"10.0.0.0/8", "10.1.0.0/16 nomatch", "10.1.2.0/24", "10.1.2.3 nomatch"})
+    want := []AddrRange{
+        {netip.MustParseAddr("10.0.0.0"), netip.MustParseAddr("10.0.255.255")},
+        {netip.MustParseAddr("10.1.2.0"), netip.MustParseAddr("10.1.2.2")},
+        {netip.MustParseAddr("10.1.2.4"), netip.MustParseAddr("10.1.2.255")},
+        {netip.MustParseAddr("10.2.0.0"), netip.MustParseAddr("10.255.255.255")},
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Fatalf("NetRanges got %v, want %v", got, want)
+    }
+}
@@ -0,0 +1,49 @@
+package health
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "time"
+)
+
+// DefaultTimeout 为单个地址探测的默认超时时间。
+const DefaultTimeout = 5 * time.Second
+
+// HTTPProbe 在切换到新一代规则后依次请求一组地址，任一地址不可达或返回 4xx/5xx 即视为检查失败（controller.HealthChecker 的实现）。
+// 说明：
+// - 地址应选择必须经过本程序规则才能访问、且一旦被误拦截就说明规则有问题的服务，例如本节点上关键工作负载的 Service 或 Pod。
+// - 请求从控制器所在的网络命名空间发出（DaemonSet 通常为 hostNetwork），需要开启 OUTPUT 入口（ENFORCE_HOOKS=output）才会经过 Pod 入向规则。
+// 字段说明：
+// - URLs: 探测地址
+// - Timeout: 单个地址的超时时间；为 0 时使用 DefaultTimeout
+type HTTPProbe struct {
+    URLs    []string
+    Timeout time.Duration
+}
+
+// NewHTTPProbe 创建探测 urls 的健康检查；timeout 为 0 时使用 DefaultTimeout。
+func NewHTTPProbe(urls []string, timeout time.Duration) *HTTPProbe {
+    if timeout <= 0 {
+        timeout = DefaultTimeout
+    }
+    return &HTTPProbe{URLs: urls, Timeout: timeout}
+}
+
+// Check 依次请求全部地址，返回全部失败地址的错误（合并）；全部成功时返回 nil。
+func (p *HTTPProbe) Check() error {
+    client := &http.Client{Timeout: p.Timeout}
+    errs := []error{}
+    for _, url := range p.URLs {
+        resp, err := client.Get(url)
+        if err != nil {
+            errs = append(errs, fmt.Errorf("probe %s: %w", url, err))
+            continue
+        }
+        _ = resp.Body.Close()
+        if resp.StatusCode >= http.StatusBadRequest {
+            errs = append(errs, fmt.Errorf("probe %s: status %d", url, resp.StatusCode))
+        }
+    }
+    return errors.Join(errs...)
+}
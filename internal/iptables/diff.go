@@ -0,0 +1,617 @@
+package iptables
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/example/iptables-controller/internal/dataplane"
+)
+
+// SyncChains 对多条链做差分同步：读取当前内容，与期望内容比较，仅下发有差异的部分。
+// 行为：
+// - 通过一次 `iptables-save -t filter` 读取 filter 表中全部链的现有规则。
+// - 对已存在的链，计算现有规则与期望规则的最长公共子序列，只对差异规则生成 `-D`/`-I` 指令（包括顺序调整）。
+// - 对不存在的链，声明并追加全部规则。
+// - 所有指令汇总为一个 `iptables-restore --noflush` 事务；若没有任何差异则不执行任何写操作。
+// 返回值：changed 为内容发生变化的链名列表（为空表示本次同步无写入）。
+func (b *Backend) SyncChains(chains []ChainRules) (changed []string, err error) {
+    if len(chains) == 0 {
+        return nil, nil
+    }
+    current, err := b.ReadChains()
+    if err != nil {
+        return nil, err
+    }
+
+    payload, changed := RenderRestoreDiff(current, chains)
+    if len(changed) == 0 {
+        return nil, nil
+    }
+    if _, err := b.exec.RunWithInput(payload, b.restoreBin, "-w", "--noflush"); err != nil {
+        return nil, fmt.Errorf("%s: %w", b.restoreBin, err)
+    }
+
+    // 记录规则变更时间，用以审计和排查
+    log.Printf("rules synced for chains %s at %s", strings.Join(changed, ","), time.Now().Format(time.RFC3339))
+    return changed, nil
+}
+
+// ReadChains 读取 filter 表当前的全部链及其规则。
+// 返回值：key 为链名，value 为该链内按顺序排列的规则（iptables-save 输出切分后的参数，不含 -A chain）；
+// 链存在但为空时 value 为空切片。
+func (b *Backend) ReadChains() (map[string][][]string, error) {
+    out, err := b.exec.Run(b.saveBin, "-t", "filter")
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", b.saveBin, err)
+    }
+    return ParseSave(out), nil
+}
+
+// ParseSave 解析 iptables-save 的输出，只关心 filter 表。
+// 说明：`:CHAIN POLICY [pkts:bytes]` 行声明链，`-A CHAIN ...` 行为链中的规则。
+func ParseSave(out string) map[string][][]string {
+    chains := map[string][][]string{}
+    inFilter := false
+    for _, line := range strings.Split(out, "\n") {
+        line = strings.TrimSpace(line)
+        switch {
+        case line == "" || strings.HasPrefix(line, "#"):
+            continue
+        case strings.HasPrefix(line, "*"):
+            inFilter = line == "*filter"
+        case !inFilter:
+            continue
+        case strings.HasPrefix(line, ":"):
+            fields := strings.Fields(line[1:])
+            if len(fields) > 0 {
+                if _, ok := chains[fields[0]]; !ok {
+                    chains[fields[0]] = [][]string{}
+                }
+            }
+        case strings.HasPrefix(line, "-A "):
+            tokens := splitRuleLine(line)
+            if len(tokens) < 2 {
+                continue
+            }
+            chain := tokens[1]
+            chains[chain] = append(chains[chain], tokens[2:])
+        }
+    }
+    return chains
+}
+
+// RenderRestoreDiff 根据当前内容与期望内容生成差分的 iptables-restore 输入。
+// 说明：
+// - 已存在链：先按序号从大到小删除多余规则，再按目标位置从小到大插入缺失规则，
+//   这样删除不会影响尚未处理的序号，插入完成后链内容与期望完全一致。
+// - 不存在的链：声明 `:CHAIN - [0:0]` 后逐条追加。
+// 返回值：payload 为 restore 输入（无变化时为空字符串），changed 为有变化的链名列表。
+func RenderRestoreDiff(current map[string][][]string, chains []ChainRules) (payload string, changed []string) {
+    var decl strings.Builder
+    var body strings.Builder
+    for _, c := range chains {
+        desired := make([]string, 0, len(c.Rules))
+        for _, r := range c.Rules {
+            desired = append(desired, CanonicalRule(r))
+        }
+
+        rules, ok := current[c.Chain]
+        if !ok {
+            fmt.Fprintf(&decl, ":%s - [0:0]\n", c.Chain)
+            for _, r := range c.Rules {
+                writeRule(&body, "-A "+c.Chain, r)
+            }
+            changed = append(changed, c.Chain)
+            continue
+        }
+
+        existing := make([]string, 0, len(rules))
+        for _, r := range rules {
+            existing = append(existing, CanonicalRule(r))
+        }
+        keepCur, keepDes := lcs(existing, desired)
+        if len(keepCur) == len(existing) && len(keepDes) == len(desired) {
+            continue
+        }
+        for i := len(existing) - 1; i >= 0; i-- {
+            if !keepCur[i] {
+                fmt.Fprintf(&body, "-D %s %d\n", c.Chain, i+1)
+            }
+        }
+        for i, r := range c.Rules {
+            if !keepDes[i] {
+                writeRule(&body, "-I "+c.Chain+" "+strconv.Itoa(i+1), r)
+            }
+        }
+        changed = append(changed, c.Chain)
+    }
+    if len(changed) == 0 {
+        return "", nil
+    }
+    return "*filter\n" + decl.String() + body.String() + "COMMIT\n", changed
+}
+
+// writeRule 以 iptables-restore 语法写出一条规则：head 为 "-A CHAIN" 或 "-I CHAIN N"。
+func writeRule(b *strings.Builder, head string, rule []string) {
+    b.WriteString(head)
+    for _, arg := range rule {
+        b.WriteString(" ")
+        b.WriteString(quoteRestoreArg(arg))
+    }
+    b.WriteString("\n")
+}
+
+// maxLCSCells 为 lcs 动态规划矩阵的单元数上限（约 8 MiB）。
+const maxLCSCells = 1 << 20
+
+// lcs 计算两组规则的最长公共子序列，返回两侧各自被保留的位置标记。
+// 说明：
+// - 保留的规则原地不动，其余规则被删除或插入，从而同时覆盖新增、删除与重排三种差异。
+// - 先去掉相同的首尾部分，只对中间部分计算 O(n·m) 的矩阵；常见的增删少量规则因此只需很小的矩阵。
+// - 中间部分的矩阵超过 maxLCSCells 时不再计算，中间部分整体删除后重新插入（同一事务内原子生效，只是写入更多），
+//   避免单条链有上万条规则时占用过多内存。
+func lcs(a, b []string) (keepA map[int]bool, keepB map[int]bool) {
+    keepA = map[int]bool{}
+    keepB = map[int]bool{}
+    head := 0
+    for head < len(a) && head < len(b) && a[head] == b[head] {
+        keepA[head] = true
+        keepB[head] = true
+        head++
+    }
+    tail := 0
+    for tail < len(a)-head && tail < len(b)-head && a[len(a)-1-tail] == b[len(b)-1-tail] {
+        keepA[len(a)-1-tail] = true
+        keepB[len(b)-1-tail] = true
+        tail++
+    }
+    a, b = a[head:len(a)-tail], b[head:len(b)-tail]
+    n, m := len(a), len(b)
+    if n == 0 || m == 0 || (n+1)*(m+1) > maxLCSCells {
+        return keepA, keepB
+    }
+
+    dp := make([][]int, n+1)
+    for i := range dp {
+        dp[i] = make([]int, m+1)
+    }
+    for i := n - 1; i >= 0; i-- {
+        for j := m - 1; j >= 0; j-- {
+            if a[i] == b[j] {
+                dp[i][j] = dp[i+1][j+1] + 1
+            } else if dp[i+1][j] >= dp[i][j+1] {
+                dp[i][j] = dp[i+1][j]
+            } else {
+                dp[i][j] = dp[i][j+1]
+            }
+        }
+    }
+    for i, j := 0, 0; i < n && j < m; {
+        switch {
+        case a[i] == b[j]:
+            keepA[head+i] = true
+            keepB[head+j] = true
+            i++
+            j++
+        case dp[i+1][j] >= dp[i][j+1]:
+            i++
+        default:
+            j++
+        }
+    }
+    return keepA, keepB
+}
+
+// CanonicalRule 将一条规则参数归一化为 iptables-save 的输出形式，便于比较“期望规则”与“现有规则”。
+// 归一化内容（覆盖本程序生成的规则形态）：
+// - `-s/-d/-i/-o/-p` 等基础匹配按 iptables-save 的固定顺序输出，地址补全掩码并换算为网络地址（10.0.0.5 -> 10.0.0.5/32）。
+// - `-p tcp --dport 80` 这类隐式协议匹配展开为 `-p tcp -m tcp --dport 80`；与 iptables 一致，隐式匹配位于
+//   第一个协议参数出现的位置（例如 `-m set ... -p tcp --dport 80` 归一化为 `-m set ... -m tcp --dport 80`）。
+// - `--ctstate` 的状态按内核输出顺序排列（ESTABLISHED,RELATED -> RELATED,ESTABLISHED）。
+// - `--limit` 的速率换算为 iptables-save 的写法（5/minute -> 5/min），取默认值的 `--limit-burst 5` 省略。
+// - `-m` 扩展匹配保持原有顺序，`-j`/`-g` 及其参数保持在末尾；目标参数中 iptables-save 会省略或补全的默认值按其输出处理
+//   （`--nflog-group 0` 省略，`-j REJECT` 补全为 `--reject-with icmp-port-unreachable` 或 icmp6-port-unreachable，见 canonicalTarget）。
+func CanonicalRule(args []string) string {
+    base := map[string]string{}
+    groups := [][]string{}
+    target := []string{}
+    // implicitPending: 已出现 -p 但尚未加载对应的隐式协议匹配
+    implicitPending := false
+
+    var cur *[]string
+    for i := 0; i < len(args); i++ {
+        a := args[i]
+        switch {
+        case len(target) > 0:
+            target = append(target, a)
+        case (a == "-s" || a == "-d" || a == "-i" || a == "-o" || a == "-p") && i+1 < len(args):
+            base[a] = canonicalBaseValue(a, args[i+1])
+            i++
+            if a == "-p" {
+                cur = nil
+                implicitPending = true
+            }
+        case a == "-m" && i+1 < len(args):
+            if args[i+1] == base["-p"] {
+                implicitPending = false
+            }
+            groups = append(groups, []string{"-m", args[i+1]})
+            cur = &groups[len(groups)-1]
+            i++
+        case a == "-j" || a == "-g":
+            target = append(target, a)
+        default:
+            if cur == nil {
+                if implicitPending {
+                    groups = append(groups, []string{"-m", base["-p"]})
+                    implicitPending = false
+                } else {
+                    groups = append(groups, []string{})
+                }
+                cur = &groups[len(groups)-1]
+            }
+            *cur = append(*cur, a)
+        }
+    }
+
+    out := []string{}
+    for _, opt := range []string{"-s", "-d", "-i", "-o", "-p"} {
+        if v, ok := base[opt]; ok {
+            out = append(out, opt, v)
+        }
+    }
+    for _, g := range groups {
+        for i := 0; i < len(g); i++ {
+            out = append(out, g[i])
+            switch {
+            case g[i] == "--ctstate" && i+1 < len(g):
+                out = append(out, canonicalCtState(g[i+1]))
+                i++
+            case g[i] == "--limit" && i+1 < len(g):
+                rate, err := CanonicalLimit(g[i+1])
+                if err != nil {
+                    rate = g[i+1]
+                }
+                out = append(out, rate)
+                i++
+            case g[i] == "--limit-burst" && i+1 < len(g) && g[i+1] == strconv.Itoa(defaultLimitBurst):
+                out = out[:len(out)-1]
+                i++
+            }
+        }
+    }
+    out = append(out, canonicalTarget(target, strings.Contains(base["-s"]+base["-d"], ":"))...)
+    return strings.Join(out, " ")
+}
+
+// canonicalTarget 归一化目标及其参数：去掉 iptables-save 不输出的 `--nflog-group 0`，
+// 为没有 --reject-with 的 REJECT 补上内核默认值（ipv6 为 icmp6-port-unreachable）。
+// 说明：规则本身不带地址族信息，ipv6 按 -s/-d 中的地址判断；不带地址的 ip6tables REJECT 规则应显式写出 --reject-with。
+func canonicalTarget(target []string, ipv6 bool) []string {
+    if len(target) < 2 {
+        return target
+    }
+    out := []string{}
+    for i := 0; i < len(target); i++ {
+        if target[1] == "NFLOG" && target[i] == "--nflog-group" && i+1 < len(target) && target[i+1] == "0" {
+            i++
+            continue
+        }
+        out = append(out, target[i])
+    }
+    if out[1] == "REJECT" && len(out) == 2 {
+        reject := "icmp-port-unreachable"
+        if ipv6 {
+            reject = "icmp6-port-unreachable"
+        }
+        out = append(out, "--reject-with", reject)
+    }
+    return out
+}
+
+// canonicalBaseValue 归一化基础匹配的取值（地址补全掩码、协议名小写）。
+func canonicalBaseValue(opt, v string) string {
+    switch opt {
+    case "-s", "-d":
+        if !strings.Contains(v, "/") {
+            if ip := net.ParseIP(v); ip != nil {
+                if ip.To4() != nil {
+                    return ip.String() + "/32"
+                }
+                return ip.String() + "/128"
+            }
+            return v
+        }
+        if _, n, err := net.ParseCIDR(v); err == nil {
+            return n.String()
+        }
+        return v
+    case "-p":
+        return strings.ToLower(v)
+    default:
+        return v
+    }
+}
+
+// ctStateOrder 为 conntrack 模块在 iptables-save 中输出状态的顺序。
+var ctStateOrder = []string{"INVALID", "NEW", "RELATED", "ESTABLISHED", "UNTRACKED", "SNAT", "DNAT"}
+
+// canonicalCtState 将逗号分隔的连接状态按内核输出顺序重新排列。
+func canonicalCtState(v string) string {
+    states := map[string]bool{}
+    for _, s := range strings.Split(v, ",") {
+        states[strings.ToUpper(strings.TrimSpace(s))] = true
+    }
+    out := []string{}
+    for _, s := range ctStateOrder {
+        if states[s] {
+            out = append(out, s)
+            delete(states, s)
+        }
+    }
+    for s := range states {
+        out = append(out, s)
+    }
+    return strings.Join(out, ",")
+}
+
+// defaultLimitBurst 为 limit 模块默认的突发上限，iptables-save 不输出取默认值的 --limit-burst。
+const defaultLimitBurst = 5
+
+// limitRates 为 limit 模块的时间单位（按周期从长到短），mult 为以 1/10000 秒计的单位长度，与 libxt_limit 一致。
+var limitRates = []struct {
+    name string
+    mult uint64
+}{
+    {"day", 10000 * 24 * 60 * 60},
+    {"hour", 10000 * 60 * 60},
+    {"min", 10000 * 60},
+    {"sec", 10000},
+}
+
+// CanonicalLimit 将 limit 速率（例如 "5/minute"、"10/s"）换算为 iptables-save 的输出形式（"5/min"、"10/sec"）。
+// 说明：内核按“每个报文的间隔”保存速率，iptables-save 输出时会选择能整除的最大单位，例如 60/min 输出为 1/sec；
+// 这里复现同样的换算，保证期望规则与现有规则可直接比较。
+func CanonicalLimit(rate string) (string, error) {
+    n, unit, ok := strings.Cut(strings.ToLower(strings.TrimSpace(rate)), "/")
+    count, err := strconv.ParseUint(n, 10, 32)
+    if !ok || err != nil || count == 0 {
+        return "", fmt.Errorf("invalid limit rate %q (expected N/sec|min|hour|day)", rate)
+    }
+    var mult uint64
+    switch unit {
+    case "s", "sec", "second":
+        mult = limitRates[3].mult
+    case "m", "min", "minute":
+        mult = limitRates[2].mult
+    case "h", "hour":
+        mult = limitRates[1].mult
+    case "d", "day":
+        mult = limitRates[0].mult
+    default:
+        return "", fmt.Errorf("invalid limit rate %q (expected N/sec|min|hour|day)", rate)
+    }
+    period := mult / count
+    if period == 0 {
+        return "", fmt.Errorf("limit rate %q too fast", rate)
+    }
+    i := 1
+    for ; i < len(limitRates); i++ {
+        if period > limitRates[i].mult || limitRates[i].mult/period < limitRates[i].mult%period {
+            break
+        }
+    }
+    return fmt.Sprintf("%d/%s", limitRates[i-1].mult/period, limitRates[i-1].name), nil
+}
+
+// splitRuleLine 按空白切分 iptables-save 的一行，支持双引号包裹的参数（例如 --comment "a b"）。
+func splitRuleLine(line string) []string {
+    tokens := []string{}
+    var cur strings.Builder
+    inQuote := false
+    hasToken := false
+    for i := 0; i < len(line); i++ {
+        ch := line[i]
+        switch {
+        case ch == '\\' && inQuote && i+1 < len(line):
+            i++
+            cur.WriteByte(line[i])
+        case ch == '"':
+            inQuote = !inQuote
+            hasToken = true
+        case (ch == ' ' || ch == '\t') && !inQuote:
+            if hasToken {
+                tokens = append(tokens, cur.String())
+                cur.Reset()
+                hasToken = false
+            }
+        default:
+            cur.WriteByte(ch)
+            hasToken = true
+        }
+    }
+    if hasToken {
+        tokens = append(tokens, cur.String())
+    }
+    return tokens
+}
+
+// ListChains 返回 filter 表中名称以 prefix 开头的全部链。
+func (b *Backend) ListChains(prefix string) ([]string, error) {
+    current, err := b.ReadChains()
+    if err != nil {
+        return nil, err
+    }
+    out := []string{}
+    for chain := range current {
+        if strings.HasPrefix(chain, prefix) {
+            out = append(out, chain)
+        }
+    }
+    sort.Strings(out)
+    return out, nil
+}
+
+// DeleteChains 在一个 iptables-restore 事务中删除给定的链。
+// 顺序：
+// 1. 按规则内容删除其它链（包括 FORWARD）中跳转到这些链的规则（不使用序号，内置链可能在读取后被其它组件改写）；
+// 2. 通过声明 `:CHAIN - [0:0]` 清空这些链；
+// 3. 使用 `-X` 删除链。
+func (b *Backend) DeleteChains(chains []string) error {
+    if len(chains) == 0 {
+        return nil
+    }
+    current, err := b.ReadChains()
+    if err != nil {
+        return err
+    }
+    payload := RenderDeleteChains(current, chains)
+    if payload == "" {
+        return nil
+    }
+    if _, err := b.exec.RunWithInput(payload, b.restoreBin, "-w", "--noflush"); err != nil {
+        return fmt.Errorf("%s: %w", b.restoreBin, err)
+    }
+    return nil
+}
+
+// RenderDeleteChains 生成删除链的 iptables-restore 输入；current 中不存在的链会被忽略。
+func RenderDeleteChains(current map[string][][]string, chains []string) string {
+    doomed := map[string]bool{}
+    for _, c := range chains {
+        if _, ok := current[c]; ok {
+            doomed[c] = true
+        }
+    }
+    if len(doomed) == 0 {
+        return ""
+    }
+
+    names := make([]string, 0, len(current))
+    for name := range current {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    var decl, unlink, del strings.Builder
+    for _, name := range names {
+        if doomed[name] {
+            fmt.Fprintf(&decl, ":%s - [0:0]\n", name)
+            fmt.Fprintf(&del, "-X %s\n", name)
+            continue
+        }
+        for _, r := range current[name] {
+            if doomed[ruleTarget(r)] {
+                writeRule(&unlink, "-D "+name, r)
+            }
+        }
+    }
+    return "*filter\n" + decl.String() + unlink.String() + del.String() + "COMMIT\n"
+}
+
+// RenderRemoveJumps 生成删除内置链 hook 中跳转到 chains 的规则的 iptables-restore 输入。
+// 说明：按规则内容删除（`-D <hook> -j <链>`，每个副本一条），不使用序号；内置链与 Calico、kube-proxy 共用，
+// 它们在读取与提交之间改写内置链时，过期的序号会指向其它组件的规则。
+// 返回值：payload 为空表示没有需要删除的跳转；removed 为被删除跳转的目标，按规则在链中的顺序排列。
+func RenderRemoveJumps(hook string, rules [][]string, chains []string) (payload string, removed []string) {
+    doomed := map[string]bool{}
+    for _, c := range chains {
+        doomed[c] = true
+    }
+    var body strings.Builder
+    for _, r := range rules {
+        if target := ruleTarget(r); doomed[target] {
+            writeRule(&body, "-D "+hook, r)
+            removed = append(removed, target)
+        }
+    }
+    if len(removed) == 0 {
+        return "", nil
+    }
+    return "*filter\n" + body.String() + "COMMIT\n", removed
+}
+
+// RenderJumpPlacement 生成把根链跳转放到期望位置的 iptables-restore 输入；跳转已在期望位置时返回空字符串。
+// 参数说明：
+// - rules: hook 当前的规则（iptables-save 形式）。
+// - rootChains: 期望连续出现的根链跳转，按顺序排列。
+// 说明：
+// - 先按规则内容删除每一条旧跳转（`-D <hook> -j <根链>`，每个副本一条），再在锚点处按顺序插入全部跳转；
+//   整个输入在一个事务内原子提交，不存在跳转被删除而新跳转尚未生效的窗口。
+// - 内置链与 Calico、kube-proxy 共用，它们可能在读取与提交之间改写内置链；删除不使用序号，不会误删其它组件的规则。
+//   插入位置按删除后其它规则的序号计算，若期间其它组件增删了规则，跳转可能偏离锚点，下一次同步会再次移动到期望位置。
+func RenderJumpPlacement(hook string, rules [][]string, rootChains []string, position string) string {
+    ours := map[string]bool{}
+    for _, c := range rootChains {
+        ours[c] = true
+    }
+
+    // 拆分为本程序的跳转与其它规则
+    oldIdx := []int{}
+    otherIdx := []int{}
+    otherTargets := []string{}
+    for i, r := range rules {
+        if ours[ruleTarget(r)] {
+            oldIdx = append(oldIdx, i)
+            continue
+        }
+        otherIdx = append(otherIdx, i)
+        otherTargets = append(otherTargets, ruleTarget(r))
+    }
+    anchor := dataplane.AnchorIndex(otherTargets, position)
+
+    // 已满足：跳转恰好按顺序连续出现，且之前恰好有 anchor 条其它规则
+    if len(oldIdx) == len(rootChains) && (len(oldIdx) == 0 || oldIdx[0] == anchor) {
+        inPlace := true
+        for k, i := range oldIdx {
+            if i != anchor+k || ruleTarget(rules[i]) != rootChains[k] {
+                inPlace = false
+                break
+            }
+        }
+        if inPlace {
+            return ""
+        }
+    }
+
+    var body strings.Builder
+    for _, i := range oldIdx {
+        writeRule(&body, "-D "+hook, rules[i])
+    }
+    for k, c := range rootChains {
+        if anchor == len(otherIdx) {
+            fmt.Fprintf(&body, "-A %s -j %s\n", hook, c)
+        } else {
+            fmt.Fprintf(&body, "-I %s %d -j %s\n", hook, anchor+k+1, c)
+        }
+    }
+    return "*filter\n" + body.String() + "COMMIT\n"
+}
+
+// ruleTarget 返回规则中 -j/-g 的目标（无目标时返回空字符串）。
+func ruleTarget(rule []string) string {
+    for i := 0; i+1 < len(rule); i++ {
+        if rule[i] == "-j" || rule[i] == "-g" {
+            return rule[i+1]
+        }
+    }
+    return ""
+}
+
+// ListRules 返回指定链当前的规则（iptables-save 形式的参数，不含 -A chain）；链不存在时返回错误。
+func (b *Backend) ListRules(chain string) ([][]string, error) {
+    current, err := b.ReadChains()
+    if err != nil {
+        return nil, err
+    }
+    rules, ok := current[chain]
+    if !ok {
+        return nil, fmt.Errorf("chain %s does not exist", chain)
+    }
+    return rules, nil
+}
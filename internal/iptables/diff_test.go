@@ -0,0 +1,301 @@
+package iptables
+
+import (
+    "strconv"
+    "strings"
+    "testing"
+)
+
+// savedRule 解析一行 iptables-save 输出（"-A <链> ..."），返回去掉 "-A <链>" 后的参数。
+func savedRule(t *testing.T, line string) []string {
+    t.Helper()
+    for _, rules := range ParseSave("*filter\n" + line + "\nCOMMIT\n") {
+        if len(rules) == 1 {
+            return rules[0]
+        }
+    }
+    t.Fatalf("cannot parse save line %q", line)
+    return nil
+}
+
+// 期望规则（控制器生成的参数）与 iptables-save 对同一条规则的输出（取自 iptables v1.8 legacy/nft 的实际输出）归一化后必须一致，
+// 否则内容未变化的链每次同步都会被改写。
+func TestCanonicalRuleMatchesSave(t *testing.T) {
+    cases := []struct {
+        name    string
+        desired []string
+        save    string
+    }{
+        {
+            name:    "implicit tcp match",
+            desired: []string{"-d", "10.244.1.10", "-p", "tcp", "--dport", "80", "-j", "ACCEPT"},
+            save:    "-A MS-IN-A -d 10.244.1.10/32 -p tcp -m tcp --dport 80 -j ACCEPT",
+        },
+        {
+            name:    "implicit match after an explicit one",
+            desired: []string{"-m", "set", "--match-set", "MS-SRC-A", "src", "-d", "10.244.1.10", "-p", "udp", "--dport", "53", "-j", "ACCEPT"},
+            save:    "-A MS-IN-A -d 10.244.1.10/32 -p udp -m set --match-set MS-SRC-A src -m udp --dport 53 -j ACCEPT",
+        },
+        {
+            name:    "multiport has no implicit match",
+            desired: []string{"-d", "10.244.1.10", "-p", "tcp", "-m", "multiport", "--dports", "80,443,8000:8080", "-j", "ACCEPT"},
+            save:    "-A MS-IN-A -d 10.244.1.10/32 -p tcp -m multiport --dports 80,443,8000:8080 -j ACCEPT",
+        },
+        {
+            name:    "ipv4 host suffix",
+            desired: []string{"-s", "10.244.1.10", "-m", "comment", "--comment", "legacy_rule-1", "-j", "RETURN"},
+            save:    "-A MS-OUT-A -s 10.244.1.10/32 -m comment --comment legacy_rule-1 -j RETURN",
+        },
+        {
+            name:    "network address of a cidr",
+            desired: []string{"-d", "10.244.1.10", "-s", "10.1.2.3/8", "-j", "DROP"},
+            save:    "-A MS-IN-A -s 10.0.0.0/8 -d 10.244.1.10/32 -j DROP",
+        },
+        {
+            name:    "ipv6 host suffix",
+            desired: []string{"-d", "FD00:0:0::5", "-j", "ACCEPT"},
+            save:    "-A MS-IN-A -d fd00::5/128 -j ACCEPT",
+        },
+        {
+            name:    "quoted comment",
+            desired: []string{"-d", "10.244.1.10", "-m", "comment", "--comment", "owner=default/StatefulSet/web dir=in pod=web-0 peer=*", "-j", "DROP"},
+            save:    `-A MS-IN-A -d 10.244.1.10/32 -m comment --comment "owner=default/StatefulSet/web dir=in pod=web-0 peer=*" -j DROP`,
+        },
+        {
+            name:    "escaped quote in a comment",
+            desired: []string{"-m", "comment", "--comment", `say "hi"`, "-j", "ACCEPT"},
+            save:    `-A MS-IN-A -m comment --comment "say \"hi\"" -j ACCEPT`,
+        },
+        {
+            name:    "ctstate order",
+            desired: []string{"-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-m", "comment", "--comment", "dir=in established", "-j", "ACCEPT"},
+            save:    `-A MS-ROOT-IN -m conntrack --ctstate RELATED,ESTABLISHED -m comment --comment "dir=in established" -j ACCEPT`,
+        },
+        {
+            name:    "limit unit and default burst",
+            desired: []string{"-d", "10.244.1.10", "-m", "limit", "--limit", "5/minute", "--limit-burst", "5", "-j", "LOG", "--log-prefix", "MS-DENY web "},
+            save:    `-A MS-IN-A -d 10.244.1.10/32 -m limit --limit 5/min -j LOG --log-prefix "MS-DENY web "`,
+        },
+        {
+            name:    "limit rescaled to a larger unit",
+            desired: []string{"-m", "limit", "--limit", "60/minute", "--limit-burst", "10", "-j", "LOG", "--log-prefix", "MS-DENY"},
+            save:    "-A MS-IN-A -m limit --limit 1/sec --limit-burst 10 -j LOG --log-prefix MS-DENY",
+        },
+        {
+            name:    "limit per day",
+            desired: []string{"-m", "limit", "--limit", "48/day", "-j", "LOG", "--log-prefix", "MS-DENY"},
+            save:    "-A MS-IN-A -m limit --limit 2/hour -j LOG --log-prefix MS-DENY",
+        },
+        {
+            name:    "nflog group 0 is omitted",
+            desired: []string{"-m", "limit", "--limit", "10/s", "-j", "NFLOG", "--nflog-prefix", "MS-DENY web", "--nflog-group", "0"},
+            save:    `-A MS-IN-A -m limit --limit 10/sec -j NFLOG --nflog-prefix "MS-DENY web"`,
+        },
+        {
+            name:    "nflog without a group",
+            desired: []string{"-m", "limit", "--limit", "10/s", "-j", "NFLOG", "--nflog-prefix", "MS-DENY web"},
+            save:    `-A MS-IN-A -m limit --limit 10/sec -j NFLOG --nflog-prefix "MS-DENY web"`,
+        },
+        {
+            name:    "nflog group",
+            desired: []string{"-m", "limit", "--limit", "10/s", "-j", "NFLOG", "--nflog-prefix", "MS-DENY web", "--nflog-group", "5"},
+            save:    `-A MS-IN-A -m limit --limit 10/sec -j NFLOG --nflog-prefix "MS-DENY web" --nflog-group 5`,
+        },
+        {
+            name:    "reject default",
+            desired: []string{"-d", "10.244.1.10", "-s", "10.0.0.0/8", "-j", "REJECT"},
+            save:    "-A MS-IN-A -s 10.0.0.0/8 -d 10.244.1.10/32 -j REJECT --reject-with icmp-port-unreachable",
+        },
+        {
+            name:    "ipv6 reject default",
+            desired: []string{"-d", "fd00::5", "-j", "REJECT"},
+            save:    "-A MS-IN-A -d fd00::5/128 -j REJECT --reject-with icmp6-port-unreachable",
+        },
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            saved := savedRule(t, tc.save)
+            got, want := CanonicalRule(tc.desired), CanonicalRule(saved)
+            if got != want {
+                t.Fatalf("desired canonicalizes to\n  %q\nsaved rule to\n  %q", got, want)
+            }
+            // iptables-save 的输出本身已是归一化形式
+            if joined := strings.Join(saved, " "); want != joined {
+                t.Fatalf("saved rule canonicalizes to %q, want it unchanged %q", want, joined)
+            }
+        })
+    }
+}
+
+// 控制器下发的链经 iptables-save 读回后再次同步，不应产生任何写入。
+func TestRenderRestoreDiffUnchangedFromSave(t *testing.T) {
+    save := strings.Join([]string{
+        "# Generated by iptables-save v1.8.7 on Fri Oct 16 10:00:00 2026",
+        "*filter",
+        ":FORWARD ACCEPT [0:0]",
+        ":MS-G1-IN-A - [0:0]",
+        ":MS-ROOT-IN - [0:0]",
+        "-A FORWARD -j MS-ROOT-IN",
+        `-A MS-G1-IN-A -d 10.244.1.10/32 -m set --match-set MS-G1-SRC-A src -m comment --comment "owner=default/StatefulSet/web dir=in pod=web-0" -j ACCEPT`,
+        `-A MS-G1-IN-A -d 10.244.1.10/32 -p tcp -m tcp --dport 22 -m comment --comment "owner=default/StatefulSet/web dir=in rule=0" -j REJECT --reject-with icmp-port-unreachable`,
+        `-A MS-G1-IN-A -d 10.244.1.10/32 -m limit --limit 5/min -m comment --comment "owner=default/StatefulSet/web dir=in pod=web-0" -j NFLOG --nflog-prefix "MS-DENY web"`,
+        `-A MS-G1-IN-A -d 10.244.1.10/32 -m comment --comment "owner=default/StatefulSet/web dir=in pod=web-0" -j DROP`,
+        `-A MS-ROOT-IN -m conntrack --ctstate RELATED,ESTABLISHED -m comment --comment "dir=in established" -j ACCEPT`,
+        `-A MS-ROOT-IN -m comment --comment "dir=in gen=1" -j MS-G1-ROOT-IN`,
+        "COMMIT",
+        "# Completed on Fri Oct 16 10:00:00 2026",
+    }, "\n")
+    comment := []string{"-m", "comment", "--comment", "owner=default/StatefulSet/web dir=in pod=web-0"}
+    chains := []ChainRules{
+        {Chain: "MS-G1-IN-A", Rules: [][]string{
+            append([]string{"-m", "set", "--match-set", "MS-G1-SRC-A", "src", "-d", "10.244.1.10"}, append(comment, "-j", "ACCEPT")...),
+            {"-d", "10.244.1.10", "-p", "tcp", "--dport", "22", "-m", "comment", "--comment", "owner=default/StatefulSet/web dir=in rule=0", "-j", "REJECT"},
+            append([]string{"-d", "10.244.1.10", "-m", "limit", "--limit", "5/minute"}, append(comment, "-j", "NFLOG", "--nflog-prefix", "MS-DENY web")...),
+            append([]string{"-d", "10.244.1.10"}, append(comment, "-j", "DROP")...),
+        }},
+        {Chain: "MS-ROOT-IN", Rules: [][]string{
+            {"-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-m", "comment", "--comment", "dir=in established", "-j", "ACCEPT"},
+            {"-m", "comment", "--comment", "dir=in gen=1", "-j", "MS-G1-ROOT-IN"},
+        }},
+    }
+    if payload, changed := RenderRestoreDiff(ParseSave(save), chains); payload != "" || len(changed) != 0 {
+        t.Fatalf("unchanged chains rewritten (%v):\n%s", changed, payload)
+    }
+}
+
+// applyDiff 按 iptables-restore 的语义把 payload 中对 chain 的 -D <n>/-I <n>/-A 指令作用于 rules（规则以 "-j <目标>" 表示）。
+func applyDiff(t *testing.T, chain string, rules []string, payload string) []string {
+    t.Helper()
+    out := append([]string{}, rules...)
+    for _, line := range strings.Split(payload, "\n") {
+        fields := strings.Fields(line)
+        if len(fields) < 3 || fields[1] != chain {
+            continue
+        }
+        switch fields[0] {
+        case "-D":
+            n, err := strconv.Atoi(fields[2])
+            if err != nil || n < 1 || n > len(out) {
+                t.Fatalf("bad delete %q for %v", line, out)
+            }
+            out = append(out[:n-1], out[n:]...)
+        case "-I":
+            n, err := strconv.Atoi(fields[2])
+            if err != nil || n < 1 || n > len(out)+1 {
+                t.Fatalf("bad insert %q for %v", line, out)
+            }
+            rule := strings.Join(fields[3:], " ")
+            out = append(out[:n-1], append([]string{rule}, out[n-1:]...)...)
+        case "-A":
+            out = append(out, strings.Join(fields[2:], " "))
+        }
+    }
+    return out
+}
+
+// LCS 差分：先按序号从大到小删除，再按目标位置从小到大插入，结果与期望完全一致。
+func TestRenderRestoreDiffOrdering(t *testing.T) {
+    cases := []struct {
+        name    string
+        current []string
+        desired []string
+        payload string
+    }{
+        {
+            name:    "append",
+            current: []string{"a", "b"},
+            desired: []string{"a", "b", "c"},
+            payload: "*filter\n-I C 3 -j c\nCOMMIT\n",
+        },
+        {
+            name:    "delete in the middle",
+            current: []string{"a", "b", "c"},
+            desired: []string{"a", "c"},
+            payload: "*filter\n-D C 2\nCOMMIT\n",
+        },
+        {
+            name:    "replace one rule",
+            current: []string{"a", "b", "c"},
+            desired: []string{"a", "x", "c"},
+            payload: "*filter\n-D C 2\n-I C 2 -j x\nCOMMIT\n",
+        },
+        {
+            name:    "deletes from the end first",
+            current: []string{"a", "x", "b", "y", "c"},
+            desired: []string{"a", "b", "c", "z"},
+            payload: "*filter\n-D C 4\n-D C 2\n-I C 4 -j z\nCOMMIT\n",
+        },
+        {
+            name:    "move to the front",
+            current: []string{"a", "b", "c"},
+            desired: []string{"c", "a", "b"},
+            payload: "*filter\n-D C 3\n-I C 1 -j c\nCOMMIT\n",
+        },
+        {
+            name:    "inserts in ascending order",
+            current: []string{"b", "d"},
+            desired: []string{"a", "b", "c", "d", "e"},
+            payload: "*filter\n-I C 1 -j a\n-I C 3 -j c\n-I C 5 -j e\nCOMMIT\n",
+        },
+        {
+            name:    "unchanged",
+            current: []string{"a", "b"},
+            desired: []string{"a", "b"},
+            payload: "",
+        },
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            current := map[string][][]string{"C": jumpRules(tc.current...)}
+            payload, _ := RenderRestoreDiff(current, []ChainRules{{Chain: "C", Rules: jumpRules(tc.desired...)}})
+            if payload != tc.payload {
+                t.Fatalf("payload = %q, want %q", payload, tc.payload)
+            }
+            want := []string{}
+            for _, target := range tc.desired {
+                want = append(want, "-j "+target)
+            }
+            before := []string{}
+            for _, target := range tc.current {
+                before = append(before, "-j "+target)
+            }
+            if got := applyDiff(t, "C", before, payload); strings.Join(got, "\n") != strings.Join(want, "\n") {
+                t.Fatalf("chain after restore = %v, want %v", got, want)
+            }
+        })
+    }
+}
+
+func TestRenderRestoreDiffNewChain(t *testing.T) {
+    payload, changed := RenderRestoreDiff(map[string][][]string{}, []ChainRules{{Chain: "C", Rules: jumpRules("a", "b")}})
+    if want := "*filter\n:C - [0:0]\n-A C -j a\n-A C -j b\nCOMMIT\n"; payload != want {
+        t.Fatalf("payload = %q, want %q", payload, want)
+    }
+    if len(changed) != 1 || changed[0] != "C" {
+        t.Fatalf("changed = %v, want [C]", changed)
+    }
+}
+
+// 超出矩阵上限时只保留相同的首尾，中间整体重写，结果仍与期望一致。
+func TestLCSCapKeepsCommonEnds(t *testing.T) {
+    n := 1100
+    a, b := []string{"head"}, []string{"head"}
+    for i := 0; i < n; i++ {
+        a = append(a, "a"+strconv.Itoa(i))
+        b = append(b, "b"+strconv.Itoa(i))
+    }
+    a = append(a, "shared", "tail")
+    b = append(b, "shared", "tail")
+    a[n/2] = "common"
+    b[n/2] = "common"
+    keepA, keepB := lcs(a, b)
+    if len(keepA) != 3 || len(keepB) != 3 || !keepA[0] || !keepA[len(a)-1] || !keepA[len(a)-2] {
+        t.Fatalf("keep = %d/%d, want only the common head and tail", len(keepA), len(keepB))
+    }
+
+    // 未超出上限时中间部分照常计算
+    keepA, keepB = lcs([]string{"head", "x", "common", "y", "tail"}, []string{"head", "p", "common", "q", "tail"})
+    if len(keepA) != 3 || !keepA[2] || !keepB[2] {
+        t.Fatalf("keep = %v/%v, want head, common and tail", keepA, keepB)
+    }
+}
@@ -0,0 +1,75 @@
+package iptables
+
+import (
+    "errors"
+    "strings"
+    "testing"
+
+    "github.com/example/iptables-controller/internal/dataplane/fake"
+)
+
+// lastInput 返回最后一次以 prefix 开头的命令的 stdin；没有时返回 false。
+func lastInput(exec *fake.Executor, prefix string) (string, bool) {
+    for i := len(exec.Commands) - 1; i >= 0; i-- {
+        if strings.HasPrefix(exec.Commands[i], prefix) {
+            return exec.Inputs[i], true
+        }
+    }
+    return "", false
+}
+
+func TestSyncSetUnchangedIsNoop(t *testing.T) {
+    exec := fake.NewExecutor()
+    exec.Respond("ipset save MS-SRC-A", "create MS-SRC-A hash:ip family inet hashsize 1024 maxelem 65536\nadd MS-SRC-A 10.0.0.1\n")
+    b := NewBackend(exec)
+    if err := b.SyncIPSet("MS-SRC-A", []string{"10.0.0.1"}); err != nil {
+        t.Fatalf("SyncIPSet: %v", err)
+    }
+    if _, ok := lastInput(exec, "ipset restore"); ok {
+        t.Fatalf("unchanged set was rewritten: %q", exec.Commands)
+    }
+}
+
+func TestSyncSetSwapsMembers(t *testing.T) {
+    exec := fake.NewExecutor()
+    exec.Respond("ipset save MS-SRC-A", "create MS-SRC-A hash:ip family inet hashsize 1024 maxelem 65536\nadd MS-SRC-A 10.0.0.1\n")
+    b := NewBackend(exec)
+    if err := b.SyncIPSet("MS-SRC-A", []string{"10.0.0.2"}); err != nil {
+        t.Fatalf("SyncIPSet: %v", err)
+    }
+    input, ok := lastInput(exec, "ipset restore")
+    if !ok || !strings.Contains(input, "swap MS-SRC-A-T MS-SRC-A") || !strings.Contains(input, "add MS-SRC-A-T 10.0.0.2") {
+        t.Fatalf("expected swap through the temp set, got %q", input)
+    }
+}
+
+// 同名集合以其它类型存在时不能 create -exist 或 swap，应销毁后按新类型重建。
+func TestSyncSetRecreatesOnTypeChange(t *testing.T) {
+    exec := fake.NewExecutor()
+    exec.Respond("ipset save MS-DSTNET-A", "create MS-DSTNET-A hash:ip family inet hashsize 1024 maxelem 65536\nadd MS-DSTNET-A 10.0.0.1\n")
+    b := NewBackend(exec)
+    if err := b.SyncNetSet("MS-DSTNET-A", []string{"10.0.0.0/8", "10.1.0.0/16 nomatch"}); err != nil {
+        t.Fatalf("SyncNetSet: %v", err)
+    }
+    for _, cmd := range exec.Commands {
+        if strings.HasPrefix(cmd, "ipset create") {
+            t.Fatalf("unexpected %q on a set of another type", cmd)
+        }
+    }
+    input, ok := lastInput(exec, "ipset restore")
+    want := "destroy MS-DSTNET-A\ncreate MS-DSTNET-A hash:net family inet\nadd MS-DSTNET-A 10.0.0.0/8\nadd MS-DSTNET-A 10.1.0.0/16 nomatch\n"
+    if !ok || input != want {
+        t.Fatalf("recreate input:\n got  %q\n want %q", input, want)
+    }
+}
+
+func TestSyncSetRecreateFailure(t *testing.T) {
+    exec := fake.NewExecutor()
+    exec.Respond("ipset save MS-PORT-0-A", "create MS-PORT-0-A hash:ip family inet hashsize 1024 maxelem 65536\n")
+    exec.FailOn("ipset restore", errors.New("Set cannot be destroyed: it is in use by a kernel component"))
+    b := NewBackend(exec)
+    err := b.SyncIPPortSet("MS-PORT-0-A", []string{"10.0.0.1,tcp:80"})
+    if err == nil || !strings.Contains(err.Error(), "recreate as hash:ip,port (was hash:ip)") {
+        t.Fatalf("expected recreate error, got %v", err)
+    }
+}
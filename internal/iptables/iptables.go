@@ -2,15 +2,83 @@ package iptables
 
 import (
     "bytes"
+    "crypto/sha256"
+    "encoding/base32"
     "fmt"
     "log"
     "os/exec"
     "strings"
-    "time"
+
+    "github.com/example/iptables-controller/internal/dataplane"
 )
 
+// Backend 是基于 iptables + ipset 的 dataplane.Dataplane 实现。
+// 字段说明：
+// - exec: 命令执行器；生产环境使用 HostExecutor 在宿主机执行，测试中可替换为 fake 执行器以记录命令或注入失败。
+// - family: 处理的地址族；IPv6 实例使用 ip6tables 系列命令并创建 `family inet6` 的 ipset。
+// - mode: iptables 模式（legacy / nft / 默认），决定调用哪一套命令，见 DetectMode。
+// - iptablesBin / saveBin / restoreBin: 该地址族与模式对应的 iptables、iptables-save、iptables-restore 命令名。
+type Backend struct {
+    exec        dataplane.Executor
+    family      dataplane.Family
+    mode        Mode
+    iptablesBin string
+    saveBin     string
+    restoreBin  string
+}
+
+// NewBackend 创建处理 IPv4 的 iptables 数据面实现；exec 为 nil 时使用 HostExecutor。
+func NewBackend(exec dataplane.Executor) *Backend {
+    return NewFamilyBackend(dataplane.IPv4, ModeDefault, exec)
+}
+
+// NewFamilyBackend 创建处理指定地址族、使用指定模式命令的 iptables 数据面实现。
+// 说明：IPv6 使用 ip6tables 系列命令；mode 非默认时命令名带模式后缀，例如 iptables-nft-restore、ip6tables-legacy-save。
+func NewFamilyBackend(family dataplane.Family, mode Mode, exec dataplane.Executor) *Backend {
+    if exec == nil {
+        exec = HostExecutor{}
+    }
+    if family != dataplane.IPv6 {
+        family = dataplane.IPv4
+    }
+    bin, save, restore := binaryNames(family, mode)
+    return &Backend{
+        exec:        exec,
+        family:      family,
+        mode:        mode,
+        iptablesBin: bin,
+        saveBin:     save,
+        restoreBin:  restore,
+    }
+}
+
+// Name 返回实现名称，即实际调用的 iptables 命令名（例如 "iptables"、"ip6tables-nft"）。
+func (b *Backend) Name() string { return b.iptablesBin }
+
+// Mode 返回本实例使用的 iptables 模式名称（"legacy"、"nft" 或 "default"）。
+func (b *Backend) Mode() string { return modeName(b.mode) }
+
+// ipsetFamily 返回创建 ipset 时使用的 family 参数（inet 或 inet6）。
+func (b *Backend) ipsetFamily() string {
+    if b.family == dataplane.IPv6 {
+        return "inet6"
+    }
+    return "inet"
+}
+
+// HostExecutor 通过 RunCommand / RunCommandWithInput 在宿主机上执行命令，是 dataplane.Executor 的默认实现。
+type HostExecutor struct{}
+
+// Run 见 RunCommand。
+func (HostExecutor) Run(name string, args ...string) (string, error) { return RunCommand(name, args...) }
+
+// RunWithInput 见 RunCommandWithInput。
+func (HostExecutor) RunWithInput(input, name string, args ...string) (string, error) {
+    return RunCommandWithInput(input, name, args...)
+}
+
 // RunCommand 在宿主机中执行一个命令并返回 stdout 的文本内容或错误（包含 stderr）。
-// 说明：所有对 iptables 的调用均通过该方法执行，以便统一处理 stderr 并在出错时返回详细信息。
+// 说明：HostExecutor 通过该方法执行所有 iptables/ipset 调用，以便统一处理 stderr 并在出错时返回详细信息。
 func RunCommand(name string, args ...string) (string, error) {
     cmd := exec.Command(name, args...)
     var out bytes.Buffer
@@ -23,18 +91,33 @@ func RunCommand(name string, args ...string) (string, error) {
     return strings.TrimSpace(out.String()), nil
 }
 
+// RunCommandWithInput 与 RunCommand 相同，但会把 input 写入命令的 stdin。
+// 说明：用于 iptables-restore / ipset restore 等从标准输入读取批量指令的命令。
+func RunCommandWithInput(input, name string, args ...string) (string, error) {
+    cmd := exec.Command(name, args...)
+    var out bytes.Buffer
+    var stderr bytes.Buffer
+    cmd.Stdin = strings.NewReader(input)
+    cmd.Stdout = &out
+    cmd.Stderr = &stderr
+    if err := cmd.Run(); err != nil {
+        return "", fmt.Errorf("%v: %s", err, stderr.String())
+    }
+    return strings.TrimSpace(out.String()), nil
+}
+
 // EnsureChain 确保给定的 iptables 链存在；若不存在则创建。
 // 细节：
 // - 使用 `iptables -w` 等待 xtables 锁，避免与其他进程（例如 Calico）并发冲突时失败。
 // - 通过 `-L` 检查链是否存在，若不存在则使用 `-N` 创建。
 // - 该方法只创建属于本程序管理的自定义链，不会删除或修改其他链以避免与 CNI 冲突。
-func EnsureChain(chain string) error {
+func (b *Backend) EnsureChain(chain string) error {
     // -w to wait for xtables lock
-    _, err := RunCommand("iptables", "-w", "-n", "-L", chain)
+    _, err := b.exec.Run(b.iptablesBin, "-w", "-n", "-L", chain)
     if err == nil {
         return nil
     }
-    _, err = RunCommand("iptables", "-w", "-N", chain)
+    _, err = b.exec.Run(b.iptablesBin, "-w", "-N", chain)
     if err != nil {
         return err
     }
@@ -42,95 +125,293 @@ func EnsureChain(chain string) error {
     return nil
 }
 
-// EnsureJump 确保在 FORWARD 链上存在一条跳转到 rootChain 的规则。
+// EnsureJumps 确保在内置链 hook（FORWARD/OUTPUT/INPUT）中按 rootChains 的顺序连续跳转到各根链。
 // 参数说明：
-// - position: "append" 表示追加到链末尾；"insert" 表示插入到链首。
+// - hook: 挂载跳转的内置链名，见 dataplane.HookForward 等常量。
+// - position: "insert"（链首）、"append"（链尾）或 "before:<链名>"（紧挨在跳转到该链的规则之前，例如 before:cali-FORWARD）。
 // 目的：让 iptables 在处理转发流量时进入我们的自定义链，从而实现基于 Pod IP 的策略控制。
 // 说明：
-// - 追加（append）对 CNI 影响最小，但若 CNI 在前面已 ACCEPT，可能导致规则不生效。
-// - 插入（insert）优先生效，但可能影响 CNI 规则优先级。
-func EnsureJump(rootChain, position string) error {
-    // 如果希望插入到链首，则先删除已有跳转（若存在）再插入，确保优先生效
-    if position == "insert" {
-        // 尝试删除已有跳转（忽略错误）
-        _, _ = RunCommand("iptables", "-w", "-D", "FORWARD", "-j", rootChain)
-        _, err := RunCommand("iptables", "-w", "-I", "FORWARD", "1", "-j", rootChain)
+// - 检查后移动（check-and-move）：先读取 hook 现有规则，跳转已在期望位置时不做任何写操作；
+//   否则在一个 iptables-restore 事务中按规则内容删除旧跳转、再在锚点处插入新跳转；事务原子提交，不会出现“删除后尚未插入”的无策略窗口，
+//   也不会因其它组件在读取后改写内置链而按过期序号误删其规则（见 RenderJumpPlacement）。
+// - 追加（append）对 CNI 影响最小，但 Calico 的 cali-FORWARD 在前面 ACCEPT 后本程序的规则不会被匹配。
+// - before:cali-FORWARD 让策略紧挨在 Calico 之前生效，同时保留 kube-proxy 等放在更前面的规则。
+func (b *Backend) EnsureJumps(hook string, rootChains []string, position string) error {
+    current, err := b.ReadChains()
+    if err != nil {
         return err
     }
-
-    // 追加模式：若已存在则不重复添加
-    _, err := RunCommand("iptables", "-w", "-C", "FORWARD", "-j", rootChain)
-    if err == nil {
+    payload := RenderJumpPlacement(hook, current[hook], rootChains, position)
+    if payload == "" {
         return nil
     }
-    _, err = RunCommand("iptables", "-w", "-A", "FORWARD", "-j", rootChain)
-    return err
+    if _, err := b.exec.RunWithInput(payload, b.restoreBin, "-w", "--noflush"); err != nil {
+        return fmt.Errorf("%s: %w", b.restoreBin, err)
+    }
+    log.Printf("placed jumps to %s in %s (position %s)", strings.Join(rootChains, ","), hook, position)
+    return nil
 }
 
-// SyncRules 用给定的规则集合替换指定链的内容。
-// 参数：
-// - chain: 目标链名
-// - rules: 每一条规则为一个字符串切片，表示追加到链时的参数（不包含 -A chain 部分），例如 {"-s", "10.0.0.5", "-j", "ACCEPT"}
-// 行为：
-// - 先 `-F` 清空链（仅清空链本身，不删除跳转规则）。
-// - 逐条 `-A` 添加规则。
-// - 完成后通过日志记录同步时间，以便审计和排查。
-// 返回值：changed 恒返回 true（目前每次直接替换）；如需差分更新可在后续实现中加入比较逻辑。
-func SyncRules(chain string, rules [][]string) (changed bool, err error) {
-    // flush chain
-    if _, err := RunCommand("iptables", "-w", "-F", chain); err != nil {
-        return false, err
-    }
-
-    for _, r := range rules {
-        args := append([]string{"-A", chain}, r...)
-        _, err := RunCommand("iptables", append([]string{"-w"}, args...)...)
-        if err != nil {
-            return false, err
-        }
+// RemoveJumps 删除内置链 hook 中跳转到 chains 的规则（一次 iptables-restore 事务），返回被删除跳转的目标。
+func (b *Backend) RemoveJumps(hook string, chains []string) ([]string, error) {
+    current, err := b.ReadChains()
+    if err != nil {
+        return nil, err
+    }
+    payload, removed := RenderRemoveJumps(hook, current[hook], chains)
+    if payload == "" {
+        return nil, nil
     }
+    if _, err := b.exec.RunWithInput(payload, b.restoreBin, "-w", "--noflush"); err != nil {
+        return nil, fmt.Errorf("%s: %w", b.restoreBin, err)
+    }
+    log.Printf("removed jumps to %s from %s", strings.Join(removed, ","), hook)
+    return removed, nil
+}
 
-    // 记录规则变更时间，用以审计和排查
-    log.Printf("rules synced for chain %s at %s", chain, time.Now().Format(time.RFC3339))
-    return true, nil
+// ChainRules 描述一条自定义链的期望内容，与 dataplane.ChainRules 为同一类型。
+type ChainRules = dataplane.ChainRules
+
+// quoteRestoreArg 对含空白或引号的参数加双引号，保证 iptables-restore 能按原样切分参数。
+func quoteRestoreArg(arg string) string {
+    if arg != "" && !strings.ContainsAny(arg, " \t\"'") {
+        return arg
+    }
+    return "\"" + strings.ReplaceAll(arg, "\"", "\\\"") + "\""
 }
 
 // EnsureIPSet 确保给定的 ipset 存在；若不存在则创建。
-// 说明：使用 hash:ip 类型保存 IP 列表，适用于白名单集合。
-func EnsureIPSet(setName string) error {
+// 说明：使用 hash:ip 类型保存 IP 列表，适用于白名单集合；集合的 family 与本实例的地址族一致。
+func (b *Backend) EnsureIPSet(setName string) error {
+    return b.ensureSet(setName, SetTypeIP)
+}
+
+// ensureSet 创建 setType 类型、family 与本实例一致的 ipset（已存在时不做修改）。
+func (b *Backend) ensureSet(setName, setType string) error {
     if strings.TrimSpace(setName) == "" {
         return nil
     }
-    _, err := RunCommand("ipset", "create", setName, "hash:ip", "-exist")
+    _, err := b.exec.Run("ipset", "create", setName, setType, "family", b.ipsetFamily(), "-exist")
     return err
 }
 
 // SyncIPSet 用给定的 IP 列表替换指定 ipset 的内容。
-// 行为：先 flush，再逐条 add（使用 -exist 避免重复错误）。
-func SyncIPSet(setName string, ips []string) error {
+// 行为：
+// - 先读取现有成员，与期望一致时直接返回（不产生写操作）。
+// - 否则在临时集合（TempSetName）中构建完整成员，再 `swap` 到正式集合并销毁临时集合；
+//   全部指令通过一次 `ipset restore` 执行。
+// 目的：正式集合始终是“旧的完整内容”或“新的完整内容”之一，`--match-set` 规则不会看到空集合或部分集合。
+func (b *Backend) SyncIPSet(setName string, ips []string) error {
+    return b.syncSet(setName, SetTypeIP, ips)
+}
+
+// SyncIPPortSet 用给定的成员（"ip,proto:port"）替换 hash:ip,port 类型 ipset 的内容，方式与 SyncIPSet 相同。
+func (b *Backend) SyncIPPortSet(setName string, members []string) error {
+    return b.syncSet(setName, SetTypeIPPort, members)
+}
+
+// SyncNetSet 用给定的成员（"cidr" 或 "cidr nomatch"，见 dataplane.NetMember）替换 hash:net 类型 ipset 的内容，方式与 SyncIPSet 相同。
+func (b *Backend) SyncNetSet(setName string, members []string) error {
+    return b.syncSet(setName, SetTypeNet, members)
+}
+
+// syncSet 确保 setType 类型的集合存在，并在成员与期望不一致时通过临时集合原子替换。
+// 说明：同名集合已以其它类型存在时（例如升级后同一名称改为 hash:ip,port 或 hash:net），`ipset create -exist` 与 `ipset swap` 都会失败，
+// 此时销毁后按新类型重建（见 RenderSetRecreate）；集合仍被规则引用时内核拒绝销毁，返回错误，等引用它的规则被改写或回收后的同步再重建。
+func (b *Backend) syncSet(setName, setType string, members []string) error {
     if strings.TrimSpace(setName) == "" {
         return nil
     }
-    if err := EnsureIPSet(setName); err != nil {
-        return err
+    current, currentType, readErr := b.readSet(setName)
+    if readErr == nil && currentType != "" && currentType != setType {
+        if _, err := b.exec.RunWithInput(RenderSetRecreate(setName, setType, b.ipsetFamily(), members), "ipset", "restore", "-exist"); err != nil {
+            return fmt.Errorf("ipset %s: recreate as %s (was %s): %w", setName, setType, currentType, err)
+        }
+        return nil
     }
-    if _, err := RunCommand("ipset", "flush", setName); err != nil {
+    if err := b.ensureSet(setName, setType); err != nil {
         return err
     }
-    for _, ip := range ips {
-        if strings.TrimSpace(ip) == "" {
+    if readErr == nil && sameMembers(current, members) {
+        return nil
+    }
+    if _, err := b.exec.RunWithInput(RenderSetSwap(setName, setType, b.ipsetFamily(), members), "ipset", "restore", "-exist"); err != nil {
+        return fmt.Errorf("ipset restore %s: %w", setName, err)
+    }
+    return nil
+}
+
+// ipset 集合类型。
+// - SetTypeIP: 白名单集合，成员为 IP
+// - SetTypeIPPort: 旧规则的端口列表超出 multiport 上限时使用，成员为 "ip,proto:port"
+// - SetTypeNet: 白名单中的 ipBlock 对端，成员为网段，例外网段带 nomatch
+const (
+    SetTypeIP     = "hash:ip"
+    SetTypeIPPort = "hash:ip,port"
+    SetTypeNet    = "hash:net"
+)
+
+// RenderIPSetSwap 生成通过临时集合原子替换 hash:ip 集合 setName 成员的 `ipset restore` 输入（见 RenderSetSwap）。
+func RenderIPSetSwap(setName, family string, ips []string) string {
+    return RenderSetSwap(setName, SetTypeIP, family, ips)
+}
+
+// RenderSetSwap 生成通过临时集合原子替换 setName 成员的 `ipset restore` 输入。
+// 说明：临时集合先 create（-exist 兼容上次异常退出的残留）再 flush，保证从空集合开始构建；
+// setType 与 family（inet 或 inet6）必须与正式集合一致，否则 swap 会失败。
+func RenderSetSwap(setName, setType, family string, members []string) string {
+    tmp := TempSetName(setName)
+    var sb strings.Builder
+    fmt.Fprintf(&sb, "create %s %s family %s\n", tmp, setType, family)
+    fmt.Fprintf(&sb, "flush %s\n", tmp)
+    for _, m := range members {
+        if m = strings.TrimSpace(m); m == "" {
+            continue
+        }
+        fmt.Fprintf(&sb, "add %s %s\n", tmp, m)
+    }
+    fmt.Fprintf(&sb, "swap %s %s\n", tmp, setName)
+    fmt.Fprintf(&sb, "destroy %s\n", tmp)
+    return sb.String()
+}
+
+// TempSetName 返回 setName 对应的临时集合名（追加 "-T"）。
+// 说明：MakeSetName 生成的名称最长 28 字符，追加后仍在 ipset 31 字符的限制内。
+func TempSetName(setName string) string {
+    return setName + "-T"
+}
+
+// RenderSetRecreate 生成销毁集合 setName、再按 setType 重建并写入成员的 `ipset restore` 输入，用于集合类型变化（类型不同的集合不能 swap）。
+// 说明：销毁失败（集合仍被规则引用）时 `ipset restore` 在第一行即停止，原集合保持不变。
+func RenderSetRecreate(setName, setType, family string, members []string) string {
+    var sb strings.Builder
+    fmt.Fprintf(&sb, "destroy %s\n", setName)
+    fmt.Fprintf(&sb, "create %s %s family %s\n", setName, setType, family)
+    for _, m := range members {
+        if m = strings.TrimSpace(m); m == "" {
+            continue
+        }
+        fmt.Fprintf(&sb, "add %s %s\n", setName, m)
+    }
+    return sb.String()
+}
+
+// ListIPSetMembers 返回指定 ipset 当前的成员列表（基于 `ipset save` 输出的 add 行；成员之后的选项如 nomatch 一并保留）。
+func (b *Backend) ListIPSetMembers(setName string) ([]string, error) {
+    members, _, err := b.readSet(setName)
+    return members, err
+}
+
+// readSet 通过 `ipset save` 读取集合的成员与类型（create 行的第三个字段，例如 hash:ip）。
+func (b *Backend) readSet(setName string) (members []string, setType string, err error) {
+    out, err := b.exec.Run("ipset", "save", setName)
+    if err != nil {
+        return nil, "", err
+    }
+    members = []string{}
+    for _, line := range strings.Split(out, "\n") {
+        fields := strings.Fields(line)
+        if len(fields) < 3 || fields[1] != setName {
             continue
         }
-        if _, err := RunCommand("ipset", "add", setName, ip, "-exist"); err != nil {
-            return err
+        switch fields[0] {
+        case "create":
+            setType = fields[2]
+        case "add":
+            members = append(members, strings.Join(fields[2:], " "))
+        }
+    }
+    return members, setType, nil
+}
+
+// ListIPSets 返回名称以 prefix 开头、且 family 与本实例地址族一致的全部 ipset（基于 `ipset list -t` 的 Name/Header 行）。
+// 说明：ipset 的名称空间不区分地址族，按 family 过滤可避免 IPv4 实例把 IPv6 集合当作孤儿回收（反之亦然）。
+func (b *Backend) ListIPSets(prefix string) ([]string, error) {
+    out, err := b.exec.Run("ipset", "list", "-t")
+    if err != nil {
+        return nil, err
+    }
+    return ParseIPSetHeaders(out, prefix, b.ipsetFamily()), nil
+}
+
+// ParseIPSetHeaders 解析 `ipset list -t` 的输出，返回名称以 prefix 开头且 family 匹配的集合名。
+// 说明：Header 行形如 `Header: family inet6 hashsize 1024 maxelem 65536`。
+func ParseIPSetHeaders(out, prefix, family string) []string {
+    sets := []string{}
+    name := ""
+    for _, line := range strings.Split(out, "\n") {
+        line = strings.TrimSpace(line)
+        switch {
+        case strings.HasPrefix(line, "Name:"):
+            name = strings.TrimSpace(strings.TrimPrefix(line, "Name:"))
+        case strings.HasPrefix(line, "Header:"):
+            fields := strings.Fields(strings.TrimPrefix(line, "Header:"))
+            setFamily := "inet"
+            for i := 0; i+1 < len(fields); i++ {
+                if fields[i] == "family" {
+                    setFamily = fields[i+1]
+                }
+            }
+            if name != "" && strings.HasPrefix(name, prefix) && setFamily == family {
+                sets = append(sets, name)
+            }
+            name = ""
+        }
+    }
+    return sets
+}
+
+// DestroyIPSet 销毁指定 ipset；集合不存在时视为成功。
+// 说明：仍被 iptables 规则引用的集合无法销毁，调用方需先删除引用它的链。
+func (b *Backend) DestroyIPSet(setName string) error {
+    if _, err := b.exec.Run("ipset", "destroy", setName); err != nil {
+        if strings.Contains(err.Error(), "does not exist") {
+            return nil
         }
+        return err
     }
     return nil
 }
 
-// MakeChainName 根据前缀、命名空间和名称生成合法的 iptables 链名。
+// sameMembers 判断现有成员与期望成员是否为同一集合（忽略顺序、重复与空白项）。
+func sameMembers(current, desired []string) bool {
+    want := map[string]struct{}{}
+    for _, ip := range desired {
+        if ip = strings.TrimSpace(ip); ip != "" {
+            want[ip] = struct{}{}
+        }
+    }
+    have := map[string]struct{}{}
+    for _, ip := range current {
+        have[ip] = struct{}{}
+    }
+    if len(have) != len(want) {
+        return false
+    }
+    for ip := range want {
+        if _, ok := have[ip]; !ok {
+            return false
+        }
+    }
+    return true
+}
+
+// 名称长度限制。
+// - MaxChainNameLen: iptables 链名上限（内核 XT_EXTENSION_MAXNAMELEN 为 29，含结尾 NUL）。
+// - MaxSetNameLen: 本程序生成的 ipset 名称上限；ipset 上限为 31，预留 TempSetName 追加的 "-T"。
+// - MaxLogPrefixLen: LOG 目标 --log-prefix 的上限（29 个字符）；NFLOG 的上限更宽，为保持一致统一按该值生成。
+const (
+    MaxChainNameLen = 28
+    MaxSetNameLen   = 29
+    MaxLogPrefixLen = 29
+)
+
+// nameHashLen 为名称中哈希部分的长度（base32 字符，约 50 bit）。
+const nameHashLen = 10
+
+// MakeChainName 根据前缀、用途和固定名称生成链名（用于 MS-ROOT-IN 这类全局唯一的链）。
 // 说明：
-// - iptables 链名长度通常受限（不同内核/iptables 版本略有差异，常见限制约为 28），因此这里对生成的链名做截断以保证兼容性。
+// - 仅用于不依赖外部输入的固定名称；与 Deployment 相关的链请使用 MakeOwnerChainName，以避免截断导致的重名。
 // - 将非法字符（如 '/'、':'）替换为 '-'，并返回大写字符串以便可读性和一致性。
 func MakeChainName(prefix, ns, name string) string {
     base := fmt.Sprintf("%s-%s-%s", prefix, ns, name)
@@ -144,8 +425,8 @@ func MakeChainName(prefix, ns, name string) string {
     return strings.ToUpper(base)
 }
 
-// MakeSetName 根据前缀、用途与名称生成合法的 ipset 名称。
-// 说明：ipset 名称长度限制通常为 31，这里做截断以保证兼容性。
+// MakeSetName 根据前缀、用途与固定名称生成 ipset 名称。
+// 说明：与 Deployment 相关的集合请使用 MakeOwnerSetName。
 func MakeSetName(prefix, role, name string) string {
     base := fmt.Sprintf("%s-%s-%s", prefix, role, name)
     if len(base) > 28 {
@@ -156,6 +437,71 @@ func MakeSetName(prefix, role, name string) string {
     return strings.ToUpper(base)
 }
 
+// MakeOwnerChainName 为属于某个工作负载（namespace/name）的链生成名称，格式为 `<prefix>-<role>-<可读部分>-<哈希>`。
+// 说明：
+// - 哈希由完整的 "namespace/name" 计算（稳定、与长度无关），因此
+//   `production/payment-api` 与 `production/payment-worker` 即使可读部分被截断成相同前缀，也会得到不同的链名。
+// - 可读部分取 "namespace-name" 并按剩余长度截断，仅用于人工排查；归属关系以哈希与注册表为准。
+// - prefix 带代号，随代号增长变长；`<prefix>-<role>-<哈希>` 已超过 MaxChainNameLen 时返回错误，不生成内核会拒绝的名称。
+func MakeOwnerChainName(prefix, role, ns, name string) (string, error) {
+    return makeHashedName(prefix, role, ns+"/"+name, MaxChainNameLen)
+}
+
+// MakeOwnerSetName 为属于某个工作负载的 ipset 生成名称，规则同 MakeOwnerChainName，长度上限为 MaxSetNameLen。
+func MakeOwnerSetName(prefix, role, ns, name string) (string, error) {
+    return makeHashedName(prefix, role, ns+"/"+name, MaxSetNameLen)
+}
+
+// MakeOwnerLogPrefix 为属于某个工作负载的拒绝日志生成前缀，格式为 `<prefix>-<role>-<可读部分>-<哈希> `。
+// 说明：哈希与 MakeOwnerChainName 使用同一 "namespace/name" 计算，日志可直接对应到专用链与 Deployment；
+// 结尾保留一个空格，使内核日志中前缀与后面的报文字段分开。
+func MakeOwnerLogPrefix(prefix, role, ns, name string) (string, error) {
+    base, err := makeHashedName(prefix, role, ns+"/"+name, MaxLogPrefixLen-1)
+    if err != nil {
+        return "", err
+    }
+    return base + " ", nil
+}
+
+// makeHashedName 生成 `<prefix>-<role>-<可读部分>-<哈希>` 形式、长度不超过 maxLen 的名称。
+// 说明：可读部分可以省略，prefix、role 与哈希不截断（代号与用途名会被解析，哈希保证不重名）；三者放不下时返回错误。
+func makeHashedName(prefix, role, identity string, maxLen int) (string, error) {
+    sum := sha256.Sum256([]byte(identity))
+    hash := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(sum[:])[:nameHashLen]
+
+    head := strings.ToUpper(prefix + "-" + role + "-")
+    if len(head)+len(hash) > maxLen {
+        return "", fmt.Errorf("name %s%s is longer than %d characters", head, hash, maxLen)
+    }
+    room := maxLen - len(head) - len(hash) - 1
+    readable := sanitizeName(identity)
+    if room <= 0 {
+        return head + hash, nil
+    }
+    if len(readable) > room {
+        readable = readable[:room]
+    }
+    readable = strings.Trim(readable, "-")
+    if readable == "" {
+        return head + hash, nil
+    }
+    return head + readable + "-" + hash, nil
+}
+
+// sanitizeName 将名称中链名/集合名不允许或易混淆的字符替换为 '-'，并转为大写。
+func sanitizeName(s string) string {
+    var sb strings.Builder
+    for _, r := range strings.ToUpper(s) {
+        switch {
+        case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+            sb.WriteRune(r)
+        default:
+            sb.WriteRune('-')
+        }
+    }
+    return sb.String()
+}
+
 /* 关键常量与系统变量说明：
  - iptables 二进制：程序通过执行系统命令 `iptables` 来应用规则，容器镜像需包含该二进制并以具备操作主机网络命名空间的方式运行（例如 hostNetwork 或 NET_ADMIN 特权）。
  - xtables 锁（-w 标志）：当多个进程同时操作 iptables 时会发生锁竞争，`-w` 命令选项会在获取锁失败时等待，减少并发失败风险。
@@ -164,8 +510,15 @@ func MakeSetName(prefix, role, name string) string {
      - `-I <chain> <pos> <rule>`: 在指定位置插入规则（常用于将跳转插入到链的第一条，保证较高优先级）。
      - `-A <chain> <rule>`: 在链末尾追加规则。
      - `-F <chain>`: 清空链中所有规则（不删除链本身）。
+     - `-D <chain> <num>`: 删除指定序号的规则（差分同步时用于删除本程序自有链中的多余规则）；内置链与其它组件共用，其中的跳转按规则内容（`-D <chain> <rule>`）删除。
      - `-N <chain>`: 新建链。
- - 链名长度限制：iptables 链名在不同内核/iptables 版本中存在长度限制（常见约 28 字符），因此 `MakeChainName` 对生成的名称做了截断以保证兼容性。
+     - `-X <chain>`: 删除（已清空且不再被引用的）链，垃圾回收时使用。
+ - iptables-restore：`SyncChains`、`EnsureJumps`、`RemoveJumps` 与 `DeleteChains` 都把变更渲染为一个 `iptables-restore -w --noflush` 输入，在一个事务中提交。`--noflush` 保证只改动输入中涉及的链，不会清空 Calico/kube-proxy 的链；输入中以 `:CHAIN - [0:0]` 声明的链会被创建或清空（只用于新建链与待删除的链）。
+ - 差分同步：`SyncChains` 先用 `iptables-save -t filter` 读取现有规则并归一化（`CanonicalRule`），只对差异规则生成 `-D`/`-I` 指令；内容一致的链不产生任何写操作。
+ - ipset 原子替换：`SyncIPSet` 通过 `ipset restore` 在临时集合 `<name>-T` 中构建成员，再 `swap` 到正式集合并 `destroy` 临时集合，白名单集合不会经历空集合或部分集合的状态。
+ - 链名长度限制：iptables 链名最长 28 字符、ipset 名称最长 31 字符。与工作负载相关的名称由 `MakeOwnerChainName`/`MakeOwnerSetName` 生成：可读部分按剩余长度截断，末尾附加由完整 "namespace/name" 计算的哈希，截断不会导致不同工作负载重名；代号增长到连 `<prefix>-<role>-<哈希>` 都放不下时返回错误，该工作负载被拒绝下发（见 FamilyPlan.Refused），而不是生成超长的名称。
  - 权限要求：执行 iptables 修改通常需要 root 权限或具备 `NET_ADMIN` 能力的进程。
- - Pod IP 变量：代码使用 `Pod.Status.PodIP` 作为规则中的 IP，需注意该字段在 Pod 尚未分配 IP 或尚未就绪时可能为空字符串，逻辑中会跳过空 IP。
+ - Pod IP 变量：代码使用 `Pod.Status.PodIPs`（为空时回退到 `Pod.Status.PodIP`）中的全部地址，按地址族分别写入 iptables 与 ip6tables；Pod 尚未分配 IP 时跳过。
+ - 地址族：`NewFamilyBackend(IPv6, ...)` 使用 ip6tables / ip6tables-save / ip6tables-restore，ipset 以 `family inet6` 创建；ipset 名称不区分地址族，因此 IPv6 集合使用独立的用途名（SRC6/DST6）。
+ - iptables 模式：legacy 与 nft 两种模式的规则集互不可见。`DetectMode` 在启动时比较 `iptables-legacy-save` 与 `iptables-nft-save` 中 KUBE-/cali- 链的数量，选出与 kube-proxy、Calico 一致的模式，之后所有命令都使用带模式后缀的命令名（iptables-nft、iptables-nft-save 等）。
 */
@@ -0,0 +1,213 @@
+package iptables
+
+import (
+    "reflect"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+// jumpRules 返回依次跳转到 targets 的规则（iptables-save 形式）。
+func jumpRules(targets ...string) [][]string {
+    rules := [][]string{}
+    for _, t := range targets {
+        rules = append(rules, []string{"-j", t})
+    }
+    return rules
+}
+
+// applyJumpPayload 按 iptables-restore 的语义把 payload 中的 -D/-I/-A 指令作用于 hook 的跳转目标列表。
+// 说明：-D 按规则内容删除第一条匹配的规则（这里按跳转目标比较），-I 的序号从 1 开始。
+func applyJumpPayload(t *testing.T, hook string, targets []string, payload string) []string {
+    t.Helper()
+    out := append([]string{}, targets...)
+    for _, line := range strings.Split(payload, "\n") {
+        fields := strings.Fields(line)
+        if len(fields) < 4 || fields[1] != hook {
+            continue
+        }
+        target := fields[len(fields)-1]
+        switch fields[0] {
+        case "-D":
+            if _, err := strconv.Atoi(fields[2]); err == nil {
+                t.Fatalf("delete by index on a shared chain: %q", line)
+            }
+            removed := false
+            for i, existing := range out {
+                if existing == target {
+                    out = append(out[:i], out[i+1:]...)
+                    removed = true
+                    break
+                }
+            }
+            if !removed {
+                t.Fatalf("%q matches no rule in %v", line, out)
+            }
+        case "-I":
+            n, err := strconv.Atoi(fields[2])
+            if err != nil || n < 1 || n > len(out)+1 {
+                t.Fatalf("bad insert position in %q for %v", line, out)
+            }
+            out = append(out[:n-1], append([]string{target}, out[n-1:]...)...)
+        case "-A":
+            out = append(out, target)
+        }
+    }
+    return out
+}
+
+func TestRenderJumpPlacement(t *testing.T) {
+    roots := []string{"MS-ROOT-OUT", "MS-ROOT-IN"}
+    cases := []struct {
+        name     string
+        current  []string
+        position string
+        payload  string
+        want     []string
+    }{
+        {
+            name:     "empty hook",
+            current:  nil,
+            position: "insert",
+            payload:  "*filter\n-A FORWARD -j MS-ROOT-OUT\n-A FORWARD -j MS-ROOT-IN\nCOMMIT\n",
+            want:     roots,
+        },
+        {
+            name:     "insert at the top",
+            current:  []string{"KUBE-FORWARD", "cali-FORWARD"},
+            position: "insert",
+            payload:  "*filter\n-I FORWARD 1 -j MS-ROOT-OUT\n-I FORWARD 2 -j MS-ROOT-IN\nCOMMIT\n",
+            want:     []string{"MS-ROOT-OUT", "MS-ROOT-IN", "KUBE-FORWARD", "cali-FORWARD"},
+        },
+        {
+            name:     "append after other rules",
+            current:  []string{"KUBE-FORWARD", "cali-FORWARD"},
+            position: "append",
+            payload:  "*filter\n-A FORWARD -j MS-ROOT-OUT\n-A FORWARD -j MS-ROOT-IN\nCOMMIT\n",
+            want:     []string{"KUBE-FORWARD", "cali-FORWARD", "MS-ROOT-OUT", "MS-ROOT-IN"},
+        },
+        {
+            name:     "before an anchor",
+            current:  []string{"KUBE-FORWARD", "cali-FORWARD", "DOCKER"},
+            position: "before:cali-FORWARD",
+            payload:  "*filter\n-I FORWARD 2 -j MS-ROOT-OUT\n-I FORWARD 3 -j MS-ROOT-IN\nCOMMIT\n",
+            want:     []string{"KUBE-FORWARD", "MS-ROOT-OUT", "MS-ROOT-IN", "cali-FORWARD", "DOCKER"},
+        },
+        {
+            name:     "before an anchor prefix",
+            current:  []string{"KUBE-FORWARD", "cali-FORWARD"},
+            position: "before:cali-*",
+            payload:  "*filter\n-I FORWARD 2 -j MS-ROOT-OUT\n-I FORWARD 3 -j MS-ROOT-IN\nCOMMIT\n",
+            want:     []string{"KUBE-FORWARD", "MS-ROOT-OUT", "MS-ROOT-IN", "cali-FORWARD"},
+        },
+        {
+            name:     "missing anchor falls back to the top",
+            current:  []string{"KUBE-FORWARD"},
+            position: "before:cali-FORWARD",
+            payload:  "*filter\n-I FORWARD 1 -j MS-ROOT-OUT\n-I FORWARD 2 -j MS-ROOT-IN\nCOMMIT\n",
+            want:     []string{"MS-ROOT-OUT", "MS-ROOT-IN", "KUBE-FORWARD"},
+        },
+        {
+            name:     "already in place at the top",
+            current:  []string{"MS-ROOT-OUT", "MS-ROOT-IN", "cali-FORWARD"},
+            position: "insert",
+            want:     []string{"MS-ROOT-OUT", "MS-ROOT-IN", "cali-FORWARD"},
+        },
+        {
+            name:     "already in place before the anchor",
+            current:  []string{"KUBE-FORWARD", "MS-ROOT-OUT", "MS-ROOT-IN", "cali-FORWARD"},
+            position: "before:cali-FORWARD",
+            want:     []string{"KUBE-FORWARD", "MS-ROOT-OUT", "MS-ROOT-IN", "cali-FORWARD"},
+        },
+        {
+            name:     "already appended",
+            current:  []string{"cali-FORWARD", "MS-ROOT-OUT", "MS-ROOT-IN"},
+            position: "append",
+            want:     []string{"cali-FORWARD", "MS-ROOT-OUT", "MS-ROOT-IN"},
+        },
+        {
+            name:     "move in front of the anchor",
+            current:  []string{"cali-FORWARD", "MS-ROOT-OUT", "MS-ROOT-IN"},
+            position: "before:cali-FORWARD",
+            payload:  "*filter\n-D FORWARD -j MS-ROOT-OUT\n-D FORWARD -j MS-ROOT-IN\n-I FORWARD 1 -j MS-ROOT-OUT\n-I FORWARD 2 -j MS-ROOT-IN\nCOMMIT\n",
+            want:     []string{"MS-ROOT-OUT", "MS-ROOT-IN", "cali-FORWARD"},
+        },
+        {
+            name:     "wrong order",
+            current:  []string{"MS-ROOT-IN", "MS-ROOT-OUT", "cali-FORWARD"},
+            position: "insert",
+            payload:  "*filter\n-D FORWARD -j MS-ROOT-IN\n-D FORWARD -j MS-ROOT-OUT\n-I FORWARD 1 -j MS-ROOT-OUT\n-I FORWARD 2 -j MS-ROOT-IN\nCOMMIT\n",
+            want:     []string{"MS-ROOT-OUT", "MS-ROOT-IN", "cali-FORWARD"},
+        },
+        {
+            name:     "stale duplicates are removed once each",
+            current:  []string{"MS-ROOT-OUT", "KUBE-FORWARD", "MS-ROOT-IN", "cali-FORWARD", "MS-ROOT-IN"},
+            position: "append",
+            payload:  "*filter\n-D FORWARD -j MS-ROOT-OUT\n-D FORWARD -j MS-ROOT-IN\n-D FORWARD -j MS-ROOT-IN\n-A FORWARD -j MS-ROOT-OUT\n-A FORWARD -j MS-ROOT-IN\nCOMMIT\n",
+            want:     []string{"KUBE-FORWARD", "cali-FORWARD", "MS-ROOT-OUT", "MS-ROOT-IN"},
+        },
+        {
+            name:     "one root missing",
+            current:  []string{"MS-ROOT-OUT", "cali-FORWARD"},
+            position: "insert",
+            payload:  "*filter\n-D FORWARD -j MS-ROOT-OUT\n-I FORWARD 1 -j MS-ROOT-OUT\n-I FORWARD 2 -j MS-ROOT-IN\nCOMMIT\n",
+            want:     []string{"MS-ROOT-OUT", "MS-ROOT-IN", "cali-FORWARD"},
+        },
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            payload := RenderJumpPlacement("FORWARD", jumpRules(tc.current...), roots, tc.position)
+            if payload != tc.payload {
+                t.Fatalf("payload = %q, want %q", payload, tc.payload)
+            }
+            if got := applyJumpPayload(t, "FORWARD", tc.current, payload); !reflect.DeepEqual(got, tc.want) {
+                t.Fatalf("FORWARD after restore = %v, want %v", got, tc.want)
+            }
+        })
+    }
+}
+
+// 旧跳转带有其它匹配条件时，按 iptables-save 中的完整规则内容删除。
+func TestRenderJumpPlacementDeletesBySpec(t *testing.T) {
+    current := [][]string{
+        {"-m", "comment", "--comment", "policy root", "-j", "MS-ROOT-IN"},
+        {"-j", "cali-FORWARD"},
+    }
+    payload := RenderJumpPlacement("FORWARD", current, []string{"MS-ROOT-IN"}, "append")
+    want := "*filter\n-D FORWARD -m comment --comment \"policy root\" -j MS-ROOT-IN\n-A FORWARD -j MS-ROOT-IN\nCOMMIT\n"
+    if payload != want {
+        t.Fatalf("payload = %q, want %q", payload, want)
+    }
+}
+
+func TestRenderRemoveJumps(t *testing.T) {
+    current := []string{"MS-ROOT-OUT", "KUBE-FORWARD", "MS-ROOT-IN", "cali-FORWARD", "MS-ROOT-IN"}
+    payload, removed := RenderRemoveJumps("FORWARD", jumpRules(current...), []string{"MS-ROOT-OUT", "MS-ROOT-IN"})
+    want := "*filter\n-D FORWARD -j MS-ROOT-OUT\n-D FORWARD -j MS-ROOT-IN\n-D FORWARD -j MS-ROOT-IN\nCOMMIT\n"
+    if payload != want {
+        t.Fatalf("payload = %q, want %q", payload, want)
+    }
+    if wantRemoved := []string{"MS-ROOT-OUT", "MS-ROOT-IN", "MS-ROOT-IN"}; !reflect.DeepEqual(removed, wantRemoved) {
+        t.Fatalf("removed = %v, want %v", removed, wantRemoved)
+    }
+    if got := applyJumpPayload(t, "FORWARD", current, payload); !reflect.DeepEqual(got, []string{"KUBE-FORWARD", "cali-FORWARD"}) {
+        t.Fatalf("FORWARD after restore = %v", got)
+    }
+
+    if payload, removed := RenderRemoveJumps("FORWARD", jumpRules("cali-FORWARD"), []string{"MS-ROOT-IN"}); payload != "" || removed != nil {
+        t.Fatalf("no jumps to remove, got %q %v", payload, removed)
+    }
+}
+
+func TestRenderDeleteChainsUnlinksBySpec(t *testing.T) {
+    current := map[string][][]string{
+        "FORWARD":       jumpRules("KUBE-FORWARD", "MS-ROOT-IN", "cali-FORWARD"),
+        "MS-ROOT-IN":    {{"-j", "MS-G1-ROOT-IN"}},
+        "MS-G1-ROOT-IN": {},
+    }
+    payload := RenderDeleteChains(current, []string{"MS-ROOT-IN", "MS-G1-ROOT-IN", "MS-MISSING"})
+    want := "*filter\n:MS-G1-ROOT-IN - [0:0]\n:MS-ROOT-IN - [0:0]\n-D FORWARD -j MS-ROOT-IN\n-X MS-G1-ROOT-IN\n-X MS-ROOT-IN\nCOMMIT\n"
+    if payload != want {
+        t.Fatalf("payload = %q, want %q", payload, want)
+    }
+}
@@ -0,0 +1,107 @@
+package iptables
+
+import (
+    "fmt"
+    "log"
+    "strings"
+
+    "github.com/example/iptables-controller/internal/dataplane"
+)
+
+// Mode 表示 iptables 命令使用的内核后端。
+// 说明：同一台主机上 iptables-legacy 与 iptables-nft 写入的是两套互不相干的规则集，
+// 本程序必须与 Calico、kube-proxy 使用同一种模式，否则规则虽然写入成功却不会生效。
+type Mode string
+
+const (
+    // ModeDefault 表示直接调用 `iptables`，模式由镜像内的 alternatives 决定。
+    ModeDefault Mode = ""
+    // ModeLegacy 使用 iptables-legacy / iptables-legacy-save / iptables-legacy-restore。
+    ModeLegacy Mode = "legacy"
+    // ModeNFT 使用 iptables-nft / iptables-nft-save / iptables-nft-restore。
+    ModeNFT Mode = "nft"
+)
+
+// ParseMode 解析 IPTABLES_MODE 的取值：auto（或空）返回 false 表示需要探测，legacy/nft 返回对应模式。
+func ParseMode(value string) (Mode, bool, error) {
+    switch strings.ToLower(strings.TrimSpace(value)) {
+    case "", "auto":
+        return ModeDefault, false, nil
+    case "legacy":
+        return ModeLegacy, true, nil
+    case "nft", "nf_tables":
+        return ModeNFT, true, nil
+    default:
+        return ModeDefault, false, fmt.Errorf("unknown iptables mode %q (expected auto, legacy or nft)", value)
+    }
+}
+
+// DetectMode 探测主机上 Calico / kube-proxy 正在使用的 iptables 模式（思路与 kube-proxy 的 iptables-wrapper 相同）。
+// 流程：
+// 1. 分别执行 `iptables-legacy-save` 与 `iptables-nft-save`，统计两套规则集中 `KUBE-*` / `cali-*` 链的数量。
+// 2. 数量多的一方即为集群组件使用的模式。
+// 3. 两者都没有（例如组件尚未启动）时，回退到 `iptables --version` 报告的模式；仍无法判断时使用 ModeDefault。
+// 说明：某个 save 命令不存在或执行失败时按 0 计数，不视为错误；exec 为 nil 时使用 HostExecutor。
+func DetectMode(exec dataplane.Executor) Mode {
+    if exec == nil {
+        exec = HostExecutor{}
+    }
+    legacy := countClusterChains(exec, "iptables-legacy-save")
+    nft := countClusterChains(exec, "iptables-nft-save")
+
+    mode := ModeDefault
+    switch {
+    case nft > legacy:
+        mode = ModeNFT
+    case legacy > nft:
+        mode = ModeLegacy
+    default:
+        if out, err := exec.Run("iptables", "--version"); err == nil {
+            switch {
+            case strings.Contains(out, "nf_tables"):
+                mode = ModeNFT
+            case strings.Contains(out, "legacy"):
+                mode = ModeLegacy
+            }
+        }
+    }
+    log.Printf("iptables mode probe: legacy=%d nft=%d cluster chains, using %q", legacy, nft, modeName(mode))
+    return mode
+}
+
+// countClusterChains 统计 save 命令输出中 kube-proxy（KUBE-）与 Calico（cali-）链的声明数量。
+func countClusterChains(exec dataplane.Executor, saveBin string) int {
+    out, err := exec.Run(saveBin)
+    if err != nil {
+        return 0
+    }
+    n := 0
+    for _, line := range strings.Split(out, "\n") {
+        line = strings.TrimSpace(line)
+        if strings.HasPrefix(line, ":KUBE-") || strings.HasPrefix(line, ":cali-") {
+            n++
+        }
+    }
+    return n
+}
+
+// modeName 返回用于日志与 API 的模式名称（ModeDefault 显示为 "default"）。
+func modeName(mode Mode) string {
+    if mode == ModeDefault {
+        return "default"
+    }
+    return string(mode)
+}
+
+// binaryNames 返回地址族与模式对应的 iptables、iptables-save、iptables-restore 命令名，
+// 例如 IPv6 + nft 为 ip6tables-nft / ip6tables-nft-save / ip6tables-nft-restore。
+func binaryNames(family dataplane.Family, mode Mode) (bin, save, restore string) {
+    base := "iptables"
+    if family == dataplane.IPv6 {
+        base = "ip6tables"
+    }
+    if mode != ModeDefault {
+        base += "-" + string(mode)
+    }
+    return base, base + "-save", base + "-restore"
+}
@@ -0,0 +1,63 @@
+package iptables
+
+import (
+    "errors"
+    "testing"
+
+    "github.com/example/iptables-controller/internal/dataplane/fake"
+)
+
+const (
+    legacySave = "# Generated by iptables-save\n*nat\n:PREROUTING ACCEPT [0:0]\n:KUBE-SERVICES - [0:0]\n:KUBE-POSTROUTING - [0:0]\nCOMMIT\n*filter\n:FORWARD ACCEPT [0:0]\n:KUBE-FORWARD - [0:0]\n-A FORWARD -j KUBE-FORWARD\nCOMMIT\n"
+    nftSave    = "# Warning: iptables-legacy tables present, use iptables-legacy-save to see them\n*filter\n:FORWARD ACCEPT [0:0]\n:cali-FORWARD - [0:0]\n-A FORWARD -m comment --comment \"cali:wUHhoiAYhphO9Mso\" -j cali-FORWARD\nCOMMIT\n"
+)
+
+func TestDetectMode(t *testing.T) {
+    errMissing := errors.New("exec: not found")
+    cases := []struct {
+        name    string
+        legacy  string
+        nft     string
+        failNFT bool
+        version string
+        want    Mode
+    }{
+        {name: "legacy has more chains", legacy: legacySave, nft: nftSave, version: "iptables v1.8.7 (nf_tables)", want: ModeLegacy},
+        {name: "nft has more chains", legacy: nftSave, nft: legacySave, version: "iptables v1.8.7 (legacy)", want: ModeNFT},
+        {name: "nft save missing", legacy: nftSave, failNFT: true, want: ModeLegacy},
+        {name: "tie falls back to nf_tables version", legacy: nftSave, nft: nftSave, version: "iptables v1.8.7 (nf_tables)\n", want: ModeNFT},
+        {name: "no chains falls back to legacy version", version: "iptables v1.8.4 (legacy)\n", want: ModeLegacy},
+        {name: "old version without a mode", version: "iptables v1.6.1\n", want: ModeDefault},
+        {name: "comments and rules are not chains", legacy: "# :KUBE-SERVICES\n*filter\n-A FORWARD -j KUBE-FORWARD\nCOMMIT\n", want: ModeDefault},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            exec := fake.NewExecutor()
+            exec.Respond("iptables-legacy-save", tc.legacy)
+            exec.Respond("iptables-nft-save", tc.nft)
+            if tc.failNFT {
+                exec.FailOn("iptables-nft-save", errMissing)
+            }
+            if tc.version != "" {
+                exec.Respond("iptables --version", tc.version)
+            } else {
+                exec.FailOn("iptables --version", errMissing)
+            }
+            if got := DetectMode(exec); got != tc.want {
+                t.Fatalf("DetectMode = %q, want %q", got, tc.want)
+            }
+        })
+    }
+}
+
+func TestCountClusterChains(t *testing.T) {
+    exec := fake.NewExecutor()
+    exec.Respond("iptables-legacy-save", legacySave+nftSave)
+    exec.FailOn("iptables-nft-save", errors.New("exit status 1"))
+    if got := countClusterChains(exec, "iptables-legacy-save"); got != 4 {
+        t.Fatalf("legacy chains = %d, want 4", got)
+    }
+    if got := countClusterChains(exec, "iptables-nft-save"); got != 0 {
+        t.Fatalf("failed save counted %d chains, want 0", got)
+    }
+}
@@ -0,0 +1,70 @@
+package iptables
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestMakeOwnerSetNameLength(t *testing.T) {
+    cases := []struct {
+        name    string
+        prefix  string
+        role    string
+        want    string
+        wantErr bool
+    }{
+        {name: "readable part fits", prefix: "MS-G1", role: "SRC", want: "MS-G1-SRC-DEFAULT-"},
+        {name: "readable part truncated", prefix: "MS-G42", role: "DSTNET6", want: "MS-G42-DSTNET6-DEF-"},
+        {name: "no room for the readable part", prefix: "MS-G12345", role: "DSTNET6", want: "MS-G12345-DSTNET6-"},
+        {name: "exactly the limit", prefix: "MS-G123456", role: "DSTNET6", want: "MS-G123456-DSTNET6-"},
+        {name: "generation too long", prefix: "MS-G1234567", role: "DSTNET6", wantErr: true},
+        {name: "port set role too long", prefix: "MS-G123456", role: "PORT6-12", wantErr: true},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            got, err := MakeOwnerSetName(tc.prefix, tc.role, "default", "web")
+            if tc.wantErr {
+                if err == nil {
+                    t.Fatalf("got %q, want an error", got)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("MakeOwnerSetName: %v", err)
+            }
+            if len(got) > MaxSetNameLen || len(TempSetName(got)) > 31 {
+                t.Fatalf("%q (temp %q) exceeds the ipset name limit", got, TempSetName(got))
+            }
+            if !strings.HasPrefix(got, tc.want) || len(got) != len(tc.want)+nameHashLen {
+                t.Fatalf("got %q, want %q followed by the hash", got, tc.want)
+            }
+        })
+    }
+}
+
+// 可读部分被截断成相同前缀、或完全省略时，不同工作负载仍由哈希区分。
+func TestMakeOwnerChainNameDistinct(t *testing.T) {
+    for _, prefix := range []string{"MS", "MS-G1234567"} {
+        a, errA := MakeOwnerChainName(prefix, "IN", "production", "payment-api")
+        b, errB := MakeOwnerChainName(prefix, "IN", "production", "payment-worker")
+        if errA != nil || errB != nil {
+            t.Fatalf("MakeOwnerChainName(%q): %v %v", prefix, errA, errB)
+        }
+        if a == b || len(a) > MaxChainNameLen || len(b) > MaxChainNameLen {
+            t.Fatalf("prefix %q: got %q and %q", prefix, a, b)
+        }
+    }
+}
+
+func TestMakeOwnerLogPrefixLength(t *testing.T) {
+    got, err := MakeOwnerLogPrefix("MS", "AUDIT-HIN", "production", "payment-api")
+    if err != nil {
+        t.Fatalf("MakeOwnerLogPrefix: %v", err)
+    }
+    if len(got) > MaxLogPrefixLen || !strings.HasSuffix(got, " ") {
+        t.Fatalf("log prefix %q", got)
+    }
+    if _, err := MakeOwnerLogPrefix("MS-G1234567", "AUDIT-HIN", "production", "payment-api"); err == nil {
+        t.Fatal("over-long log prefix was accepted")
+    }
+}
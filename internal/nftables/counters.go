@@ -0,0 +1,52 @@
+package nftables
+
+import (
+    "fmt"
+    "strings"
+
+    "github.com/example/iptables-controller/internal/dataplane"
+)
+
+// ListCounters 返回各链中每条规则的计数（来自规则中的 `counter` 语句）；不存在的链不出现在结果中。
+// 说明：规则参数经 untranslateRule 还原，只包含地址、集合引用、注释与判决。
+func (b *Backend) ListCounters(chains []string) (map[string][]dataplane.RuleCounter, error) {
+    state, err := b.readTable()
+    if err != nil {
+        return nil, err
+    }
+    result := map[string][]dataplane.RuleCounter{}
+    for _, chain := range chains {
+        lines, ok := state.chains[chain]
+        if !ok {
+            continue
+        }
+        counters := make([]dataplane.RuleCounter, 0, len(lines))
+        for _, l := range lines {
+            packets, bytes := parseCounter(l.text)
+            counters = append(counters, dataplane.RuleCounter{Rule: untranslateRule(l.text), Packets: packets, Bytes: bytes})
+        }
+        result[chain] = counters
+    }
+    return result, nil
+}
+
+// ResetCounters 将各链的计数清零。
+// 说明：匿名 counter 无法单独清零（`nft reset rules` 需要较新的 nft 版本），这里在一个事务中用上次下发的内容重写链（flush + add rule），
+// 新规则的计数从 0 开始，规则语义不变；尚未由本实例下发过的链被忽略。
+func (b *Backend) ResetCounters(chains []string) error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    var script strings.Builder
+    for _, chain := range chains {
+        rendered, ok := b.chains[chain]
+        if !ok {
+            continue
+        }
+        fmt.Fprintf(&script, "flush chain inet %s %s\n", b.table, chain)
+        script.WriteString(rendered)
+    }
+    if script.Len() == 0 {
+        return nil
+    }
+    return b.apply(script.String())
+}
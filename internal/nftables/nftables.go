@@ -0,0 +1,516 @@
+package nftables
+
+import (
+    "fmt"
+    "log"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/example/iptables-controller/internal/dataplane"
+    "github.com/example/iptables-controller/internal/iptables"
+)
+
+// DefaultTable 为本程序独占的 nftables 表名（family 固定为 inet）。
+// 说明：IPv4 与 IPv6 实例各用一张表（IPv6 表名为 DefaultTable 加 "6" 后缀），两者链名相同但互不干扰。
+const DefaultTable = "microseg"
+
+// Backend 是基于原生 nftables 的 dataplane.Dataplane 实现。
+// 设计要点：
+// - 所有对象都放在独立的 `inet <table>` 表中，不触碰 iptables-nft 或 Calico 创建的表。
+// - IP 集合使用 nft 命名集合（named set），规则中以 `@集合名` 引用。
+// - 每次变更都拼成一个脚本通过 `nft -f -` 提交，脚本内的全部语句在一个事务中原子生效。
+// 字段说明：
+// - table: 表名
+// - family: 处理的地址族，决定命名集合的元素类型（ipv4_addr/ipv6_addr）与集合匹配使用 ip 还是 ip6
+// - exec: 命令执行器（默认在宿主机执行，测试中可替换）
+// - chains / sets: 上次成功下发的链内容与集合成员（渲染后的文本），用于跳过无变化的写入
+type Backend struct {
+    table  string
+    family dataplane.Family
+    exec   dataplane.Executor
+
+    mu     sync.Mutex
+    chains map[string]string
+    sets   map[string]string
+}
+
+// NewBackend 创建处理 IPv4 的 nftables 数据面实现；table 为空时使用 DefaultTable，exec 为 nil 时在宿主机执行命令。
+func NewBackend(table string, exec dataplane.Executor) *Backend {
+    return NewFamilyBackend(dataplane.IPv4, table, exec)
+}
+
+// NewFamilyBackend 创建处理指定地址族的 nftables 数据面实现。
+// 说明：table 为空时 IPv4 使用 DefaultTable，IPv6 使用 DefaultTable+"6"。
+func NewFamilyBackend(family dataplane.Family, table string, exec dataplane.Executor) *Backend {
+    if family != dataplane.IPv6 {
+        family = dataplane.IPv4
+    }
+    if strings.TrimSpace(table) == "" {
+        table = DefaultTable
+        if family == dataplane.IPv6 {
+            table += "6"
+        }
+    }
+    if exec == nil {
+        exec = iptables.HostExecutor{}
+    }
+    return &Backend{
+        table:  table,
+        family: family,
+        exec:   exec,
+        chains: map[string]string{},
+        sets:   map[string]string{},
+    }
+}
+
+// Name 返回实现名称。
+func (b *Backend) Name() string { return "nftables" }
+
+// EnsureChain 确保表与自定义链存在（nft 的 add 语句本身是幂等的）。
+func (b *Backend) EnsureChain(chain string) error {
+    return b.apply(fmt.Sprintf("add chain inet %s %s\n", b.table, chain))
+}
+
+// EnsureJumps 确保本表中与 hook 对应的基础链（forward/output/input，链名与 hook 同名小写）存在，并按 rootChains 的顺序跳转到各根链。
+// 说明：
+// - nftables 中不同表的基础链相互独立，ACCEPT 只结束当前基础链，DROP 则最终生效，
+//   因此不需要像 iptables 那样与 Calico 争夺 FORWARD 链中的位置，"before:<链名>" 按 "insert" 处理。
+// - position 映射为基础链优先级："append" 使用 filter+10，其余使用 filter-10。
+// - 基础链只包含本程序的跳转：内容与期望一致时不写入，否则在同一个 `nft -f` 事务中清空并按顺序重建。
+func (b *Backend) EnsureJumps(hook string, rootChains []string, position string) error {
+    priority := "filter - 10"
+    if position == dataplane.JumpAppend {
+        priority = "filter + 10"
+    }
+    baseChain := strings.ToLower(hook)
+    base := fmt.Sprintf("add chain inet %s %s { type filter hook %s priority %s; policy accept; }\n", b.table, baseChain, baseChain, priority)
+    if err := b.apply(base); err != nil {
+        return err
+    }
+
+    out, err := b.exec.Run("nft", "list", "chain", "inet", b.table, baseChain)
+    if err != nil {
+        return err
+    }
+    current := []string{}
+    for _, line := range strings.Split(out, "\n") {
+        line = strings.TrimSpace(line)
+        if strings.HasPrefix(line, "jump ") {
+            current = append(current, strings.TrimPrefix(line, "jump "))
+        }
+    }
+    if strings.Join(current, ",") == strings.Join(rootChains, ",") {
+        return nil
+    }
+    var script strings.Builder
+    fmt.Fprintf(&script, "flush chain inet %s %s\n", b.table, baseChain)
+    for _, c := range rootChains {
+        fmt.Fprintf(&script, "add rule inet %s %s jump %s\n", b.table, baseChain, c)
+    }
+    return b.apply(script.String())
+}
+
+// RemoveJumps 删除本表中与 hook 对应的基础链（只包含本程序的跳转），返回其中跳转到 chains 的目标；基础链不存在时不做写操作。
+func (b *Backend) RemoveJumps(hook string, chains []string) ([]string, error) {
+    state, err := b.readTable()
+    if err != nil {
+        return nil, err
+    }
+    baseChain := strings.ToLower(hook)
+    rules, ok := state.chains[baseChain]
+    if !ok {
+        return nil, nil
+    }
+    wanted := map[string]bool{}
+    for _, c := range chains {
+        wanted[c] = true
+    }
+    removed := []string{}
+    for _, r := range rules {
+        fields := strings.Fields(r.text)
+        for i := 0; i+1 < len(fields); i++ {
+            if (fields[i] == "jump" || fields[i] == "goto") && wanted[fields[i+1]] {
+                removed = append(removed, fields[i+1])
+                break
+            }
+        }
+    }
+    // nft 只能删除空链，先清空再删除（同一事务）
+    if err := b.apply(fmt.Sprintf("flush chain inet %s %s\ndelete chain inet %s %s\n", b.table, baseChain, b.table, baseChain)); err != nil {
+        return nil, err
+    }
+    return removed, nil
+}
+
+// DeleteTable 删除本程序独占的表（连同其中剩余的链与集合），返回被删除的表名；表不存在时返回空字符串且不做任何操作。
+// 说明：用于 cleanup，在删除链与集合之后调用，使节点上不留下空表。
+func (b *Backend) DeleteTable() (string, error) {
+    if _, err := b.exec.Run("nft", "list", "table", "inet", b.table); err != nil {
+        if strings.Contains(err.Error(), "No such file or directory") {
+            return "", nil
+        }
+        return "", err
+    }
+    if _, err := b.exec.Run("nft", "delete", "table", "inet", b.table); err != nil {
+        return "", fmt.Errorf("nft: %w", err)
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.chains = map[string]string{}
+    b.sets = map[string]string{}
+    return "inet " + b.table, nil
+}
+
+// SyncChains 将多条链同步为期望内容。
+// 行为：
+// - 先翻译全部规则；任意规则无法翻译时整体失败，不做部分下发。
+// - 与上次成功下发的内容相同且链仍存在时跳过；其余链以 `flush chain` + `add rule` 重写。
+// - 全部变更放在一个 `nft -f` 脚本中，先声明链再写规则，保证链之间的跳转可解析。
+func (b *Backend) SyncChains(chains []dataplane.ChainRules) ([]string, error) {
+    existing, err := b.listChains()
+    if err != nil {
+        return nil, err
+    }
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    rendered := map[string]string{}
+    changed := []string{}
+    for _, c := range chains {
+        var body strings.Builder
+        for _, r := range c.Rules {
+            stmt, err := translateRule(r, b.addrKeyword())
+            if err != nil {
+                return nil, fmt.Errorf("chain %s: %w", c.Chain, err)
+            }
+            fmt.Fprintf(&body, "add rule inet %s %s %s\n", b.table, c.Chain, stmt)
+        }
+        rendered[c.Chain] = body.String()
+        if existing[c.Chain] && b.chains[c.Chain] == body.String() {
+            continue
+        }
+        changed = append(changed, c.Chain)
+    }
+    if len(changed) == 0 {
+        return nil, nil
+    }
+
+    var script strings.Builder
+    for _, name := range changed {
+        fmt.Fprintf(&script, "add chain inet %s %s\n", b.table, name)
+    }
+    for _, name := range changed {
+        fmt.Fprintf(&script, "flush chain inet %s %s\n", b.table, name)
+        script.WriteString(rendered[name])
+    }
+    if err := b.apply(script.String()); err != nil {
+        return nil, err
+    }
+    for _, name := range changed {
+        b.chains[name] = rendered[name]
+    }
+
+    // 记录规则变更时间，用以审计和排查
+    log.Printf("nft rules synced for chains %s at %s", strings.Join(changed, ","), time.Now().Format(time.RFC3339))
+    return changed, nil
+}
+
+// EnsureIPSet 确保命名集合存在，元素类型与地址族一致（ipv4_addr 或 ipv6_addr）。
+func (b *Backend) EnsureIPSet(setName string) error {
+    if strings.TrimSpace(setName) == "" {
+        return nil
+    }
+    return b.apply(b.setDecl(setName))
+}
+
+// SyncIPSet 在一个事务内完成 flush + add element，集合成员不会经历“空集合”的中间状态。
+func (b *Backend) SyncIPSet(setName string, ips []string) error {
+    members := []string{}
+    for _, ip := range ips {
+        if ip = strings.TrimSpace(ip); ip != "" {
+            members = append(members, ip)
+        }
+    }
+    return b.syncSet(setName, b.setDecl(setName), members)
+}
+
+// SyncIPPortSet 同步“IP + 协议端口”集合，元素类型为 `<地址> . inet_proto . inet_service`，成员 "ip,proto:port" 写为 `ip . proto . port`。
+// 说明：规则以 `<ip|ip6> daddr . meta l4proto . th dport @<集合>` 匹配（见 translateRule 对 `--match-set <name> dst,dst` 的翻译）。
+func (b *Backend) SyncIPPortSet(setName string, members []string) error {
+    elements := []string{}
+    for _, m := range members {
+        ip, proto, port, ok := dataplane.ParseIPPortMember(strings.TrimSpace(m))
+        if !ok {
+            if strings.TrimSpace(m) != "" {
+                return fmt.Errorf("invalid ip,port member %q", m)
+            }
+            continue
+        }
+        elements = append(elements, fmt.Sprintf("%s . %s . %d", ip, proto, port))
+    }
+    return b.syncSet(setName, b.ipPortSetDecl(setName), elements)
+}
+
+// SyncNetSet 同步网段集合：nftables 集合没有 nomatch，按与 ipset hash:net 相同的最长前缀语义把成员换算为互不重叠的地址区间（见 netRanges），
+// 写入带 interval 标志的集合；规则的匹配方式与白名单集合相同。
+func (b *Backend) SyncNetSet(setName string, members []string) error {
+    elements, err := netRanges(members)
+    if err != nil {
+        return err
+    }
+    return b.syncSet(setName, b.netSetDecl(setName), elements)
+}
+
+// syncSet 以 decl 声明集合，并在一个事务内替换为给定的元素；与上次写入的内容相同时不做写操作。
+func (b *Backend) syncSet(setName, decl string, members []string) error {
+    if strings.TrimSpace(setName) == "" {
+        return nil
+    }
+    sort.Strings(members)
+    joined := strings.Join(members, ", ")
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if cached, ok := b.sets[setName]; ok && cached == joined {
+        return nil
+    }
+
+    script := decl + fmt.Sprintf("flush set inet %s %s\n", b.table, setName)
+    if len(members) > 0 {
+        script += fmt.Sprintf("add element inet %s %s { %s }\n", b.table, setName, joined)
+    }
+    if err := b.apply(script); err != nil {
+        return err
+    }
+    b.sets[setName] = joined
+    return nil
+}
+
+// setDecl 返回命名集合的声明语句。
+func (b *Backend) setDecl(setName string) string {
+    setType := "ipv4_addr"
+    if b.family == dataplane.IPv6 {
+        setType = "ipv6_addr"
+    }
+    return fmt.Sprintf("add set inet %s %s { type %s; }\n", b.table, setName, setType)
+}
+
+// netSetDecl 返回网段集合（区间集合）的声明语句。
+func (b *Backend) netSetDecl(setName string) string {
+    setType := "ipv4_addr"
+    if b.family == dataplane.IPv6 {
+        setType = "ipv6_addr"
+    }
+    return fmt.Sprintf("add set inet %s %s { type %s; flags interval; }\n", b.table, setName, setType)
+}
+
+// ipPortSetDecl 返回“IP + 协议端口”集合的声明语句。
+func (b *Backend) ipPortSetDecl(setName string) string {
+    setType := "ipv4_addr"
+    if b.family == dataplane.IPv6 {
+        setType = "ipv6_addr"
+    }
+    return fmt.Sprintf("add set inet %s %s { type %s . inet_proto . inet_service; }\n", b.table, setName, setType)
+}
+
+// addrKeyword 返回集合匹配使用的地址协议关键字（ip 或 ip6）。
+func (b *Backend) addrKeyword() string {
+    if b.family == dataplane.IPv6 {
+        return "ip6"
+    }
+    return "ip"
+}
+
+// apply 以 `nft -f -` 提交脚本；脚本总是以声明本表开头，保证表在首次使用时被创建。
+func (b *Backend) apply(script string) error {
+    full := fmt.Sprintf("add table inet %s\n", b.table) + script
+    if _, err := b.exec.RunWithInput(full, "nft", "-f", "-"); err != nil {
+        return fmt.Errorf("nft: %w", err)
+    }
+    return nil
+}
+
+// tableState 是 `nft -a list table` 输出的解析结果。
+// 字段说明：
+// - chains: 链名 -> 链内规则（文本与 handle）
+// - sets: 命名集合名称
+type tableState struct {
+    chains map[string][]ruleLine
+    sets   []string
+}
+
+// ruleLine 表示链中的一条规则：text 为去掉 handle 注释后的规则文本，handle 用于按句柄删除。
+type ruleLine struct {
+    text   string
+    handle string
+}
+
+// readTable 读取并解析本表的链、规则句柄与集合；表不存在时返回空结果。
+func (b *Backend) readTable() (*tableState, error) {
+    state := &tableState{chains: map[string][]ruleLine{}}
+    out, err := b.exec.Run("nft", "-a", "list", "table", "inet", b.table)
+    if err != nil {
+        if strings.Contains(err.Error(), "No such file or directory") {
+            return state, nil
+        }
+        return nil, err
+    }
+    chain := ""
+    for _, raw := range strings.Split(out, "\n") {
+        line := strings.TrimSpace(raw)
+        text, handle := line, ""
+        if i := strings.Index(line, "# handle "); i >= 0 {
+            text = strings.TrimSpace(line[:i])
+            handle = strings.TrimSpace(line[i+len("# handle "):])
+        }
+        fields := strings.Fields(text)
+        switch {
+        case len(fields) >= 2 && fields[0] == "chain":
+            chain = fields[1]
+            state.chains[chain] = []ruleLine{}
+        case len(fields) >= 2 && fields[0] == "set":
+            state.sets = append(state.sets, fields[1])
+            chain = ""
+        case text == "}":
+            chain = ""
+        case chain != "" && handle != "":
+            state.chains[chain] = append(state.chains[chain], ruleLine{text: text, handle: handle})
+        }
+    }
+    return state, nil
+}
+
+// listChains 返回本表当前存在的链；表不存在时返回空集合。
+func (b *Backend) listChains() (map[string]bool, error) {
+    state, err := b.readTable()
+    if err != nil {
+        return nil, err
+    }
+    chains := map[string]bool{}
+    for name := range state.chains {
+        chains[name] = true
+    }
+    return chains, nil
+}
+
+// ListRules 返回链当前的规则（经 untranslateRule 还原的 iptables 风格参数）；链不存在时返回错误。
+func (b *Backend) ListRules(chain string) ([][]string, error) {
+    state, err := b.readTable()
+    if err != nil {
+        return nil, err
+    }
+    lines, ok := state.chains[chain]
+    if !ok {
+        return nil, fmt.Errorf("chain %s does not exist", chain)
+    }
+    rules := make([][]string, 0, len(lines))
+    for _, l := range lines {
+        rules = append(rules, untranslateRule(l.text))
+    }
+    return rules, nil
+}
+
+// ListChains 返回本表中名称以 prefix 开头的全部链。
+func (b *Backend) ListChains(prefix string) ([]string, error) {
+    state, err := b.readTable()
+    if err != nil {
+        return nil, err
+    }
+    out := []string{}
+    for name := range state.chains {
+        if strings.HasPrefix(name, prefix) {
+            out = append(out, name)
+        }
+    }
+    sort.Strings(out)
+    return out, nil
+}
+
+// DeleteChains 在一个 nft 事务中删除给定的链：先按句柄删除指向它们的 jump/goto 规则，再 flush，最后 delete。
+func (b *Backend) DeleteChains(chains []string) error {
+    if len(chains) == 0 {
+        return nil
+    }
+    state, err := b.readTable()
+    if err != nil {
+        return err
+    }
+    doomed := map[string]bool{}
+    for _, c := range chains {
+        if _, ok := state.chains[c]; ok {
+            doomed[c] = true
+        }
+    }
+    if len(doomed) == 0 {
+        return nil
+    }
+
+    names := make([]string, 0, len(state.chains))
+    for name := range state.chains {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    var unlink, del strings.Builder
+    touched := []string{}
+    for _, name := range names {
+        if doomed[name] {
+            fmt.Fprintf(&del, "flush chain inet %s %s\n", b.table, name)
+            fmt.Fprintf(&del, "delete chain inet %s %s\n", b.table, name)
+            continue
+        }
+        for _, r := range state.chains[name] {
+            fields := strings.Fields(r.text)
+            for i := 0; i+1 < len(fields); i++ {
+                if (fields[i] == "jump" || fields[i] == "goto") && doomed[fields[i+1]] {
+                    fmt.Fprintf(&unlink, "delete rule inet %s %s handle %s\n", b.table, name, r.handle)
+                    touched = append(touched, name)
+                    break
+                }
+            }
+        }
+    }
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if err := b.apply(unlink.String() + del.String()); err != nil {
+        return err
+    }
+    for name := range doomed {
+        delete(b.chains, name)
+    }
+    // 指向被删链的规则已移除，相关链的缓存不再可信，下一次同步时重写
+    for _, name := range touched {
+        delete(b.chains, name)
+    }
+    return nil
+}
+
+// ListIPSets 返回本表中名称以 prefix 开头的全部命名集合。
+func (b *Backend) ListIPSets(prefix string) ([]string, error) {
+    state, err := b.readTable()
+    if err != nil {
+        return nil, err
+    }
+    out := []string{}
+    for _, name := range state.sets {
+        if strings.HasPrefix(name, prefix) {
+            out = append(out, name)
+        }
+    }
+    return out, nil
+}
+
+// DestroyIPSet 删除命名集合；调用前引用该集合的规则必须已被删除。
+func (b *Backend) DestroyIPSet(setName string) error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if err := b.apply(fmt.Sprintf("delete set inet %s %s\n", b.table, setName)); err != nil {
+        return err
+    }
+    delete(b.sets, setName)
+    return nil
+}
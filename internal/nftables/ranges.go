@@ -0,0 +1,25 @@
+package nftables
+
+import (
+    "github.com/example/iptables-controller/internal/dataplane"
+)
+
+// netRanges 将网段集合的成员（见 dataplane.NetMember）换算为 nft 区间集合的元素。
+// 说明：
+// - 与 ipset hash:net 一致按最长前缀匹配（见 dataplane.NetRanges），nft 集合没有 nomatch，例外网段从区间中扣除。
+// - 返回的区间互不重叠且不相邻（nft 区间集合不接受重叠的元素），单个地址写为地址本身，其余写为 "lo-hi"。
+func netRanges(members []string) ([]string, error) {
+    ranges, err := dataplane.NetRanges(members)
+    if err != nil {
+        return nil, err
+    }
+    out := make([]string, 0, len(ranges))
+    for _, r := range ranges {
+        if r.Lo == r.Hi {
+            out = append(out, r.Lo.String())
+            continue
+        }
+        out = append(out, r.Lo.String()+"-"+r.Hi.String())
+    }
+    return out, nil
+}
@@ -0,0 +1,355 @@
+package nftables
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+
+    "github.com/example/iptables-controller/internal/iptables"
+)
+
+// translateRule 将一条 iptables 风格的规则参数翻译为 nft 规则语句。
+// 支持的参数（覆盖控制器生成的全部规则形态）：
+// - `-s/-d <ip|cidr>` -> `ip saddr/daddr ...`（含 ':' 时使用 ip6）
+// - `-p <proto>` 以及其后的 `--dport/--sport` -> `meta l4proto <proto>`、`<proto> dport ...`
+// - `-m multiport --dports/--sports 80,443,8000:8090` -> `<proto> dport { 80, 443, 8000-8090 }`
+// - `-m set --match-set <name> src|dst` -> `ip saddr/daddr @<name>`（setAddr 为 "ip6" 时使用 ip6）
+// - `-m set --match-set <name> dst,dst`（IP + 协议端口集合）-> `ip daddr . meta l4proto . th dport @<name>`
+// - `-m conntrack --ctstate A,B` -> `ct state { a, b }`
+// - `-m comment --comment <text>` -> `comment "<text>"`（nft 要求放在语句末尾）
+// - `-m limit --limit N/unit [--limit-burst B]` -> `limit rate N/unit [burst B packets]`
+// - `-j ACCEPT|DROP|REJECT|RETURN|<chain>` -> `accept|drop|reject|return|jump <chain>`
+// - `-j LOG --log-prefix P` -> `log prefix "P"`；`-j NFLOG --nflog-prefix P [--nflog-group N]` -> `log prefix "P" group N`
+// 每条规则都在判决前附加 `counter` 语句，与 iptables 一样为每条规则保留报文/字节计数。
+// 遇到不支持的参数时返回错误，避免生成与期望语义不一致的规则。
+func translateRule(args []string, setAddr string) (string, error) {
+    out := []string{}
+    proto := ""
+    comment := ""
+    verdict := ""
+    target := ""
+    logPrefix := ""
+    logGroup := ""
+
+    next := func(i int) (string, error) {
+        if i+1 >= len(args) {
+            return "", fmt.Errorf("missing value for %q", args[i])
+        }
+        return args[i+1], nil
+    }
+
+    for i := 0; i < len(args); i++ {
+        a := args[i]
+        switch a {
+        case "-s", "-d":
+            v, err := next(i)
+            if err != nil {
+                return "", err
+            }
+            dir := "saddr"
+            if a == "-d" {
+                dir = "daddr"
+            }
+            out = append(out, addrFamily(v), dir, v)
+            i++
+        case "-p":
+            v, err := next(i)
+            if err != nil {
+                return "", err
+            }
+            proto = strings.ToLower(v)
+            out = append(out, "meta", "l4proto", proto)
+            i++
+        case "--dport", "--sport":
+            v, err := next(i)
+            if err != nil {
+                return "", err
+            }
+            if proto != "tcp" && proto != "udp" && proto != "sctp" {
+                return "", fmt.Errorf("%s requires -p tcp|udp|sctp", a)
+            }
+            out = append(out, proto, strings.TrimPrefix(a, "--"), portExpr(v))
+            i++
+        case "--dports", "--sports":
+            v, err := next(i)
+            if err != nil {
+                return "", err
+            }
+            if proto != "tcp" && proto != "udp" && proto != "sctp" {
+                return "", fmt.Errorf("%s requires -p tcp|udp|sctp", a)
+            }
+            out = append(out, proto, strings.TrimSuffix(strings.TrimPrefix(a, "--"), "s"), portListExpr(v))
+            i++
+        case "-m":
+            v, err := next(i)
+            if err != nil {
+                return "", err
+            }
+            switch v {
+            case "set", "conntrack", "comment", "limit", "multiport":
+            case "tcp", "udp", "sctp":
+                if proto != v {
+                    return "", fmt.Errorf("-m %s without matching -p", v)
+                }
+            default:
+                return "", fmt.Errorf("unsupported match module %q", v)
+            }
+            i++
+        case "--match-set":
+            if i+2 >= len(args) {
+                return "", fmt.Errorf("--match-set requires <name> <src|dst>")
+            }
+            name, flag := args[i+1], args[i+2]
+            switch flag {
+            case "src":
+                out = append(out, setAddr, "saddr", "@"+name)
+            case "dst":
+                out = append(out, setAddr, "daddr", "@"+name)
+            case "dst,dst":
+                out = append(out, setAddr, "daddr", ".", "meta", "l4proto", ".", "th", "dport", "@"+name)
+            default:
+                return "", fmt.Errorf("unsupported --match-set flag %q", flag)
+            }
+            i += 2
+        case "--ctstate":
+            v, err := next(i)
+            if err != nil {
+                return "", err
+            }
+            states := strings.Split(strings.ToLower(v), ",")
+            out = append(out, "ct", "state", "{ "+strings.Join(states, ", ")+" }")
+            i++
+        case "--limit":
+            v, err := next(i)
+            if err != nil {
+                return "", err
+            }
+            rate, err := limitRate(v)
+            if err != nil {
+                return "", err
+            }
+            out = append(out, "limit", "rate", rate)
+            i++
+        case "--limit-burst":
+            v, err := next(i)
+            if err != nil {
+                return "", err
+            }
+            out = append(out, "burst", v, "packets")
+            i++
+        case "--log-prefix", "--nflog-prefix":
+            v, err := next(i)
+            if err != nil {
+                return "", err
+            }
+            logPrefix = v
+            i++
+        case "--nflog-group":
+            v, err := next(i)
+            if err != nil {
+                return "", err
+            }
+            logGroup = v
+            i++
+        case "--comment":
+            v, err := next(i)
+            if err != nil {
+                return "", err
+            }
+            comment = v
+            i++
+        case "-j":
+            v, err := next(i)
+            if err != nil {
+                return "", err
+            }
+            target = strings.ToUpper(v)
+            verdict = translateTarget(v)
+            i++
+        default:
+            return "", fmt.Errorf("unsupported rule argument %q", a)
+        }
+    }
+
+    switch target {
+    case "LOG", "NFLOG":
+        verdict = "log"
+        if logPrefix != "" {
+            verdict += " prefix " + strconv.Quote(logPrefix)
+        }
+        if target == "NFLOG" {
+            // nft 的 log 语句带 group 时走 nfnetlink_log，组号缺省为 0（与 NFLOG 默认一致）
+            if logGroup == "" {
+                logGroup = "0"
+            }
+            verdict += " group " + logGroup
+        }
+    }
+
+    out = append(out, "counter")
+    if verdict != "" {
+        out = append(out, verdict)
+    }
+    if comment != "" {
+        out = append(out, "comment", strconv.Quote(comment))
+    }
+    return strings.Join(out, " "), nil
+}
+
+// translateTarget 将 iptables 目标翻译为 nft 的判决语句；非内置目标视为跳转到自定义链。
+func translateTarget(target string) string {
+    switch strings.ToUpper(target) {
+    case "ACCEPT":
+        return "accept"
+    case "DROP":
+        return "drop"
+    case "REJECT":
+        return "reject"
+    case "RETURN":
+        return "return"
+    default:
+        return "jump " + target
+    }
+}
+
+// limitRate 将 iptables limit 速率（5/min、10/second 等）转换为 nft 写法（5/minute、10/second）。
+// 说明：先按 iptables 的方式换算为 iptables-save 形式，保证两种数据面对同一配置得到相同的实际速率。
+func limitRate(v string) (string, error) {
+    canon, err := iptables.CanonicalLimit(v)
+    if err != nil {
+        return "", err
+    }
+    n, unit, _ := strings.Cut(canon, "/")
+    switch unit {
+    case "sec":
+        unit = "second"
+    case "min":
+        unit = "minute"
+    }
+    return n + "/" + unit, nil
+}
+
+// addrFamily 根据地址字面量判断使用 ip 还是 ip6 匹配。
+func addrFamily(addr string) string {
+    if strings.Contains(addr, ":") {
+        return "ip6"
+    }
+    return "ip"
+}
+
+// portExpr 将 iptables 的端口写法（80、8000:8090）转换为 nft 写法（80、8000-8090）。
+func portExpr(v string) string {
+    return strings.ReplaceAll(v, ":", "-")
+}
+
+// portListExpr 将 multiport 的端口列表（80,443,8000:8090）转换为 nft 的匿名集合（{ 80, 443, 8000-8090 }），只有一项时不加花括号。
+func portListExpr(v string) string {
+    items := strings.Split(v, ",")
+    if len(items) == 1 {
+        return portExpr(items[0])
+    }
+    for i, item := range items {
+        items[i] = portExpr(item)
+    }
+    return "{ " + strings.Join(items, ", ") + " }"
+}
+
+// untranslateRule 将 `nft list` 输出的规则文本还原为 iptables 风格参数。
+// 说明：只还原地址、集合引用、注释与判决/跳转，足以从规则注释与跳转关系中恢复归属信息；
+// 其余匹配条件（协议端口、连接状态、计数等）会被忽略。
+func untranslateRule(text string) []string {
+    tokens := splitFields(text)
+    matches := []string{}
+    comment := []string{}
+    target := []string{}
+    for i := 0; i < len(tokens); i++ {
+        t := tokens[i]
+        switch {
+        case (t == "ip" || t == "ip6") && i+2 < len(tokens) && tokens[i+1] == "daddr" && tokens[i+2] == ".":
+            // IP + 协议端口集合：`ip daddr . meta l4proto . th dport @<name>`；须在下面的地址匹配之前判断，否则 "." 会被当作地址
+            for j := i + 2; j < len(tokens); j++ {
+                if strings.HasPrefix(tokens[j], "@") {
+                    matches = append(matches, "-m", "set", "--match-set", strings.TrimPrefix(tokens[j], "@"), "dst,dst")
+                    i = j
+                    break
+                }
+            }
+        case (t == "ip" || t == "ip6") && i+2 < len(tokens) && (tokens[i+1] == "saddr" || tokens[i+1] == "daddr"):
+            v := tokens[i+2]
+            if strings.HasPrefix(v, "@") {
+                flag := "src"
+                if tokens[i+1] == "daddr" {
+                    flag = "dst"
+                }
+                matches = append(matches, "-m", "set", "--match-set", strings.TrimPrefix(v, "@"), flag)
+            } else if tokens[i+1] == "saddr" {
+                matches = append(matches, "-s", v)
+            } else {
+                matches = append(matches, "-d", v)
+            }
+            i += 2
+        case t == "comment" && i+1 < len(tokens):
+            comment = []string{"-m", "comment", "--comment", tokens[i+1]}
+            i++
+        case (t == "jump" || t == "goto") && i+1 < len(tokens):
+            target = []string{"-j", tokens[i+1]}
+            i++
+        case t == "accept" || t == "drop" || t == "return" || t == "reject":
+            target = []string{"-j", strings.ToUpper(t)}
+        case t == "log":
+            target = []string{"-j", "LOG"}
+            for j := i + 1; j+1 < len(tokens); j++ {
+                if tokens[j] == "group" {
+                    target = []string{"-j", "NFLOG"}
+                    break
+                }
+            }
+        }
+    }
+    out := append(matches, comment...)
+    return append(out, target...)
+}
+
+// parseCounter 从 `nft list` 输出的规则文本中提取 `counter packets N bytes M` 的计数；规则不含计数时返回 0。
+func parseCounter(text string) (packets, bytes uint64) {
+    tokens := splitFields(text)
+    for i := 0; i+4 < len(tokens); i++ {
+        if tokens[i] == "counter" && tokens[i+1] == "packets" && tokens[i+3] == "bytes" {
+            packets, _ = strconv.ParseUint(tokens[i+2], 10, 64)
+            bytes, _ = strconv.ParseUint(tokens[i+4], 10, 64)
+            return packets, bytes
+        }
+    }
+    return 0, 0
+}
+
+// splitFields 按空白切分 nft 规则文本，双引号内的内容（例如注释）作为一个字段。
+func splitFields(text string) []string {
+    fields := []string{}
+    var cur strings.Builder
+    inQuote, has := false, false
+    for i := 0; i < len(text); i++ {
+        ch := text[i]
+        switch {
+        case ch == '\\' && inQuote && i+1 < len(text):
+            i++
+            cur.WriteByte(text[i])
+        case ch == '"':
+            inQuote = !inQuote
+            has = true
+        case (ch == ' ' || ch == '\t') && !inQuote:
+            if has {
+                fields = append(fields, cur.String())
+                cur.Reset()
+                has = false
+            }
+        default:
+            cur.WriteByte(ch)
+            has = true
+        }
+    }
+    if has {
+        fields = append(fields, cur.String())
+    }
+    return fields
+}
@@ -0,0 +1,49 @@
+package nftables
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// TestTranslateRoundTrip 检查 translateRule 生成的规则经 untranslateRule 还原后，用于差分与计数归属的部分（地址、集合引用、注释、判决）保持不变。
+func TestTranslateRoundTrip(t *testing.T) {
+    cases := []struct {
+        name    string
+        setAddr string
+        args    []string
+        want    []string
+    }{
+        {
+            name:    "port set",
+            setAddr: "ip",
+            args:    []string{"-d", "10.244.1.5", "-s", "10.0.0.0/8", "-p", "tcp", "-m", "set", "--match-set", "MS-PORT-0-DEFAULT-WEB-ABC", "dst,dst", "-m", "comment", "--comment", "owner=default/web dir=in rule=0", "-j", "ACCEPT"},
+            want:    []string{"-d", "10.244.1.5", "-s", "10.0.0.0/8", "-m", "set", "--match-set", "MS-PORT-0-DEFAULT-WEB-ABC", "dst,dst", "-m", "comment", "--comment", "owner=default/web dir=in rule=0", "-j", "ACCEPT"},
+        },
+        {
+            name:    "ipv6 port set",
+            setAddr: "ip6",
+            args:    []string{"-d", "fd00::5", "-p", "udp", "-m", "set", "--match-set", "MS-PORT6-1-DEFAULT-WEB-ABC", "dst,dst", "-j", "DROP"},
+            want:    []string{"-d", "fd00::5", "-m", "set", "--match-set", "MS-PORT6-1-DEFAULT-WEB-ABC", "dst,dst", "-j", "DROP"},
+        },
+        {
+            name:    "whitelist set",
+            setAddr: "ip",
+            args:    []string{"-m", "set", "--match-set", "MS-SRC-DEFAULT-WEB-ABC", "src", "-d", "10.244.1.5", "-m", "comment", "--comment", "owner=default/web dir=in peer=default/api", "-j", "ACCEPT"},
+            want:    []string{"-m", "set", "--match-set", "MS-SRC-DEFAULT-WEB-ABC", "src", "-d", "10.244.1.5", "-m", "comment", "--comment", "owner=default/web dir=in peer=default/api", "-j", "ACCEPT"},
+        },
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            text, err := translateRule(tc.args, tc.setAddr)
+            if err != nil {
+                t.Fatalf("translateRule: %v", err)
+            }
+            // `nft list` 的输出在计数语句中带有数值
+            listed := strings.Replace(text, "counter", "counter packets 3 bytes 180", 1)
+            if got := untranslateRule(listed); !reflect.DeepEqual(got, tc.want) {
+                t.Fatalf("untranslateRule(%q)\n got  %q\n want %q", listed, got, tc.want)
+            }
+        })
+    }
+}